@@ -2,16 +2,25 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/asenalabs/asena/internal/clientip"
 	"github.com/asenalabs/asena/internal/config"
 	"github.com/asenalabs/asena/internal/handler"
 	"github.com/asenalabs/asena/internal/middleware"
 	"github.com/asenalabs/asena/internal/proxy"
+	"github.com/asenalabs/asena/internal/proxy/tcp"
+	"github.com/asenalabs/asena/internal/proxy/udp"
+	"github.com/asenalabs/asena/internal/rule"
 	"github.com/asenalabs/asena/internal/server"
 	"github.com/asenalabs/asena/pkg/cli"
 	"github.com/asenalabs/asena/pkg/logger"
@@ -26,6 +35,13 @@ var (
 	gracefulShutdownTime  = 5 * time.Second
 )
 
+// clientAuthTypes maps an entrypoint's tls.client_auth.mode to how its server asks for certificates.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	config.ClientAuthRequest:       tls.RequestClientCert,
+	config.ClientAuthVerifyIfGiven: tls.VerifyClientCertIfGiven,
+	config.ClientAuthRequire:       tls.RequireAndVerifyClientCert,
+}
+
 func StartAsena() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
@@ -55,11 +71,56 @@ func StartAsena() {
 		logg.Fatal("Failed to initialize dynamic configurations", zap.Error(err))
 	}
 
+	// HTTP routers take requests from the http and https entrypoints, TCP routers connections from
+	// the tcp ones, and UDP routers datagrams from the udp ones.
+	var httpEntrypoints, tcpEntrypoints, udpEntrypoints []string
+	for name, ep := range asenaCfg.Entrypoints {
+		switch *ep.Protocol {
+		case config.ProtocolTCP:
+			tcpEntrypoints = append(tcpEntrypoints, name)
+		case config.ProtocolUDP:
+			udpEntrypoints = append(udpEntrypoints, name)
+		default:
+			httpEntrypoints = append(httpEntrypoints, name)
+		}
+	}
+
 	pm := proxy.NewProxyManger(logg)
+	pm.SetEntrypoints(httpEntrypoints)
+	tm := tcp.NewManager(logg)
+	tm.SetEntrypoints(tcpEntrypoints)
+	um := udp.NewManager(logg)
+	um.SetEntrypoints(udpEntrypoints)
+
+	var acme *server.ACME
+	if a := asenaCfg.ACME; a != nil {
+		var email string
+		if a.Email != nil {
+			email = *a.Email
+		}
+		acme = server.NewACME(server.ACMEConfig{
+			Email:    email,
+			CAServer: *a.CAServer,
+			Storage:  *a.Storage,
+			Domains:  a.Domains,
+			Logg:     logg,
+		})
+	}
+
+	// The certificates are loaded before the entrypoints start, so those that only have certificates
+	// from dynamic.yaml start with HTTPS.
+	certs := server.NewCertStore(logg)
+	certs.Build(dynamicConfigService.Get().TLS)
 
 	go func() {
 		for newDCfg := range dynamicConfigService.Updates() {
+			certs.Build(newDCfg.TLS)
+			if acme != nil {
+				acme.SetHosts(ruleHosts(newDCfg.HTTP))
+			}
 			pm.BuildReverseProxy(newDCfg.HTTP, asenaCfg.ProxyTransport)
+			tm.Build(newDCfg.TCP, asenaCfg.ProxyTransport)
+			um.Build(newDCfg.UDP)
 		}
 	}()
 
@@ -67,25 +128,117 @@ func StartAsena() {
 	mux := http.NewServeMux()
 	handler.RegisterRoutes(pm, mux, logg)
 
-	chain := middleware.New(
-		middleware.Logging(logg),
-	)
-	wrappedMux := chain.Then(mux)
-
-	//	server configurations
-	srvCfg := server.ServerConfig{
-		Address:     *asenaCfg.Asena.Port,
-		Version:     version,
-		EnableHTTPS: *asenaCfg.Asena.EnableHTTPS,
-		CertFileTLS: *asenaCfg.Asena.TLSCertFile,
-		KeyFileTLS:  *asenaCfg.Asena.TLSKeyFile,
-		Proxy:       wrappedMux,
-		Logg:        logg,
+	resolver, err := clientip.NewResolver(asenaCfg.Asena.TrustedProxies, *asenaCfg.Asena.TrustedProxiesHeader)
+	if err != nil {
+		logg.Fatal("Failed to load trusted proxies", zap.Error(err))
 	}
 
-	srv, err := server.ServeHTTPS(&srvCfg)
-	if err != nil {
-		logg.Fatal("Failed to start server", zap.Error(err))
+	//	Routers without entrypoints take requests from all of them, so every entrypoint removes the
+	//	headers any entrypoint's client_auth fills in, not just its own.
+	var certHeaders []string
+	for _, ep := range asenaCfg.Entrypoints {
+		if ep.TLS != nil && ep.TLS.ClientAuth != nil {
+			headers := ep.TLS.ClientAuth.Headers
+			certHeaders = append(certHeaders, *headers.Subject, *headers.SANs, *headers.Fingerprint)
+		}
+	}
+
+	//	One server per entrypoint
+	type runningServer struct {
+		address  string
+		shutdown func(context.Context) error
+	}
+	var servers []runningServer
+	for _, name := range slices.Sorted(maps.Keys(asenaCfg.Entrypoints)) {
+		ep := asenaCfg.Entrypoints[name]
+
+		var h http.Handler
+		if ep.RedirectTo != nil {
+			h = server.RedirectToHTTPS(*asenaCfg.Entrypoints[*ep.RedirectTo].Address)
+		} else {
+			ms := []middleware.Middleware{
+				middleware.Entrypoint(name),
+				middleware.ClientIP(resolver),
+			}
+			if len(certHeaders) > 0 {
+				var own middleware.ClientCertHeaders
+				if ep.TLS != nil && ep.TLS.ClientAuth != nil {
+					headers := ep.TLS.ClientAuth.Headers
+					own = middleware.ClientCertHeaders{
+						Subject:     *headers.Subject,
+						SANs:        *headers.SANs,
+						Fingerprint: *headers.Fingerprint,
+					}
+				}
+				ms = append(ms, middleware.ClientCert(own, certHeaders))
+			}
+			h = middleware.New(append(ms, middleware.Logging(logg))...).Then(mux)
+		}
+		if acme != nil && *ep.Protocol == config.ProtocolHTTP {
+			// The CA checks HTTP-01 challenges on port 80, before any redirect.
+			h = acme.HTTPHandler(h)
+		}
+
+		srvCfg := server.ServerConfig{
+			Name:              name,
+			Address:           *ep.Address,
+			Version:           version,
+			EnableHTTPS:       *ep.Protocol == config.ProtocolHTTPS,
+			Proxy:             h,
+			Logg:              logg,
+			ReadHeaderTimeout: *ep.Timeouts.ReadHeader,
+			ReadTimeout:       *ep.Timeouts.Read,
+			WriteTimeout:      *ep.Timeouts.Write,
+			IdleTimeout:       *ep.Timeouts.Idle,
+		}
+		if ep.TLS != nil {
+			srvCfg.CertFileTLS = *ep.TLS.CertFile
+			srvCfg.KeyFileTLS = *ep.TLS.KeyFile
+			if ca := ep.TLS.ClientAuth; ca != nil {
+				srvCfg.ClientAuth = clientAuthTypes[*ca.Mode]
+				srvCfg.ClientCAFiles = ca.CAFiles
+			}
+		}
+		if ep.ProxyProtocol != nil {
+			srvCfg.ProxyProtocolTrustedIPs = ep.ProxyProtocol.TrustedIPs
+		}
+		if ep.HTTP3 != nil {
+			srvCfg.HTTP3 = *ep.HTTP3
+		}
+		if ep.TLS != nil {
+			// https entrypoints, and tcp ones whose routers terminate TLS.
+			srvCfg.Certs = certs
+		}
+		if *ep.Protocol == config.ProtocolHTTPS {
+			srvCfg.ACME = acme
+		}
+
+		switch *ep.Protocol {
+		case config.ProtocolTCP:
+			srv, err := server.ServeTCP(&srvCfg, func(conn net.Conn, tlsConfig *tls.Config) {
+				tm.ServeConn(name, conn, tlsConfig)
+			})
+			if err != nil {
+				logg.Fatal("Failed to start server", zap.String("entrypoint", name), zap.Error(err))
+			}
+			servers = append(servers, runningServer{address: srv.Addr, shutdown: srv.Shutdown})
+			continue
+		case config.ProtocolUDP:
+			srv, err := server.ServeUDP(&srvCfg, func(conn *net.UDPConn) {
+				um.Serve(name, conn)
+			})
+			if err != nil {
+				logg.Fatal("Failed to start server", zap.String("entrypoint", name), zap.Error(err))
+			}
+			servers = append(servers, runningServer{address: srv.Addr, shutdown: srv.Shutdown})
+			continue
+		}
+
+		srv, err := server.ServeHTTPS(&srvCfg)
+		if err != nil {
+			logg.Fatal("Failed to start server", zap.String("entrypoint", name), zap.Error(err))
+		}
+		servers = append(servers, runningServer{address: srv.Addr, shutdown: srv.Shutdown})
 	}
 
 	// Graceful shutdown
@@ -95,9 +248,41 @@ func StartAsena() {
 	shutDownCtx, cancel := context.WithTimeout(context.Background(), gracefulShutdownTime)
 	defer cancel()
 
-	if err := srv.Shutdown(shutDownCtx); err != nil {
-		logg.Warn("Asena server forced to shutdown", zap.String("version", version), zap.Error(err))
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.shutdown(shutDownCtx); err != nil {
+				logg.Warn("Asena server forced to shutdown", zap.String("version", version), zap.String("address", srv.address), zap.Error(err))
+			}
+		}()
 	}
+	wg.Wait()
 
 	logg.Info("Asena server gracefully shutdown", zap.String("version", version))
 }
+
+// ruleHosts returns the hosts of the Host matchers in cfg's router rules, for ACME to get certificates
+// for. A rule that can't be read is left out; the proxy manager warns about it.
+func ruleHosts(cfg *config.HTTPCfg) []string {
+	var hosts []string
+	if cfg == nil {
+		return hosts
+	}
+	for _, r := range cfg.Routers {
+		if r == nil || r.Rule == nil {
+			continue
+		}
+		tree, err := rule.ParseRule(*r.Rule)
+		if err != nil {
+			continue
+		}
+		for _, h := range rule.Hosts(tree) {
+			if !slices.Contains(hosts, h) {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,42 @@
+// Package clientcert reads the certificate a client authenticated with over TLS. The ClientCertSAN
+// rule matcher, the client_auth router requirement and the entrypoint's client certificate headers
+// all ask here, so they agree on which certificates count: only ones verified against the entrypoint's
+// CA bundle.
+package clientcert
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+)
+
+// Verified returns the certificate the client sent, if it was verified against the entrypoint's CA
+// bundle, or nil. A certificate only requested, without a CA bundle to check it, doesn't count.
+func Verified(r *http.Request) *x509.Certificate {
+	if r == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// SANs returns cert's subject alternative names: DNS names, email addresses, IP addresses and URIs,
+// in that order.
+func SANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs))
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	return sans
+}
+
+// Fingerprint returns the SHA-256 of cert, in lowercase hex.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,74 @@
+// Package clientip works out which address a request came from. The balancer's hash algorithms,
+// the ClientIP rule matcher and the middlewares all ask here, so they always agree on who the
+// client is.
+package clientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// clientKey is the context key of the address a Resolver settled on.
+type clientKey struct{}
+
+// trustedKey is the context key marking a request that came straight from a trusted proxy, whose
+// X-Forwarded-For it wrote.
+type trustedKey struct{}
+
+// NewContext returns ctx carrying ip as the client's address. The server sets it once per request,
+// from a Resolver, before anything else looks at the request.
+func NewContext(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientKey{}, ip)
+}
+
+// FromContext returns the client's IP address put on ctx with NewContext, or "" without one.
+func FromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientKey{}).(string)
+	return ip
+}
+
+// WithTrustedPeer returns ctx marked as coming from a trusted proxy that writes X-Forwarded-For, so
+// the chain in it may be passed on to the backends.
+func WithTrustedPeer(ctx context.Context) context.Context {
+	return context.WithValue(ctx, trustedKey{}, true)
+}
+
+// TrustedPeer reports whether ctx was marked with WithTrustedPeer.
+func TrustedPeer(ctx context.Context) bool {
+	trusted, _ := ctx.Value(trustedKey{}).(bool)
+	return trusted
+}
+
+// FromRequest returns the client's IP address (no port): the one a Resolver put on the request's
+// context, or without one, the address of the TCP connection. It returns "" if r is nil or no address
+// is available at all.
+//
+// Headers like X-Forwarded-For are only believed through a Resolver, and only from trusted proxies: a
+// header is just text the client sent, and anyone can put any value in it.
+func FromRequest(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	if ip := FromContext(r.Context()); ip != "" {
+		return ip
+	}
+	return Peer(r)
+}
+
+// Peer extracts just the IP portion (no port) from a request's RemoteAddr: the address of whoever
+// opened the connection, which behind a load balancer is the load balancer. It returns "" if r is nil
+// or no address is available at all.
+func Peer(r *http.Request) string {
+	if r == nil || r.RemoteAddr == "" {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// No port to strip, for whatever reason - use the raw value
+		// rather than failing outright. Still deterministic.
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,168 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver finds the real client behind trusted proxies, like a cloud load balancer in front of
+// Asena. A request from a trusted proxy carries the addresses it was forwarded for in a header, and
+// those are believed only as far back as the proxies in the chain are trusted too.
+//
+// Only the one header the trusted proxies write is read. A proxy passes the others on as the client
+// sent them, so believing whichever is present would let the client pick its own address.
+type Resolver struct {
+	trusted []*net.IPNet
+	header  string
+}
+
+// NewResolver returns a Resolver trusting the given CIDR ranges, whose proxies write the client's
+// address to header: X-Forwarded-For, Forwarded (RFC 7239) or X-Real-IP. A bare IP address is a
+// range of one. Without ranges, no header is ever believed and the client is the connection's address.
+func NewResolver(trustedProxies []string, header string) (*Resolver, error) {
+	trusted, err := ParseNets(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxy %w", err)
+	}
+	header = http.CanonicalHeaderKey(header)
+	switch header {
+	case "X-Forwarded-For", "Forwarded", "X-Real-Ip":
+	default:
+		return nil, fmt.Errorf("trusted proxies can't write the client's address to %q", header)
+	}
+	return &Resolver{trusted: trusted, header: header}, nil
+}
+
+// Header returns the canonical name of the header the trusted proxies write.
+func (res *Resolver) Header() string {
+	return res.header
+}
+
+// ParseNets parses a list of CIDR ranges, where a bare IP address is a range of one.
+func ParseNets(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, raw := range cidrs {
+		cidr := raw
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", raw)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Resolve returns the client's IP address for r.
+//
+// When the connection comes from a trusted proxy, the Resolver's header names the client. X-Forwarded-For
+// and Forwarded list every hop, and each proxy adds the one it got the request from at the end, so the
+// list is read from the end: trusted addresses are passed over, and the first untrusted one is the
+// client. Anything left of it was written by the client itself and could say anything. If every hop is
+// trusted, the first is the client.
+func (res *Resolver) Resolve(r *http.Request) string {
+	peer := Peer(r)
+	if !res.Trusts(peer) {
+		return peer
+	}
+
+	var hops []string
+	switch res.header {
+	case "Forwarded":
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	case "X-Forwarded-For":
+		hops = splitList(r.Header.Values("X-Forwarded-For"))
+	default:
+		if ip := parseHop(r.Header.Get(res.header)); ip != "" {
+			return ip
+		}
+	}
+	if len(hops) == 0 {
+		return peer
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == "" {
+			// A hop that isn't an address ("unknown", an obfuscated name, garbage) ends the
+			// chain: nothing before it can be tied to a proxy we trust.
+			break
+		}
+		client = ip
+		if !res.Trusts(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// Trusts reports whether addr, an IP address, is in one of the trusted ranges. A nil Resolver trusts
+// nothing.
+func (res *Resolver) Trusts(addr string) bool {
+	if res == nil {
+		return false
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range res.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits comma-separated header values into their entries, in order.
+func splitList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, entry := range strings.Split(v, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				out = append(out, entry)
+			}
+		}
+	}
+	return out
+}
+
+// forwardedFor returns the for= parameter of every element of Forwarded headers, in order. An element
+// without one still counts as a hop, as "", so the chain isn't read past it.
+func forwardedFor(values []string) []string {
+	var out []string
+	for _, element := range splitList(values) {
+		hop := ""
+		for _, pair := range strings.Split(element, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(name, "for") {
+				hop = strings.Trim(value, `"`)
+			}
+		}
+		out = append(out, hop)
+	}
+	return out
+}
+
+// parseHop returns the IP address in a hop: a bare address, or one with a port, with IPv6 in
+// brackets when it has a port. It returns "" for anything else.
+func parseHop(hop string) string {
+	hop = strings.TrimSpace(hop)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolver_Resolve(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}
+
+	tests := []struct {
+		name    string
+		header  string
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer, header ignored", "X-Forwarded-For", "203.0.113.9:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.9"},
+		{"trusted peer, no header", "X-Forwarded-For", "10.1.2.3:1234", nil, "10.1.2.3"},
+		{"x-forwarded-for", "X-Forwarded-For", "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entries left of the client", "X-Forwarded-For", "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 10.9.9.9"}, "198.51.100.1"},
+		{"every hop trusted", "X-Forwarded-For", "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "10.0.0.5, 192.0.2.1"}, "10.0.0.5"},
+		{"garbage ends the chain", "X-Forwarded-For", "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, nonsense, 10.0.0.7"}, "10.0.0.7"},
+		{"forged forwarded next to the real chain", "X-Forwarded-For", "10.1.2.3:1234", map[string]string{
+			"Forwarded":       "for=1.2.3.4",
+			"X-Forwarded-For": "198.51.100.4",
+		}, "198.51.100.4"},
+		{"forged x-real-ip without a chain", "X-Forwarded-For", "10.1.2.3:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "10.1.2.3"},
+		{"x-real-ip", "X-Real-IP", "192.0.2.1:1234", map[string]string{"X-Real-IP": "198.51.100.2"}, "198.51.100.2"},
+		{"forwarded", "forwarded", "10.1.2.3:1234", map[string]string{
+			"Forwarded":       `for=198.51.100.3;proto=https, for="[2001:db8::7]:4711"`,
+			"X-Forwarded-For": "1.2.3.4",
+		}, "198.51.100.3"},
+		{"forwarded obfuscated", "Forwarded", "10.1.2.3:1234", map[string]string{"Forwarded": "for=_hidden, for=10.0.0.8"}, "10.0.0.8"},
+		{"ipv6 peer", "X-Forwarded-For", "[2001:db8::1]:443", map[string]string{"X-Forwarded-For": "2001:DB8:FFFF::1, 198.51.100.5"}, "198.51.100.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := NewResolver(trusted, tt.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "http://a.com/", nil)
+			r.RemoteAddr = tt.peer
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := res.Resolve(r); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromRequest_PrefersResolvedAddress(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	if got := FromRequest(r); got != "10.1.2.3" {
+		t.Fatalf("expected the connection's address, got %q", got)
+	}
+
+	r = r.WithContext(NewContext(r.Context(), "198.51.100.1"))
+	if got := FromRequest(r); got != "198.51.100.1" {
+		t.Errorf("expected the resolved address, got %q", got)
+	}
+	if got := Peer(r); got != "10.1.2.3" {
+		t.Errorf("expected Peer to keep the connection's address, got %q", got)
+	}
+}
+
+func TestNewResolver_RejectsBadRanges(t *testing.T) {
+	if _, err := NewResolver([]string{"10.0.0.0/33"}, "X-Forwarded-For"); err == nil {
+		t.Error("expected an error for a bad CIDR range")
+	}
+	if _, err := NewResolver([]string{"lb.internal"}, "X-Forwarded-For"); err == nil {
+		t.Error("expected an error for a host name")
+	}
+	if _, err := NewResolver(nil, "X-Client-IP"); err == nil {
+		t.Error("expected an error for a header trusted proxies can't write")
+	}
+}
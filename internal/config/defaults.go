@@ -3,6 +3,14 @@ package config
 import (
 	"crypto/tls"
 	"fmt"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/asenalabs/asena/pkg/cli"
@@ -12,9 +20,24 @@ import (
 // ============================== Static ==============================
 
 var (
+	ProtocolHTTP            = "http"
+	ProtocolHTTPS           = "https"
+	ProtocolTCP             = "tcp"
+	ProtocolUDP             = "udp"
 	portHTTP                = ":80"
 	portHTTPS               = ":443"
 	disableHTTPS            = false
+	epReadHeaderTimeout     = 10 * time.Second
+	epReadTimeout           = time.Duration(0)
+	epWriteTimeout          = time.Duration(0)
+	epIdleTimeout           = 3 * time.Minute
+	epHTTP3                 = true
+	ClientAuthRequest       = "request"
+	ClientAuthVerifyIfGiven = "verify-if-given"
+	ClientAuthRequire       = "require"
+	clientCertSubject       = "X-Client-Cert-Subject"
+	clientCertSANs          = "X-Client-Cert-SANs"
+	clientCertFingerprint   = "X-Client-Cert-Fingerprint"
 	certFile                = "/etc/letsencrypt/live/example.com/cert.pem"
 	keyFile                 = "/etc/letsencrypt/live/example.com/privkey.pem"
 	llPath                  = "/var/log/asena/asena.log"
@@ -31,6 +54,13 @@ var (
 	ptTLSHandshakeTimeout   = 10 * time.Second
 	ptExpectContinueTimeout = 1 * time.Second
 	ptTLSMinVersion         = uint16(tls.VersionTLS12)
+	acmeCAServer            = "https://acme-v02.api.letsencrypt.org/directory"
+	acmeStorage             = "/var/lib/asena/acme"
+	trustedProxiesHeader    = "X-Forwarded-For"
+
+	// Names of the entrypoints Asena gets when asena.yaml lists none.
+	entrypointWeb       = "web"
+	entrypointWebSecure = "websecure"
 
 	asenaConfigHeaderComment = `#-#-#-#-#-#-#-#-#-#-#-#-#-#-#-#-#-#
 #       Asena configuration       #
@@ -54,8 +84,20 @@ func setAsenaConfigs(cfg *AsenaConfig, asenaConfigFile string, cliOpts *cli.Opti
 	setVariablesGotFromCLI(cliOpts)
 
 	normalizeAsenaCfg(cfg.Asena)
+	cfg.Entrypoints = normalizeEntrypointsCfg(cfg.Entrypoints, cfg.Asena)
 	normalizeLogCfg(cfg.Log)
 	normalizeProxyTransportCfg(cfg.ProxyTransport)
+	normalizeACMECfg(cfg.ACME)
+
+	if err := validateAsenaCfg(cfg.Asena); err != nil {
+		return err
+	}
+	if err := validateEntrypointsCfg(cfg.Entrypoints); err != nil {
+		return err
+	}
+	if err := validateACMECfg(cfg.ACME); err != nil {
+		return err
+	}
 
 	err := configwriter.WriteConfig(asenaConfigFile, cfg, asenaConfigHeaderComment)
 	if err != nil {
@@ -68,17 +110,213 @@ func normalizeAsenaCfg(cfg *AsenaCfg) {
 	if cfg.EnableHTTPS == nil {
 		cfg.EnableHTTPS = &disableHTTPS
 	}
-	if !*cfg.EnableHTTPS {
-		cfg.Port = &portHTTP
-	} else {
-		cfg.Port = &portHTTPS
-	}
 	if cfg.TLSCertFile == nil {
 		cfg.TLSCertFile = &certFile
 	}
 	if cfg.TLSKeyFile == nil {
 		cfg.TLSKeyFile = &keyFile
 	}
+	if cfg.TrustedProxiesHeader == nil {
+		cfg.TrustedProxiesHeader = &trustedProxiesHeader
+	}
+}
+
+// normalizeEntrypointsCfg fills in every entrypoint's defaults, from asena where it has them. Without
+// any entrypoints, it returns the ones older versions had, from enable_https and the CLI ports:
+// "web" for plain HTTP, or "websecure" for HTTPS with "web" redirecting to it.
+func normalizeEntrypointsCfg(eps map[string]*EntrypointCfg, asena *AsenaCfg) map[string]*EntrypointCfg {
+	if len(eps) == 0 {
+		eps = map[string]*EntrypointCfg{entrypointWeb: {Address: &portHTTP}}
+		if *asena.EnableHTTPS {
+			eps[entrypointWeb].RedirectTo = &entrypointWebSecure
+			eps[entrypointWebSecure] = &EntrypointCfg{Address: &portHTTPS, Protocol: &ProtocolHTTPS}
+		}
+	}
+
+	for _, ep := range eps {
+		if ep == nil {
+			continue
+		}
+		if ep.Protocol == nil {
+			ep.Protocol = &ProtocolHTTP
+			if ep.TLS != nil {
+				ep.Protocol = &ProtocolHTTPS
+			}
+		}
+		if *ep.Protocol == ProtocolHTTPS || (*ep.Protocol == ProtocolTCP && ep.TLS != nil) {
+			if ep.TLS == nil {
+				ep.TLS = &EntrypointTLSCfg{}
+			}
+			if ep.TLS.CertFile == nil {
+				ep.TLS.CertFile = asena.TLSCertFile
+			}
+			if ep.TLS.KeyFile == nil {
+				ep.TLS.KeyFile = asena.TLSKeyFile
+			}
+			normalizeClientAuthCfg(ep.TLS.ClientAuth)
+		}
+		if ep.Timeouts == nil {
+			ep.Timeouts = &EntrypointTimeoutsCfg{}
+		}
+		if ep.Timeouts.ReadHeader == nil {
+			ep.Timeouts.ReadHeader = &epReadHeaderTimeout
+		}
+		if ep.Timeouts.Read == nil {
+			ep.Timeouts.Read = &epReadTimeout
+		}
+		if ep.Timeouts.Write == nil {
+			ep.Timeouts.Write = &epWriteTimeout
+		}
+		if ep.Timeouts.Idle == nil {
+			ep.Timeouts.Idle = &epIdleTimeout
+		}
+		if ep.HTTP3 == nil && *ep.Protocol == ProtocolHTTPS {
+			ep.HTTP3 = &epHTTP3
+		}
+		if ep.ProxyProtocol == nil && *ep.Protocol != ProtocolUDP {
+			ep.ProxyProtocol = asena.ProxyProtocol
+		}
+	}
+	return eps
+}
+
+func normalizeClientAuthCfg(cfg *ClientAuthCfg) {
+	if cfg == nil {
+		return
+	}
+	if cfg.Mode == nil {
+		cfg.Mode = &ClientAuthRequire
+	}
+	if cfg.Headers == nil {
+		cfg.Headers = &ClientCertHeadersCfg{}
+	}
+	if cfg.Headers.Subject == nil {
+		cfg.Headers.Subject = &clientCertSubject
+	}
+	if cfg.Headers.SANs == nil {
+		cfg.Headers.SANs = &clientCertSANs
+	}
+	if cfg.Headers.Fingerprint == nil {
+		cfg.Headers.Fingerprint = &clientCertFingerprint
+	}
+}
+
+// validateEntrypointsCfg runs after normalizeEntrypointsCfg.
+func validateEntrypointsCfg(eps map[string]*EntrypointCfg) error {
+	addresses := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(eps)) {
+		ep := eps[name]
+		if ep == nil || ep.Address == nil || *ep.Address == "" {
+			return fmt.Errorf("invalid asena configuration: entrypoint %q needs an address", name)
+		}
+		// A UDP port is a different port from the TCP one with the same number, so DNS can have both.
+		key := *ep.Address
+		if *ep.Protocol == ProtocolUDP {
+			key += "/udp"
+		}
+		if other, ok := addresses[key]; ok {
+			return fmt.Errorf("invalid asena configuration: entrypoints %q and %q have the same address", other, name)
+		}
+		addresses[key] = name
+		if ep.HTTP3 != nil && *ep.HTTP3 {
+			// HTTP/3 takes the UDP port as well.
+			if other, ok := addresses[*ep.Address+"/udp"]; ok {
+				return fmt.Errorf("invalid asena configuration: entrypoints %q and %q have the same address", other, name)
+			}
+			addresses[*ep.Address+"/udp"] = name
+		}
+
+		switch *ep.Protocol {
+		case ProtocolHTTP:
+			if ep.TLS != nil {
+				return fmt.Errorf("invalid asena configuration: entrypoint %q: tls needs protocol https or tcp", name)
+			}
+		case ProtocolHTTPS:
+		case ProtocolTCP:
+			if ep.RedirectTo != nil {
+				return fmt.Errorf("invalid asena configuration: entrypoint %q: redirect_to needs protocol http or https", name)
+			}
+		case ProtocolUDP:
+			if ep.TLS != nil || ep.RedirectTo != nil || ep.ProxyProtocol != nil {
+				return fmt.Errorf("invalid asena configuration: entrypoint %q: tls, redirect_to and proxy_protocol don't work with protocol udp", name)
+			}
+		default:
+			return fmt.Errorf("invalid asena configuration: entrypoint %q: unknown protocol %q", name, *ep.Protocol)
+		}
+
+		if ep.TLS != nil && ep.TLS.ClientAuth != nil {
+			if *ep.Protocol != ProtocolHTTPS {
+				return fmt.Errorf("invalid asena configuration: entrypoint %q: tls.client_auth needs protocol https", name)
+			}
+			if err := validateClientAuthCfg(ep.TLS.ClientAuth); err != nil {
+				return fmt.Errorf("invalid asena configuration: entrypoint %q: tls.client_auth: %w", name, err)
+			}
+		}
+
+		if ep.HTTP3 != nil && *ep.HTTP3 && *ep.Protocol != ProtocolHTTPS {
+			return fmt.Errorf("invalid asena configuration: entrypoint %q: http3 needs protocol https", name)
+		}
+
+		if ep.RedirectTo != nil {
+			target, ok := eps[*ep.RedirectTo]
+			if !ok || target == nil || *ep.RedirectTo == name || target.Protocol == nil || *target.Protocol != ProtocolHTTPS {
+				return fmt.Errorf("invalid asena configuration: entrypoint %q: redirect_to must name another https entrypoint", name)
+			}
+		}
+
+		t := ep.Timeouts
+		if *t.ReadHeader < 0 || *t.Read < 0 || *t.Write < 0 || *t.Idle < 0 {
+			return fmt.Errorf("invalid asena configuration: entrypoint %q: timeouts can't be negative", name)
+		}
+
+		if pp := ep.ProxyProtocol; pp != nil {
+			for _, cidr := range pp.TrustedIPs {
+				if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+					return fmt.Errorf("invalid asena configuration: entrypoint %q: proxy_protocol.trusted_ips: %q is not an IP address or CIDR range", name, cidr)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validateAsenaCfg(cfg *AsenaCfg) error {
+	for _, cidr := range cfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			return fmt.Errorf("invalid asena configuration: trusted_proxies: %q is not an IP address or CIDR range", cidr)
+		}
+	}
+	switch http.CanonicalHeaderKey(*cfg.TrustedProxiesHeader) {
+	case "X-Forwarded-For", "Forwarded", "X-Real-Ip":
+	default:
+		return fmt.Errorf("invalid asena configuration: trusted_proxies_header must be X-Forwarded-For, Forwarded or X-Real-IP, got %q", *cfg.TrustedProxiesHeader)
+	}
+	if cfg.ProxyProtocol != nil {
+		if len(cfg.ProxyProtocol.TrustedIPs) == 0 {
+			return fmt.Errorf("invalid asena configuration: proxy_protocol.trusted_ips section is missing")
+		}
+		for _, cidr := range cfg.ProxyProtocol.TrustedIPs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+				return fmt.Errorf("invalid asena configuration: proxy_protocol.trusted_ips: %q is not an IP address or CIDR range", cidr)
+			}
+		}
+	}
+	return nil
+}
+
+// validateClientAuthCfg runs after normalizeClientAuthCfg. Only request mode asks for a certificate
+// without checking it, so the others need CAs to check it against.
+func validateClientAuthCfg(cfg *ClientAuthCfg) error {
+	switch *cfg.Mode {
+	case ClientAuthRequest:
+	case ClientAuthVerifyIfGiven, ClientAuthRequire:
+		if len(cfg.CAFiles) == 0 {
+			return fmt.Errorf("mode %s needs ca_files", *cfg.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown mode %q, use request, verify-if-given or require", *cfg.Mode)
+	}
+	return nil
 }
 
 func normalizeLogCfg(cfg *LogCfg) {
@@ -129,6 +367,41 @@ func normalizeProxyTransportCfg(cfg *ProxyTransportCfg) {
 	}
 }
 
+func normalizeACMECfg(cfg *ACMECfg) {
+	if cfg == nil {
+		return
+	}
+	if cfg.CAServer == nil {
+		cfg.CAServer = &acmeCAServer
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = &acmeStorage
+	}
+	for i, d := range cfg.Domains {
+		cfg.Domains[i] = strings.ToLower(strings.TrimSpace(d))
+	}
+}
+
+// validateACMECfg runs after normalizeACMECfg. The HTTP-01 and TLS-ALPN-01 challenges can't prove a
+// wildcard name, so domains must be names of their own.
+func validateACMECfg(cfg *ACMECfg) error {
+	if cfg == nil {
+		return nil
+	}
+	if u, err := url.Parse(*cfg.CAServer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid asena configuration: acme.ca_server must be an http or https URL")
+	}
+	if *cfg.Storage == "" {
+		return fmt.Errorf("invalid asena configuration: acme.storage must be a directory")
+	}
+	for _, d := range cfg.Domains {
+		if d == "" || strings.ContainsAny(d, "*:/") {
+			return fmt.Errorf("invalid asena configuration: acme.domains: %q must be a host name, without wildcards", d)
+		}
+	}
+	return nil
+}
+
 func setVariablesGotFromCLI(opts *cli.Options) {
 	if opts.PortHTTP != "" {
 		portHTTP = opts.PortHTTP
@@ -147,22 +420,96 @@ func setVariablesGotFromCLI(opts *cli.Options) {
 // ============================== Dynamic ==============================
 
 var (
-	RoundRobin          = "round-robin"
-	WeightedRoundRobin  = "weighted-round-robin"
-	LeastConnections    = "least-connections"
-	LeastTime           = "least-time"
-	IPHash              = "ip-hash"
-	StickySession       = "sticky-session"
-	ConsistentHash      = "consistent-hash"
-	flashInterval       = 500 * time.Millisecond
-	passHostHeaderFalse = false
+	RoundRobin            = "round-robin"
+	WeightedRoundRobin    = "weighted-round-robin"
+	LeastConnections      = "least-connections"
+	LeastTime             = "least-time"
+	IPHash                = "ip-hash"
+	StickySession         = "sticky-session"
+	ConsistentHash        = "consistent-hash"
+	flashInterval         = 500 * time.Millisecond
+	passHostHeaderFalse   = false
+	hcPath                = "/"
+	hcInterval            = 10 * time.Second
+	hcTimeout             = 2 * time.Second
+	hcExpectedStatus      = 200
+	hcHealthyThreshold    = 2
+	hcUnhealthyThreshold  = 3
+	odConsecutiveFailures = 5
+	odWindow              = 10 * time.Second
+	odBaseEjectionTime    = 30 * time.Second
+	odMaxEjectionTime     = 5 * time.Minute
+	cbErrorRatio          = 0.5
+	cbLatencyPercentile   = 99.0
+	cbWindow              = 10 * time.Second
+	cbMinRequests         = 20
+	cbOpenDuration        = 30 * time.Second
+	cbHalfOpenRequests    = 3
+	retryAttempts         = 3
+	ppVersion             = 2
+	mirrorMaxBodySize     = int64(1 << 20) // bytes
+	mirrorTimeout         = 10 * time.Second
+	weightedWeight        = uint(1)
+	weightedStickyMaxAge  = 24 * time.Hour
+	weightedStickySecure  = false
+	foFailureThreshold    = 3
+	foRecoveryInterval    = 10 * time.Second
+	tcpPassthrough        = false
+	udpSessionTimeout     = 30 * time.Second
+	udpMaxSessions        = 10_000
+	rlPeriod              = time.Second
+	rlKey                 = RateLimitKeyClientIP
+	baRealm               = "asena"
+	baRemoveHeader        = false
+	faTimeout             = 5 * time.Second
+	jwtJWKSRefresh        = 15 * time.Minute
+	jwtLeeway             = time.Duration(0)
+	jwtRealm              = "asena"
+	corsAllowMethods      = []string{"GET", "HEAD", "POST"}
+	corsAllowCredentials  = false
+	corsMaxAge            = time.Duration(0)
+	compressEncodings     = []string{CompressZstd, CompressBrotli, CompressGzip}
+	compressMinSize       = 1024 // bytes
+	cacheMemoryMB         = 64
+	cacheMaxEntrySize     = 1 << 20 // bytes
+	cacheDiskMB           = 1024
+	cachePurgeAllowedIPs  = []string{"127.0.0.1/32", "::1/128"}
+	// Formats that are compressed already; compressing them again costs CPU and saves nothing.
+	compressExcludeContentTypes = []string{
+		"image/png", "image/jpeg", "image/gif", "image/webp", "image/avif",
+		"video/*", "audio/*", "font/woff", "font/woff2",
+		"application/zip", "application/gzip", "application/zstd", "application/grpc",
+	}
+)
+
+// Content codings a compress middleware can produce, by their Accept-Encoding names.
+const (
+	CompressZstd   = "zstd"
+	CompressBrotli = "br"
+	CompressGzip   = "gzip"
+)
+
+// Rate limit keys: what a rate_limit middleware counts requests per.
+const (
+	RateLimitKeyClientIP = "client_ip"
+	RateLimitKeyHeader   = "header"
+	RateLimitKeyRouter   = "router"
 )
 
 func setDynamicConfigs(cfg *DynamicConfig) error {
+	if cfg.HTTP == nil && (cfg.TCP != nil || cfg.UDP != nil) {
+		// A file that only routes TCP or UDP doesn't need an empty http section.
+		cfg.HTTP = &HTTPCfg{Routers: map[string]*RoutersCfg{}, Services: map[string]*ServiceCfg{}}
+	}
+
 	if err := validateHTTPCfg(cfg.HTTP); err != nil {
 		return err
 	}
 
+	if err := validateMiddlewaresCfg(cfg.HTTP); err != nil {
+		return err
+	}
+
 	for _, s := range cfg.HTTP.Services {
 		normalizeServicesCfg(s)
 		if err := validateServiceCfg(s); err != nil {
@@ -170,6 +517,164 @@ func setDynamicConfigs(cfg *DynamicConfig) error {
 		}
 	}
 
+	if err := validateServiceRefsCfg(cfg.HTTP.Services); err != nil {
+		return err
+	}
+
+	if err := validateTCPCfg(cfg.TCP); err != nil {
+		return err
+	}
+
+	if err := validateUDPCfg(cfg.UDP); err != nil {
+		return err
+	}
+
+	if err := validateTLSCfg(cfg.TLS); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateTLSCfg checks the tls section, which is optional. The files are read when the certificates
+// are loaded, where one that can't be is skipped with a warning.
+func validateTLSCfg(cfg *TLSCfg) error {
+	if cfg == nil {
+		return nil
+	}
+	for i, c := range cfg.Certificates {
+		if c == nil || c.CertFile == nil || *c.CertFile == "" || c.KeyFile == nil || *c.KeyFile == "" {
+			return fmt.Errorf("invalid dynamic configuration: tls.certificates[%d] needs cert_file and key_file", i)
+		}
+	}
+	if c := cfg.DefaultCertificate; c != nil && (c.CertFile == nil || *c.CertFile == "" || c.KeyFile == nil || *c.KeyFile == "") {
+		return fmt.Errorf("invalid dynamic configuration: tls.default_certificate needs cert_file and key_file")
+	}
+	return nil
+}
+
+// validateTCPCfg normalizes and checks the tcp section, which is optional. Rules are read when the
+// routers are built, the same as for HTTP routers.
+func validateTCPCfg(cfg *TCPCfg) error {
+	if cfg == nil {
+		return nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Services)) {
+		s := cfg.Services[name]
+		if s == nil || s.LoadBalancer == nil {
+			return fmt.Errorf("invalid dynamic configuration: tcp service %q: load_balancer section is missing", name)
+		}
+		normalizeTCPLoadBalancerCfg(s.LoadBalancer)
+		if err := validateTCPLoadBalancerCfg(name, s.LoadBalancer); err != nil {
+			return err
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Routers)) {
+		r := cfg.Routers[name]
+		if r == nil || r.Rule == nil || strings.TrimSpace(*r.Rule) == "" {
+			return fmt.Errorf("invalid dynamic configuration: tcp router %q needs a rule", name)
+		}
+		if r.Service == nil || cfg.Services[*r.Service] == nil {
+			return fmt.Errorf("invalid dynamic configuration: tcp router %q needs the name of a tcp service", name)
+		}
+		if r.TLS != nil && r.TLS.Passthrough == nil {
+			r.TLS.Passthrough = &tcpPassthrough
+		}
+	}
+	return nil
+}
+
+// validateUDPCfg normalizes and checks the udp section, which is optional.
+func validateUDPCfg(cfg *UDPCfg) error {
+	if cfg == nil {
+		return nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Services)) {
+		s := cfg.Services[name]
+		if s == nil || s.LoadBalancer == nil {
+			return fmt.Errorf("invalid dynamic configuration: udp service %q: load_balancer section is missing", name)
+		}
+		lb := s.LoadBalancer
+		if lb.Algorithm == nil {
+			lb.Algorithm = &RoundRobin
+		}
+		if lb.SessionTimeout == nil {
+			lb.SessionTimeout = &udpSessionTimeout
+		}
+		if lb.MaxSessions == nil {
+			lb.MaxSessions = &udpMaxSessions
+		}
+		if len(lb.Servers) == 0 {
+			return fmt.Errorf("invalid dynamic configuration: udp service %q: load_balancer.servers section is missing", name)
+		}
+		for _, srv := range lb.Servers {
+			if srv == nil || srv.Address == nil {
+				return fmt.Errorf("invalid dynamic configuration: udp service %q: every server needs an address", name)
+			}
+			if host, port, err := net.SplitHostPort(*srv.Address); err != nil || host == "" || port == "" {
+				return fmt.Errorf("invalid dynamic configuration: udp service %q: server address %q must be host:port", name, *srv.Address)
+			}
+		}
+		if err := validateServiceAlgorithm(lb.Algorithm); err != nil {
+			return err
+		}
+		if *lb.Algorithm == StickySession || *lb.Algorithm == LeastTime {
+			return fmt.Errorf("invalid dynamic configuration: udp service %q: algorithm %s doesn't work for UDP", name, *lb.Algorithm)
+		}
+		if *lb.SessionTimeout <= 0 {
+			return fmt.Errorf("invalid dynamic configuration: udp service %q: session_timeout must be greater than 0", name)
+		}
+		if *lb.MaxSessions <= 0 {
+			return fmt.Errorf("invalid dynamic configuration: udp service %q: max_sessions must be greater than 0", name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Routers)) {
+		r := cfg.Routers[name]
+		if r == nil || r.Service == nil || cfg.Services[*r.Service] == nil {
+			return fmt.Errorf("invalid dynamic configuration: udp router %q needs the name of a udp service", name)
+		}
+	}
+	return nil
+}
+
+func normalizeTCPLoadBalancerCfg(cfg *TCPLoadBalancerCfg) {
+	if cfg.Algorithm == nil {
+		cfg.Algorithm = &RoundRobin
+	}
+	if cfg.OutlierDetection != nil {
+		normalizeOutlierDetectionCfg(cfg.OutlierDetection)
+	}
+	if pp := cfg.ProxyProtocol; pp != nil && pp.Version == nil {
+		pp.Version = &ppVersion
+	}
+}
+
+// validateTCPLoadBalancerCfg runs after normalizeTCPLoadBalancerCfg. Sticky Sessions needs a cookie
+// and Least Time a response, and a TCP connection has neither.
+func validateTCPLoadBalancerCfg(service string, cfg *TCPLoadBalancerCfg) error {
+	if len(cfg.Servers) == 0 {
+		return fmt.Errorf("invalid dynamic configuration: tcp service %q: load_balancer.servers section is missing", service)
+	}
+	for _, srv := range cfg.Servers {
+		if srv == nil || srv.Address == nil {
+			return fmt.Errorf("invalid dynamic configuration: tcp service %q: every server needs an address", service)
+		}
+		if host, port, err := net.SplitHostPort(*srv.Address); err != nil || host == "" || port == "" {
+			return fmt.Errorf("invalid dynamic configuration: tcp service %q: server address %q must be host:port", service, *srv.Address)
+		}
+	}
+	if err := validateServiceAlgorithm(cfg.Algorithm); err != nil {
+		return err
+	}
+	if *cfg.Algorithm == StickySession || *cfg.Algorithm == LeastTime {
+		return fmt.Errorf("invalid dynamic configuration: tcp service %q: algorithm %s doesn't work for TCP", service, *cfg.Algorithm)
+	}
+	if err := validateOutlierDetectionCfg(cfg.OutlierDetection); err != nil {
+		return err
+	}
+	if pp := cfg.ProxyProtocol; pp != nil && *pp.Version != 1 && *pp.Version != 2 {
+		return fmt.Errorf("invalid dynamic configuration: proxy_protocol.version must be 1 or 2")
+	}
 	return nil
 }
 
@@ -186,7 +691,318 @@ func validateHTTPCfg(cfg *HTTPCfg) error {
 	return nil
 }
 
+// validateMiddlewaresCfg checks the middlewares section and every router's references into it.
+// A router that names a middleware that doesn't exist fails the whole reload instead of being
+// skipped: the missing middleware could be the one that was supposed to protect it.
+func validateMiddlewaresCfg(cfg *HTTPCfg) error {
+	for name, m := range cfg.Middlewares {
+		if m != nil {
+			normalizeMiddlewareCfg(m)
+		}
+		if m == nil || middlewareTypes(m) != 1 {
+			return fmt.Errorf("invalid dynamic configuration: middleware %q must set exactly one middleware type", name)
+		}
+		if err := validateMiddlewareCfg(m); err != nil {
+			return fmt.Errorf("invalid dynamic configuration: middleware %q: %w", name, err)
+		}
+	}
+
+	for name, r := range cfg.Routers {
+		if r == nil {
+			continue
+		}
+		for _, ref := range r.Middlewares {
+			if _, ok := cfg.Middlewares[ref]; !ok {
+				return fmt.Errorf("invalid dynamic configuration: router %q uses unknown middleware %q", name, ref)
+			}
+		}
+	}
+	return nil
+}
+
+// middlewareTypes counts the middleware types m sets. Each new middleware type adds its field here.
+func middlewareTypes(m *MiddlewareCfg) int {
+	n := 0
+	for _, set := range []bool{
+		m.StripPrefix != nil,
+		m.AddPrefix != nil,
+		m.ReplacePathRegex != nil,
+		m.Headers != nil,
+		m.RateLimit != nil,
+		m.BasicAuth != nil,
+		m.ForwardAuth != nil,
+		m.JWT != nil,
+		m.CORS != nil,
+		m.Compress != nil,
+		m.Cache != nil,
+	} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// validateMiddlewareCfg checks the one type block m sets. Errors are wrapped with the
+// middleware's name by the caller.
+func validateMiddlewareCfg(m *MiddlewareCfg) error {
+	switch {
+	case m.StripPrefix != nil:
+		if len(m.StripPrefix.Prefixes) == 0 {
+			return fmt.Errorf("strip_prefix.prefixes must list at least one prefix")
+		}
+		for _, p := range m.StripPrefix.Prefixes {
+			if !strings.HasPrefix(p, "/") {
+				return fmt.Errorf("strip_prefix prefix %q must start with /", p)
+			}
+		}
+	case m.AddPrefix != nil:
+		if m.AddPrefix.Prefix == nil || !strings.HasPrefix(*m.AddPrefix.Prefix, "/") {
+			return fmt.Errorf("add_prefix.prefix must start with /")
+		}
+	case m.ReplacePathRegex != nil:
+		if m.ReplacePathRegex.Regex == nil || m.ReplacePathRegex.Replacement == nil {
+			return fmt.Errorf("replace_path_regex needs both regex and replacement")
+		}
+		if _, err := regexp.Compile(*m.ReplacePathRegex.Regex); err != nil {
+			return fmt.Errorf("replace_path_regex.regex is invalid: %w", err)
+		}
+	case m.Headers != nil:
+		for _, ops := range []*HeaderOpsCfg{m.Headers.Request, m.Headers.Response} {
+			if err := validateHeaderOpsCfg(ops); err != nil {
+				return err
+			}
+		}
+	case m.RateLimit != nil:
+		return validateRateLimitCfg(m.RateLimit)
+	case m.BasicAuth != nil:
+		if (m.BasicAuth.UsersFile == nil || *m.BasicAuth.UsersFile == "") && len(m.BasicAuth.Users) == 0 {
+			return fmt.Errorf("basic_auth needs users or users_file")
+		}
+	case m.ForwardAuth != nil:
+		if m.ForwardAuth.Address == nil {
+			return fmt.Errorf("forward_auth.address is required")
+		}
+		u, err := url.Parse(*m.ForwardAuth.Address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("forward_auth.address must be an http or https URL")
+		}
+		if *m.ForwardAuth.Timeout <= 0 {
+			return fmt.Errorf("forward_auth.timeout must be greater than 0")
+		}
+	case m.JWT != nil:
+		return validateJWTCfg(m.JWT)
+	case m.CORS != nil:
+		return validateCORSCfg(m.CORS)
+	case m.Compress != nil:
+		return validateCompressCfg(m.Compress)
+	case m.Cache != nil:
+		return validateCacheCfg(m.Cache)
+	}
+	return nil
+}
+
+// validateHeaderOpsCfg only checks header names. Values are templates, and those are parsed (and
+// rejected) when the middleware is built.
+func validateHeaderOpsCfg(cfg *HeaderOpsCfg) error {
+	if cfg == nil {
+		return nil
+	}
+
+	names := slices.Clone(cfg.Remove)
+	for name := range cfg.Set {
+		names = append(names, name)
+	}
+	for name := range cfg.Add {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, " \t:\r\n") {
+			return fmt.Errorf("headers: %q is not a valid header name", name)
+		}
+	}
+	return nil
+}
+
+// validateRateLimitCfg runs after normalizeRateLimitCfg, so only average and header may still be nil.
+func validateRateLimitCfg(cfg *RateLimitCfg) error {
+	if cfg.Average == nil || *cfg.Average <= 0 {
+		return fmt.Errorf("rate_limit.average must be greater than 0")
+	}
+	if *cfg.Period <= 0 {
+		return fmt.Errorf("rate_limit.period must be greater than 0")
+	}
+	if *cfg.Burst < 1 {
+		return fmt.Errorf("rate_limit.burst must be at least 1")
+	}
+	switch *cfg.Key {
+	case RateLimitKeyClientIP, RateLimitKeyRouter:
+	case RateLimitKeyHeader:
+		if cfg.Header == nil || *cfg.Header == "" {
+			return fmt.Errorf("rate_limit.header must be set when key is header")
+		}
+	default:
+		return fmt.Errorf("rate_limit.key must be one of client_ip, header, router, got %q", *cfg.Key)
+	}
+	return nil
+}
+
+// jwtAlgorithms are the signing algorithms a jwt middleware can verify. "none" is deliberately
+// not one of them.
+var jwtAlgorithms = []string{
+	"HS256", "HS384", "HS512",
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// validateJWTCfg runs after normalizeMiddlewareCfg. The key files and the JWKS file are read when
+// the middleware is built, not here.
+func validateJWTCfg(cfg *JWTCfg) error {
+	if len(cfg.KeyFiles) == 0 && (cfg.Secret == nil || *cfg.Secret == "") && cfg.JWKSFile == nil && cfg.JWKSURL == nil {
+		return fmt.Errorf("jwt needs at least one of key_files, secret, jwks_file, jwks_url")
+	}
+	if cfg.JWKSURL != nil {
+		u, err := url.Parse(*cfg.JWKSURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("jwt.jwks_url must be an http or https URL")
+		}
+	}
+	if *cfg.JWKSRefresh <= 0 {
+		return fmt.Errorf("jwt.jwks_refresh must be greater than 0")
+	}
+	if *cfg.Leeway < 0 {
+		return fmt.Errorf("jwt.leeway must not be negative")
+	}
+	for _, alg := range cfg.Algorithms {
+		if !slices.Contains(jwtAlgorithms, alg) {
+			return fmt.Errorf("jwt.algorithms: unsupported algorithm %q", alg)
+		}
+	}
+	for claim, header := range cfg.ForwardClaims {
+		if claim == "" {
+			return fmt.Errorf("jwt.forward_claims: claim name must not be empty")
+		}
+		if header == "" || strings.ContainsAny(header, " \t:\r\n") {
+			return fmt.Errorf("jwt.forward_claims: %q is not a valid header name", header)
+		}
+	}
+	return nil
+}
+
+// validateCORSCfg runs after normalizeMiddlewareCfg. An origin is "*", an exact origin like
+// "https://app.example.com", or one wildcard subdomain like "https://*.example.com".
+func validateCORSCfg(cfg *CORSCfg) error {
+	if len(cfg.AllowOrigins) == 0 && len(cfg.AllowOriginRegex) == 0 {
+		return fmt.Errorf("cors needs allow_origins or allow_origin_regex")
+	}
+	for _, origin := range cfg.AllowOrigins {
+		if origin == "*" {
+			if *cfg.AllowCredentials {
+				return fmt.Errorf("cors: allow_origins \"*\" can't be used with allow_credentials, list the origins instead")
+			}
+			continue
+		}
+		if !validCORSOrigin(origin) {
+			return fmt.Errorf("cors: allow_origins %q must be \"*\", scheme://host[:port], or scheme://*.host[:port]", origin)
+		}
+	}
+	for _, re := range cfg.AllowOriginRegex {
+		if _, err := regexp.Compile(re); err != nil {
+			return fmt.Errorf("cors: allow_origin_regex %q is invalid: %w", re, err)
+		}
+	}
+	if *cfg.MaxAge < 0 {
+		return fmt.Errorf("cors.max_age must not be negative")
+	}
+	return nil
+}
+
+// validateCompressCfg runs after normalizeMiddlewareCfg. Content types are "type/subtype" or
+// "type/*".
+func validateCompressCfg(cfg *CompressCfg) error {
+	seen := map[string]bool{}
+	for _, enc := range cfg.Encodings {
+		switch enc {
+		case CompressZstd, CompressBrotli, CompressGzip:
+		default:
+			return fmt.Errorf("compress.encodings must only list zstd, br, gzip, got %q", enc)
+		}
+		if seen[enc] {
+			return fmt.Errorf("compress.encodings lists %q twice", enc)
+		}
+		seen[enc] = true
+	}
+	if *cfg.MinSize < 0 {
+		return fmt.Errorf("compress.min_size must not be negative")
+	}
+	for _, ct := range slices.Concat(cfg.IncludeContentTypes, cfg.ExcludeContentTypes) {
+		typ, sub, ok := strings.Cut(ct, "/")
+		if !ok || typ == "" || typ == "*" || sub == "" || strings.ContainsAny(ct, " ;") {
+			return fmt.Errorf("compress: content type %q must be type/subtype or type/*", ct)
+		}
+	}
+	return nil
+}
+
+// validateCacheCfg runs after normalizeMiddlewareCfg.
+func validateCacheCfg(cfg *CacheCfg) error {
+	if *cfg.MemoryMB < 1 {
+		return fmt.Errorf("cache.memory_mb must be at least 1")
+	}
+	if *cfg.MaxEntrySize < 1 || *cfg.MaxEntrySize > *cfg.MemoryMB<<20 {
+		return fmt.Errorf("cache.max_entry_size must be at least 1 and fit in memory_mb")
+	}
+	if cfg.DiskDir != nil {
+		if *cfg.DiskDir == "" {
+			return fmt.Errorf("cache.disk_dir must not be empty")
+		}
+		if *cfg.DiskMB < 1 {
+			return fmt.Errorf("cache.disk_mb must be at least 1")
+		}
+	}
+	if p := cfg.Purge; p != nil {
+		if p.Path == nil || !strings.HasPrefix(*p.Path, "/") {
+			return fmt.Errorf("cache.purge.path must start with /")
+		}
+		for _, ip := range p.AllowedIPs {
+			if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+				return fmt.Errorf("cache.purge.allowed_ips: %q is not an IP address or CIDR range", ip)
+			}
+		}
+	}
+	return nil
+}
+
+func validCORSOrigin(origin string) bool {
+	scheme, host, ok := strings.Cut(origin, "://")
+	if !ok || scheme == "" || strings.ContainsAny(host, "/?#") {
+		return false
+	}
+	host = strings.TrimPrefix(host, "*.")
+	return host != "" && !strings.Contains(host, "*")
+}
+
 func validateServiceCfg(cfg *ServiceCfg) error {
+	if cfg != nil && (cfg.Weighted != nil || cfg.Failover != nil) {
+		if serviceKinds(cfg) != 1 {
+			return fmt.Errorf("invalid dynamic configuration: a service must set exactly one of load_balancer, weighted, failover")
+		}
+		var err error
+		if cfg.Weighted != nil {
+			err = validateWeightedCfg(cfg.Weighted)
+		} else {
+			err = validateFailoverCfg(cfg.Failover)
+		}
+		if err != nil {
+			return err
+		}
+		if err := validateCircuitBreakerCfg(cfg.CircuitBreaker); err != nil {
+			return err
+		}
+		return validateMirroringCfg(cfg.Mirroring)
+	}
 	if cfg == nil || cfg.LoadBalancer == nil {
 		return errMissing("load_balancer")
 	}
@@ -196,6 +1012,42 @@ func validateServiceCfg(cfg *ServiceCfg) error {
 	if err := validateServiceAlgorithm(cfg.LoadBalancer.Algorithm); err != nil {
 		return err
 	}
+	if err := validateHealthCheckCfg(cfg.LoadBalancer.HealthCheck); err != nil {
+		return err
+	}
+	if err := validateOutlierDetectionCfg(cfg.LoadBalancer.OutlierDetection); err != nil {
+		return err
+	}
+	if err := validateRetryCfg(cfg.LoadBalancer.Retry); err != nil {
+		return err
+	}
+	if pp := cfg.LoadBalancer.ProxyProtocol; pp != nil && *pp.Version != 1 && *pp.Version != 2 {
+		return fmt.Errorf("invalid dynamic configuration: proxy_protocol.version must be 1 or 2")
+	}
+	if err := validateCircuitBreakerCfg(cfg.CircuitBreaker); err != nil {
+		return err
+	}
+	if err := validateMirroringCfg(cfg.Mirroring); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateHealthCheckCfg runs after normalizeHealthCheckCfg, so every field is already set.
+// A nil block means health checks are off for this service, which is valid.
+func validateHealthCheckCfg(cfg *HealthCheckCfg) error {
+	if cfg == nil {
+		return nil
+	}
+	if *cfg.Interval <= 0 {
+		return fmt.Errorf("invalid dynamic configuration: health_check.interval must be greater than 0")
+	}
+	if *cfg.Timeout <= 0 || *cfg.Timeout > *cfg.Interval {
+		return fmt.Errorf("invalid dynamic configuration: health_check.timeout must be greater than 0 and not longer than interval")
+	}
+	if *cfg.HealthyThreshold < 1 || *cfg.UnhealthyThreshold < 1 {
+		return fmt.Errorf("invalid dynamic configuration: health_check thresholds must be at least 1")
+	}
 	return nil
 }
 
@@ -221,7 +1073,239 @@ func validateServiceAlgorithm(alg *string) error {
 	return nil
 }
 
+// validateOutlierDetectionCfg runs after normalizeOutlierDetectionCfg, same as validateHealthCheckCfg.
+func validateOutlierDetectionCfg(cfg *OutlierDetectionCfg) error {
+	if cfg == nil {
+		return nil
+	}
+	if *cfg.ConsecutiveFailures < 1 {
+		return fmt.Errorf("invalid dynamic configuration: outlier_detection.consecutive_failures must be at least 1")
+	}
+	if *cfg.Window <= 0 {
+		return fmt.Errorf("invalid dynamic configuration: outlier_detection.window must be greater than 0")
+	}
+	if *cfg.BaseEjectionTime <= 0 || *cfg.MaxEjectionTime < *cfg.BaseEjectionTime {
+		return fmt.Errorf("invalid dynamic configuration: outlier_detection.base_ejection_time must be greater than 0 and not longer than max_ejection_time")
+	}
+	return nil
+}
+
+// validateRetryCfg runs after normalizeRetryCfg. per_try_timeout is optional: nil means a retry
+// attempt is only bounded by the transport's own timeouts, like a normal request.
+func validateRetryCfg(cfg *RetryCfg) error {
+	if cfg == nil {
+		return nil
+	}
+	if *cfg.Attempts < 1 {
+		return fmt.Errorf("invalid dynamic configuration: retry.attempts must be at least 1")
+	}
+	if cfg.PerTryTimeout != nil && *cfg.PerTryTimeout <= 0 {
+		return fmt.Errorf("invalid dynamic configuration: retry.per_try_timeout must be greater than 0")
+	}
+	for _, code := range cfg.RetryOnStatus {
+		if code < 500 || code > 599 {
+			return fmt.Errorf("invalid dynamic configuration: retry.retry_on_status only accepts 5xx codes, got %d", code)
+		}
+	}
+	return nil
+}
+
+// validateCircuitBreakerCfg runs after normalizeCircuitBreakerCfg. Only the three trip conditions
+// may still be nil here, and at least one of them is always set by then.
+func validateCircuitBreakerCfg(cfg *CircuitBreakerCfg) error {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.ConsecutiveFailures != nil && *cfg.ConsecutiveFailures < 1 {
+		return fmt.Errorf("invalid dynamic configuration: circuit_breaker.consecutive_failures must be at least 1")
+	}
+	if cfg.ErrorRatio != nil && (*cfg.ErrorRatio <= 0 || *cfg.ErrorRatio > 1) {
+		return fmt.Errorf("invalid dynamic configuration: circuit_breaker.error_ratio must be greater than 0 and at most 1")
+	}
+	if cfg.LatencyThreshold != nil && *cfg.LatencyThreshold <= 0 {
+		return fmt.Errorf("invalid dynamic configuration: circuit_breaker.latency_threshold must be greater than 0")
+	}
+	if *cfg.LatencyPercentile <= 0 || *cfg.LatencyPercentile >= 100 {
+		return fmt.Errorf("invalid dynamic configuration: circuit_breaker.latency_percentile must be between 0 and 100")
+	}
+	if *cfg.Window <= 0 || *cfg.OpenDuration <= 0 {
+		return fmt.Errorf("invalid dynamic configuration: circuit_breaker.window and open_duration must be greater than 0")
+	}
+	if *cfg.MinRequests < 1 || *cfg.HalfOpenRequests < 1 {
+		return fmt.Errorf("invalid dynamic configuration: circuit_breaker.min_requests and half_open_requests must be at least 1")
+	}
+	return nil
+}
+
+// validateMirroringCfg runs after normalizeMirroringCfg. Whether the mirrored services exist is
+// checked by validateMirrorsCfg, once every service has been validated.
+func validateMirroringCfg(cfg *MirroringCfg) error {
+	if cfg == nil {
+		return nil
+	}
+	if len(cfg.Mirrors) == 0 {
+		return fmt.Errorf("invalid dynamic configuration: mirroring needs at least one mirror")
+	}
+	for _, m := range cfg.Mirrors {
+		if m == nil || m.Service == nil || *m.Service == "" {
+			return fmt.Errorf("invalid dynamic configuration: mirroring.mirrors: every mirror needs a service")
+		}
+		if m.Percent == nil || *m.Percent <= 0 || *m.Percent > 100 {
+			return fmt.Errorf("invalid dynamic configuration: mirroring.mirrors: percent for %q must be greater than 0 and at most 100", *m.Service)
+		}
+	}
+	if *cfg.MaxBodySize < 0 {
+		return fmt.Errorf("invalid dynamic configuration: mirroring.max_body_size must not be negative")
+	}
+	if *cfg.Timeout <= 0 {
+		return fmt.Errorf("invalid dynamic configuration: mirroring.timeout must be greater than 0")
+	}
+	return nil
+}
+
+// serviceKinds counts the blocks that say what kind of service cfg is.
+func serviceKinds(cfg *ServiceCfg) int {
+	n := 0
+	for _, set := range []bool{cfg.LoadBalancer != nil, cfg.Weighted != nil, cfg.Failover != nil} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// validateFailoverCfg runs after normalizeFailoverCfg. Whether the services exist is checked by
+// validateServiceRefsCfg.
+func validateFailoverCfg(cfg *FailoverCfg) error {
+	if cfg.Service == nil || *cfg.Service == "" || cfg.Fallback == nil || *cfg.Fallback == "" {
+		return fmt.Errorf("invalid dynamic configuration: failover needs service and fallback")
+	}
+	if *cfg.Service == *cfg.Fallback {
+		return fmt.Errorf("invalid dynamic configuration: failover.fallback must be a different service than failover.service")
+	}
+	if *cfg.FailureThreshold < 1 {
+		return fmt.Errorf("invalid dynamic configuration: failover.failure_threshold must be at least 1")
+	}
+	if *cfg.RecoveryInterval <= 0 {
+		return fmt.Errorf("invalid dynamic configuration: failover.recovery_interval must be greater than 0")
+	}
+	return nil
+}
+
+// validateWeightedCfg runs after normalizeWeightedCfg. Whether the services exist is checked by
+// validateServiceRefsCfg.
+func validateWeightedCfg(cfg *WeightedCfg) error {
+	if len(cfg.Services) == 0 {
+		return fmt.Errorf("invalid dynamic configuration: weighted.services section is missing")
+	}
+	total := uint(0)
+	for _, ws := range cfg.Services {
+		if ws == nil || ws.Name == nil || *ws.Name == "" {
+			return fmt.Errorf("invalid dynamic configuration: weighted.services: every entry needs a name")
+		}
+		total += *ws.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("invalid dynamic configuration: weighted.services: at least one weight must be greater than 0")
+	}
+	if st := cfg.Sticky; st != nil {
+		if st.CookieName != nil && (&http.Cookie{Name: *st.CookieName, Value: "x"}).Valid() != nil {
+			return fmt.Errorf("invalid dynamic configuration: weighted.sticky.cookie_name %q is not a valid cookie name", *st.CookieName)
+		}
+		if *st.MaxAge <= 0 {
+			return fmt.Errorf("invalid dynamic configuration: weighted.sticky.max_age must be greater than 0")
+		}
+	}
+	return nil
+}
+
+// validateServiceRefsCfg checks the references between services: every service a mirroring,
+// weighted or failover block names must exist, and no service may end up sending requests to itself, directly
+// or through others.
+func validateServiceRefsCfg(services map[string]*ServiceCfg) error {
+	for name, s := range services {
+		if s == nil {
+			continue
+		}
+		if s.Mirroring != nil {
+			for _, m := range s.Mirroring.Mirrors {
+				if *m.Service == name {
+					return fmt.Errorf("invalid dynamic configuration: service %q can't mirror to itself", name)
+				}
+				if _, ok := services[*m.Service]; !ok {
+					return fmt.Errorf("invalid dynamic configuration: service %q mirrors to unknown service %q", name, *m.Service)
+				}
+			}
+		}
+		for _, child := range childServices(s) {
+			if _, ok := services[child]; !ok {
+				return fmt.Errorf("invalid dynamic configuration: service %q uses unknown service %q", name, child)
+			}
+		}
+	}
+
+	// Mirrors aren't followed: a copy is never mirrored again, so they can't loop.
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(services))
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("invalid dynamic configuration: service %q uses itself through other services", name)
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		for _, child := range childServices(services[name]) {
+			if err := visit(child); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		return nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(services)) {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// childServices returns the services a composite service sends its requests on to.
+func childServices(s *ServiceCfg) []string {
+	var children []string
+	if s != nil && s.Weighted != nil {
+		for _, ws := range s.Weighted.Services {
+			children = append(children, *ws.Name)
+		}
+	}
+	if s != nil && s.Failover != nil {
+		children = append(children, *s.Failover.Service, *s.Failover.Fallback)
+	}
+	return children
+}
+
 func normalizeServicesCfg(cfg *ServiceCfg) {
+	if cfg.CircuitBreaker != nil {
+		normalizeCircuitBreakerCfg(cfg.CircuitBreaker)
+	}
+	if cfg.Mirroring != nil {
+		normalizeMirroringCfg(cfg.Mirroring)
+	}
+	if cfg.Weighted != nil {
+		normalizeWeightedCfg(cfg.Weighted)
+		return
+	}
+	if cfg.Failover != nil {
+		normalizeFailoverCfg(cfg.Failover)
+		return
+	}
+
 	if cfg.LoadBalancer == nil {
 		cfg.LoadBalancer = &LoadBalancerCfg{}
 	}
@@ -235,6 +1319,210 @@ func normalizeServicesCfg(cfg *ServiceCfg) {
 	if cfg.LoadBalancer.PassHostHeader == nil {
 		cfg.LoadBalancer.PassHostHeader = &passHostHeaderFalse
 	}
+	if cfg.LoadBalancer.HealthCheck != nil {
+		normalizeHealthCheckCfg(cfg.LoadBalancer.HealthCheck)
+	}
+	if cfg.LoadBalancer.OutlierDetection != nil {
+		normalizeOutlierDetectionCfg(cfg.LoadBalancer.OutlierDetection)
+	}
+	if cfg.LoadBalancer.Retry != nil {
+		normalizeRetryCfg(cfg.LoadBalancer.Retry)
+	}
+	if pp := cfg.LoadBalancer.ProxyProtocol; pp != nil && pp.Version == nil {
+		pp.Version = &ppVersion
+	}
+}
+
+func normalizeFailoverCfg(cfg *FailoverCfg) {
+	if cfg.FailureThreshold == nil {
+		cfg.FailureThreshold = &foFailureThreshold
+	}
+	if cfg.RecoveryInterval == nil {
+		cfg.RecoveryInterval = &foRecoveryInterval
+	}
+}
+
+// normalizeWeightedCfg gives every service without a weight a weight of 1. The sticky cookie's
+// name is left alone: it defaults to one derived from the service's name, which only the proxy
+// knows.
+func normalizeWeightedCfg(cfg *WeightedCfg) {
+	for _, ws := range cfg.Services {
+		if ws != nil && ws.Weight == nil {
+			ws.Weight = &weightedWeight
+		}
+	}
+	if st := cfg.Sticky; st != nil {
+		if st.MaxAge == nil {
+			st.MaxAge = &weightedStickyMaxAge
+		}
+		if st.Secure == nil {
+			st.Secure = &weightedStickySecure
+		}
+	}
+}
+
+// normalizeHealthCheckCfg only runs when the service has a health_check block at all.
+// Leaving the block out turns active checks off; writing "health_check: {}" turns them
+// on with every default below.
+func normalizeHealthCheckCfg(cfg *HealthCheckCfg) {
+	if cfg.Path == nil {
+		cfg.Path = &hcPath
+	}
+	if cfg.Interval == nil {
+		cfg.Interval = &hcInterval
+	}
+	if cfg.Timeout == nil {
+		cfg.Timeout = &hcTimeout
+	}
+	if cfg.ExpectedStatus == nil {
+		cfg.ExpectedStatus = &hcExpectedStatus
+	}
+	if cfg.HealthyThreshold == nil {
+		cfg.HealthyThreshold = &hcHealthyThreshold
+	}
+	if cfg.UnhealthyThreshold == nil {
+		cfg.UnhealthyThreshold = &hcUnhealthyThreshold
+	}
+}
+
+// normalizeOutlierDetectionCfg, like normalizeHealthCheckCfg, only runs when the block is present.
+func normalizeOutlierDetectionCfg(cfg *OutlierDetectionCfg) {
+	if cfg.ConsecutiveFailures == nil {
+		cfg.ConsecutiveFailures = &odConsecutiveFailures
+	}
+	if cfg.Window == nil {
+		cfg.Window = &odWindow
+	}
+	if cfg.BaseEjectionTime == nil {
+		cfg.BaseEjectionTime = &odBaseEjectionTime
+	}
+	if cfg.MaxEjectionTime == nil {
+		cfg.MaxEjectionTime = &odMaxEjectionTime
+	}
+}
+
+// normalizeRetryCfg only sets attempts. retry_on_status stays empty unless it's configured, so by
+// default only requests that never got an answer at all (refused, reset, timed out) are retried.
+func normalizeRetryCfg(cfg *RetryCfg) {
+	if cfg.Attempts == nil {
+		cfg.Attempts = &retryAttempts
+	}
+}
+
+// normalizeCircuitBreakerCfg fills in the defaults of a circuit_breaker block. The three trip
+// conditions (consecutive_failures, error_ratio, latency_threshold) are left alone when any of
+// them is set, so only the ones the operator asked for can open the breaker. With none of them
+// set, "circuit_breaker: {}" trips on error_ratio alone.
+func normalizeCircuitBreakerCfg(cfg *CircuitBreakerCfg) {
+	if cfg.ConsecutiveFailures == nil && cfg.ErrorRatio == nil && cfg.LatencyThreshold == nil {
+		cfg.ErrorRatio = &cbErrorRatio
+	}
+	if cfg.LatencyPercentile == nil {
+		cfg.LatencyPercentile = &cbLatencyPercentile
+	}
+	if cfg.Window == nil {
+		cfg.Window = &cbWindow
+	}
+	if cfg.MinRequests == nil {
+		cfg.MinRequests = &cbMinRequests
+	}
+	if cfg.OpenDuration == nil {
+		cfg.OpenDuration = &cbOpenDuration
+	}
+	if cfg.HalfOpenRequests == nil {
+		cfg.HalfOpenRequests = &cbHalfOpenRequests
+	}
+}
+
+// normalizeMirroringCfg leaves each mirror's percent alone: it is required, so nobody mirrors all
+// of their traffic by forgetting it.
+func normalizeMirroringCfg(cfg *MirroringCfg) {
+	if cfg.MaxBodySize == nil {
+		cfg.MaxBodySize = &mirrorMaxBodySize
+	}
+	if cfg.Timeout == nil {
+		cfg.Timeout = &mirrorTimeout
+	}
+}
+
+// normalizeMiddlewareCfg fills in defaults for whichever type m sets.
+func normalizeMiddlewareCfg(m *MiddlewareCfg) {
+	if m.RateLimit != nil {
+		normalizeRateLimitCfg(m.RateLimit)
+	}
+	if m.BasicAuth != nil {
+		if m.BasicAuth.Realm == nil {
+			m.BasicAuth.Realm = &baRealm
+		}
+		if m.BasicAuth.RemoveHeader == nil {
+			m.BasicAuth.RemoveHeader = &baRemoveHeader
+		}
+	}
+	if m.ForwardAuth != nil && m.ForwardAuth.Timeout == nil {
+		m.ForwardAuth.Timeout = &faTimeout
+	}
+	if m.JWT != nil {
+		if m.JWT.JWKSRefresh == nil {
+			m.JWT.JWKSRefresh = &jwtJWKSRefresh
+		}
+		if m.JWT.Leeway == nil {
+			m.JWT.Leeway = &jwtLeeway
+		}
+		if m.JWT.Realm == nil {
+			m.JWT.Realm = &jwtRealm
+		}
+	}
+	if m.CORS != nil {
+		if len(m.CORS.AllowMethods) == 0 {
+			m.CORS.AllowMethods = corsAllowMethods
+		}
+		if m.CORS.AllowCredentials == nil {
+			m.CORS.AllowCredentials = &corsAllowCredentials
+		}
+		if m.CORS.MaxAge == nil {
+			m.CORS.MaxAge = &corsMaxAge
+		}
+	}
+	if m.Compress != nil {
+		if len(m.Compress.Encodings) == 0 {
+			m.Compress.Encodings = compressEncodings
+		}
+		if m.Compress.MinSize == nil {
+			m.Compress.MinSize = &compressMinSize
+		}
+		if m.Compress.ExcludeContentTypes == nil {
+			m.Compress.ExcludeContentTypes = compressExcludeContentTypes
+		}
+	}
+	if m.Cache != nil {
+		if m.Cache.MemoryMB == nil {
+			m.Cache.MemoryMB = &cacheMemoryMB
+		}
+		if m.Cache.MaxEntrySize == nil {
+			m.Cache.MaxEntrySize = &cacheMaxEntrySize
+		}
+		if m.Cache.DiskMB == nil {
+			m.Cache.DiskMB = &cacheDiskMB
+		}
+		if m.Cache.Purge != nil && m.Cache.Purge.AllowedIPs == nil {
+			m.Cache.Purge.AllowedIPs = cachePurgeAllowedIPs
+		}
+	}
+}
+
+// normalizeRateLimitCfg fills in period and key. burst defaults to average rounded up, so a
+// client can use a whole period's allowance at once, but not more.
+func normalizeRateLimitCfg(cfg *RateLimitCfg) {
+	if cfg.Period == nil {
+		cfg.Period = &rlPeriod
+	}
+	if cfg.Key == nil {
+		cfg.Key = &rlKey
+	}
+	if cfg.Burst == nil && cfg.Average != nil {
+		burst := max(1, int(math.Ceil(*cfg.Average)))
+		cfg.Burst = &burst
+	}
 }
 
 func errMissing(section string) error {
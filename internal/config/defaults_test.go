@@ -3,6 +3,7 @@ package config
 import (
 	"strings"
 	"testing"
+	"time"
 )
 
 // ============================== Static ==============================
@@ -11,8 +12,8 @@ func TestNormalizeAsenaCfg_defaults(t *testing.T) {
 	cfg := &AsenaCfg{}
 	normalizeAsenaCfg(cfg)
 
-	if cfg.Port == nil || *cfg.Port != portHTTP {
-		t.Errorf("expected default port %s, got %v", portHTTP, cfg.Port)
+	if cfg.EnableHTTPS == nil || *cfg.EnableHTTPS {
+		t.Errorf("expected HTTPS to be off by default, got %v", cfg.EnableHTTPS)
 	}
 	if cfg.TLSCertFile == nil || *cfg.TLSCertFile != certFile {
 		t.Errorf("expected default TLS cert file %s, got %v", certFile, cfg.TLSCertFile)
@@ -20,6 +21,123 @@ func TestNormalizeAsenaCfg_defaults(t *testing.T) {
 	if cfg.TLSKeyFile == nil || *cfg.TLSKeyFile != keyFile {
 		t.Errorf("expected default TLS key file %s, got %v", keyFile, cfg.TLSKeyFile)
 	}
+	if cfg.TrustedProxiesHeader == nil || *cfg.TrustedProxiesHeader != "X-Forwarded-For" {
+		t.Errorf("expected trusted proxies to write X-Forwarded-For by default, got %v", cfg.TrustedProxiesHeader)
+	}
+}
+
+func TestValidateAsenaCfg_TrustedProxiesHeader(t *testing.T) {
+	for header, ok := range map[string]bool{"x-forwarded-for": true, "Forwarded": true, "X-Real-IP": true, "X-Client-IP": false} {
+		cfg := &AsenaCfg{TrustedProxiesHeader: &header}
+		normalizeAsenaCfg(cfg)
+		if err := validateAsenaCfg(cfg); (err == nil) != ok {
+			t.Errorf("%s: expected valid %v, got %v", header, ok, err)
+		}
+	}
+}
+
+func TestNormalizeEntrypointsCfg_legacyDefaults(t *testing.T) {
+	cfg := &AsenaCfg{}
+	normalizeAsenaCfg(cfg)
+	eps := normalizeEntrypointsCfg(nil, cfg)
+	if len(eps) != 1 || *eps["web"].Address != portHTTP || *eps["web"].Protocol != ProtocolHTTP || eps["web"].RedirectTo != nil {
+		t.Errorf("expected one plain HTTP entrypoint, got %+v", eps)
+	}
+
+	enabled := true
+	cfg = &AsenaCfg{EnableHTTPS: &enabled}
+	normalizeAsenaCfg(cfg)
+	eps = normalizeEntrypointsCfg(nil, cfg)
+	secure := eps["websecure"]
+	if secure == nil || *secure.Address != portHTTPS || *secure.Protocol != ProtocolHTTPS || *secure.TLS.CertFile != certFile {
+		t.Fatalf("expected an HTTPS entrypoint with the asena certificate, got %+v", secure)
+	}
+	if eps["web"] == nil || eps["web"].RedirectTo == nil || *eps["web"].RedirectTo != "websecure" {
+		t.Errorf("expected web to redirect to websecure, got %+v", eps["web"])
+	}
+	if *secure.Timeouts.ReadHeader != epReadHeaderTimeout || *secure.Timeouts.Write != 0 {
+		t.Errorf("unexpected timeout defaults: %+v", secure.Timeouts)
+	}
+	if err := validateEntrypointsCfg(eps); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateEntrypointsCfg(t *testing.T) {
+	addr := func(s string) *string { return &s }
+	cfg := &AsenaCfg{ProxyProtocol: &ListenerProxyProtocolCfg{TrustedIPs: []string{"10.0.0.0/8"}}}
+	normalizeAsenaCfg(cfg)
+
+	tests := []struct {
+		name    string
+		eps     map[string]*EntrypointCfg
+		wantErr string
+	}{
+		{"valid", map[string]*EntrypointCfg{
+			"public":   {Address: addr(":443"), TLS: &EntrypointTLSCfg{}},
+			"internal": {Address: addr(":8443"), Protocol: addr("https")},
+			"probes":   {Address: addr(":8080")},
+			"postgres": {Address: addr(":5432"), Protocol: addr("tcp"), TLS: &EntrypointTLSCfg{}},
+			"dns-tcp":  {Address: addr(":53"), Protocol: addr("tcp")},
+			"dns":      {Address: addr(":53"), Protocol: addr("udp")},
+			"partners": {Address: addr(":9443"), TLS: &EntrypointTLSCfg{ClientAuth: &ClientAuthCfg{CAFiles: []string{"ca.pem"}}}},
+			"curious":  {Address: addr(":10443"), TLS: &EntrypointTLSCfg{ClientAuth: &ClientAuthCfg{Mode: addr("request")}}},
+		}, ""},
+		{"no address", map[string]*EntrypointCfg{"web": {}}, "needs an address"},
+		{"same address", map[string]*EntrypointCfg{"a": {Address: addr(":80")}, "b": {Address: addr(":80")}}, "same address"},
+		{"unknown protocol", map[string]*EntrypointCfg{"a": {Address: addr(":80"), Protocol: addr("gopher")}}, "unknown protocol"},
+		{"tls on http", map[string]*EntrypointCfg{"a": {Address: addr(":80"), Protocol: addr("http"), TLS: &EntrypointTLSCfg{}}}, "tls needs protocol https"},
+		{"redirect to http", map[string]*EntrypointCfg{
+			"a": {Address: addr(":80"), RedirectTo: addr("b")},
+			"b": {Address: addr(":8080")},
+		}, "redirect_to must name another https entrypoint"},
+		{"redirect from tcp", map[string]*EntrypointCfg{
+			"a": {Address: addr(":5432"), Protocol: addr("tcp"), RedirectTo: addr("b")},
+			"b": {Address: addr(":443"), Protocol: addr("https")},
+		}, "redirect_to needs protocol http or https"},
+		{"http3 on http", map[string]*EntrypointCfg{"a": {Address: addr(":80"), HTTP3: &epHTTP3}}, "http3 needs protocol https"},
+		{"udp on the http3 port", map[string]*EntrypointCfg{
+			"a": {Address: addr(":443"), Protocol: addr("https")},
+			"b": {Address: addr(":443"), Protocol: addr("udp")},
+		}, "same address"},
+		{"tls on udp", map[string]*EntrypointCfg{"a": {Address: addr(":53"), Protocol: addr("udp"), TLS: &EntrypointTLSCfg{}}}, "don't work with protocol udp"},
+		{"client auth without ca", map[string]*EntrypointCfg{"a": {Address: addr(":443"), TLS: &EntrypointTLSCfg{ClientAuth: &ClientAuthCfg{}}}}, "mode require needs ca_files"},
+		{"client auth unknown mode", map[string]*EntrypointCfg{"a": {Address: addr(":443"), TLS: &EntrypointTLSCfg{ClientAuth: &ClientAuthCfg{Mode: addr("always")}}}}, "unknown mode"},
+		{"client auth on tcp", map[string]*EntrypointCfg{"a": {Address: addr(":5432"), Protocol: addr("tcp"), TLS: &EntrypointTLSCfg{ClientAuth: &ClientAuthCfg{}}}}, "client_auth needs protocol https"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eps := normalizeEntrypointsCfg(tt.eps, cfg)
+			err := validateEntrypointsCfg(eps)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if *eps["public"].Protocol != ProtocolHTTPS || *eps["internal"].TLS.KeyFile != keyFile {
+					t.Errorf("expected https entrypoints to get the asena certificate, got %+v", eps["internal"].TLS)
+				}
+				if !*eps["public"].HTTP3 || eps["probes"].HTTP3 != nil {
+					t.Errorf("expected https entrypoints, and only those, to serve HTTP/3 by default")
+				}
+				if ca := eps["partners"].TLS.ClientAuth; *ca.Mode != ClientAuthRequire || *ca.Headers.SANs != clientCertSANs {
+					t.Errorf("expected client_auth to default to require with the X-Client-Cert headers, got %+v", ca)
+				}
+				if *eps["postgres"].Protocol != ProtocolTCP || *eps["postgres"].TLS.CertFile != certFile {
+					t.Errorf("expected a tcp entrypoint with tls to get the asena certificate, got %+v", eps["postgres"].TLS)
+				}
+				if eps["probes"].ProxyProtocol != cfg.ProxyProtocol {
+					t.Error("expected entrypoints to get asena's proxy_protocol")
+				}
+				if eps["dns"].ProxyProtocol != nil {
+					t.Error("expected udp entrypoints not to get asena's proxy_protocol")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
 }
 
 func TestNormalizeLogCfg_defaults(t *testing.T) {
@@ -48,6 +166,32 @@ func TestNormalizeProxyTransportCfg_defaults(t *testing.T) {
 
 // ============================== Dynamic ==============================
 
+func TestValidateACMECfg(t *testing.T) {
+	if err := validateACMECfg(nil); err != nil {
+		t.Errorf("expected acme to be optional, got %v", err)
+	}
+
+	cfg := &ACMECfg{Domains: []string{" Example.com "}}
+	normalizeACMECfg(cfg)
+	if err := validateACMECfg(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *cfg.CAServer != acmeCAServer || *cfg.Storage != acmeStorage || cfg.Domains[0] != "example.com" {
+		t.Errorf("unexpected defaults: %+v", cfg)
+	}
+
+	cfg.Domains = []string{"*.example.com"}
+	if err := validateACMECfg(cfg); err == nil || !strings.Contains(err.Error(), "without wildcards") {
+		t.Errorf("expected a wildcard error, got %v", err)
+	}
+	cfg.Domains = nil
+	pebble := "localhost:14000/dir"
+	cfg.CAServer = &pebble
+	if err := validateACMECfg(cfg); err == nil || !strings.Contains(err.Error(), "ca_server") {
+		t.Errorf("expected a ca_server error, got %v", err)
+	}
+}
+
 func TestValidateHTTPCfg(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -172,3 +316,460 @@ func TestNormalizeServicesCfg(t *testing.T) {
 		t.Errorf("expected PassHostHeader=%v, got %v", passHostHeaderFalse, cfg.LoadBalancer.PassHostHeader)
 	}
 }
+
+func TestNormalizeServicesCfg_HealthCheckDefaults(t *testing.T) {
+	cfg := &ServiceCfg{LoadBalancer: &LoadBalancerCfg{HealthCheck: &HealthCheckCfg{}}}
+	normalizeServicesCfg(cfg)
+
+	hc := cfg.LoadBalancer.HealthCheck
+	if hc.Path == nil || *hc.Path != hcPath {
+		t.Errorf("expected Path=%s, got %v", hcPath, hc.Path)
+	}
+	if hc.Interval == nil || *hc.Interval != hcInterval {
+		t.Errorf("expected Interval=%v, got %v", hcInterval, hc.Interval)
+	}
+	if hc.ExpectedStatus == nil || *hc.ExpectedStatus != hcExpectedStatus {
+		t.Errorf("expected ExpectedStatus=%d, got %v", hcExpectedStatus, hc.ExpectedStatus)
+	}
+	if err := validateHealthCheckCfg(hc); err != nil {
+		t.Errorf("unexpected error for defaults: %v", err)
+	}
+
+	// No health_check block means checks stay off.
+	off := &ServiceCfg{}
+	normalizeServicesCfg(off)
+	if off.LoadBalancer.HealthCheck != nil {
+		t.Error("expected HealthCheck to stay nil when not configured")
+	}
+}
+
+func TestValidateHealthCheckCfg_TimeoutLongerThanInterval(t *testing.T) {
+	hc := &HealthCheckCfg{}
+	normalizeHealthCheckCfg(hc)
+	timeout := *hc.Interval + 1
+	hc.Timeout = &timeout
+
+	if err := validateHealthCheckCfg(hc); err == nil || !strings.Contains(err.Error(), "health_check.timeout") {
+		t.Errorf("expected health_check.timeout error, got %v", err)
+	}
+}
+
+func TestNormalizeCircuitBreakerCfg(t *testing.T) {
+	cb := &CircuitBreakerCfg{}
+	normalizeCircuitBreakerCfg(cb)
+	if cb.ErrorRatio == nil || *cb.ErrorRatio != cbErrorRatio {
+		t.Errorf("expected ErrorRatio=%v when no trip condition is set, got %v", cbErrorRatio, cb.ErrorRatio)
+	}
+	if err := validateCircuitBreakerCfg(cb); err != nil {
+		t.Errorf("unexpected error for defaults: %v", err)
+	}
+
+	// Setting one trip condition keeps the others off.
+	n := 5
+	cb = &CircuitBreakerCfg{ConsecutiveFailures: &n}
+	normalizeCircuitBreakerCfg(cb)
+	if cb.ErrorRatio != nil {
+		t.Errorf("expected ErrorRatio to stay nil, got %v", *cb.ErrorRatio)
+	}
+
+	bad := 1.5
+	cb = &CircuitBreakerCfg{ErrorRatio: &bad}
+	normalizeCircuitBreakerCfg(cb)
+	if err := validateCircuitBreakerCfg(cb); err == nil || !strings.Contains(err.Error(), "error_ratio") {
+		t.Errorf("expected error_ratio error, got %v", err)
+	}
+}
+
+func TestValidateRetryCfg(t *testing.T) {
+	r := &RetryCfg{}
+	normalizeRetryCfg(r)
+	if r.Attempts == nil || *r.Attempts != retryAttempts {
+		t.Errorf("expected Attempts=%d, got %v", retryAttempts, r.Attempts)
+	}
+	if err := validateRetryCfg(r); err != nil {
+		t.Errorf("unexpected error for defaults: %v", err)
+	}
+
+	r.RetryOnStatus = []int{503, 404}
+	if err := validateRetryCfg(r); err == nil || !strings.Contains(err.Error(), "retry_on_status") {
+		t.Errorf("expected retry_on_status error, got %v", err)
+	}
+}
+
+func TestValidateMiddlewaresCfg_UnknownReference(t *testing.T) {
+	cfg := &HTTPCfg{
+		Routers: map[string]*RoutersCfg{
+			"api": {Middlewares: []string{"auth"}},
+		},
+		Services:    map[string]*ServiceCfg{},
+		Middlewares: map[string]*MiddlewareCfg{},
+	}
+
+	if err := validateMiddlewaresCfg(cfg); err == nil || !strings.Contains(err.Error(), `unknown middleware "auth"`) {
+		t.Errorf("expected unknown middleware error, got %v", err)
+	}
+}
+
+func TestValidateMiddlewareCfg(t *testing.T) {
+	bad := "("
+	noSlash := "api"
+	ftp := "ftp://auth.internal/check"
+	tests := []struct {
+		name    string
+		cfg     *MiddlewareCfg
+		wantErr string
+	}{
+		{"strip_prefix without prefixes", &MiddlewareCfg{StripPrefix: &StripPrefixCfg{}}, "at least one prefix"},
+		{"add_prefix without slash", &MiddlewareCfg{AddPrefix: &AddPrefixCfg{Prefix: &noSlash}}, "must start with /"},
+		{"invalid regex", &MiddlewareCfg{ReplacePathRegex: &ReplacePathRegexCfg{Regex: &bad, Replacement: &noSlash}}, "regex is invalid"},
+		{"basic_auth without users", &MiddlewareCfg{BasicAuth: &BasicAuthCfg{}}, "needs users or users_file"},
+		{"forward_auth without http address", &MiddlewareCfg{ForwardAuth: &ForwardAuthCfg{Address: &ftp}}, "http or https URL"},
+		{"cors wildcard in the middle", &MiddlewareCfg{CORS: &CORSCfg{AllowOrigins: []string{"https://app.*.example.com"}}}, "must be"},
+		{"compress with unknown encoding", &MiddlewareCfg{Compress: &CompressCfg{Encodings: []string{"deflate"}}}, "only list zstd, br, gzip"},
+		{"jwt without keys", &MiddlewareCfg{JWT: &JWTCfg{}}, "at least one of key_files"},
+		{"jwt without http jwks_url", &MiddlewareCfg{JWT: &JWTCfg{JWKSURL: &ftp}}, "jwks_url must be an http or https URL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateMiddlewareCfg(tt.cfg); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNormalizeRateLimitCfg(t *testing.T) {
+	average := 2.5
+	rl := &RateLimitCfg{Average: &average}
+	normalizeRateLimitCfg(rl)
+
+	if *rl.Burst != 3 || *rl.Period != rlPeriod || *rl.Key != RateLimitKeyClientIP {
+		t.Errorf("unexpected defaults: burst=%d period=%v key=%q", *rl.Burst, *rl.Period, *rl.Key)
+	}
+	if err := validateRateLimitCfg(rl); err != nil {
+		t.Errorf("unexpected error for defaults: %v", err)
+	}
+
+	key := RateLimitKeyHeader
+	rl.Key = &key
+	if err := validateRateLimitCfg(rl); err == nil || !strings.Contains(err.Error(), "rate_limit.header") {
+		t.Errorf("expected rate_limit.header error, got %v", err)
+	}
+}
+
+func TestValidateJWTCfg_Algorithms(t *testing.T) {
+	secret := "s3cret"
+	m := &MiddlewareCfg{JWT: &JWTCfg{Secret: &secret, Algorithms: []string{"HS256", "none"}}}
+	normalizeMiddlewareCfg(m)
+
+	if err := validateJWTCfg(m.JWT); err == nil || !strings.Contains(err.Error(), `unsupported algorithm "none"`) {
+		t.Errorf("expected none to be refused, got %v", err)
+	}
+}
+
+func TestValidateCORSCfg_AnyOriginWithCredentials(t *testing.T) {
+	credentials := true
+	m := &MiddlewareCfg{CORS: &CORSCfg{AllowOrigins: []string{"*"}, AllowCredentials: &credentials}}
+	normalizeMiddlewareCfg(m)
+
+	if err := validateCORSCfg(m.CORS); err == nil || !strings.Contains(err.Error(), "allow_credentials") {
+		t.Errorf("expected * with credentials to be refused, got %v", err)
+	}
+}
+
+func TestNormalizeCompressCfg(t *testing.T) {
+	m := &MiddlewareCfg{Compress: &CompressCfg{IncludeContentTypes: []string{"text/*"}}}
+	normalizeMiddlewareCfg(m)
+
+	if len(m.Compress.Encodings) != 3 || *m.Compress.MinSize != compressMinSize || len(m.Compress.ExcludeContentTypes) == 0 {
+		t.Errorf("unexpected defaults: %+v", m.Compress)
+	}
+	if err := validateCompressCfg(m.Compress); err != nil {
+		t.Errorf("unexpected error for defaults: %v", err)
+	}
+
+	m.Compress.IncludeContentTypes = []string{"text"}
+	if err := validateCompressCfg(m.Compress); err == nil || !strings.Contains(err.Error(), "type/subtype") {
+		t.Errorf("expected a content type error, got %v", err)
+	}
+}
+
+func TestValidateCacheCfg(t *testing.T) {
+	path := "purge"
+	m := &MiddlewareCfg{Cache: &CacheCfg{Purge: &CachePurgeCfg{Path: &path}}}
+	normalizeMiddlewareCfg(m)
+
+	if len(m.Cache.Purge.AllowedIPs) != 2 || *m.Cache.MemoryMB != cacheMemoryMB {
+		t.Errorf("unexpected defaults: %+v", m.Cache)
+	}
+	if err := validateCacheCfg(m.Cache); err == nil || !strings.Contains(err.Error(), "purge.path must start with /") {
+		t.Errorf("expected a purge path error, got %v", err)
+	}
+
+	path = "/_cache/purge"
+	m.Cache.Purge.AllowedIPs = []string{"10.0.0.0/8", "localhost"}
+	if err := validateCacheCfg(m.Cache); err == nil || !strings.Contains(err.Error(), `"localhost"`) {
+		t.Errorf("expected an allowed_ips error, got %v", err)
+	}
+
+	entry := 2 << 20
+	m.Cache.Purge.AllowedIPs = nil
+	m.Cache.MemoryMB, m.Cache.MaxEntrySize = new(int), &entry
+	*m.Cache.MemoryMB = 1
+	if err := validateCacheCfg(m.Cache); err == nil || !strings.Contains(err.Error(), "max_entry_size") {
+		t.Errorf("expected an entry size error, got %v", err)
+	}
+}
+
+func TestValidateMirroringCfg(t *testing.T) {
+	url := "http://localhost:9000"
+	shadow := "shadow"
+	percent := 150.0
+	lb := func() *LoadBalancerCfg { return &LoadBalancerCfg{Servers: []*ServerCfg{{URL: &url}}} }
+	services := map[string]*ServiceCfg{
+		"api":    {LoadBalancer: lb(), Mirroring: &MirroringCfg{Mirrors: []*MirrorCfg{{Service: &shadow, Percent: &percent}}}},
+		"shadow": {LoadBalancer: lb()},
+	}
+	for _, s := range services {
+		normalizeServicesCfg(s)
+	}
+
+	if err := validateServiceCfg(services["api"]); err == nil || !strings.Contains(err.Error(), "greater than 0 and at most 100") {
+		t.Errorf("expected a percent error, got %v", err)
+	}
+
+	percent = 10
+	if err := validateServiceCfg(services["api"]); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if *services["api"].Mirroring.MaxBodySize != mirrorMaxBodySize || *services["api"].Mirroring.Timeout != mirrorTimeout {
+		t.Errorf("unexpected defaults: %+v", services["api"].Mirroring)
+	}
+	if err := validateServiceRefsCfg(services); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	shadow = "canary"
+	if err := validateServiceRefsCfg(services); err == nil || !strings.Contains(err.Error(), `unknown service "canary"`) {
+		t.Errorf("expected an unknown service error, got %v", err)
+	}
+	shadow = "api"
+	if err := validateServiceRefsCfg(services); err == nil || !strings.Contains(err.Error(), "itself") {
+		t.Errorf("expected a self-mirror error, got %v", err)
+	}
+}
+
+func TestValidateWeightedCfg(t *testing.T) {
+	url := "http://localhost:9000"
+	v1, v2, canary, missing := "v1", "v2", "canary", "v9"
+	zero := uint(0)
+	lb := func() *LoadBalancerCfg { return &LoadBalancerCfg{Servers: []*ServerCfg{{URL: &url}}} }
+	services := map[string]*ServiceCfg{
+		"canary": {Weighted: &WeightedCfg{
+			Services: []*WeightedServiceCfg{{Name: &v1}, {Name: &v2, Weight: &zero}},
+			Sticky:   &WeightedStickyCfg{},
+		}},
+		"v1": {LoadBalancer: lb()},
+		"v2": {LoadBalancer: lb()},
+	}
+	for _, s := range services {
+		normalizeServicesCfg(s)
+	}
+
+	if services["canary"].LoadBalancer != nil {
+		t.Fatal("expected a weighted service not to get a load_balancer")
+	}
+	if *services["canary"].Weighted.Services[0].Weight != 1 || *services["canary"].Weighted.Sticky.MaxAge != weightedStickyMaxAge {
+		t.Errorf("unexpected defaults: %+v", services["canary"].Weighted)
+	}
+	for name, s := range services {
+		if err := validateServiceCfg(s); err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+	if err := validateServiceRefsCfg(services); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	bad := "bad name"
+	services["canary"].Weighted.Sticky.CookieName = &bad
+	if err := validateServiceCfg(services["canary"]); err == nil || !strings.Contains(err.Error(), "not a valid cookie name") {
+		t.Errorf("expected a cookie name error, got %v", err)
+	}
+
+	services["v2"] = &ServiceCfg{Weighted: &WeightedCfg{Services: []*WeightedServiceCfg{{Name: &canary, Weight: &weightedWeight}}}}
+	if err := validateServiceRefsCfg(services); err == nil || !strings.Contains(err.Error(), "uses itself through other services") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+	services["v2"].Weighted.Services[0].Name = &missing
+	if err := validateServiceRefsCfg(services); err == nil || !strings.Contains(err.Error(), `unknown service "v9"`) {
+		t.Errorf("expected an unknown service error, got %v", err)
+	}
+
+	services["v2"].LoadBalancer = lb()
+	if err := validateServiceCfg(services["v2"]); err == nil || !strings.Contains(err.Error(), "exactly one of") {
+		t.Errorf("expected a service kind error, got %v", err)
+	}
+}
+
+func TestValidateFailoverCfg(t *testing.T) {
+	url := "http://localhost:9000"
+	dc1, dc2, dr, missing := "dc1", "dc2", "dr", "dc9"
+	lb := func() *LoadBalancerCfg { return &LoadBalancerCfg{Servers: []*ServerCfg{{URL: &url}}} }
+	services := map[string]*ServiceCfg{
+		"dr":  {Failover: &FailoverCfg{Service: &dc1, Fallback: &dc2}},
+		"dc1": {LoadBalancer: lb()},
+		"dc2": {LoadBalancer: lb()},
+	}
+	for _, s := range services {
+		normalizeServicesCfg(s)
+	}
+
+	if services["dr"].LoadBalancer != nil {
+		t.Fatal("expected a failover service not to get a load_balancer")
+	}
+	if *services["dr"].Failover.FailureThreshold != foFailureThreshold || *services["dr"].Failover.RecoveryInterval != foRecoveryInterval {
+		t.Errorf("unexpected defaults: %+v", services["dr"].Failover)
+	}
+	for name, s := range services {
+		if err := validateServiceCfg(s); err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+	if err := validateServiceRefsCfg(services); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	services["dr"].Failover.Fallback = &dc1
+	if err := validateServiceCfg(services["dr"]); err == nil || !strings.Contains(err.Error(), "different service") {
+		t.Errorf("expected a same service error, got %v", err)
+	}
+	services["dr"].Failover.Fallback = &missing
+	if err := validateServiceRefsCfg(services); err == nil || !strings.Contains(err.Error(), `unknown service "dc9"`) {
+		t.Errorf("expected an unknown service error, got %v", err)
+	}
+
+	services["dr"].Failover.Fallback = &dc2
+	services["dc2"] = &ServiceCfg{Failover: &FailoverCfg{Service: &dc1, Fallback: &dr}}
+	if err := validateServiceRefsCfg(services); err == nil || !strings.Contains(err.Error(), "uses itself through other services") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+
+	services["dc2"].Weighted = &WeightedCfg{Services: []*WeightedServiceCfg{{Name: &dc1, Weight: &weightedWeight}}}
+	if err := validateServiceCfg(services["dc2"]); err == nil || !strings.Contains(err.Error(), "exactly one of") {
+		t.Errorf("expected a service kind error, got %v", err)
+	}
+}
+
+func TestValidateTCPCfg(t *testing.T) {
+	addr, rule, db, sticky, noPort := "10.0.0.10:5432", "HostSNI(`*`)", "db", "sticky-session", "10.0.0.10"
+	cfg := &TCPCfg{
+		Services: map[string]*TCPServiceCfg{"db": {LoadBalancer: &TCPLoadBalancerCfg{
+			Servers:       []*TCPServerCfg{{Address: &addr}},
+			ProxyProtocol: &ProxyProtocolCfg{},
+		}}},
+		Routers: map[string]*TCPRouterCfg{"db": {Rule: &rule, Service: &db, TLS: &TCPRouterTLSCfg{}}},
+	}
+	if err := validateTCPCfg(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lb := cfg.Services["db"].LoadBalancer
+	if *lb.Algorithm != RoundRobin || *lb.ProxyProtocol.Version != ppVersion || *cfg.Routers["db"].TLS.Passthrough {
+		t.Errorf("unexpected defaults: %+v, %+v", lb, cfg.Routers["db"].TLS)
+	}
+	if err := validateTCPCfg(nil); err != nil {
+		t.Errorf("expected the tcp section to be optional, got %v", err)
+	}
+
+	lb.Algorithm = &sticky
+	if err := validateTCPCfg(cfg); err == nil || !strings.Contains(err.Error(), "doesn't work for TCP") {
+		t.Errorf("expected an algorithm error, got %v", err)
+	}
+	lb.Algorithm = &RoundRobin
+	lb.Servers[0].Address = &noPort
+	if err := validateTCPCfg(cfg); err == nil || !strings.Contains(err.Error(), "must be host:port") {
+		t.Errorf("expected an address error, got %v", err)
+	}
+	lb.Servers[0].Address = &addr
+	missing := "cache"
+	cfg.Routers["db"].Service = &missing
+	if err := validateTCPCfg(cfg); err == nil || !strings.Contains(err.Error(), "needs the name of a tcp service") {
+		t.Errorf("expected an unknown service error, got %v", err)
+	}
+}
+
+func TestValidateUDPCfg(t *testing.T) {
+	addr, dns, ipHash, leastTime, noPort := "10.0.0.53:53", "dns", "ip-hash", "least-time", "10.0.0.53"
+	cfg := &UDPCfg{
+		Services: map[string]*UDPServiceCfg{"dns": {LoadBalancer: &UDPLoadBalancerCfg{
+			Algorithm: &ipHash,
+			Servers:   []*UDPServerCfg{{Address: &addr}},
+		}}},
+		Routers: map[string]*UDPRouterCfg{"dns": {Service: &dns}},
+	}
+	if err := validateUDPCfg(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lb := cfg.Services["dns"].LoadBalancer
+	if *lb.SessionTimeout != udpSessionTimeout {
+		t.Errorf("expected the default session_timeout, got %v", *lb.SessionTimeout)
+	}
+	if *lb.MaxSessions != udpMaxSessions {
+		t.Errorf("expected the default max_sessions, got %d", *lb.MaxSessions)
+	}
+	if err := validateUDPCfg(nil); err != nil {
+		t.Errorf("expected the udp section to be optional, got %v", err)
+	}
+
+	lb.Algorithm = &leastTime
+	if err := validateUDPCfg(cfg); err == nil || !strings.Contains(err.Error(), "doesn't work for UDP") {
+		t.Errorf("expected an algorithm error, got %v", err)
+	}
+	lb.Algorithm = &ipHash
+	lb.Servers[0].Address = &noPort
+	if err := validateUDPCfg(cfg); err == nil || !strings.Contains(err.Error(), "must be host:port") {
+		t.Errorf("expected an address error, got %v", err)
+	}
+	lb.Servers[0].Address = &addr
+	zero := time.Duration(0)
+	lb.SessionTimeout = &zero
+	if err := validateUDPCfg(cfg); err == nil || !strings.Contains(err.Error(), "session_timeout must be greater than 0") {
+		t.Errorf("expected a session_timeout error, got %v", err)
+	}
+	lb.SessionTimeout = &udpSessionTimeout
+	lb.MaxSessions = new(int)
+	if err := validateUDPCfg(cfg); err == nil || !strings.Contains(err.Error(), "max_sessions must be greater than 0") {
+		t.Errorf("expected a max_sessions error, got %v", err)
+	}
+	lb.MaxSessions = &udpMaxSessions
+	missing := "syslog"
+	cfg.Routers["dns"].Service = &missing
+	if err := validateUDPCfg(cfg); err == nil || !strings.Contains(err.Error(), "needs the name of a udp service") {
+		t.Errorf("expected an unknown service error, got %v", err)
+	}
+}
+
+func TestValidateTLSCfg(t *testing.T) {
+	cert, key := "/etc/asena/certs/example.com.pem", "/etc/asena/certs/example.com-key.pem"
+	cfg := &TLSCfg{
+		Certificates:       []*CertificateCfg{{CertFile: &cert, KeyFile: &key}},
+		DefaultCertificate: &CertificateCfg{CertFile: &cert, KeyFile: &key},
+	}
+	if err := validateTLSCfg(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := validateTLSCfg(nil); err != nil {
+		t.Errorf("expected the tls section to be optional, got %v", err)
+	}
+
+	cfg.Certificates = append(cfg.Certificates, &CertificateCfg{CertFile: &cert})
+	if err := validateTLSCfg(cfg); err == nil || !strings.Contains(err.Error(), "tls.certificates[1] needs cert_file and key_file") {
+		t.Errorf("expected a missing key_file error, got %v", err)
+	}
+	cfg.Certificates = cfg.Certificates[:1]
+	cfg.DefaultCertificate.KeyFile = nil
+	if err := validateTLSCfg(cfg); err == nil || !strings.Contains(err.Error(), "tls.default_certificate") {
+		t.Errorf("expected a default_certificate error, got %v", err)
+	}
+}
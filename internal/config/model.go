@@ -5,16 +5,77 @@ import "time"
 // ============================== Static ==============================
 
 type AsenaConfig struct {
-	Asena          *AsenaCfg          `yaml:"asena,omitempty"`
-	Log            *LogCfg            `yaml:"log,omitempty"`
-	ProxyTransport *ProxyTransportCfg `yaml:"proxy_transport,omitempty"`
+	Asena          *AsenaCfg                 `yaml:"asena,omitempty"`
+	Entrypoints    map[string]*EntrypointCfg `yaml:"entrypoints,omitempty"`
+	Log            *LogCfg                   `yaml:"log,omitempty"`
+	ProxyTransport *ProxyTransportCfg        `yaml:"proxy_transport,omitempty"`
+	ACME           *ACMECfg                  `yaml:"acme,omitempty"`
 }
 
+// AsenaCfg holds the settings shared by the whole process. EnableHTTPS, TLSCertFile and TLSKeyFile
+// only describe the entrypoints Asena gets when asena.yaml lists none.
 type AsenaCfg struct {
-	Port        *string
 	EnableHTTPS *bool   `yaml:"enable_https,omitempty"`
 	TLSCertFile *string `yaml:"tls_cert_file,omitempty"`
 	TLSKeyFile  *string `yaml:"tls_key_file,omitempty"`
+	// TrustedProxies lists the CIDR ranges of proxies in front of Asena whose TrustedProxiesHeader is
+	// believed when working out the client's address.
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+	// TrustedProxiesHeader is the one header the trusted proxies write the client's address to:
+	// X-Forwarded-For, Forwarded or X-Real-IP. The others may be the client's own, passed through.
+	TrustedProxiesHeader *string `yaml:"trusted_proxies_header,omitempty"`
+	// ProxyProtocol makes the entrypoints read PROXY protocol headers, from the addresses it trusts.
+	// An entrypoint's own proxy_protocol replaces it.
+	ProxyProtocol *ListenerProxyProtocolCfg `yaml:"proxy_protocol,omitempty"`
+}
+
+type ListenerProxyProtocolCfg struct {
+	TrustedIPs []string `yaml:"trusted_ips,omitempty"`
+}
+
+// EntrypointCfg is one named listener. Routers pick the entrypoints they take requests from.
+type EntrypointCfg struct {
+	Address  *string           `yaml:"address,omitempty"`
+	Protocol *string           `yaml:"protocol,omitempty"`
+	TLS      *EntrypointTLSCfg `yaml:"tls,omitempty"`
+	// RedirectTo names an https entrypoint this one sends every request to, with a redirect,
+	// instead of routing it.
+	RedirectTo    *string                   `yaml:"redirect_to,omitempty"`
+	Timeouts      *EntrypointTimeoutsCfg    `yaml:"timeouts,omitempty"`
+	ProxyProtocol *ListenerProxyProtocolCfg `yaml:"proxy_protocol,omitempty"`
+	// HTTP3 serves HTTP/3 on the UDP port of the same number as an https entrypoint's address.
+	HTTP3 *bool `yaml:"http3,omitempty"`
+}
+
+type EntrypointTLSCfg struct {
+	CertFile   *string        `yaml:"cert_file,omitempty"`
+	KeyFile    *string        `yaml:"key_file,omitempty"`
+	ClientAuth *ClientAuthCfg `yaml:"client_auth,omitempty"`
+}
+
+// ClientAuthCfg makes an https entrypoint ask clients for a certificate (mutual TLS).
+type ClientAuthCfg struct {
+	// CAFiles are PEM bundles of the CAs client certificates are verified against.
+	CAFiles []string `yaml:"ca_files,omitempty"`
+	// Mode is request, verify-if-given or require.
+	Mode    *string               `yaml:"mode,omitempty"`
+	Headers *ClientCertHeadersCfg `yaml:"headers,omitempty"`
+}
+
+// ClientCertHeadersCfg names the headers a verified client certificate's details are sent to the
+// backends in. An empty name leaves that detail out.
+type ClientCertHeadersCfg struct {
+	Subject     *string `yaml:"subject,omitempty"`
+	SANs        *string `yaml:"sans,omitempty"`
+	Fingerprint *string `yaml:"fingerprint,omitempty"`
+}
+
+// EntrypointTimeoutsCfg maps onto http.Server's timeouts. 0 means no timeout.
+type EntrypointTimeoutsCfg struct {
+	ReadHeader *time.Duration `yaml:"read_header,omitempty"`
+	Read       *time.Duration `yaml:"read,omitempty"`
+	Write      *time.Duration `yaml:"write,omitempty"`
+	Idle       *time.Duration `yaml:"idle,omitempty"`
 }
 
 type LogCfg struct {
@@ -41,31 +102,333 @@ type ProxyTransportCfg struct {
 	TLSMinVersion         *uint16
 }
 
+// ACMECfg turns on certificates from an ACME CA, like Let's Encrypt, for the https entrypoints.
+// Without Domains, they're obtained for the hosts of the Host matchers in dynamic.yaml's rules.
+type ACMECfg struct {
+	Email *string `yaml:"email,omitempty"`
+	// CAServer is the URL of the CA's ACME directory.
+	CAServer *string `yaml:"ca_server,omitempty"`
+	// Storage is the directory the account key and certificates are kept in, across restarts.
+	Storage *string  `yaml:"storage,omitempty"`
+	Domains []string `yaml:"domains,omitempty"`
+}
+
 // ============================== Dynamic ==============================
 
 type DynamicConfig struct {
 	HTTP *HTTPCfg `yaml:"http,omitempty"`
+	TCP  *TCPCfg  `yaml:"tcp,omitempty"`
+	UDP  *UDPCfg  `yaml:"udp,omitempty"`
+	TLS  *TLSCfg  `yaml:"tls,omitempty"`
+}
+
+// TLSCfg holds certificates for every https entrypoint, picked by the server name a client asks for.
+type TLSCfg struct {
+	Certificates []*CertificateCfg `yaml:"certificates,omitempty"`
+	// DefaultCertificate is for clients whose server name no certificate has. Without it, they get
+	// the entrypoint's own certificate.
+	DefaultCertificate *CertificateCfg `yaml:"default_certificate,omitempty"`
+}
+
+type CertificateCfg struct {
+	CertFile *string `yaml:"cert_file,omitempty"`
+	KeyFile  *string `yaml:"key_file,omitempty"`
 }
 
 type HTTPCfg struct {
-	Routers  map[string]*RoutersCfg `yaml:"routers,omitempty"`
-	Services map[string]*ServiceCfg `yaml:"services,omitempty"`
+	Routers     map[string]*RoutersCfg    `yaml:"routers,omitempty"`
+	Services    map[string]*ServiceCfg    `yaml:"services,omitempty"`
+	Middlewares map[string]*MiddlewareCfg `yaml:"middlewares,omitempty"`
 }
 
 type RoutersCfg struct {
-	Rule    *string `yaml:"rule,omitempty"`
-	Service *string `yaml:"service,omitempty"`
+	Rule               *string  `yaml:"rule,omitempty"`
+	Service            *string  `yaml:"service,omitempty"`
+	Middlewares        []string `yaml:"middlewares,omitempty"`
+	RetryNonIdempotent *bool    `yaml:"retry_non_idempotent,omitempty"`
+	// Entrypoints limits the router to requests that came in through these entrypoints. Without
+	// any, it takes requests from all of them.
+	Entrypoints []string `yaml:"entrypoints,omitempty"`
+	// ClientAuth makes the router turn away requests without a verified client certificate.
+	ClientAuth *RouterClientAuthCfg `yaml:"client_auth,omitempty"`
+}
+
+// RouterClientAuthCfg is a router's requirement on the client's certificate. SANs, when set, limits
+// it to certificates with one of these subject alternative names.
+type RouterClientAuthCfg struct {
+	SANs []string `yaml:"sans,omitempty"`
+}
+
+// MiddlewareCfg is one named entry of the middlewares section. Each entry sets exactly one of
+// the fields below, and that field decides which middleware it is.
+type MiddlewareCfg struct {
+	StripPrefix      *StripPrefixCfg      `yaml:"strip_prefix,omitempty"`
+	AddPrefix        *AddPrefixCfg        `yaml:"add_prefix,omitempty"`
+	ReplacePathRegex *ReplacePathRegexCfg `yaml:"replace_path_regex,omitempty"`
+	Headers          *HeadersCfg          `yaml:"headers,omitempty"`
+	RateLimit        *RateLimitCfg        `yaml:"rate_limit,omitempty"`
+	BasicAuth        *BasicAuthCfg        `yaml:"basic_auth,omitempty"`
+	ForwardAuth      *ForwardAuthCfg      `yaml:"forward_auth,omitempty"`
+	JWT              *JWTCfg              `yaml:"jwt,omitempty"`
+	CORS             *CORSCfg             `yaml:"cors,omitempty"`
+	Compress         *CompressCfg         `yaml:"compress,omitempty"`
+	Cache            *CacheCfg            `yaml:"cache,omitempty"`
+}
+
+type StripPrefixCfg struct {
+	Prefixes []string `yaml:"prefixes,omitempty"`
+}
+
+type AddPrefixCfg struct {
+	Prefix *string `yaml:"prefix,omitempty"`
+}
+
+type ReplacePathRegexCfg struct {
+	Regex       *string `yaml:"regex,omitempty"`
+	Replacement *string `yaml:"replacement,omitempty"`
+}
+
+type HeadersCfg struct {
+	Request  *HeaderOpsCfg `yaml:"request,omitempty"`
+	Response *HeaderOpsCfg `yaml:"response,omitempty"`
+}
+
+type HeaderOpsCfg struct {
+	Set    map[string]string `yaml:"set,omitempty"`
+	Add    map[string]string `yaml:"add,omitempty"`
+	Remove []string          `yaml:"remove,omitempty"`
+}
+
+type RateLimitCfg struct {
+	Average *float64       `yaml:"average,omitempty"`
+	Period  *time.Duration `yaml:"period,omitempty"`
+	Burst   *int           `yaml:"burst,omitempty"`
+	Key     *string        `yaml:"key,omitempty"`
+	Header  *string        `yaml:"header,omitempty"`
+}
+
+type BasicAuthCfg struct {
+	UsersFile    *string  `yaml:"users_file,omitempty"`
+	Users        []string `yaml:"users,omitempty"`
+	Realm        *string  `yaml:"realm,omitempty"`
+	HeaderField  *string  `yaml:"header_field,omitempty"`
+	RemoveHeader *bool    `yaml:"remove_header,omitempty"`
+}
+
+type ForwardAuthCfg struct {
+	Address             *string        `yaml:"address,omitempty"`
+	Timeout             *time.Duration `yaml:"timeout,omitempty"`
+	AuthResponseHeaders []string       `yaml:"auth_response_headers,omitempty"`
+}
+
+type JWTCfg struct {
+	KeyFiles       []string          `yaml:"key_files,omitempty"`
+	Secret         *string           `yaml:"secret,omitempty"`
+	JWKSFile       *string           `yaml:"jwks_file,omitempty"`
+	JWKSURL        *string           `yaml:"jwks_url,omitempty"`
+	JWKSRefresh    *time.Duration    `yaml:"jwks_refresh,omitempty"`
+	Algorithms     []string          `yaml:"algorithms,omitempty"`
+	Issuer         *string           `yaml:"issuer,omitempty"`
+	Audience       []string          `yaml:"audience,omitempty"`
+	Leeway         *time.Duration    `yaml:"leeway,omitempty"`
+	RequiredClaims map[string]string `yaml:"required_claims,omitempty"`
+	ForwardClaims  map[string]string `yaml:"forward_claims,omitempty"`
+	Realm          *string           `yaml:"realm,omitempty"`
+}
+
+type CORSCfg struct {
+	AllowOrigins     []string       `yaml:"allow_origins,omitempty"`
+	AllowOriginRegex []string       `yaml:"allow_origin_regex,omitempty"`
+	AllowMethods     []string       `yaml:"allow_methods,omitempty"`
+	AllowHeaders     []string       `yaml:"allow_headers,omitempty"`
+	ExposeHeaders    []string       `yaml:"expose_headers,omitempty"`
+	AllowCredentials *bool          `yaml:"allow_credentials,omitempty"`
+	MaxAge           *time.Duration `yaml:"max_age,omitempty"`
+}
+
+type CompressCfg struct {
+	Encodings           []string `yaml:"encodings,omitempty"`
+	MinSize             *int     `yaml:"min_size,omitempty"`
+	IncludeContentTypes []string `yaml:"include_content_types,omitempty"`
+	ExcludeContentTypes []string `yaml:"exclude_content_types,omitempty"`
+}
+
+type CacheCfg struct {
+	MemoryMB     *int           `yaml:"memory_mb,omitempty"`
+	MaxEntrySize *int           `yaml:"max_entry_size,omitempty"`
+	DiskDir      *string        `yaml:"disk_dir,omitempty"`
+	DiskMB       *int           `yaml:"disk_mb,omitempty"`
+	Purge        *CachePurgeCfg `yaml:"purge,omitempty"`
+}
+
+type CachePurgeCfg struct {
+	Path       *string  `yaml:"path,omitempty"`
+	AllowedIPs []string `yaml:"allowed_ips,omitempty"`
 }
 
 type ServiceCfg struct {
-	LoadBalancer *LoadBalancerCfg `yaml:"load_balancer,omitempty"`
+	LoadBalancer   *LoadBalancerCfg   `yaml:"load_balancer,omitempty"`
+	CircuitBreaker *CircuitBreakerCfg `yaml:"circuit_breaker,omitempty"`
+	Mirroring      *MirroringCfg      `yaml:"mirroring,omitempty"`
+	Weighted       *WeightedCfg       `yaml:"weighted,omitempty"`
+	Failover       *FailoverCfg       `yaml:"failover,omitempty"`
+}
+
+type FailoverCfg struct {
+	Service          *string        `yaml:"service,omitempty"`
+	Fallback         *string        `yaml:"fallback,omitempty"`
+	FailureThreshold *int           `yaml:"failure_threshold,omitempty"`
+	RecoveryInterval *time.Duration `yaml:"recovery_interval,omitempty"`
+}
+
+type WeightedCfg struct {
+	Services []*WeightedServiceCfg `yaml:"services,omitempty"`
+	Sticky   *WeightedStickyCfg    `yaml:"sticky,omitempty"`
+}
+
+type WeightedServiceCfg struct {
+	Name   *string `yaml:"name,omitempty"`
+	Weight *uint   `yaml:"weight,omitempty"`
+}
+
+type WeightedStickyCfg struct {
+	CookieName *string        `yaml:"cookie_name,omitempty"`
+	MaxAge     *time.Duration `yaml:"max_age,omitempty"`
+	Secure     *bool          `yaml:"secure,omitempty"`
+}
+
+type MirroringCfg struct {
+	Mirrors     []*MirrorCfg   `yaml:"mirrors,omitempty"`
+	MaxBodySize *int64         `yaml:"max_body_size,omitempty"`
+	Timeout     *time.Duration `yaml:"timeout,omitempty"`
+}
+
+type MirrorCfg struct {
+	Service *string  `yaml:"service,omitempty"`
+	Percent *float64 `yaml:"percent,omitempty"`
 }
 
 type LoadBalancerCfg struct {
-	Algorithm      *string        `yaml:"algorithm,omitempty"`
-	FlashInterval  *time.Duration `yaml:"flash_interval,omitempty"`
-	PassHostHeader *bool          `yaml:"pass_host_header,omitempty"`
-	Servers        []*ServerCfg   `yaml:"servers,omitempty"`
+	Algorithm        *string              `yaml:"algorithm,omitempty"`
+	FlashInterval    *time.Duration       `yaml:"flash_interval,omitempty"`
+	PassHostHeader   *bool                `yaml:"pass_host_header,omitempty"`
+	HealthCheck      *HealthCheckCfg      `yaml:"health_check,omitempty"`
+	OutlierDetection *OutlierDetectionCfg `yaml:"outlier_detection,omitempty"`
+	Retry            *RetryCfg            `yaml:"retry,omitempty"`
+	ProxyProtocol    *ProxyProtocolCfg    `yaml:"proxy_protocol,omitempty"`
+	Servers          []*ServerCfg         `yaml:"servers,omitempty"`
+}
+
+// ProxyProtocolCfg sends a PROXY protocol header to the servers at the start of every connection.
+type ProxyProtocolCfg struct {
+	Version *int `yaml:"version,omitempty"`
+}
+
+type HealthCheckCfg struct {
+	Path               *string        `yaml:"path,omitempty"`
+	Interval           *time.Duration `yaml:"interval,omitempty"`
+	Timeout            *time.Duration `yaml:"timeout,omitempty"`
+	ExpectedStatus     *int           `yaml:"expected_status,omitempty"`
+	HealthyThreshold   *int           `yaml:"healthy_threshold,omitempty"`
+	UnhealthyThreshold *int           `yaml:"unhealthy_threshold,omitempty"`
+}
+
+type OutlierDetectionCfg struct {
+	ConsecutiveFailures *int           `yaml:"consecutive_failures,omitempty"`
+	Window              *time.Duration `yaml:"window,omitempty"`
+	BaseEjectionTime    *time.Duration `yaml:"base_ejection_time,omitempty"`
+	MaxEjectionTime     *time.Duration `yaml:"max_ejection_time,omitempty"`
+}
+
+type RetryCfg struct {
+	Attempts      *int           `yaml:"attempts,omitempty"`
+	PerTryTimeout *time.Duration `yaml:"per_try_timeout,omitempty"`
+	RetryOnStatus []int          `yaml:"retry_on_status,omitempty"`
+}
+
+type CircuitBreakerCfg struct {
+	ConsecutiveFailures *int           `yaml:"consecutive_failures,omitempty"`
+	ErrorRatio          *float64       `yaml:"error_ratio,omitempty"`
+	LatencyThreshold    *time.Duration `yaml:"latency_threshold,omitempty"`
+	LatencyPercentile   *float64       `yaml:"latency_percentile,omitempty"`
+	Window              *time.Duration `yaml:"window,omitempty"`
+	MinRequests         *int           `yaml:"min_requests,omitempty"`
+	OpenDuration        *time.Duration `yaml:"open_duration,omitempty"`
+	HalfOpenRequests    *int           `yaml:"half_open_requests,omitempty"`
+}
+
+// TCPCfg routes raw TCP connections, taken on tcp entrypoints, to services that load-balance
+// them over servers.
+type TCPCfg struct {
+	Routers  map[string]*TCPRouterCfg  `yaml:"routers,omitempty"`
+	Services map[string]*TCPServiceCfg `yaml:"services,omitempty"`
+}
+
+type TCPRouterCfg struct {
+	Rule    *string `yaml:"rule,omitempty"`
+	Service *string `yaml:"service,omitempty"`
+	// Entrypoints limits the router to connections that came in through these tcp entrypoints.
+	// Without any, it takes connections from all of them.
+	Entrypoints []string `yaml:"entrypoints,omitempty"`
+	// TLS makes the router take only TLS connections. Asena terminates them, unless Passthrough
+	// is set, in which case they're sent on to the servers untouched.
+	TLS *TCPRouterTLSCfg `yaml:"tls,omitempty"`
+}
+
+type TCPRouterTLSCfg struct {
+	Passthrough *bool `yaml:"passthrough,omitempty"`
+}
+
+type TCPServiceCfg struct {
+	LoadBalancer *TCPLoadBalancerCfg `yaml:"load_balancer,omitempty"`
+}
+
+type TCPLoadBalancerCfg struct {
+	Algorithm        *string              `yaml:"algorithm,omitempty"`
+	OutlierDetection *OutlierDetectionCfg `yaml:"outlier_detection,omitempty"`
+	ProxyProtocol    *ProxyProtocolCfg    `yaml:"proxy_protocol,omitempty"`
+	Servers          []*TCPServerCfg      `yaml:"servers,omitempty"`
+}
+
+// TCPServerCfg is one server of a TCP service, by its host:port address.
+type TCPServerCfg struct {
+	Address *string `yaml:"address,omitempty"`
+	Weight  *uint   `yaml:"weight,omitempty"`
+}
+
+// UDPCfg proxies datagrams, taken on udp entrypoints, to services that load-balance them over
+// servers, one client at a time.
+type UDPCfg struct {
+	Routers  map[string]*UDPRouterCfg  `yaml:"routers,omitempty"`
+	Services map[string]*UDPServiceCfg `yaml:"services,omitempty"`
+}
+
+// UDPRouterCfg sends everything that comes in through its entrypoints to its service. A datagram
+// has nothing else to route on.
+type UDPRouterCfg struct {
+	Service     *string  `yaml:"service,omitempty"`
+	Entrypoints []string `yaml:"entrypoints,omitempty"`
+}
+
+type UDPServiceCfg struct {
+	LoadBalancer *UDPLoadBalancerCfg `yaml:"load_balancer,omitempty"`
+}
+
+type UDPLoadBalancerCfg struct {
+	Algorithm *string `yaml:"algorithm,omitempty"`
+	// SessionTimeout ends a client's session after it's been this long without a datagram either
+	// way. The client's next datagram starts a new one, on whichever server the balancer picks.
+	SessionTimeout *time.Duration `yaml:"session_timeout,omitempty"`
+	// MaxSessions caps the sessions the service has open at once. Datagrams from a new client past
+	// it are dropped, so a flood of spoofed source addresses can't open a socket for each.
+	MaxSessions *int            `yaml:"max_sessions,omitempty"`
+	Servers     []*UDPServerCfg `yaml:"servers,omitempty"`
+}
+
+// UDPServerCfg is one server of a UDP service, by its host:port address.
+type UDPServerCfg struct {
+	Address *string `yaml:"address,omitempty"`
+	Weight  *uint   `yaml:"weight,omitempty"`
 }
 
 type ServerCfg struct {
@@ -39,8 +39,8 @@ proxy_transport: {}
 
 	cfg := svc.Get()
 
-	if cfg.Asena.Port == nil || *cfg.Asena.Port != portHTTP {
-		t.Errorf("expected default port to be %s, got %v", portHTTP, *cfg.Asena.Port)
+	if web := cfg.Entrypoints["web"]; web == nil || *web.Address != portHTTP {
+		t.Errorf("expected a default entrypoint on %s, got %v", portHTTP, cfg.Entrypoints)
 	}
 	if cfg.ProxyTransport.MaxIdleConn == nil || *cfg.ProxyTransport.MaxIdleConn != ptMaxIdleConn {
 		t.Errorf("expected default maxIdleConn to be %d, got %v", ptMaxIdleConn, *cfg.ProxyTransport.MaxIdleConn)
@@ -72,8 +72,8 @@ asena:
 
 	cfg := svc.Get()
 
-	if *cfg.Asena.Port != portHTTPS {
-		t.Errorf("expected default port to be %s, got %v", portHTTP, *cfg.Asena.Port)
+	if secure := cfg.Entrypoints["websecure"]; secure == nil || *secure.Address != portHTTPS || *secure.TLS.CertFile != "mycert.pem" {
+		t.Errorf("expected an https entrypoint on %s with the configured certificate, got %v", portHTTPS, cfg.Entrypoints)
 	}
 	if *cfg.Asena.TLSCertFile != "mycert.pem" {
 		t.Errorf("expected overridden TLS cert file, got %s", *cfg.Asena.TLSCertFile)
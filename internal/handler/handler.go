@@ -9,23 +9,13 @@ import (
 
 func RegisterRoutes(pm *proxy.Manager, mux *http.ServeMux, logg *zap.Logger) {
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		serviceName, ok, err := pm.MatchRouter(r)
-		if err != nil {
-			logg.Error("failed to match router", zap.Error(err))
-			http.Error(w, "router error: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-
+		route, ok := pm.MatchRoute(r)
 		if !ok {
-			logg.Warn("No router found", zap.String("path", r.URL.Path), zap.Error(err))
+			logg.Warn("No router found", zap.String("path", r.URL.Path))
 			http.NotFound(w, r)
 			return
 		}
 
-		if ok := pm.ServeProxy(serviceName, w, r); !ok {
-			logg.Warn("No routing rule found for service", zap.String("service", serviceName))
-			http.Error(w, "404 page not found", http.StatusNotFound)
-			return
-		}
+		route.Handler.ServeHTTP(w, proxy.WithRoute(r, route))
 	})
 }
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswd maps user names to password hashes, as read from an htpasswd file. Only bcrypt
+// ($2y$, $2a$, $2b$ - what `htpasswd -B` writes) and {SHA} hashes are accepted. A line with any
+// other hash is an error rather than a user that can never log in, so a file written with the
+// wrong flags is noticed right away.
+type htpasswd map[string]string
+
+func parseHtpasswd(r io.Reader) (htpasswd, error) {
+	users := htpasswd{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", n)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("line %d: user %q: only bcrypt and {SHA} hashes are supported", n, user)
+		}
+		users[user] = hash
+	}
+	return users, sc.Err()
+}
+
+// dummyHash is a bcrypt hash, at the cost htpasswd -B uses, that an unknown user's password is
+// checked against. An unknown user then takes as long to turn away as a known one with a wrong
+// password, so the time of the answer doesn't tell which user names exist.
+const dummyHash = "$2a$10$InRm8.XeKdFQS4tMhrW.s.PiqL8W7H1KYmNCGb4EeqNTzjhNoPKSa"
+
+// check reports whether password matches user's hash.
+func (h htpasswd) check(user, password string) bool {
+	hash, ok := h[user]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return false
+	}
+
+	if sha, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(sha)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// BasicAuth asks for a user name and password with HTTP Basic authentication, and checks them
+// against htpasswd entries: the ones listed in cfg.Users, plus the ones in cfg.UsersFile.
+//
+// The file is read again whenever it changes, until ctx is done. If the new version can't be read
+// or parsed, the old users stay in place and the error is logged, so a half-written file never
+// locks everyone out (or lets everyone in).
+func BasicAuth(ctx context.Context, cfg *config.BasicAuthCfg, logg *zap.Logger) (Middleware, error) {
+	inline, err := parseHtpasswd(strings.NewReader(strings.Join(cfg.Users, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("users: %w", err)
+	}
+
+	var users atomic.Value
+	load := func() error {
+		merged := htpasswd{}
+		if cfg.UsersFile != nil && *cfg.UsersFile != "" {
+			f, err := os.Open(*cfg.UsersFile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if merged, err = parseHtpasswd(f); err != nil {
+				return fmt.Errorf("%s: %w", *cfg.UsersFile, err)
+			}
+		}
+		for user, hash := range inline {
+			merged[user] = hash
+		}
+		users.Store(merged)
+		return nil
+	}
+	if err := load(); err != nil {
+		return nil, err
+	}
+	if cfg.UsersFile != nil && *cfg.UsersFile != "" {
+		err := watchFile(ctx, *cfg.UsersFile, func() {
+			if err := load(); err != nil {
+				logg.Error("Failed to reload basic_auth users file, keeping the previous users", zap.Error(err))
+				return
+			}
+			logg.Info("Reloaded basic_auth users file", zap.String("path", *cfg.UsersFile))
+		}, logg)
+		if err != nil {
+			return nil, fmt.Errorf("watch %s: %w", *cfg.UsersFile, err)
+		}
+	}
+
+	challenge := fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", *cfg.Realm)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, password, ok := r.BasicAuth()
+			if !ok || !users.Load().(htpasswd).check(user, password) {
+				w.Header().Set("WWW-Authenticate", challenge)
+				writeError(w, http.StatusUnauthorized, "Unauthorized", "Valid credentials are required.")
+				return
+			}
+
+			if *cfg.RemoveHeader || cfg.HeaderField != nil {
+				r = r.Clone(r.Context())
+				if *cfg.RemoveHeader {
+					r.Header.Del("Authorization")
+				}
+				if cfg.HeaderField != nil {
+					r.Header.Set(*cfg.HeaderField, user)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// watchFile calls onChange, debounced, whenever path changes, until ctx is done. It watches the
+// directory rather than the file itself: tools that replace a file by writing a new one and
+// renaming it over the old one would otherwise end the watch after the first change.
+//
+// The watch is in place when watchFile returns, so no change made after that is missed.
+func watchFile(ctx context.Context, path string, onChange func(), logg *zap.Logger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var mu sync.Mutex
+		var debounce *time.Timer
+		defer func() {
+			mu.Lock()
+			if debounce != nil {
+				debounce.Stop()
+			}
+			mu.Unlock()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(path) || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+
+				mu.Lock()
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(200*time.Millisecond, onChange)
+				mu.Unlock()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logg.Error("File watcher failed", zap.String("path", path), zap.Error(err))
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptLine(t *testing.T, user, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user + ":" + string(hash)
+}
+
+func shaLine(user, password string) string {
+	sum := sha1.Sum([]byte(password))
+	return user + ":{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func basicAuthCfg(users []string, file string) *config.BasicAuthCfg {
+	realm := "staff"
+	remove := true
+	header := "X-Auth-User"
+	cfg := &config.BasicAuthCfg{Users: users, Realm: &realm, RemoveHeader: &remove, HeaderField: &header}
+	if file != "" {
+		cfg.UsersFile = &file
+	}
+	return cfg
+}
+
+func sendBasic(h http.Handler, user, password string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	if user != "" {
+		r.SetBasicAuth(user, password)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestBasicAuth(t *testing.T) {
+	m, err := BasicAuth(context.Background(), basicAuthCfg([]string{bcryptLine(t, "alice", "s3cret"), shaLine("bob", "hunter2")}, ""), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var upstream *http.Request
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { upstream = r }))
+
+	for _, c := range []struct{ user, password string }{{"alice", "s3cret"}, {"bob", "hunter2"}} {
+		upstream = nil
+		if w := sendBasic(h, c.user, c.password); w.Code != http.StatusOK || upstream == nil {
+			t.Fatalf("%s: expected the request through, got %d", c.user, w.Code)
+		}
+		if upstream.Header.Get("Authorization") != "" || upstream.Header.Get("X-Auth-User") != c.user {
+			t.Errorf("%s: expected Authorization removed and X-Auth-User set, got %v", c.user, upstream.Header)
+		}
+	}
+
+	for _, c := range []struct{ user, password string }{{"alice", "wrong"}, {"mallory", "s3cret"}, {"", ""}} {
+		w := sendBasic(h, c.user, c.password)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%q: expected 401, got %d", c.user, w.Code)
+		}
+		if got := w.Header().Get("WWW-Authenticate"); got != `Basic realm="staff", charset="UTF-8"` {
+			t.Errorf("unexpected challenge %q", got)
+		}
+	}
+}
+
+func TestDummyHash_CostsAsMuchAsARealOne(t *testing.T) {
+	// An unknown user is only as slow as a known one if the dummy hash is a bcrypt hash at the
+	// cost htpasswd -B writes.
+	if cost, err := bcrypt.Cost([]byte(dummyHash)); err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("expected a bcrypt hash of cost %d, got %d (%v)", bcrypt.DefaultCost, cost, err)
+	}
+}
+
+func TestBasicAuth_RejectsUnsupportedHash(t *testing.T) {
+	_, err := BasicAuth(context.Background(), basicAuthCfg([]string{"carol:$apr1$abc$def"}, ""), zaptest.NewLogger(t))
+	if err == nil || !strings.Contains(err.Error(), "only bcrypt and {SHA}") {
+		t.Errorf("expected an unsupported hash error, got %v", err)
+	}
+}
+
+func TestBasicAuth_ReloadsUsersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(shaLine("alice", "old")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m, err := BasicAuth(ctx, basicAuthCfg(nil, path), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	if w := sendBasic(h, "alice", "old"); w.Code != http.StatusOK {
+		t.Fatalf("expected the old password to work, got %d", w.Code)
+	}
+
+	// Replace the file the way editors do: write a new one, rename it over the old one.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(shaLine("alice", "new")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		w := sendBasic(h, "alice", "new")
+		if w.Code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the new password to work after the file changed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if w := sendBasic(h, "alice", "old"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the old password to stop working, got %d", w.Code)
+	}
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap"
+)
+
+// Build creates one Middleware for each entry of the middlewares section of dynamic.yaml, keyed by
+// its name. A router that lists the same name more than once, or two routers that list it, share one
+// instance, so state like a rate limiter's buckets belongs to the named middleware, not to the router.
+//
+// ctx lives as long as this config is serving traffic. Middlewares that run something in the
+// background (a file watcher, a cleanup loop) stop it when ctx is cancelled on the next reload.
+//
+// An entry that fails to build is logged and left out of the result. The routers that use it are
+// then skipped by the proxy, instead of serving traffic without it.
+func Build(ctx context.Context, cfgs map[string]*config.MiddlewareCfg, logg *zap.Logger) map[string]Middleware {
+	built := make(map[string]Middleware, len(cfgs))
+	for name, cfg := range cfgs {
+		m, err := build(ctx, name, cfg, logg)
+		if err != nil {
+			logg.Error("Failed to build middleware", zap.String("middleware", name), zap.Error(err))
+			continue
+		}
+		built[name] = m
+	}
+	return built
+}
+
+func build(ctx context.Context, name string, cfg *config.MiddlewareCfg, logg *zap.Logger) (Middleware, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("middleware %q is empty", name)
+	}
+
+	switch {
+	case cfg.StripPrefix != nil:
+		return StripPrefix(cfg.StripPrefix.Prefixes), nil
+	case cfg.AddPrefix != nil:
+		return AddPrefix(*cfg.AddPrefix.Prefix), nil
+	case cfg.ReplacePathRegex != nil:
+		re, err := regexp.Compile(*cfg.ReplacePathRegex.Regex)
+		if err != nil {
+			return nil, err
+		}
+		return ReplacePathRegex(re, *cfg.ReplacePathRegex.Replacement), nil
+	case cfg.Headers != nil:
+		return Headers(cfg.Headers)
+	case cfg.RateLimit != nil:
+		return RateLimit(ctx, cfg.RateLimit), nil
+	case cfg.BasicAuth != nil:
+		return BasicAuth(ctx, cfg.BasicAuth, logg)
+	case cfg.ForwardAuth != nil:
+		return ForwardAuth(cfg.ForwardAuth, logg), nil
+	case cfg.JWT != nil:
+		return JWT(ctx, cfg.JWT, logg)
+	case cfg.CORS != nil:
+		return CORS(cfg.CORS)
+	case cfg.Compress != nil:
+		return Compress(cfg.Compress), nil
+	case cfg.Cache != nil:
+		return Cache(ctx, name, cfg.Cache, logg)
+	default:
+		return nil, fmt.Errorf("middleware %q has no known type", name)
+	}
+}
@@ -0,0 +1,602 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asenalabs/asena/internal/clientip"
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap"
+)
+
+// cacheableStatus are the status codes a response may be stored with (RFC 9110 section 15.1).
+var cacheableStatus = []int{200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// cacheControl is a parsed Cache-Control header: directive name to value, "" for none.
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := cacheControl{}
+	for _, v := range values {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns a delta-seconds directive, like max-age=60.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// responseCache is one cache middleware's state.
+type responseCache struct {
+	store        *cacheStore
+	maxEntrySize int
+	logg         *zap.Logger
+	now          func() time.Time
+
+	// revalidating holds the keys being revalidated in the background, so a burst of requests for
+	// one stale entry sends one request upstream, not one each.
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+// Cache stores responses and answers repeated GET and HEAD requests from the store, following
+// RFC 9111 for a shared cache: a response is stored only if its status and Cache-Control allow it
+// and it says how long it is fresh (max-age, s-maxage or Expires) or can be revalidated (ETag or
+// Last-Modified). private, no-store, Set-Cookie and Vary: * responses are never stored, nor are
+// responses to requests with Authorization unless they say public, s-maxage or must-revalidate.
+//
+// A stale entry is revalidated with If-None-Match / If-Modified-Since. Within its
+// stale-while-revalidate window it is served at once while that happens in the background; within
+// stale-if-error it is served when the service answers 5xx or can't be reached.
+//
+// Every answer says where it came from in X-Cache: HIT, MISS, or STALE. Unsafe requests (POST,
+// PUT, DELETE, PATCH) that succeed invalidate what is stored for their URL.
+//
+// With a purge path, POST or PURGE requests to it from allowed_ips remove entries by key
+// (?key=host/path?query) or by prefix (?prefix=host/path). Everything runs until ctx is done,
+// when the disk tier's directory is removed.
+func Cache(ctx context.Context, name string, cfg *config.CacheCfg, logg *zap.Logger) (Middleware, error) {
+	var disk *diskTier
+	if cfg.DiskDir != nil {
+		var err error
+		if disk, err = newDiskTier(*cfg.DiskDir, name, *cfg.DiskMB<<20, logg); err != nil {
+			return nil, err
+		}
+		go func() {
+			<-ctx.Done()
+			disk.close()
+		}()
+	}
+
+	c := &responseCache{
+		store:        newCacheStore(*cfg.MemoryMB<<20, disk),
+		maxEntrySize: *cfg.MaxEntrySize,
+		logg:         logg,
+		now:          time.Now,
+		revalidating: make(map[string]bool),
+	}
+
+	var purge func(w http.ResponseWriter, r *http.Request)
+	var purgePath string
+	if cfg.Purge != nil {
+		purgePath = *cfg.Purge.Path
+		purge = c.purgeHandler(cfg.Purge.AllowedIPs)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if purge != nil && r.URL.Path == purgePath {
+				purge(w, r)
+				return
+			}
+			c.serve(ctx, w, r, next)
+		})
+	}, nil
+}
+
+// cacheKey is the URL a request is for: its host, without a port or letter case, and its path
+// and query as sent.
+func cacheKey(r *http.Request) string {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host + r.URL.RequestURI()
+}
+
+// variantKey is key for a response that varies on names.
+func variantKey(key string, names []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range names {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// lookup finds the entry for r, following a Vary marker to the right variant, and returns it with
+// the key it is stored under.
+func (c *responseCache) lookup(r *http.Request) (*cacheEntry, string) {
+	key := cacheKey(r)
+	e, ok := c.store.get(key)
+	if !ok {
+		return nil, ""
+	}
+	if e.VaryMarker {
+		key = variantKey(key, e.VaryNames, r)
+		if e, ok = c.store.get(key); !ok || e.VaryMarker {
+			return nil, ""
+		}
+	}
+	return e, key
+}
+
+func (c *responseCache) serve(ctx context.Context, w http.ResponseWriter, r *http.Request, next http.Handler) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch:
+		c.invalidateOnSuccess(w, r, next)
+		return
+	default:
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	// WebSocket upgrades and range requests go straight through.
+	if r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	reqCC := parseCacheControl(r.Header.Values("Cache-Control"))
+	if reqCC.has("no-store") {
+		w.Header().Set("X-Cache", "MISS")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	e, key := c.lookup(r)
+	if e == nil {
+		c.fetch(w, r, next, nil)
+		return
+	}
+
+	now := c.now()
+	age := e.InitialAge + now.Sub(e.ResponseTime)
+	noCache := reqCC.has("no-cache") || (len(reqCC) == 0 && r.Header.Get("Pragma") == "no-cache")
+	fresh := age < e.FreshFor && !noCache
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		fresh = false
+	}
+	if fresh {
+		c.write(w, r, e, age, "HIT")
+		return
+	}
+
+	stale := age - e.FreshFor
+	if !e.MustRevalidate && !noCache && stale < e.StaleWhileRevalidate {
+		c.write(w, r, e, age, "STALE")
+		c.revalidateInBackground(ctx, r, key, e, next)
+		return
+	}
+	c.fetch(w, r, next, e)
+}
+
+// fetch sends r upstream and stores the answer if it can. With a stale entry, the request is made
+// conditional; a 304 refreshes and serves the entry, and a 5xx within stale-if-error serves it
+// as it is.
+func (c *responseCache) fetch(w http.ResponseWriter, r *http.Request, next http.Handler, stale *cacheEntry) {
+	upstream := r
+	if stale != nil {
+		upstream = conditionalRequest(r.Context(), r, stale)
+	}
+	start := c.now()
+
+	rec := &cacheRecorder{client: w, header: http.Header{}, limit: c.maxEntrySize}
+	rec.decide = func(code int, h http.Header) (passThrough, store bool) {
+		if stale != nil {
+			if code == http.StatusNotModified {
+				return false, false
+			}
+			staleFor := start.Sub(stale.ResponseTime) + stale.InitialAge - stale.FreshFor
+			if code >= 500 && !stale.MustRevalidate && staleFor < stale.StaleIfError {
+				return false, false
+			}
+		}
+		h.Set("X-Cache", "MISS")
+		return true, r.Method == http.MethodGet && storable(r, code, h)
+	}
+	next.ServeHTTP(rec, upstream)
+	rec.finish()
+
+	switch {
+	case rec.passThrough:
+		if rec.store {
+			c.put(r, rec.code, rec.header, rec.body, start)
+		}
+	case rec.code == http.StatusNotModified:
+		e := c.refresh(r, stale, rec.header, start)
+		c.write(w, r, e, e.InitialAge, "HIT")
+	default:
+		age := stale.InitialAge + c.now().Sub(stale.ResponseTime)
+		c.write(w, r, stale, age, "STALE")
+	}
+}
+
+// revalidateInBackground refreshes a stale entry without keeping the client waiting. The request
+// is detached from the client's, which is about to end.
+func (c *responseCache) revalidateInBackground(ctx context.Context, r *http.Request, key string, stale *cacheEntry, next http.Handler) {
+	c.mu.Lock()
+	if c.revalidating[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mu.Unlock()
+
+	upstream := conditionalRequest(context.WithoutCancel(r.Context()), r, stale)
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, key)
+			c.mu.Unlock()
+		}()
+		if ctx.Err() != nil {
+			return
+		}
+
+		start := c.now()
+		rec := &cacheRecorder{header: http.Header{}, limit: c.maxEntrySize}
+		rec.decide = func(code int, h http.Header) (bool, bool) {
+			return false, code != http.StatusNotModified && storable(upstream, code, h)
+		}
+		// The handler is the rest of the chain and the proxy, built for a request in flight; a
+		// panic here must not take the process down.
+		defer func() {
+			if p := recover(); p != nil {
+				c.logg.Error("Background cache revalidation panicked", zap.Any("panic", p))
+			}
+		}()
+		next.ServeHTTP(rec, upstream)
+		rec.finish()
+
+		switch {
+		case rec.code == http.StatusNotModified:
+			c.refresh(upstream, stale, rec.header, start)
+		case rec.store:
+			c.put(upstream, rec.code, rec.header, rec.body, start)
+		}
+	}()
+}
+
+// conditionalRequest turns r into a GET that asks whether stale is still current. The client's
+// own conditional headers are dropped; they are answered from the cache.
+func conditionalRequest(ctx context.Context, r *http.Request, stale *cacheEntry) *http.Request {
+	up := r.Clone(ctx)
+	up.Method = http.MethodGet
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		up.Header.Del(h)
+	}
+	if etag := stale.Header.Get("ETag"); etag != "" {
+		up.Header.Set("If-None-Match", etag)
+	}
+	if lm := stale.Header.Get("Last-Modified"); lm != "" {
+		up.Header.Set("If-Modified-Since", lm)
+	}
+	return up
+}
+
+// storable reports whether a response may be stored, see Cache.
+func storable(r *http.Request, code int, h http.Header) bool {
+	if !slices.Contains(cacheableStatus, code) {
+		return false
+	}
+	cc := parseCacheControl(h.Values("Cache-Control"))
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	if h.Get("Set-Cookie") != "" || strings.Contains(h.Get("Vary"), "*") {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+
+	explicit := cc.has("max-age") || cc.has("s-maxage") || h.Get("Expires") != ""
+	validator := h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+	return explicit || validator
+}
+
+// newCacheEntry works out freshness from the response headers (RFC 9111 section 4.2).
+func newCacheEntry(code int, h http.Header, body []byte, requested, received time.Time) *cacheEntry {
+	cc := parseCacheControl(h.Values("Cache-Control"))
+	e := &cacheEntry{Status: code, Header: h, Body: body, ResponseTime: received}
+
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = received
+	}
+	apparentAge := max(0, received.Sub(date))
+	ageValue, _ := strconv.Atoi(h.Get("Age"))
+	correctedAge := time.Duration(ageValue)*time.Second + received.Sub(requested)
+	e.InitialAge = max(apparentAge, correctedAge)
+
+	switch sMaxAge, ok := cc.seconds("s-maxage"); {
+	case cc.has("no-cache"):
+		// Stored, but checked with the service every time.
+	case ok:
+		e.FreshFor = sMaxAge
+	default:
+		if maxAge, ok := cc.seconds("max-age"); ok {
+			e.FreshFor = maxAge
+		} else if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+			e.FreshFor = max(0, expires.Sub(date))
+		}
+	}
+
+	e.StaleWhileRevalidate, _ = cc.seconds("stale-while-revalidate")
+	e.StaleIfError, _ = cc.seconds("stale-if-error")
+	// s-maxage includes proxy-revalidate (RFC 9111 section 5.2.2.10).
+	e.MustRevalidate = cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("s-maxage")
+	return e
+}
+
+func (c *responseCache) put(r *http.Request, code int, h http.Header, body []byte, requested time.Time) {
+	h = h.Clone()
+	for _, hop := range hopHeaders {
+		h.Del(hop)
+	}
+	h.Del("X-Cache")
+	e := newCacheEntry(code, h, body, requested, c.now())
+
+	key := cacheKey(r)
+	if names := varyNames(h); len(names) > 0 {
+		c.store.put(key, &cacheEntry{VaryMarker: true, VaryNames: names})
+		key = variantKey(key, names, r)
+	}
+	c.store.put(key, e)
+}
+
+// refresh updates a stale entry with the headers of a 304 for it (RFC 9111 section 4.3.4).
+func (c *responseCache) refresh(r *http.Request, stale *cacheEntry, h http.Header, requested time.Time) *cacheEntry {
+	merged := stale.Header.Clone()
+	for k, vv := range h {
+		switch k {
+		case "Content-Length", "X-Cache":
+			continue
+		}
+		merged[k] = vv
+	}
+	for _, hop := range hopHeaders {
+		merged.Del(hop)
+	}
+
+	e := newCacheEntry(stale.Status, merged, stale.Body, requested, c.now())
+	key := cacheKey(r)
+	if names := varyNames(merged); len(names) > 0 {
+		key = variantKey(key, names, r)
+	}
+	c.store.put(key, e)
+	return e
+}
+
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// write answers from the cache, with a 304 if the client's own copy is still current.
+func (c *responseCache) write(w http.ResponseWriter, r *http.Request, e *cacheEntry, age time.Duration, status string) {
+	h := w.Header()
+	for k, vv := range e.Header {
+		h[k] = slices.Clone(vv)
+	}
+	h.Set("Age", strconv.Itoa(int(age.Seconds())))
+	h.Set("X-Cache", status)
+
+	if notModified(r, e.Header) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(e.Body)
+	}
+}
+
+// notModified evaluates the client's If-None-Match, or failing that If-Modified-Since, against a
+// stored response (RFC 9110 section 13.2.2).
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// invalidateOnSuccess passes an unsafe request through, and drops what is stored for its URL if
+// it succeeded (RFC 9111 section 4.4).
+func (c *responseCache) invalidateOnSuccess(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	key := cacheKey(r)
+	hw := &headerWriter{ResponseWriter: w, before: func(_ http.Header, code int) {
+		if code < 400 {
+			c.store.purge(func(primary string) bool { return primary == key })
+		}
+	}}
+	next.ServeHTTP(hw, r)
+}
+
+func (c *responseCache) purgeHandler(allowed []string) func(w http.ResponseWriter, r *http.Request) {
+	var nets []*net.IPNet
+	for _, a := range allowed {
+		if !strings.Contains(a, "/") {
+			if ip := net.ParseIP(a); ip.To4() != nil {
+				a += "/32"
+			} else {
+				a += "/128"
+			}
+		}
+		if _, n, err := net.ParseCIDR(a); err == nil {
+			nets = append(nets, n)
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != "PURGE" {
+			w.Header().Set("Allow", "POST, PURGE")
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed", "Purge with POST or PURGE.")
+			return
+		}
+		ip := net.ParseIP(clientip.FromRequest(r))
+		if ip == nil || !slices.ContainsFunc(nets, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+			writeError(w, http.StatusForbidden, "Forbidden", "This address may not purge the cache.")
+			return
+		}
+
+		q := r.URL.Query()
+		var match func(primary string) bool
+		switch key, prefix := q.Get("key"), q.Get("prefix"); {
+		case key != "" && prefix == "":
+			match = func(primary string) bool { return primary == key }
+		case prefix != "" && key == "":
+			match = func(primary string) bool { return strings.HasPrefix(primary, prefix) }
+		default:
+			writeError(w, http.StatusBadRequest, "Bad request", "Set exactly one of key and prefix.")
+			return
+		}
+
+		n := c.store.purge(match)
+		c.logg.Info("Purged cache", zap.String("router", RouterName(r.Context())), zap.Int("entries", n))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int{"purged": n})
+	}
+}
+
+// cacheRecorder sits between the chain and the client. When the status is known, decide says
+// whether the response goes to the client as it comes (passThrough) and whether to keep a copy of
+// it (store). A kept copy is given up if the body grows past limit. Without a client, nothing
+// passes through.
+type cacheRecorder struct {
+	client http.ResponseWriter
+	header http.Header
+	decide func(code int, h http.Header) (passThrough, store bool)
+	limit  int
+
+	code        int
+	wroteHeader bool
+	passThrough bool
+	store       bool
+	body        []byte
+}
+
+func (w *cacheRecorder) Header() http.Header { return w.header }
+
+func (w *cacheRecorder) WriteHeader(code int) {
+	if code < http.StatusOK {
+		if w.client != nil {
+			copyHeader(w.client.Header(), w.header)
+			w.client.WriteHeader(code)
+		}
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.code = code
+	w.passThrough, w.store = w.decide(code, w.header)
+	w.passThrough = w.passThrough && w.client != nil
+
+	if w.passThrough {
+		copyHeader(w.client.Header(), w.header)
+		w.client.WriteHeader(code)
+	}
+}
+
+func (w *cacheRecorder) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.store {
+		if len(w.body)+len(b) > w.limit {
+			w.store, w.body = false, nil
+		} else {
+			w.body = append(w.body, b...)
+		}
+	}
+	if w.passThrough {
+		return w.client.Write(b)
+	}
+	return len(b), nil
+}
+
+func (w *cacheRecorder) Flush() {
+	if w.passThrough {
+		_ = http.NewResponseController(w.client).Flush()
+	}
+}
+
+// finish covers a handler that returned without writing anything.
+func (w *cacheRecorder) finish() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		dst[k] = vv
+	}
+}
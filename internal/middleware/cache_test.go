@@ -0,0 +1,371 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap"
+)
+
+// testCache returns a cache handler in front of next, with a clock that only moves when the test
+// moves it.
+func testCache(t *testing.T, next http.Handler) (http.Handler, *responseCache, *time.Time) {
+	t.Helper()
+	now := time.Unix(1_000_000, 0)
+	c := &responseCache{
+		store:        newCacheStore(1<<20, nil),
+		maxEntrySize: 1 << 16,
+		logg:         zap.NewNop(),
+		now:          func() time.Time { return now },
+		revalidating: make(map[string]bool),
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serve(context.Background(), w, r, next)
+	})
+	return h, c, &now
+}
+
+func get(h http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	for k, vv := range header {
+		r.Header[k] = vv
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCache_MissThenHit(t *testing.T) {
+	var calls atomic.Int32
+	h, _, now := testCache(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = fmt.Fprintf(w, "v%d", n)
+	}))
+
+	if w := get(h, "/a?x=1", nil); w.Header().Get("X-Cache") != "MISS" || w.Body.String() != "v1" {
+		t.Fatalf("expected a MISS, got %q %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+
+	*now = now.Add(10 * time.Second)
+	w := get(h, "/a?x=1", nil)
+	if w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "v1" {
+		t.Fatalf("expected a HIT, got %q %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if got := w.Header().Get("Age"); got != "10" {
+		t.Errorf("Age = %q, want 10", got)
+	}
+
+	if w := get(h, "/a?x=2", nil); w.Header().Get("X-Cache") != "MISS" {
+		t.Error("expected a different query to be a different entry")
+	}
+
+	*now = now.Add(time.Minute)
+	if w := get(h, "/a?x=1", nil); w.Header().Get("X-Cache") != "MISS" || w.Body.String() != "v3" {
+		t.Errorf("expected the expired entry to be fetched again, got %q %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+}
+
+func TestCache_NotStored(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		req    http.Header
+	}{
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, nil},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, nil},
+		{"set-cookie", http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"s=1"}}, nil},
+		{"no freshness or validator", http.Header{}, nil},
+		{"authorization", http.Header{"Cache-Control": {"max-age=60"}}, http.Header{"Authorization": {"Bearer x"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			h, _, _ := testCache(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				for k, vv := range tt.header {
+					w.Header()[k] = vv
+				}
+				_, _ = w.Write([]byte("body"))
+			}))
+			get(h, "/", tt.req)
+			get(h, "/", tt.req)
+			if calls.Load() != 2 {
+				t.Errorf("expected both requests to reach the service, got %d", calls.Load())
+			}
+		})
+	}
+}
+
+func TestCache_Vary(t *testing.T) {
+	h, _, _ := testCache(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Language")))
+	}))
+
+	get(h, "/", http.Header{"Accept-Language": {"en"}})
+	get(h, "/", http.Header{"Accept-Language": {"fr"}})
+
+	for _, lang := range []string{"en", "fr"} {
+		w := get(h, "/", http.Header{"Accept-Language": {lang}})
+		if w.Header().Get("X-Cache") != "HIT" || w.Body.String() != lang {
+			t.Errorf("%s: expected a HIT with its own variant, got %q %q", lang, w.Header().Get("X-Cache"), w.Body.String())
+		}
+	}
+	if w := get(h, "/", http.Header{"Accept-Language": {"de"}}); w.Header().Get("X-Cache") != "MISS" {
+		t.Error("expected an unseen variant to be a MISS")
+	}
+}
+
+func TestCache_RevalidatesWithETag(t *testing.T) {
+	var calls atomic.Int32
+	h, _, now := testCache(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("full body"))
+	}))
+
+	get(h, "/", nil)
+	*now = now.Add(11 * time.Second)
+
+	w := get(h, "/", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "full body" || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("expected the refreshed entry, got %d %q %q", w.Code, w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected one revalidation, got %d calls", calls.Load())
+	}
+
+	if w := get(h, "/", nil); w.Header().Get("X-Cache") != "HIT" || calls.Load() != 2 {
+		t.Error("expected the 304 to make the entry fresh again")
+	}
+	if w := get(h, "/", http.Header{"If-None-Match": {`W/"v1"`}}); w.Code != http.StatusNotModified {
+		t.Errorf("expected the client's own validator to get a 304, got %d", w.Code)
+	}
+}
+
+func TestCache_StaleWhileRevalidate(t *testing.T) {
+	var calls atomic.Int32
+	fetched := make(chan struct{}, 1)
+	h, c, now := testCache(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=30")
+		_, _ = fmt.Fprintf(w, "v%d", n)
+		if n > 1 {
+			fetched <- struct{}{}
+		}
+	}))
+
+	get(h, "/", nil)
+	*now = now.Add(5 * time.Second)
+
+	w := get(h, "/", nil)
+	if w.Header().Get("X-Cache") != "STALE" || w.Body.String() != "v1" {
+		t.Fatalf("expected the stale entry at once, got %q %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+
+	select {
+	case <-fetched:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a background revalidation")
+	}
+	for i := 0; i < 100; i++ {
+		c.mu.Lock()
+		busy := len(c.revalidating) > 0
+		c.mu.Unlock()
+		if !busy {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if w := get(h, "/", nil); w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "v2" {
+		t.Errorf("expected the revalidated entry, got %q %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+}
+
+func TestCache_StaleIfError(t *testing.T) {
+	var failing atomic.Bool
+	h, _, now := testCache(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=1, stale-if-error=60")
+		_, _ = w.Write([]byte("good"))
+	}))
+
+	get(h, "/", nil)
+	failing.Store(true)
+	*now = now.Add(30 * time.Second)
+
+	w := get(h, "/", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "good" || w.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("expected the stale entry, got %d %q %q", w.Code, w.Body.String(), w.Header().Get("X-Cache"))
+	}
+
+	*now = now.Add(time.Minute)
+	if w := get(h, "/", nil); w.Code != http.StatusBadGateway {
+		t.Errorf("expected the error once stale-if-error ran out, got %d", w.Code)
+	}
+}
+
+func TestCache_UnsafeRequestInvalidates(t *testing.T) {
+	var calls atomic.Int32
+	h, _, _ := testCache(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	get(h, "/item", nil)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/item", strings.NewReader("x")))
+
+	if w := get(h, "/item", nil); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("expected the POST to drop the entry, got %q", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestCache_Purge(t *testing.T) {
+	path := "/_cache/purge"
+	memory, entry := 1, 1<<16
+	cfg := &config.CacheCfg{
+		MemoryMB:     &memory,
+		MaxEntrySize: &entry,
+		Purge:        &config.CachePurgeCfg{Path: &path, AllowedIPs: []string{"127.0.0.1"}},
+	}
+	m, err := Cache(context.Background(), "c", cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, p := range []string{"/a/1", "/a/2", "/b"} {
+		get(h, "http://example.com"+p, nil)
+	}
+
+	purge := func(remote, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "http://example.com"+path+"?"+query, nil)
+		r.RemoteAddr = remote + ":4000"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := purge("10.0.0.1", "prefix=example.com/a"); w.Code != http.StatusForbidden {
+		t.Errorf("expected a disallowed address to be refused, got %d", w.Code)
+	}
+	if w := purge("127.0.0.1", "key=x&prefix=y"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected both key and prefix to be refused, got %d", w.Code)
+	}
+	if w := purge("127.0.0.1", "prefix=example.com/a"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"purged":2`) {
+		t.Errorf("expected two entries purged, got %d %s", w.Code, w.Body.String())
+	}
+
+	if w := get(h, "http://example.com/a/1", nil); w.Header().Get("X-Cache") != "MISS" {
+		t.Error("expected the purged entry to be gone")
+	}
+	if w := get(h, "http://example.com/b", nil); w.Header().Get("X-Cache") != "HIT" {
+		t.Error("expected the other entry to stay")
+	}
+}
+
+func TestCacheStore_SpillsToDisk(t *testing.T) {
+	disk, err := newDiskTier(t.TempDir(), "c", 1<<20, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.close()
+
+	entry := func(body string) *cacheEntry {
+		return &cacheEntry{Status: 200, Header: http.Header{"Etag": {`"x"`}}, Body: []byte(body)}
+	}
+	s := newCacheStore(entry(strings.Repeat("a", 600)).size()+10, disk)
+	s.put("host/a", entry(strings.Repeat("a", 600)))
+	s.put("host/b", entry(strings.Repeat("b", 600)))
+
+	e, ok := s.get("host/a")
+	if !ok || string(e.Body) != strings.Repeat("a", 600) || e.Header.Get("ETag") != `"x"` {
+		t.Fatal("expected the evicted entry to come back from disk")
+	}
+	if _, ok := s.get("host/b"); !ok {
+		t.Fatal("expected the entry moved out to make room to be on disk")
+	}
+
+	if n := s.purge(func(primary string) bool { return true }); n != 2 {
+		t.Errorf("expected both entries purged, got %d", n)
+	}
+}
+
+func TestNewDiskTier_KeepsLiveDirectories(t *testing.T) {
+	parent := t.TempDir()
+	stale := filepath.Join(parent, "asena-cache-c-999999999-1")
+	if err := os.Mkdir(stale, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := newDiskTier(parent, "c", 1<<20, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.close()
+	// A reload builds the next tier while the one above still serves.
+	next, err := newDiskTier(parent, "c", 1<<20, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.close()
+
+	if _, err := os.Stat(live.dir); err != nil {
+		t.Errorf("expected the live tier's directory to be kept: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the directory of an exited process to be removed, got %v", err)
+	}
+}
+
+func TestDiskTier_ConcurrentPutsOfOneKey(t *testing.T) {
+	disk, err := newDiskTier(t.TempDir(), "c", 1<<20, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			disk.put("host/a", &cacheEntry{Status: 200, Body: []byte(strings.Repeat("a", 10_000))})
+		}()
+	}
+	wg.Wait()
+
+	e, ok := disk.take("host/a")
+	if !ok || len(e.Body) != 10_000 {
+		t.Fatal("expected a whole entry back")
+	}
+	if left, _ := filepath.Glob(filepath.Join(disk.dir, ".tmp-*")); len(left) != 0 {
+		t.Errorf("expected no temporary files left, got %v", left)
+	}
+}
@@ -0,0 +1,319 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// cacheEntry is one stored response, or, with VaryMarker set, a note that the responses for this
+// URL vary on the request headers in VaryNames and are stored under their own keys. Fields are
+// exported for gob, which writes them to the disk tier.
+type cacheEntry struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	// ResponseTime is when the response was received, and InitialAge how old it already was then
+	// (RFC 9111 section 4.2.3).
+	ResponseTime time.Time
+	InitialAge   time.Duration
+
+	FreshFor             time.Duration
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	MustRevalidate       bool
+
+	VaryMarker bool
+	VaryNames  []string
+}
+
+// size is roughly how much memory e takes, for the LRU's budget.
+func (e *cacheEntry) size() int {
+	n := len(e.Body) + 256
+	for k, vv := range e.Header {
+		n += len(k)
+		for _, v := range vv {
+			n += len(v)
+		}
+	}
+	return n
+}
+
+// cacheKeyPrimary returns the URL part of a store key. A key is the URL, or for a response that
+// varies, the URL, a NUL, and the request's values of the varying headers.
+func cacheKeyPrimary(key string) string {
+	primary, _, _ := strings.Cut(key, "\x00")
+	return primary
+}
+
+// lru is a size-bounded least-recently-used map. It is not safe for concurrent use.
+type lru struct {
+	capacity int
+	used     int
+	order    *list.List // front is most recently used
+	items    map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	entry *cacheEntry
+	size  int
+}
+
+func newLRU(capacity int) *lru {
+	return &lru{capacity: capacity, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lru) get(key string) (*cacheEntry, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruItem).entry, true
+}
+
+// put stores e under key and returns whatever it had to evict to make room.
+func (l *lru) put(key string, e *cacheEntry, size int) []*lruItem {
+	l.remove(key)
+	l.items[key] = l.order.PushFront(&lruItem{key: key, entry: e, size: size})
+	l.used += size
+
+	var evicted []*lruItem
+	for l.used > l.capacity && l.order.Len() > 1 {
+		oldest := l.order.Back()
+		item := oldest.Value.(*lruItem)
+		l.order.Remove(oldest)
+		delete(l.items, item.key)
+		l.used -= item.size
+		evicted = append(evicted, item)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) (*lruItem, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*lruItem)
+	l.order.Remove(el)
+	delete(l.items, key)
+	l.used -= item.size
+	return item, true
+}
+
+// keys returns every key, for purging.
+func (l *lru) keys() []string {
+	keys := make([]string, 0, len(l.items))
+	for k := range l.items {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// cacheStore keeps entries in memory, and, with a disk tier, moves what memory evicts to disk
+// instead of dropping it. An entry read from disk moves back to memory.
+type cacheStore struct {
+	mu  sync.Mutex
+	mem *lru
+
+	disk *diskTier
+}
+
+func newCacheStore(memBytes int, disk *diskTier) *cacheStore {
+	return &cacheStore{mem: newLRU(memBytes), disk: disk}
+}
+
+func (s *cacheStore) get(key string) (*cacheEntry, bool) {
+	s.mu.Lock()
+	e, ok := s.mem.get(key)
+	s.mu.Unlock()
+	if ok || s.disk == nil {
+		return e, ok
+	}
+
+	if e, ok = s.disk.take(key); ok {
+		s.put(key, e)
+	}
+	return e, ok
+}
+
+func (s *cacheStore) put(key string, e *cacheEntry) {
+	s.mu.Lock()
+	evicted := s.mem.put(key, e, e.size())
+	s.mu.Unlock()
+
+	if s.disk != nil {
+		for _, item := range evicted {
+			s.disk.put(item.key, item.entry)
+		}
+	}
+}
+
+// purge removes every entry whose URL matches, and returns how many it removed.
+func (s *cacheStore) purge(match func(primary string) bool) int {
+	n := 0
+	s.mu.Lock()
+	for _, key := range s.mem.keys() {
+		if match(cacheKeyPrimary(key)) {
+			s.mem.remove(key)
+			n++
+		}
+	}
+	s.mu.Unlock()
+
+	if s.disk != nil {
+		n += s.disk.purge(match)
+	}
+	return n
+}
+
+// diskTier stores entries as gob files named after a hash of their key, with the index, and so
+// the LRU order, kept in memory. File I/O happens outside the lock; an entry whose file has gone
+// missing is simply a miss.
+type diskTier struct {
+	dir  string
+	logg *zap.Logger
+
+	mu    sync.Mutex
+	index *lru // entries are nil; only keys and sizes are kept
+}
+
+// newDiskTier makes a directory of its own under parent, named after the middleware and this
+// process, and removes it when ctx is done. The tier of the config being replaced on a reload
+// still writes to its own directory until then, so only directories left behind by a process
+// that has exited, without cleaning up, are removed here.
+func newDiskTier(parent, name string, capacity int, logg *zap.Logger) (*diskTier, error) {
+	prefix := "asena-cache-" + name + "-"
+	if old, err := filepath.Glob(filepath.Join(parent, prefix+"*")); err == nil {
+		for _, dir := range old {
+			pid, _, _ := strings.Cut(strings.TrimPrefix(filepath.Base(dir), prefix), "-")
+			if n, err := strconv.Atoi(pid); err == nil && n != os.Getpid() && !processRunning(n) {
+				_ = os.RemoveAll(dir)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(parent, 0o700); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(parent, prefix+strconv.Itoa(os.Getpid())+"-*")
+	if err != nil {
+		return nil, err
+	}
+	return &diskTier{dir: dir, logg: logg, index: newLRU(capacity)}, nil
+}
+
+// processRunning reports whether a process with this pid exists.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func (d *diskTier) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
+
+func (d *diskTier) put(key string, e *cacheEntry) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		d.logg.Warn("Failed to encode cache entry", zap.Error(err))
+		return
+	}
+
+	// Write to a temporary file of this put's own and rename it, so a reader never sees half an
+	// entry, and two puts of the same key don't write into the same file.
+	if err := d.write(d.path(key), buf.Bytes()); err != nil {
+		d.logg.Warn("Failed to write cache entry to disk", zap.Error(err))
+		return
+	}
+
+	d.mu.Lock()
+	evicted := d.index.put(key, nil, buf.Len())
+	d.mu.Unlock()
+	for _, item := range evicted {
+		_ = os.Remove(d.path(item.key))
+	}
+}
+
+func (d *diskTier) write(path string, data []byte) error {
+	f, err := os.CreateTemp(d.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// take reads key's entry and removes it from disk: the caller moves it to memory.
+func (d *diskTier) take(key string) (*cacheEntry, bool) {
+	d.mu.Lock()
+	_, ok := d.index.remove(key)
+	d.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	path := d.path(key)
+	data, err := os.ReadFile(path)
+	_ = os.Remove(path)
+	if err != nil {
+		return nil, false
+	}
+	var e cacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e); err != nil {
+		d.logg.Warn("Failed to decode cache entry from disk", zap.Error(err))
+		return nil, false
+	}
+	return &e, true
+}
+
+func (d *diskTier) purge(match func(primary string) bool) int {
+	var removed []string
+	d.mu.Lock()
+	for _, key := range d.index.keys() {
+		if match(cacheKeyPrimary(key)) {
+			d.index.remove(key)
+			removed = append(removed, key)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, key := range removed {
+		_ = os.Remove(d.path(key))
+	}
+	return len(removed)
+}
+
+func (d *diskTier) close() {
+	_ = os.RemoveAll(d.dir)
+}
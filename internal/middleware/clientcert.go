@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/asenalabs/asena/internal/clientcert"
+)
+
+// ClientCertHeaders names the request headers the details of a client's verified certificate are
+// sent to backends in. An empty name leaves that detail out.
+type ClientCertHeaders struct {
+	Subject     string
+	SANs        string
+	Fingerprint string
+}
+
+// ClientCert puts the details of the certificate the client authenticated with into h's headers. The
+// headers are always removed from the request first, so a client can't send its own; only a
+// certificate verified against the entrypoint's CA bundle fills them in.
+//
+// strip lists the headers every other entrypoint fills in, which are removed too: a router without
+// entrypoints takes requests from all of them, so its backend would otherwise trust a header a client
+// sent to an entrypoint that doesn't ask for certificates. An entrypoint without client_auth passes a
+// zero h, and only strips.
+func ClientCert(h ClientCertHeaders, strip []string) Middleware {
+	names := slices.Concat([]string{h.Subject, h.SANs, h.Fingerprint}, strip)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, name := range names {
+				if name != "" {
+					r.Header.Del(name)
+				}
+			}
+			if cert := clientcert.Verified(r); cert != nil {
+				if h.Subject != "" {
+					r.Header.Set(h.Subject, cert.Subject.String())
+				}
+				if h.SANs != "" {
+					r.Header.Set(h.SANs, strings.Join(clientcert.SANs(cert), ","))
+				}
+				if h.Fingerprint != "" {
+					r.Header.Set(h.Fingerprint, clientcert.Fingerprint(cert))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireClientCert turns away a request whose client didn't authenticate with a verified
+// certificate, or, when sans isn't empty, with one that has none of them, ignoring letter case.
+func RequireClientCert(sans []string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cert := clientcert.Verified(r)
+			if cert == nil {
+				writeError(w, http.StatusForbidden, "Forbidden", "A valid client certificate is required.")
+				return
+			}
+			if len(sans) > 0 && !slices.ContainsFunc(clientcert.SANs(cert), func(san string) bool {
+				return slices.ContainsFunc(sans, func(want string) bool { return strings.EqualFold(san, want) })
+			}) {
+				writeError(w, http.StatusForbidden, "Forbidden", "This client certificate may not use this route.")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
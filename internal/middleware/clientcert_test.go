@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/asenalabs/asena/internal/clientcert"
+)
+
+// withClientCert returns a request whose client authenticated with cert, verified or not.
+func withClientCert(cert *x509.Certificate, verified bool) *http.Request {
+	r := httptest.NewRequest("GET", "https://a.com/", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if verified {
+		r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	}
+	return r
+}
+
+func TestClientCert(t *testing.T) {
+	cert := &x509.Certificate{
+		Raw:            []byte("cert"),
+		Subject:        pkix.Name{CommonName: "partner"},
+		DNSNames:       []string{"partner.example.com"},
+		EmailAddresses: []string{"ops@partner.example.com"},
+	}
+	headers := ClientCertHeaders{Subject: "X-Client-Cert-Subject", SANs: "X-Client-Cert-SANs", Fingerprint: "X-Client-Cert-Fingerprint"}
+
+	var got http.Header
+	h := ClientCert(headers, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+
+	r := withClientCert(cert, true)
+	r.Header.Set("X-Client-Cert-Subject", "CN=forged")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if v := got.Get("X-Client-Cert-Subject"); v != "CN=partner" {
+		t.Errorf("expected the subject of the verified certificate, got %q", v)
+	}
+	if v := got.Get("X-Client-Cert-SANs"); v != "partner.example.com,ops@partner.example.com" {
+		t.Errorf("expected the SANs of the verified certificate, got %q", v)
+	}
+	if v := got.Get("X-Client-Cert-Fingerprint"); v != clientcert.Fingerprint(cert) {
+		t.Errorf("expected the fingerprint of the verified certificate, got %q", v)
+	}
+
+	r = withClientCert(cert, false)
+	r.Header.Set("X-Client-Cert-Subject", "CN=forged")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	for _, name := range []string{"X-Client-Cert-Subject", "X-Client-Cert-SANs", "X-Client-Cert-Fingerprint"} {
+		if v := got.Get(name); v != "" {
+			t.Errorf("expected %s to be removed without a verified certificate, got %q", name, v)
+		}
+	}
+}
+
+func TestClientCert_StripsHeadersOfOtherEntrypoints(t *testing.T) {
+	// Headers another entrypoint's client_auth fills in, which a router without entrypoints would
+	// pass on from this one as well.
+	strip := []string{"X-Partner-Subject", "X-Partner-SANs", "X-Partner-Fingerprint"}
+	cert := &x509.Certificate{Raw: []byte("cert"), Subject: pkix.Name{CommonName: "partner"}}
+
+	var got http.Header
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	})
+
+	tests := []struct {
+		name    string
+		headers ClientCertHeaders
+		r       *http.Request
+	}{
+		{"entrypoint without client_auth", ClientCertHeaders{}, httptest.NewRequest("GET", "http://a.com/", nil)},
+		{"entrypoint with other headers", ClientCertHeaders{Subject: "X-Client-Cert-Subject"}, withClientCert(cert, true)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range strip {
+				tt.r.Header.Set(name, "forged")
+			}
+			ClientCert(tt.headers, strip)(next).ServeHTTP(httptest.NewRecorder(), tt.r)
+			for _, name := range strip {
+				if v := got.Get(name); v != "" {
+					t.Errorf("expected %s to be removed, got %q", name, v)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	cert := &x509.Certificate{DNSNames: []string{"partner.example.com"}}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name string
+		sans []string
+		r    *http.Request
+		want int
+	}{
+		{"no certificate", nil, httptest.NewRequest("GET", "https://a.com/", nil), http.StatusForbidden},
+		{"unverified certificate", nil, withClientCert(cert, false), http.StatusForbidden},
+		{"any verified certificate", nil, withClientCert(cert, true), http.StatusOK},
+		{"listed SAN", []string{"other.example.com", "PARTNER.example.com"}, withClientCert(cert, true), http.StatusOK},
+		{"unlisted SAN", []string{"other.example.com"}, withClientCert(cert, true), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			RequireClientCert(tt.sans)(ok).ServeHTTP(w, tt.r)
+			if w.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
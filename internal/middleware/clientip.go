@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/asenalabs/asena/internal/clientip"
+)
+
+// ClientIP works out the real client of every request once, with res, and puts it on the request's
+// context. It goes first in the server's chain, so access logs, rules, balancers and router
+// middlewares all read the same address through clientip.FromRequest. A request straight from a
+// trusted proxy that writes X-Forwarded-For is marked too, so the proxy keeps the chain it sent.
+func ClientIP(res *clientip.Resolver) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := clientip.NewContext(r.Context(), res.Resolve(r))
+			if res.Header() == "X-Forwarded-For" && res.Trusts(clientip.Peer(r)) {
+				ctx = clientip.WithTrustedPeer(ctx)
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package middleware
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoder is a compressor that can be flushed mid-stream and reused for the next response.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// brotliLevel trades some ratio for speed: this runs on every response, not once at build time.
+const brotliLevel = 4
+
+// encoderPools keeps idle encoders per coding. Building one allocates its whole window, which is
+// far more than most responses.
+var encoderPools = map[string]*sync.Pool{
+	config.CompressGzip: {New: func() any {
+		w, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+		return w
+	}},
+	config.CompressBrotli: {New: func() any {
+		return brotli.NewWriterLevel(io.Discard, brotliLevel)
+	}},
+	config.CompressZstd: {New: func() any {
+		// Browsers refuse zstd windows over 8 MiB.
+		w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(8<<20))
+		return w
+	}},
+}
+
+// contentTypes matches media types against patterns like "text/html" or "text/*".
+type contentTypes []string
+
+func (c contentTypes) match(mediaType string) bool {
+	for _, p := range c {
+		if p == mediaType || (strings.HasSuffix(p, "/*") && strings.HasPrefix(mediaType, p[:len(p)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks the coding to use from an Accept-Encoding header: the one the client
+// gives the highest q-value, with ties going to the first in offered. It returns "" if the client
+// accepts none of them.
+func negotiateEncoding(acceptEncoding string, offered []string) string {
+	best, bestQ := "", 0.0
+	q := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[name] = weight
+	}
+
+	for _, enc := range offered {
+		weight, ok := q[enc]
+		if !ok {
+			if weight, ok = q["*"]; !ok {
+				continue
+			}
+		}
+		if weight > bestQ {
+			best, bestQ = enc, weight
+		}
+	}
+	return best
+}
+
+// Compress compresses responses on the fly, with whichever of zstd, br and gzip the client
+// prefers, in the order of encodings when it has no preference.
+//
+// A response is compressed only if it has a Content-Type that is included (all types, when the
+// include list is empty) and not excluded, is at least minSize bytes, has a body (not HEAD, 204, 304
+// or 206), isn't encoded already, and its Cache-Control doesn't say no-transform. Every response
+// that could be compressed gets Vary: Accept-Encoding, whether or not this client accepts any
+// coding, so caches keep the two versions apart.
+//
+// A compressed response loses Content-Length and Accept-Ranges, and a strong ETag becomes weak: the
+// bytes differ from the uncompressed ones, and a strong tag would promise they don't.
+func Compress(cfg *config.CompressCfg) Middleware {
+	include := contentTypes(cfg.IncludeContentTypes)
+	exclude := contentTypes(cfg.ExcludeContentTypes)
+	compressible := func(h http.Header) bool {
+		mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+		if err != nil {
+			return false
+		}
+		return (len(include) == 0 || include.match(mediaType)) && !exclude.match(mediaType)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{
+				ResponseWriter: w,
+				encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.Encodings),
+				minSize:        *cfg.MinSize,
+				compressible:   compressible,
+			}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// compressWriter decides whether to compress once the status and headers are known. When the
+// length isn't known up front, it holds back up to minSize bytes of body to find out whether the
+// response is big enough. A Flush before then settles it in favor of compressing, so a stream that
+// stays under minSize isn't held back until it ends; an uncompressible type was let through at
+// WriteHeader already.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding     string
+	minSize      int
+	compressible func(h http.Header) bool
+
+	code        int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	enc         encoder
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if code < http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.code = code
+
+	h := w.Header()
+	if !w.eligible(h, code) {
+		w.passThrough()
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if w.encoding == "" {
+		w.passThrough()
+		return
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err == nil {
+			if n < w.minSize {
+				w.passThrough()
+			} else {
+				w.startCompressing()
+			}
+		}
+	}
+}
+
+func (w *compressWriter) eligible(h http.Header, code int) bool {
+	switch code {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	if ce := h.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return false
+	}
+	if h.Get("Content-Range") != "" {
+		return false
+	}
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+				return false
+			}
+		}
+	}
+	return w.compressible(h)
+}
+
+func (w *compressWriter) passThrough() {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.code)
+}
+
+func (w *compressWriter) startCompressing() {
+	w.decided = true
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", w.encoding)
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+
+	w.enc = encoderPools[w.encoding].Get().(encoder)
+	w.enc.Reset(w.ResponseWriter)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+		w.startCompressing()
+		if err := w.writeBuffered(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// writeBuffered writes out what was held back, compressed or not.
+func (w *compressWriter) writeBuffered() error {
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (w *compressWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.startCompressing()
+		_ = w.writeBuffered()
+	}
+	if w.enc != nil {
+		_ = w.enc.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// close finishes the response once the handler is done: a body that stayed under minSize goes out
+// as it is, and a compressed one gets its final block.
+func (w *compressWriter) close() {
+	if !w.wroteHeader {
+		return
+	}
+	if !w.decided {
+		w.passThrough()
+		_ = w.writeBuffered()
+	}
+	if w.enc != nil {
+		_ = w.enc.Close()
+		w.enc.Reset(io.Discard)
+		encoderPools[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
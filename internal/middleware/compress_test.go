@@ -0,0 +1,253 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+func compressCfg() *config.CompressCfg {
+	minSize := 1024
+	return &config.CompressCfg{
+		Encodings:           []string{config.CompressZstd, config.CompressBrotli, config.CompressGzip},
+		MinSize:             &minSize,
+		ExcludeContentTypes: []string{"image/png", "video/*"},
+	}
+}
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		t.Fatalf("unexpected encoding %q", encoding)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	offered := []string{"zstd", "br", "gzip"}
+	cases := map[string]string{
+		"gzip, deflate, br, zstd": "zstd",
+		"gzip, br":                "br",
+		"br;q=0.5, gzip":          "gzip",
+		"zstd;q=0, gzip;q=0.1":    "gzip",
+		"*":                       "zstd",
+		"*;q=0.1, gzip;q=0.5":     "gzip",
+		"deflate":                 "",
+		"":                        "",
+	}
+	for header, want := range cases {
+		if got := negotiateEncoding(header, offered); got != want {
+			t.Errorf("Accept-Encoding %q: got %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	page := strings.Repeat("<p>hello, compressed world</p>\n", 200)
+
+	tests := []struct {
+		name         string
+		accept       string
+		header       http.Header
+		body         string
+		wantEncoding string
+		wantVary     bool
+	}{
+		{"gzip", "gzip", http.Header{"Content-Type": {"text/html; charset=utf-8"}, "Etag": {`"v1"`}}, page, "gzip", true},
+		{"brotli", "br, gzip;q=0.5", http.Header{"Content-Type": {"text/html"}}, page, "br", true},
+		{"zstd", "zstd", http.Header{"Content-Type": {"application/json"}}, page, "zstd", true},
+		{"too small", "gzip", http.Header{"Content-Type": {"text/html"}}, "tiny", "", true},
+		{"client accepts none", "", http.Header{"Content-Type": {"text/html"}}, page, "", true},
+		{"excluded type", "gzip", http.Header{"Content-Type": {"image/png"}}, page, "", false},
+		{"excluded wildcard", "gzip", http.Header{"Content-Type": {"video/mp4"}}, page, "", false},
+		{"already encoded", "gzip", http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"br"}}, page, "br", false},
+		{"no-transform", "gzip", http.Header{"Content-Type": {"text/html"}, "Cache-Control": {"public, no-transform"}}, page, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Compress(compressCfg())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, vv := range tt.header {
+					w.Header()[k] = vv
+				}
+				// Written in pieces, as the proxy copies a body it doesn't know the length of.
+				for i := 0; i < len(tt.body); i += 512 {
+					_, _ = io.WriteString(w, tt.body[i:min(i+512, len(tt.body))])
+				}
+			}))
+
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if got := w.Header().Get("Vary") == "Accept-Encoding"; got != tt.wantVary {
+				t.Errorf("Vary: Accept-Encoding = %v, want %v", got, tt.wantVary)
+			}
+
+			body := w.Body.String()
+			if tt.wantEncoding != "" && tt.wantEncoding != tt.header.Get("Content-Encoding") {
+				body = decompress(t, tt.wantEncoding, w.Body.Bytes())
+				if w.Body.Len() >= len(tt.body) {
+					t.Errorf("expected a smaller body, got %d bytes for %d", w.Body.Len(), len(tt.body))
+				}
+			}
+			if body != tt.body {
+				t.Errorf("body changed: got %d bytes, want %d", len(body), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestCompress_WeakensETagAndDropsLength(t *testing.T) {
+	page := strings.Repeat("a", 4096)
+	h := Compress(compressCfg())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "4096")
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", `"abc"`)
+		_, _ = io.WriteString(w, page)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if got := w.Header().Get("ETag"); got != `W/"abc"` {
+		t.Errorf("expected a weak ETag, got %q", got)
+	}
+	if w.Header().Get("Content-Length") != "" || w.Header().Get("Accept-Ranges") != "" {
+		t.Errorf("expected Content-Length and Accept-Ranges removed, got %v", w.Header())
+	}
+	if got := decompress(t, "gzip", w.Body.Bytes()); got != page {
+		t.Error("body changed")
+	}
+}
+
+func TestCompress_FlushesStreamedResponses(t *testing.T) {
+	release := make(chan struct{})
+	h := Compress(compressCfg())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: first\n\n")
+		http.NewResponseController(w).Flush()
+		<-release
+		_, _ = io.WriteString(w, "data: second\n\n")
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	defer close(release)
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzip stream, got %v", resp.Header)
+	}
+
+	line := make(chan string, 1)
+	go func() {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		s, _ := bufio.NewReader(zr).ReadString('\n')
+		line <- s
+	}()
+
+	select {
+	case got := <-line:
+		if got != "data: first\n" {
+			t.Errorf("expected the first event, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the first event was held back until the response ended")
+	}
+}
+
+func TestCompress_FlushesSmallStreams(t *testing.T) {
+	// A stream that stays under min_size: each flush has to reach the client.
+	release := make(chan struct{})
+	h := Compress(compressCfg())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, "{\"progress\":1}\n")
+		http.NewResponseController(w).Flush()
+		<-release
+		_, _ = io.WriteString(w, "{\"progress\":2}\n")
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	defer close(release)
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzip stream, got %v", resp.Header)
+	}
+
+	line := make(chan string, 1)
+	go func() {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		s, _ := bufio.NewReader(zr).ReadString('\n')
+		line <- s
+	}()
+
+	select {
+	case got := <-line:
+		if got != "{\"progress\":1}\n" {
+			t.Errorf("expected the first line, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the first line was held back until the response ended")
+	}
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// routerKey, entrypointKey and requestIDKey are context keys, unexported so only the helpers below
+// can read or write them.
+type routerKey struct{}
+type entrypointKey struct{}
+type requestIDKey struct{}
+
+// WithRouterName returns ctx carrying the name of the router a request matched. The proxy sets it
+// before running the router's chain, so middlewares can key on the router without importing the
+// proxy package.
+func WithRouterName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, routerKey{}, name)
+}
+
+// RouterName returns the name set by WithRouterName, or "" outside a router's chain.
+func RouterName(ctx context.Context) string {
+	name, _ := ctx.Value(routerKey{}).(string)
+	return name
+}
+
+// Entrypoint puts the name of the entrypoint a request came in through on its context. It goes first
+// in each entrypoint's chain, so routers can be matched by entrypoint.
+func Entrypoint(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), entrypointKey{}, name)))
+		})
+	}
+}
+
+// EntrypointName returns the name set by Entrypoint, or "" for a request that didn't come in through
+// one.
+func EntrypointName(ctx context.Context) string {
+	name, _ := ctx.Value(entrypointKey{}).(string)
+	return name
+}
+
+// withRequestID returns r with a request ID on its context, and the ID itself. An ID already on the
+// context wins, then the client's X-Request-Id, then a new random one. Keeping it on the context
+// means every middleware in the chain, and the request and response side of each, agree on one ID.
+func withRequestID(r *http.Request) (*http.Request, string) {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return r, id
+	}
+
+	id := r.Header.Get("X-Request-Id")
+	if id == "" {
+		var b [16]byte
+		_, _ = rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)), id
+}
@@ -0,0 +1,203 @@
+package middleware
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/asenalabs/asena/internal/config"
+)
+
+// corsResponseHeaders are the CORS headers a backend might set itself. The cors middleware removes
+// them from every response it handles, so the browser sees one policy, not two that disagree.
+var corsResponseHeaders = []string{
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Expose-Headers",
+	"Access-Control-Max-Age",
+}
+
+// corsOrigins decides which origins are allowed.
+type corsOrigins struct {
+	any       bool
+	exact     map[string]bool
+	wildcards []corsWildcard
+	regexes   []*regexp.Regexp
+}
+
+// corsWildcard is an origin like "https://*.example.com", kept as "https://" and ".example.com".
+type corsWildcard struct{ prefix, suffix string }
+
+func newCORSOrigins(cfg *config.CORSCfg) (*corsOrigins, error) {
+	o := &corsOrigins{exact: make(map[string]bool)}
+	for _, origin := range cfg.AllowOrigins {
+		origin = strings.ToLower(origin)
+		switch {
+		case origin == "*":
+			o.any = true
+		case strings.Contains(origin, "://*."):
+			scheme, host, _ := strings.Cut(origin, "://*")
+			o.wildcards = append(o.wildcards, corsWildcard{prefix: scheme + "://", suffix: host})
+		default:
+			o.exact[origin] = true
+		}
+	}
+	for _, expr := range cfg.AllowOriginRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		o.regexes = append(o.regexes, re)
+	}
+	return o, nil
+}
+
+// allows reports whether origin may read responses. A wildcard matches subdomains at any depth, but
+// not the domain itself: "https://*.example.com" allows "https://a.b.example.com", not
+// "https://example.com".
+func (o *corsOrigins) allows(origin string) bool {
+	if o.any {
+		return true
+	}
+	lower := strings.ToLower(origin)
+	if o.exact[lower] {
+		return true
+	}
+	for _, w := range o.wildcards {
+		sub, ok := strings.CutPrefix(lower, w.prefix)
+		if !ok {
+			continue
+		}
+		if sub, ok = strings.CutSuffix(sub, w.suffix); ok && sub != "" && !strings.ContainsAny(sub, "/:@") {
+			return true
+		}
+	}
+	for _, re := range o.regexes {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS answers cross-origin requests from browsers for a router, so its services don't have to.
+//
+// A preflight (OPTIONS with Origin and Access-Control-Request-Method) is answered 204 right here and
+// never reaches the service, or the balancer: it isn't load, and would only skew things like
+// least-time's latency averages. If the origin, the method and every requested header are allowed,
+// the answer carries the Access-Control-Allow-* headers; otherwise it carries none, and the browser
+// refuses the real request.
+//
+// Any other request with an Origin goes through to the service. On the way back, whatever CORS
+// headers the service set are replaced with this policy's.
+func CORS(cfg *config.CORSCfg) (Middleware, error) {
+	origins, err := newCORSOrigins(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := make([]string, len(cfg.AllowMethods))
+	for i, m := range cfg.AllowMethods {
+		methods[i] = strings.ToUpper(m)
+	}
+	allowMethods := strings.Join(methods, ", ")
+
+	anyHeader := slices.Contains(cfg.AllowHeaders, "*")
+	headers := make(map[string]bool, len(cfg.AllowHeaders))
+	for _, h := range cfg.AllowHeaders {
+		headers[strings.ToLower(h)] = true
+	}
+	allowHeaders := strings.Join(cfg.AllowHeaders, ", ")
+
+	exposeHeaders := strings.Join(cfg.ExposeHeaders, ", ")
+	credentials := *cfg.AllowCredentials
+	var maxAge string
+	if *cfg.MaxAge > 0 {
+		maxAge = strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	}
+
+	// With "*" and no credentials the answer is the same for every origin, so caches don't need to
+	// keep one copy per origin.
+	varyOrigin := !origins.any
+
+	allowOrigin := func(h http.Header, origin string) {
+		if origins.any {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	// headersAllowed reports whether every header in an Access-Control-Request-Headers list is.
+	headersAllowed := func(requested string) bool {
+		if anyHeader {
+			return true
+		}
+		for _, h := range strings.Split(requested, ",") {
+			if h = strings.TrimSpace(h); h != "" && !headers[strings.ToLower(h)] {
+				return false
+			}
+		}
+		return true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			reqMethod := r.Header.Get("Access-Control-Request-Method")
+			if r.Method == http.MethodOptions && reqMethod != "" {
+				h := w.Header()
+				h.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+
+				reqHeaders := r.Header.Get("Access-Control-Request-Headers")
+				if origins.allows(origin) && slices.Contains(methods, reqMethod) && headersAllowed(reqHeaders) {
+					allowOrigin(h, origin)
+					h.Set("Access-Control-Allow-Methods", allowMethods)
+					if reqHeaders != "" {
+						if anyHeader {
+							// A literal "*" means nothing to a browser sending credentials, so
+							// echo the list back instead.
+							h.Set("Access-Control-Allow-Headers", reqHeaders)
+						} else {
+							h.Set("Access-Control-Allow-Headers", allowHeaders)
+						}
+					}
+					if maxAge != "" {
+						h.Set("Access-Control-Max-Age", maxAge)
+					}
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			allowed := origins.allows(origin)
+			w = &headerWriter{ResponseWriter: w, before: func(h http.Header, _ int) {
+				for _, name := range corsResponseHeaders {
+					h.Del(name)
+				}
+				if varyOrigin {
+					h.Add("Vary", "Origin")
+				}
+				if allowed {
+					allowOrigin(h, origin)
+					if exposeHeaders != "" {
+						h.Set("Access-Control-Expose-Headers", exposeHeaders)
+					}
+				}
+			}}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+)
+
+func corsCfg(mutate func(*config.CORSCfg)) *config.CORSCfg {
+	credentials, maxAge := false, time.Duration(0)
+	cfg := &config.CORSCfg{AllowMethods: []string{"GET", "HEAD", "POST"}, AllowCredentials: &credentials, MaxAge: &maxAge}
+	mutate(cfg)
+	return cfg
+}
+
+func TestCORSOrigins_Allows(t *testing.T) {
+	o, err := newCORSOrigins(corsCfg(func(c *config.CORSCfg) {
+		c.AllowOrigins = []string{"https://app.example.com", "https://*.example.org"}
+		c.AllowOriginRegex = []string{`^http://localhost:\d+$`}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"https://app.example.com":       true,
+		"https://APP.example.com":       true,
+		"http://app.example.com":        false,
+		"https://a.example.org":         true,
+		"https://a.b.example.org":       true,
+		"https://example.org":           false,
+		"https://evil.com/.example.org": false,
+		"https://evilexample.org":       false,
+		"http://localhost:5173":         true,
+		"http://localhost.evil.com:80":  false,
+	}
+	for origin, want := range cases {
+		if got := o.allows(origin); got != want {
+			t.Errorf("%s: allows() = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func TestCORS_AnswersPreflightWithoutTheService(t *testing.T) {
+	maxAge := 10 * time.Minute
+	m, err := CORS(corsCfg(func(c *config.CORSCfg) {
+		c.AllowOrigins = []string{"https://app.example.com"}
+		c.AllowMethods = []string{"GET", "PUT"}
+		c.AllowHeaders = []string{"Content-Type", "Authorization"}
+		*c.AllowCredentials = true
+		c.MaxAge = &maxAge
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("preflight for %s must not reach the service", r.Header.Get("Origin"))
+	}))
+
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodOptions, "/items/1", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			r.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := preflight("https://app.example.com", "PUT", "content-type,authorization")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, PUT",
+		"Access-Control-Allow-Headers":     "Content-Type, Authorization",
+		"Access-Control-Max-Age":           "600",
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"other origin": preflight("https://evil.example", "PUT", ""),
+		"other method": preflight("https://app.example.com", "DELETE", ""),
+		"other header": preflight("https://app.example.com", "PUT", "X-Debug"),
+	} {
+		if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%s: expected 204 without CORS headers, got %d %v", name, w.Code, w.Header())
+		}
+	}
+}
+
+func TestCORS_ReplacesTheServicesHeaders(t *testing.T) {
+	m, err := CORS(corsCfg(func(c *config.CORSCfg) {
+		c.AllowOrigins = []string{"https://app.example.com"}
+		c.ExposeHeaders = []string{"X-Total-Count"}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reached int
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(method, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send(http.MethodGet, "https://app.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "" ||
+		w.Header().Get("Access-Control-Expose-Headers") != "X-Total-Count" ||
+		w.Header().Get("Vary") != "Origin" {
+		t.Errorf("unexpected headers for an allowed origin: %v", w.Header())
+	}
+
+	w = send(http.MethodGet, "https://evil.example")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected the service's CORS headers removed for a disallowed origin, got %v", w.Header())
+	}
+
+	// OPTIONS without Access-Control-Request-Method is an ordinary request, not a preflight.
+	send(http.MethodOptions, "https://app.example.com")
+	if w := send(http.MethodGet, ""); w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("expected a request without Origin to pass untouched, got %v", w.Header())
+	}
+	if reached != 4 {
+		t.Errorf("expected 4 requests to reach the service, got %d", reached)
+	}
+}
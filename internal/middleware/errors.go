@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeError answers with the same JSON error body the proxy uses when a service can't be reached,
+// so a client sees one error format whichever part of Asena turned it away. message tells the
+// client what to do about it.
+func writeError(w http.ResponseWriter, code int, msg, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   msg,
+		"code":    code,
+		"message": message,
+	})
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/asenalabs/asena/internal/clientip"
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap"
+)
+
+// forwardAuthBodyLimit caps how much of a denying auth service's body is passed on to the client.
+const forwardAuthBodyLimit = 64 << 10 // 64 KiB
+
+// hopHeaders are connection-level headers that belong to one hop and must not be copied onto the
+// subrequest, the same list httputil.ReverseProxy drops.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// ForwardAuth asks an auth service whether a request may go through. It sends a GET to address with
+// the request's headers (cookies, Authorization, ...) and where it was going in X-Forwarded-Method,
+// -Proto, -Host and -Uri, plus the client's address in X-Forwarded-For. The request body is not sent.
+//
+// A 2xx answer lets the request through, with the auth service's headers listed in
+// AuthResponseHeaders (like X-User) copied onto it. Those headers are always removed from the
+// client's request first, so a client can't claim to be someone by sending X-User itself.
+//
+// Any other answer, redirects included, goes back to the client as it is, so a login redirect or a
+// WWW-Authenticate challenge from the auth service reaches the browser. If the auth service can't be
+// reached, the request is refused with 502: no answer is not a yes.
+func ForwardAuth(cfg *config.ForwardAuthCfg, logg *zap.Logger) Middleware {
+	client := &http.Client{
+		Timeout: *cfg.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	copyHeaders := make([]string, 0, len(cfg.AuthResponseHeaders))
+	for _, h := range cfg.AuthResponseHeaders {
+		copyHeaders = append(copyHeaders, http.CanonicalHeaderKey(h))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authReq, err := http.NewRequestWithContext(r.Context(), http.MethodGet, *cfg.Address, nil)
+			if err != nil {
+				logg.Error("Failed to build forward_auth request", zap.Error(err))
+				writeError(w, http.StatusBadGateway, "Authentication service not available", "Please try again later.")
+				return
+			}
+			authReq.Header = forwardAuthHeaders(r)
+
+			resp, err := client.Do(authReq)
+			if err != nil {
+				logg.Warn("Forward auth request failed", zap.String("address", *cfg.Address), zap.Error(err))
+				writeError(w, http.StatusBadGateway, "Authentication service not available", "Please try again later.")
+				return
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				for k, vv := range resp.Header {
+					w.Header()[k] = vv
+				}
+				// The body may be cut at forwardAuthBodyLimit, so let net/http work out the length.
+				for _, hop := range hopHeaders {
+					w.Header().Del(hop)
+				}
+				w.Header().Del("Content-Length")
+				w.WriteHeader(resp.StatusCode)
+				_, _ = io.Copy(w, io.LimitReader(resp.Body, forwardAuthBodyLimit))
+				return
+			}
+
+			r = r.Clone(r.Context())
+			for _, h := range copyHeaders {
+				r.Header.Del(h)
+				if vv := resp.Header.Values(h); len(vv) > 0 {
+					r.Header[h] = vv
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardAuthHeaders builds the auth subrequest's headers from the original request.
+func forwardAuthHeaders(r *http.Request) http.Header {
+	h := r.Header.Clone()
+	for _, hop := range hopHeaders {
+		h.Del(hop)
+	}
+	h.Del("Content-Length")
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	h.Set("X-Forwarded-Method", r.Method)
+	h.Set("X-Forwarded-Proto", proto)
+	h.Set("X-Forwarded-Host", r.Host)
+	h.Set("X-Forwarded-Uri", r.URL.RequestURI())
+
+	// From a trusted proxy, this appends the address the request came in from to the chain, like
+	// a proxy hop: the client is already in it. Anyone else's chain is just text the client sent,
+	// so it's replaced with the client's own address.
+	h.Del("X-Forwarded-For")
+	if clientip.TrustedPeer(r.Context()) {
+		if ip := clientip.Peer(r); ip != "" {
+			if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+				ip = strings.Join(prior, ", ") + ", " + ip
+			}
+			h.Set("X-Forwarded-For", ip)
+		}
+	} else if ip := clientip.FromRequest(r); ip != "" {
+		h.Set("X-Forwarded-For", ip)
+	}
+	return h
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/clientip"
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestForwardAuth(t *testing.T) {
+	var seen http.Header
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+		if r.Header.Get("Cookie") != "session=ok" {
+			w.Header().Set("Location", "https://login.example/")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		w.Header().Set("X-User", "alice")
+	}))
+	defer auth.Close()
+
+	address := auth.URL
+	timeout := time.Second
+	m := ForwardAuth(&config.ForwardAuthCfg{Address: &address, Timeout: &timeout, AuthResponseHeaders: []string{"X-User"}}, zaptest.NewLogger(t))
+
+	var upstream *http.Request
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { upstream = r }))
+
+	r := httptest.NewRequest("POST", "http://app.example/orders?id=1", nil)
+	r.Header.Set("Cookie", "session=ok")
+	r.Header.Set("X-User", "admin") // a client trying to pick its own identity
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || upstream == nil {
+		t.Fatalf("expected the request through, got %d", w.Code)
+	}
+	if got := upstream.Header.Values("X-User"); len(got) != 1 || got[0] != "alice" {
+		t.Errorf("expected X-User from the auth service only, got %v", got)
+	}
+	if seen.Get("X-Forwarded-Method") != "POST" || seen.Get("X-Forwarded-Uri") != "/orders?id=1" || seen.Get("X-Forwarded-Host") != "app.example" {
+		t.Errorf("unexpected forwarded headers on the auth request: %v", seen)
+	}
+
+	upstream = nil
+	r = httptest.NewRequest("GET", "http://app.example/", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if upstream != nil {
+		t.Fatal("expected the request to be stopped")
+	}
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://login.example/" {
+		t.Errorf("expected the auth service's redirect to reach the client, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestForwardAuth_UnreachableIsRefused(t *testing.T) {
+	auth := httptest.NewServer(http.NotFoundHandler())
+	address := auth.URL
+	auth.Close()
+
+	timeout := time.Second
+	h := ForwardAuth(&config.ForwardAuthCfg{Address: &address, Timeout: &timeout}, zaptest.NewLogger(t))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { t.Error("request must not go through") }))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", w.Code)
+	}
+}
+
+func TestForwardAuth_ForwardedForOnlyFromTrustedProxies(t *testing.T) {
+	var seen string
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("X-Forwarded-For")
+	}))
+	defer auth.Close()
+
+	res, err := clientip.NewResolver([]string{"10.0.0.0/8"}, "X-Forwarded-For")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := auth.URL
+	timeout := time.Second
+	h := ClientIP(res)(ForwardAuth(&config.ForwardAuthCfg{Address: &address, Timeout: &timeout}, zaptest.NewLogger(t))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	tests := []struct {
+		name   string
+		remote string
+		want   string
+	}{
+		{"untrusted peer with a forged chain", "203.0.113.7:4000", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.5:4000", "1.2.3.4, 10.0.0.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			r.Header.Set("X-Forwarded-For", "1.2.3.4")
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			if seen != tt.want {
+				t.Errorf("expected X-Forwarded-For %q on the auth request, got %q", tt.want, seen)
+			}
+		})
+	}
+}
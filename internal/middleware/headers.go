@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/asenalabs/asena/internal/clientip"
+	"github.com/asenalabs/asena/internal/config"
+)
+
+// headerVars are the placeholders a header value may use, e.g. "{client_ip}".
+var headerVars = map[string]bool{
+	"client_ip":  true,
+	"router":     true,
+	"request_id": true,
+}
+
+// Headers changes request headers on the way to the service and response headers on the way
+// back to the client. On each side, remove runs first, then set, then add, so a header can be
+// cleared and given a fresh value by the same middleware.
+//
+// Response changes are applied as the response leaves this middleware, after the proxy copied the
+// backend's headers and added its own defaults, so they always have the last word.
+func Headers(cfg *config.HeadersCfg) (Middleware, error) {
+	req, err := newHeaderOps(cfg.Request)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	resp, err := newHeaderOps(cfg.Response)
+	if err != nil {
+		return nil, fmt.Errorf("response: %w", err)
+	}
+	needID := req.usesRequestID || resp.usesRequestID
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			vars := templateVars{
+				clientIP: clientip.FromRequest(r),
+				router:   RouterName(r.Context()),
+			}
+			if needID {
+				r, vars.requestID = withRequestID(r)
+			}
+
+			if !req.empty() {
+				r2 := r.Clone(r.Context())
+				req.apply(r2.Header, vars)
+				if host := r2.Header.Get("Host"); host != "" {
+					// net/http ignores a "Host" entry in Header; the Host field is what gets sent.
+					r2.Host = host
+					r2.Header.Del("Host")
+				}
+				r = r2
+			}
+
+			if !resp.empty() {
+				w = &headerWriter{ResponseWriter: w, before: func(h http.Header, _ int) { resp.apply(h, vars) }}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// headerOps is one side (request or response) of a headers middleware, with every value
+// already parsed into a template.
+type headerOps struct {
+	remove        []string
+	set, add      map[string]headerTemplate
+	usesRequestID bool
+}
+
+func newHeaderOps(cfg *config.HeaderOpsCfg) (*headerOps, error) {
+	ops := &headerOps{}
+	if cfg == nil {
+		return ops, nil
+	}
+
+	for _, name := range cfg.Remove {
+		ops.remove = append(ops.remove, http.CanonicalHeaderKey(name))
+	}
+
+	var err error
+	if ops.set, err = ops.parse(cfg.Set); err != nil {
+		return nil, err
+	}
+	if ops.add, err = ops.parse(cfg.Add); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+func (o *headerOps) parse(values map[string]string) (map[string]headerTemplate, error) {
+	parsed := make(map[string]headerTemplate, len(values))
+	for name, value := range values {
+		t, err := parseHeaderTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("header %q: %w", name, err)
+		}
+		o.usesRequestID = o.usesRequestID || t.uses("request_id")
+		parsed[http.CanonicalHeaderKey(name)] = t
+	}
+	return parsed, nil
+}
+
+func (o *headerOps) empty() bool {
+	return len(o.remove) == 0 && len(o.set) == 0 && len(o.add) == 0
+}
+
+func (o *headerOps) apply(h http.Header, vars templateVars) {
+	for _, name := range o.remove {
+		h.Del(name)
+	}
+	for name, t := range o.set {
+		h.Set(name, t.render(vars))
+	}
+	for name, t := range o.add {
+		h.Add(name, t.render(vars))
+	}
+}
+
+type templateVars struct {
+	clientIP, router, requestID string
+}
+
+// headerTemplate is a header value cut into literal text and placeholders. Parsing happens once,
+// when the middleware is built, so a typo'd placeholder is caught and logged when the config loads,
+// not sent as a literal "{clinet_ip}" on every request.
+type headerTemplate []templatePart
+
+type templatePart struct {
+	text     string
+	variable string // set instead of text for a placeholder
+}
+
+func parseHeaderTemplate(s string) (headerTemplate, error) {
+	var t headerTemplate
+	for {
+		open := strings.IndexByte(s, '{')
+		if open == -1 {
+			break
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end == -1 {
+			break
+		}
+		name := s[open+1 : open+end]
+		if !headerVars[name] {
+			return nil, fmt.Errorf("unknown placeholder {%s} (supported: {client_ip}, {router}, {request_id})", name)
+		}
+		if open > 0 {
+			t = append(t, templatePart{text: s[:open]})
+		}
+		t = append(t, templatePart{variable: name})
+		s = s[open+end+1:]
+	}
+	if s != "" {
+		t = append(t, templatePart{text: s})
+	}
+	return t, nil
+}
+
+func (t headerTemplate) uses(variable string) bool {
+	for _, p := range t {
+		if p.variable == variable {
+			return true
+		}
+	}
+	return false
+}
+
+func (t headerTemplate) render(vars templateVars) string {
+	if len(t) == 1 && t[0].variable == "" {
+		return t[0].text
+	}
+
+	var b strings.Builder
+	for _, p := range t {
+		switch p.variable {
+		case "":
+			b.WriteString(p.text)
+		case "client_ip":
+			b.WriteString(vars.clientIP)
+		case "router":
+			b.WriteString(vars.router)
+		case "request_id":
+			b.WriteString(vars.requestID)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/asenalabs/asena/internal/config"
+)
+
+func TestHeaders_RequestAndResponse(t *testing.T) {
+	m, err := Headers(&config.HeadersCfg{
+		Request: &config.HeaderOpsCfg{
+			Set:    map[string]string{"X-Client": "ip={client_ip} via {router}"},
+			Remove: []string{"Cookie"},
+		},
+		Response: &config.HeaderOpsCfg{
+			Set:    map[string]string{"Content-Security-Policy": "frame-ancestors https://partner.example"},
+			Add:    map[string]string{"X-Request-Id": "{request_id}"},
+			Remove: []string{"X-Frame-Options"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var upstream *http.Request
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.5:4242"
+	r.Header.Set("Cookie", "session=1")
+	r.Header.Set("X-Request-Id", "abc")
+	r = r.WithContext(WithRouterName(r.Context(), "api"))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if got := upstream.Header.Get("X-Client"); got != "ip=203.0.113.5 via api" {
+		t.Errorf("expected templated request header, got %q", got)
+	}
+	if upstream.Header.Get("Cookie") != "" {
+		t.Error("expected Cookie to be removed before the request goes upstream")
+	}
+	if r.Header.Get("Cookie") == "" {
+		t.Error("expected the caller's request to be left untouched")
+	}
+
+	if w.Header().Get("X-Frame-Options") != "" {
+		t.Error("expected X-Frame-Options set by the backend to be removed")
+	}
+	if got := w.Header().Get("Content-Security-Policy"); got != "frame-ancestors https://partner.example" {
+		t.Errorf("unexpected Content-Security-Policy %q", got)
+	}
+	if got := w.Header().Get("X-Request-Id"); got != "abc" {
+		t.Errorf("expected the client's request ID to be reused, got %q", got)
+	}
+}
+
+func TestHeaders_GeneratedRequestIDMatchesBothSides(t *testing.T) {
+	m, err := Headers(&config.HeadersCfg{
+		Request:  &config.HeaderOpsCfg{Set: map[string]string{"X-Request-Id": "{request_id}"}},
+		Response: &config.HeaderOpsCfg{Set: map[string]string{"X-Request-Id": "{request_id}"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent string
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = r.Header.Get("X-Request-Id")
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if len(sent) != 32 || w.Header().Get("X-Request-Id") != sent {
+		t.Errorf("expected one generated ID on both sides, got request %q response %q", sent, w.Header().Get("X-Request-Id"))
+	}
+}
+
+func TestHeaders_SetHost(t *testing.T) {
+	m, err := Headers(&config.HeadersCfg{Request: &config.HeaderOpsCfg{Set: map[string]string{"Host": "internal.local"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var upstream *http.Request
+	m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { upstream = r })).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://a.com/", nil))
+
+	if upstream.Host != "internal.local" {
+		t.Errorf("expected Host to be rewritten, got %q", upstream.Host)
+	}
+}
+
+func TestParseHeaderTemplate(t *testing.T) {
+	if _, err := parseHeaderTemplate("{clinet_ip}"); err == nil || !strings.Contains(err.Error(), "unknown placeholder") {
+		t.Errorf("expected unknown placeholder error, got %v", err)
+	}
+
+	tmpl, err := parseHeaderTemplate("a {router} b {not closed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tmpl.render(templateVars{router: "r"}); got != "a r b {not closed" {
+		t.Errorf("unexpected render %q", got)
+	}
+}
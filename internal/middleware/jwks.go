@@ -0,0 +1,290 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// jwksFetchTimeout bounds one download of a remote JWKS.
+	jwksFetchTimeout = 10 * time.Second
+	// jwksMinRefetch is how soon a token with an unknown key ID may trigger another download. A
+	// client sending made-up key IDs then costs the identity provider one request per this long,
+	// not one per request.
+	jwksMinRefetch = 30 * time.Second
+	// jwksMaxSize caps how much of a JWKS document is read.
+	jwksMaxSize = 1 << 20 // 1 MiB
+)
+
+// jwtKey is one key a token may be signed with. kid and alg are empty for keys that don't say.
+type jwtKey struct {
+	kid string
+	alg string
+	key any // []byte, *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+}
+
+// jwk is the part of RFC 7517's JSON Web Key that describes signature keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// parseJWKS reads a JWK Set. Keys that are only for encryption ("use": "enc"), or of a type that
+// can't verify a JWT signature, are skipped rather than failing the whole set: a provider
+// publishing one exotic key should not break every token signed with the others.
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make([]jwtKey, 0, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS: key %d (kid %q): %w", i, k.Kid, err)
+		}
+		if key == nil {
+			continue
+		}
+		keys = append(keys, jwtKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	return keys, nil
+}
+
+// publicKey builds the verification key k describes, or returns nil for a key type it doesn't
+// know.
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %w", err)
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("unsupported RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("x is not an Ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("k is not a base64url secret")
+		}
+		return secret, nil
+	}
+	return nil, nil
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("not a base64url number")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// readKeyFile reads the public keys in a PEM file: "PUBLIC KEY" (PKIX), "RSA PUBLIC KEY" (PKCS#1)
+// and "CERTIFICATE" blocks. A private key is an error, not something to quietly use: it does not
+// belong on the proxy.
+func readKeyFile(path string) ([]jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []jwtKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key any
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			return nil, fmt.Errorf("%s: unexpected PEM block %q, only public keys and certificates are accepted", path, block.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, jwtKey{key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no PEM public key found", path)
+	}
+	return keys, nil
+}
+
+// remoteJWKS is a JWK Set downloaded from a URL and kept in memory. It is downloaded again every
+// refresh, and sooner when a token names a key ID it doesn't have yet (the provider rotated its
+// keys), but never more often than jwksMinRefetch.
+//
+// A failed download keeps the keys from the last good one.
+type remoteJWKS struct {
+	url     string
+	client  *http.Client
+	refresh time.Duration
+	// minRefetch is jwksMinRefetch, lowered by tests.
+	minRefetch time.Duration
+	logg       *zap.Logger
+
+	set atomic.Pointer[[]jwtKey]
+
+	mu        sync.Mutex
+	lastFetch time.Time
+}
+
+func newRemoteJWKS(url string, refresh time.Duration, logg *zap.Logger) *remoteJWKS {
+	s := &remoteJWKS{
+		url:        url,
+		client:     &http.Client{Timeout: jwksFetchTimeout},
+		refresh:    refresh,
+		minRefetch: jwksMinRefetch,
+		logg:       logg,
+	}
+	s.set.Store(&[]jwtKey{})
+	return s
+}
+
+// keys returns the keys from the last good download.
+func (s *remoteJWKS) keys() []jwtKey {
+	return *s.set.Load()
+}
+
+// fetch downloads the set. With force false, it does nothing if the last download was less than
+// minRefetch ago; a caller that was waiting for a download in progress then just uses its result.
+func (s *remoteJWKS) fetch(ctx context.Context, force bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !force && !s.lastFetch.IsZero() && time.Since(s.lastFetch) < s.minRefetch {
+		return
+	}
+	s.lastFetch = time.Now()
+
+	keys, err := s.download(ctx)
+	if err != nil {
+		s.logg.Warn("Failed to fetch JWKS, keeping the previous keys", zap.String("url", s.url), zap.Error(err))
+		return
+	}
+	s.set.Store(&keys)
+}
+
+func (s *remoteJWKS) download(ctx context.Context) ([]jwtKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// run downloads the set every refresh until ctx is done.
+func (s *remoteJWKS) run(ctx context.Context) {
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.fetch(ctx, true)
+		}
+	}
+}
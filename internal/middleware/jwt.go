@@ -0,0 +1,233 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/jwtclaims"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+// errNoJWTKey is returned when none of the configured keys can have signed a token.
+var errNoJWTKey = errors.New("no key matches the token's kid and alg")
+
+// jwtKeys is every key a jwt middleware accepts: the static ones (key_files and secret), the ones
+// in jwks_file, and the ones downloaded from jwks_url.
+type jwtKeys struct {
+	static []jwtKey
+	file   atomic.Pointer[[]jwtKey]
+	remote *remoteJWKS
+}
+
+// candidates returns the keys that could have signed a token with this kid and signing method.
+// A key with no kid of its own (a static key, or a JWK without one) is a candidate for any kid.
+func (k *jwtKeys) candidates(kid string, method jwt.SigningMethod) []jwt.VerificationKey {
+	var found []jwt.VerificationKey
+	add := func(keys []jwtKey) {
+		for _, key := range keys {
+			if kid != "" && key.kid != "" && key.kid != kid {
+				continue
+			}
+			if key.alg != "" && key.alg != method.Alg() {
+				continue
+			}
+			if keyFits(key.key, method) {
+				found = append(found, key.key)
+			}
+		}
+	}
+
+	add(k.static)
+	if file := k.file.Load(); file != nil {
+		add(*file)
+	}
+	if k.remote != nil {
+		add(k.remote.keys())
+	}
+	return found
+}
+
+// keyFits reports whether key is the kind of key method verifies with. This is what stops a token
+// that claims HS256 from being checked with an RSA public key used as an HMAC secret.
+func keyFits(key any, method jwt.SigningMethod) bool {
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		_, ok := key.([]byte)
+		return ok
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodECDSA:
+		_, ok := key.(*ecdsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodEd25519:
+		_, ok := key.(ed25519.PublicKey)
+		return ok
+	}
+	return false
+}
+
+// JWT lets a request through only with a valid bearer token in its Authorization header. The
+// signature is checked against the configured keys, exp must be set and not passed, nbf must have
+// passed, and iss, aud and required_claims must match when they are set.
+//
+// Keys come from key_files (PEM public keys or certificates), secret (HMAC), jwks_file (read again
+// when it changes) and jwks_url (downloaded every jwks_refresh, and sooner when a token names a key
+// ID it hasn't seen, so a key rotation at the provider is picked up without waiting). Background
+// work stops when ctx is done.
+//
+// The claims listed in forward_claims are sent to the service as headers. Those headers are always
+// removed from the client's request first, so a client can't set them itself.
+//
+// A request without a valid token is answered 401 with a WWW-Authenticate: Bearer challenge, and
+// never reaches the service.
+func JWT(ctx context.Context, cfg *config.JWTCfg, logg *zap.Logger) (Middleware, error) {
+	keys := &jwtKeys{}
+	for _, path := range cfg.KeyFiles {
+		fileKeys, err := readKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keys.static = append(keys.static, fileKeys...)
+	}
+	if cfg.Secret != nil && *cfg.Secret != "" {
+		keys.static = append(keys.static, jwtKey{key: []byte(*cfg.Secret)})
+	}
+
+	if cfg.JWKSFile != nil {
+		path := *cfg.JWKSFile
+		load := func() error {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			fileKeys, err := parseJWKS(data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			keys.file.Store(&fileKeys)
+			return nil
+		}
+		if err := load(); err != nil {
+			return nil, err
+		}
+		err := watchFile(ctx, path, func() {
+			if err := load(); err != nil {
+				logg.Error("Failed to reload jwks_file, keeping the previous keys", zap.Error(err))
+				return
+			}
+			logg.Info("Reloaded jwks_file", zap.String("path", path))
+		}, logg)
+		if err != nil {
+			return nil, fmt.Errorf("watch %s: %w", path, err)
+		}
+	}
+
+	if cfg.JWKSURL != nil {
+		// The first download happens in the background so a slow identity provider doesn't hold up
+		// the reload. Requests that arrive before it's done wait for it in keyfunc below.
+		keys.remote = newRemoteJWKS(*cfg.JWKSURL, *cfg.JWKSRefresh, logg)
+		go func() {
+			keys.remote.fetch(ctx, false)
+			keys.remote.run(ctx)
+		}()
+	}
+
+	keyfunc := func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		found := keys.candidates(kid, token.Method)
+		if len(found) == 0 && keys.remote != nil {
+			keys.remote.fetch(ctx, false)
+			found = keys.candidates(kid, token.Method)
+		}
+		if len(found) == 0 {
+			return nil, errNoJWTKey
+		}
+		return jwt.VerificationKeySet{Keys: found}, nil
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(*cfg.Leeway),
+		jwt.WithJSONNumber(),
+	}
+	if len(cfg.Algorithms) > 0 {
+		opts = append(opts, jwt.WithValidMethods(cfg.Algorithms))
+	}
+	if cfg.Issuer != nil {
+		opts = append(opts, jwt.WithIssuer(*cfg.Issuer))
+	}
+	if len(cfg.Audience) > 0 {
+		opts = append(opts, jwt.WithAudience(cfg.Audience...))
+	}
+	parser := jwt.NewParser(opts...)
+
+	forward := make(map[string]string, len(cfg.ForwardClaims))
+	for claim, header := range cfg.ForwardClaims {
+		forward[claim] = http.CanonicalHeaderKey(header)
+	}
+
+	challenge := fmt.Sprintf("Bearer realm=%q", *cfg.Realm)
+	reject := func(w http.ResponseWriter, description string) {
+		if description == "" {
+			// RFC 6750: a request with no token at all gets no error code.
+			w.Header().Set("WWW-Authenticate", challenge)
+		} else {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("%s, error=\"invalid_token\", error_description=%q", challenge, description))
+		}
+		writeError(w, http.StatusUnauthorized, "Unauthorized", "A valid bearer token is required.")
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw := jwtclaims.BearerToken(r)
+			if raw == "" {
+				reject(w, "")
+				return
+			}
+
+			claims := jwt.MapClaims{}
+			if _, err := parser.ParseWithClaims(raw, claims, keyfunc); err != nil {
+				logg.Debug("Rejected JWT", zap.String("router", RouterName(r.Context())), zap.Error(err))
+				if errors.Is(err, jwt.ErrTokenExpired) {
+					reject(w, "The access token expired")
+				} else {
+					reject(w, "The access token is invalid")
+				}
+				return
+			}
+
+			for name, want := range cfg.RequiredClaims {
+				ok := jwtclaims.Has(claims, name, want)
+				if want == "" {
+					_, ok = jwtclaims.Lookup(claims, name)
+				}
+				if !ok {
+					logg.Debug("Rejected JWT without a required claim", zap.String("router", RouterName(r.Context())), zap.String("claim", name))
+					reject(w, "The access token is missing a required claim")
+					return
+				}
+			}
+
+			if len(forward) > 0 {
+				r = r.Clone(r.Context())
+				for claim, header := range forward {
+					r.Header.Del(header)
+					if v, ok := jwtclaims.Lookup(claims, claim); ok {
+						r.Header.Set(header, jwtclaims.String(v))
+					}
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
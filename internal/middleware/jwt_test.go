@@ -0,0 +1,236 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap/zaptest"
+)
+
+func rsaKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// jwksServer serves the public halves of keys, by kid, as a JWK Set. set replaces them.
+func jwksServer(t *testing.T, keys map[string]*rsa.PrivateKey) (srv *httptest.Server, set func(map[string]*rsa.PrivateKey)) {
+	var mu sync.Mutex
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var out struct {
+			Keys []map[string]string `json:"keys"`
+		}
+		for kid, k := range keys {
+			out.Keys = append(out.Keys, map[string]string{
+				"kty": "RSA", "use": "sig", "alg": "RS256", "kid": kid,
+				"n": base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func(next map[string]*rsa.PrivateKey) {
+		mu.Lock()
+		keys = next
+		mu.Unlock()
+	}
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func sendBearer(h http.Handler, token string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	for k, vv := range header {
+		r.Header[k] = vv
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func jwtCfg(mutate func(*config.JWTCfg)) *config.JWTCfg {
+	refresh, leeway, realm := time.Hour, time.Duration(0), "asena"
+	cfg := &config.JWTCfg{JWKSRefresh: &refresh, Leeway: &leeway, Realm: &realm}
+	mutate(cfg)
+	return cfg
+}
+
+func TestJWT_JWKSURL(t *testing.T) {
+	key, other := rsaKey(t), rsaKey(t)
+	srv, _ := jwksServer(t, map[string]*rsa.PrivateKey{"k1": key})
+
+	issuer := "https://id.example"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m, err := JWT(ctx, jwtCfg(func(c *config.JWTCfg) {
+		c.JWKSURL = &srv.URL
+		c.Issuer = &issuer
+		c.Audience = []string{"api"}
+		c.RequiredClaims = map[string]string{"role": "admin"}
+		c.ForwardClaims = map[string]string{"sub": "X-User", "role": "X-Roles"}
+	}), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var upstream *http.Request
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { upstream = r }))
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "alice", "iss": issuer, "aud": "api", "role": []any{"user", "admin"},
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+	}
+
+	w := sendBearer(h, signRS256(t, key, "k1", valid()), http.Header{"X-User": {"mallory"}})
+	if w.Code != http.StatusOK || upstream == nil {
+		t.Fatalf("expected a valid token through, got %d %s", w.Code, w.Body)
+	}
+	if got := upstream.Header.Values("X-User"); len(got) != 1 || got[0] != "alice" {
+		t.Errorf("expected X-User from the token only, got %v", got)
+	}
+	if got := upstream.Header.Get("X-Roles"); got != "user,admin" {
+		t.Errorf("expected the roles list joined, got %q", got)
+	}
+
+	w = sendBearer(h, "", nil)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer realm="asena"` {
+		t.Errorf("expected a bare challenge without a token, got %d %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	rejected := map[string]func(c jwt.MapClaims) (string, string){
+		"expired": func(c jwt.MapClaims) (string, string) {
+			c["exp"] = time.Now().Add(-time.Minute).Unix()
+			return signRS256(t, key, "k1", c), "expired"
+		},
+		"no exp": func(c jwt.MapClaims) (string, string) {
+			delete(c, "exp")
+			return signRS256(t, key, "k1", c), "invalid"
+		},
+		"not yet valid": func(c jwt.MapClaims) (string, string) {
+			c["nbf"] = time.Now().Add(time.Minute).Unix()
+			return signRS256(t, key, "k1", c), "invalid"
+		},
+		"wrong issuer": func(c jwt.MapClaims) (string, string) {
+			c["iss"] = "https://evil.example"
+			return signRS256(t, key, "k1", c), "invalid"
+		},
+		"wrong audience": func(c jwt.MapClaims) (string, string) {
+			c["aud"] = "billing"
+			return signRS256(t, key, "k1", c), "invalid"
+		},
+		"missing required claim": func(c jwt.MapClaims) (string, string) {
+			c["role"] = "user"
+			return signRS256(t, key, "k1", c), "required claim"
+		},
+		"unknown key": func(c jwt.MapClaims) (string, string) {
+			return signRS256(t, other, "k1", c), "invalid"
+		},
+	}
+	for name, mk := range rejected {
+		upstream = nil
+		token, want := mk(valid())
+		w := sendBearer(h, token, nil)
+		if w.Code != http.StatusUnauthorized || upstream != nil {
+			t.Errorf("%s: expected 401, got %d", name, w.Code)
+			continue
+		}
+		if got := w.Header().Get("WWW-Authenticate"); !strings.Contains(got, `error="invalid_token"`) || !strings.Contains(got, want) {
+			t.Errorf("%s: unexpected challenge %q", name, got)
+		}
+	}
+}
+
+func TestJWT_RejectsHMACTokenSignedWithThePublicKey(t *testing.T) {
+	key := rsaKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pub, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := JWT(context.Background(), jwtCfg(func(c *config.JWTCfg) { c.KeyFiles = []string{path} }), zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	claims := jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Minute).Unix()}
+	if w := sendBearer(h, signRS256(t, key, "", claims), nil); w.Code != http.StatusOK {
+		t.Fatalf("expected an RS256 token through, got %d", w.Code)
+	}
+
+	// The public key is public, so anyone can use its bytes as an HMAC secret.
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := sendBearer(h, forged, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected an HS256 token signed with the public key to be rejected, got %d", w.Code)
+	}
+}
+
+func TestRemoteJWKS_RefetchesForUnknownKeyAtMostEveryMinRefetch(t *testing.T) {
+	oldKey, newKey := rsaKey(t), rsaKey(t)
+	srv, set := jwksServer(t, map[string]*rsa.PrivateKey{"old": oldKey})
+
+	s := newRemoteJWKS(srv.URL, time.Hour, zaptest.NewLogger(t))
+	s.fetch(context.Background(), false)
+	set(map[string]*rsa.PrivateKey{"new": newKey})
+
+	keys := &jwtKeys{remote: s}
+	s.fetch(context.Background(), false)
+	if len(keys.candidates("new", jwt.SigningMethodRS256)) != 0 {
+		t.Fatal("expected no download within minRefetch of the last one")
+	}
+
+	s.minRefetch = 0
+	s.fetch(context.Background(), false)
+	if len(keys.candidates("new", jwt.SigningMethodRS256)) != 1 {
+		t.Error("expected the rotated key after a new download")
+	}
+	if len(keys.candidates("old", jwt.SigningMethodRS256)) != 0 {
+		t.Error("expected the old key to be gone")
+	}
+}
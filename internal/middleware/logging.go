@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/asenalabs/asena/internal/clientip"
 	"go.uber.org/zap"
 )
 
@@ -15,9 +16,11 @@ func Logging(log *zap.Logger) Middleware {
 			next.ServeHTTP(w, r)
 
 			log.Info("request",
+				zap.String("entrypoint", EntrypointName(r.Context())),
 				zap.String("method", r.Method),
 				zap.String("path", r.URL.Path),
 				zap.String("remote_addr", r.RemoteAddr),
+				zap.String("client_ip", clientip.FromRequest(r)),
 				zap.String("user_agent", r.UserAgent()),
 				zap.Duration("latency", time.Since(start)),
 			)
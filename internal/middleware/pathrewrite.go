@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// StripPrefix removes a prefix from the request path before the request reaches the service, for a
+// backend that expects to be mounted at "/" but is routed to under, say, "/billing". The prefix is
+// passed on in X-Forwarded-Prefix, so the backend can still build links that work from outside.
+//
+// When more than one prefix matches, the longest one is stripped. Matching works like the PathPrefix
+// rule matcher: a plain string prefix of the decoded path. A path that matches none is left alone.
+func StripPrefix(prefixes []string) Middleware {
+	sorted := slices.Clone(prefixes)
+	slices.SortStableFunc(sorted, func(a, b string) int { return len(b) - len(a) })
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, prefix := range sorted {
+				if !strings.HasPrefix(r.URL.Path, prefix) {
+					continue
+				}
+
+				path := ensureLeadingSlash(r.URL.Path[len(prefix):])
+				rawPath := ensureLeadingSlash(trimEscaped(r.URL.EscapedPath(), len(prefix)))
+				r = withPath(r, path, rawPath)
+				r.Header.Set("X-Forwarded-Prefix", prefix)
+				break
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AddPrefix puts prefix in front of the request path, for a backend that serves everything
+// under a fixed path the public URL doesn't have.
+func AddPrefix(prefix string) Middleware {
+	prefix = strings.TrimSuffix(prefix, "/")
+	escapedPrefix := (&url.URL{Path: prefix}).EscapedPath()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = withPath(r, prefix+ensureLeadingSlash(r.URL.Path), escapedPrefix+ensureLeadingSlash(r.URL.EscapedPath()))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ReplacePathRegex rewrites the request path with re and replacement, which can refer to capture
+// groups as $1 or ${name}. A path re doesn't match is left alone.
+//
+// The regex runs on the path as the client sent it, still percent-encoded. That's the only form
+// that keeps an encoded "/" (%2F) apart from a real one; the decoded path is worked out from the
+// result afterwards.
+func ReplacePathRegex(re *regexp.Regexp, replacement string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			escaped := r.URL.EscapedPath()
+			if !re.MatchString(escaped) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rawPath := ensureLeadingSlash(re.ReplaceAllString(escaped, replacement))
+			path, err := url.PathUnescape(rawPath)
+			if err != nil {
+				http.Error(w, "400 bad request", http.StatusBadRequest)
+				return
+			}
+
+			next.ServeHTTP(w, withPath(r, path, rawPath))
+		})
+	}
+}
+
+// withPath returns a shallow copy of r with a new path, in both its decoded and escaped form. The
+// URL and headers are copied too, so the caller's request is never changed underneath it.
+//
+// RawPath is only kept when it differs from the default encoding of path, the same rule net/url
+// itself follows, so a plain path doesn't end up with a redundant RawPath.
+func withPath(r *http.Request, path, rawPath string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.Header = r.Header.Clone()
+
+	r2.URL.Path = path
+	r2.URL.RawPath = ""
+	if rawPath != r2.URL.EscapedPath() {
+		r2.URL.RawPath = rawPath
+	}
+	return r2
+}
+
+// trimEscaped drops the first n decoded bytes from an escaped path, where each %XX is one
+// decoded byte. It's how StripPrefix finds where the prefix ends in RawPath, which it can't
+// just cut at len(prefix) when the prefix itself has escaped characters in it.
+func trimEscaped(escaped string, n int) string {
+	i := 0
+	for ; n > 0 && i < len(escaped); n-- {
+		if escaped[i] == '%' && i+2 < len(escaped) {
+			i += 3
+		} else {
+			i++
+		}
+	}
+	return escaped[i:]
+}
+
+func ensureLeadingSlash(p string) string {
+	if strings.HasPrefix(p, "/") {
+		return p
+	}
+	return "/" + p
+}
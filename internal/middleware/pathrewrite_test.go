@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+// capture runs m on a request for target and returns the request the next handler got.
+func capture(t *testing.T, m Middleware, target string) (*http.Request, *httptest.ResponseRecorder) {
+	t.Helper()
+
+	var got *http.Request
+	h := m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r }))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	return got, w
+}
+
+func TestStripPrefix(t *testing.T) {
+	tests := []struct {
+		name, target, wantPath, wantEscaped, wantPrefix string
+	}{
+		{"strips prefix", "/billing/invoices", "/invoices", "/invoices", "/billing"},
+		{"whole path becomes root", "/billing", "/", "/", "/billing"},
+		{"longest prefix wins", "/billing/v2/invoices", "/invoices", "/invoices", "/billing/v2"},
+		{"keeps encoded slash", "/billing/a%2Fb", "/a/b", "/a%2Fb", "/billing"},
+		{"no match left alone", "/orders/1", "/orders/1", "/orders/1", ""},
+	}
+
+	m := StripPrefix([]string{"/billing", "/billing/v2"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := capture(t, m, tt.target)
+			if got.URL.Path != tt.wantPath || got.URL.EscapedPath() != tt.wantEscaped {
+				t.Errorf("expected path %q (escaped %q), got %q (escaped %q)", tt.wantPath, tt.wantEscaped, got.URL.Path, got.URL.EscapedPath())
+			}
+			if p := got.Header.Get("X-Forwarded-Prefix"); p != tt.wantPrefix {
+				t.Errorf("expected X-Forwarded-Prefix %q, got %q", tt.wantPrefix, p)
+			}
+		})
+	}
+}
+
+func TestStripPrefix_EncodedPrefix(t *testing.T) {
+	// "/a b" is 4 decoded bytes but 6 escaped ones; RawPath must be cut after the %20, not at 4.
+	got, _ := capture(t, StripPrefix([]string{"/a b"}), "/a%20b/x%2Fy")
+	if got.URL.Path != "/x/y" || got.URL.EscapedPath() != "/x%2Fy" {
+		t.Errorf("expected /x/y (escaped /x%%2Fy), got %q (escaped %q)", got.URL.Path, got.URL.EscapedPath())
+	}
+}
+
+func TestAddPrefix(t *testing.T) {
+	got, _ := capture(t, AddPrefix("/api/"), "/users/a%2Fb")
+	if got.URL.Path != "/api/users/a/b" || got.URL.EscapedPath() != "/api/users/a%2Fb" {
+		t.Errorf("expected /api/users/a/b (escaped /api/users/a%%2Fb), got %q (escaped %q)", got.URL.Path, got.URL.EscapedPath())
+	}
+}
+
+func TestReplacePathRegex(t *testing.T) {
+	m := ReplacePathRegex(regexp.MustCompile(`^/v1/users/(\d+)$`), "/users/$1/profile")
+
+	got, _ := capture(t, m, "/v1/users/42")
+	if got.URL.Path != "/users/42/profile" {
+		t.Errorf("expected /users/42/profile, got %q", got.URL.Path)
+	}
+
+	got, _ = capture(t, m, "/v1/orders/42")
+	if got.URL.Path != "/v1/orders/42" {
+		t.Errorf("expected a non-matching path to be left alone, got %q", got.URL.Path)
+	}
+}
+
+func TestReplacePathRegex_InvalidResult(t *testing.T) {
+	m := ReplacePathRegex(regexp.MustCompile(`^/x$`), "/%zz")
+
+	got, w := capture(t, m, "/x")
+	if got != nil || w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a replacement that isn't a valid escaped path, got %d", w.Code)
+	}
+}
+
+func TestStripPrefix_DoesNotChangeCallersRequest(t *testing.T) {
+	var next *http.Request
+	h := StripPrefix([]string{"/billing"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { next = r }))
+
+	r := httptest.NewRequest("GET", "/billing/x", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if r.URL.Path != "/billing/x" || r.Header.Get("X-Forwarded-Prefix") != "" {
+		t.Errorf("expected the original request to be untouched, got path %q", r.URL.Path)
+	}
+	if next.URL.Path != "/x" {
+		t.Errorf("expected /x downstream, got %q", next.URL.Path)
+	}
+}
@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/asenalabs/asena/internal/clientip"
+	"github.com/asenalabs/asena/internal/config"
+)
+
+// tokenBucket holds up to burst tokens and refills at rate tokens per second. Each request takes one.
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitMaxKeys caps how many buckets a rate limiter keeps, whatever keys clients send.
+const rateLimitMaxKeys = 100_000
+
+// rateLimiter keeps one token bucket per key.
+//
+// A bucket that has been idle long enough to refill completely is exactly the same as a new one,
+// so the sweeper drops those. Memory then only grows with the number of keys that were active
+// within one refill time, whatever the total number of clients. Past maxKeys, the bucket used
+// longest ago makes room for the new one: it's the one closest to full, so dropping it lets the
+// least through.
+type rateLimiter struct {
+	rate    float64 // tokens per second
+	burst   float64
+	maxKeys int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// lru holds the buckets, the most recently used first.
+	lru *list.List
+
+	now func() time.Time
+}
+
+func newRateLimiter(average float64, period time.Duration, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    average / period.Seconds(),
+		burst:   float64(burst),
+		maxKeys: rateLimitMaxKeys,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// take takes a token from key's bucket. It reports whether there was one, how many whole tokens
+// are left, and how long until the next token (retryAfter) and until the bucket is full (reset).
+func (l *rateLimiter) take(key string) (ok bool, remaining int, retryAfter, reset time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var b *tokenBucket
+	if e, found := l.buckets[key]; found {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*tokenBucket)
+	} else {
+		if l.lru.Len() >= l.maxKeys {
+			l.remove(l.lru.Back())
+		}
+		b = &tokenBucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		retryAfter = l.seconds(1 - b.tokens)
+	}
+	return ok, int(b.tokens), retryAfter, l.seconds(l.burst - b.tokens)
+}
+
+func (l *rateLimiter) remove(e *list.Element) {
+	l.lru.Remove(e)
+	delete(l.buckets, e.Value.(*tokenBucket).key)
+}
+
+// seconds is how long it takes to refill n tokens.
+func (l *rateLimiter) seconds(n float64) time.Duration {
+	return time.Duration(n / l.rate * float64(time.Second))
+}
+
+// sweep drops every bucket that has had time to refill completely since it was last used.
+func (l *rateLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	full := l.seconds(l.burst)
+	// The list is in order of use, so the full buckets are all at the back.
+	for e := l.lru.Back(); e != nil && now.Sub(e.Value.(*tokenBucket).last) >= full; e = l.lru.Back() {
+		l.remove(e)
+	}
+}
+
+// run sweeps once per refill time (at least once a second) until ctx is done.
+func (l *rateLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(max(l.seconds(l.burst), time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.sweep()
+		}
+	}
+}
+
+// RateLimit allows each key average requests per period, with bursts of up to burst requests. The
+// key is the client IP, the value of a header (falling back to the client IP when the header is
+// missing, so leaving it out is no way around the limit), or the matched router. A client that can
+// pick its own header value gets a fresh bucket for each one, so a header key only limits clients
+// when something in front, like forward_auth or jwt, vouches for the value.
+//
+// Every answer carries RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset. A request over the
+// limit is answered 429 with Retry-After, and never reaches the service.
+//
+// The buckets are swept until ctx is done.
+func RateLimit(ctx context.Context, cfg *config.RateLimitCfg) Middleware {
+	limiter := newRateLimiter(*cfg.Average, *cfg.Period, *cfg.Burst)
+	go limiter.run(ctx)
+
+	key := rateLimitKey(cfg)
+	limit := strconv.Itoa(*cfg.Burst)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, remaining, retryAfter, reset := limiter.take(key(r))
+
+			h := w.Header()
+			h.Set("RateLimit-Limit", limit)
+			h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			h.Set("RateLimit-Reset", ceilSeconds(reset))
+
+			if !ok {
+				h.Set("Retry-After", ceilSeconds(retryAfter))
+				writeError(w, http.StatusTooManyRequests, "Too many requests", "Please try again later.")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func rateLimitKey(cfg *config.RateLimitCfg) func(r *http.Request) string {
+	switch *cfg.Key {
+	case config.RateLimitKeyRouter:
+		return func(r *http.Request) string { return RouterName(r.Context()) }
+	case config.RateLimitKeyHeader:
+		name := http.CanonicalHeaderKey(*cfg.Header)
+		return func(r *http.Request) string {
+			if v := r.Header.Get(name); v != "" {
+				return "h:" + v
+			}
+			return "ip:" + clientip.FromRequest(r)
+		}
+	default:
+		return clientip.FromRequest
+	}
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+)
+
+// testLimiter returns a limiter whose clock only moves when the test moves it.
+func testLimiter(average float64, period time.Duration, burst int) (*rateLimiter, *time.Time) {
+	l := newRateLimiter(average, period, burst)
+	now := time.Unix(1_000_000, 0)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestRateLimiter_BurstThenRefill(t *testing.T) {
+	l, now := testLimiter(2, time.Second, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, _, _, _ := l.take("a"); !ok {
+			t.Fatalf("request %d: expected the burst to allow it", i)
+		}
+	}
+
+	ok, remaining, retryAfter, _ := l.take("a")
+	if ok || remaining != 0 {
+		t.Fatalf("expected the 4th request to be limited, got ok=%v remaining=%d", ok, remaining)
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Errorf("expected a token after 500ms at 2/s, got %v", retryAfter)
+	}
+
+	if ok, _, _, _ := l.take("b"); !ok {
+		t.Error("expected another key to have its own bucket")
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if ok, _, _, _ := l.take("a"); !ok {
+		t.Error("expected one token to have refilled")
+	}
+}
+
+func TestRateLimiter_SweepDropsOnlyFullBuckets(t *testing.T) {
+	l, now := testLimiter(1, time.Second, 2)
+
+	l.take("idle")
+	*now = now.Add(1500 * time.Millisecond)
+	l.take("busy")
+	*now = now.Add(600 * time.Millisecond)
+	l.sweep()
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("expected the bucket that had time to refill to be dropped")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("expected the recently used bucket to be kept")
+	}
+}
+
+func TestRateLimiter_EvictsLeastRecentlyUsedPastMaxKeys(t *testing.T) {
+	l, now := testLimiter(1, time.Second, 2)
+	l.maxKeys = 2
+
+	l.take("a")
+	*now = now.Add(100 * time.Millisecond)
+	l.take("b")
+	l.take("a")
+	l.take("c")
+
+	if len(l.buckets) != 2 {
+		t.Fatalf("expected the buckets to stay at maxKeys, got %d", len(l.buckets))
+	}
+	if _, ok := l.buckets["b"]; ok {
+		t.Error("expected the bucket used longest ago to make room")
+	}
+	if ok, _, _, _ := l.take("a"); ok {
+		t.Error("expected the busy bucket to be kept, and empty")
+	}
+}
+
+func TestRateLimit_Answers429WithHeaders(t *testing.T) {
+	average, burst := 1.0, 1
+	period := time.Minute
+	key := config.RateLimitKeyHeader
+	header := "X-Api-Key"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := RateLimit(ctx, &config.RateLimitCfg{Average: &average, Period: &period, Burst: &burst, Key: &key, Header: &header})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(apiKey string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		if apiKey != "" {
+			r.Header.Set("X-Api-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := send("k1"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("expected the first request through with RateLimit headers, got %d %v", w.Code, w.Header())
+	}
+
+	w := send("k1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected Retry-After: 60, got %q", w.Header().Get("Retry-After"))
+	}
+
+	if w := send("k2"); w.Code != http.StatusOK {
+		t.Errorf("expected a different key to be allowed, got %d", w.Code)
+	}
+	if w := send(""); w.Code != http.StatusOK {
+		t.Errorf("expected a request without the header to fall back to its client IP, got %d", w.Code)
+	}
+}
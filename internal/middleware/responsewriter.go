@@ -0,0 +1,44 @@
+package middleware
+
+import "net/http"
+
+// headerWriter is a ResponseWriter that calls before on the response headers right before they're
+// sent, once, whichever of WriteHeader, Write or Flush comes first. It's how a middleware changes
+// headers that the proxy (or ModifyResponse) has already set by the time the response comes back
+// through the chain.
+//
+// 1xx informational responses pass straight through; before only sees the final status.
+//
+// Unwrap lets http.ResponseController reach the underlying writer, so hijacking for WebSocket
+// upgrades keeps working through the wrapper.
+type headerWriter struct {
+	http.ResponseWriter
+	before      func(h http.Header, code int)
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= http.StatusOK {
+		w.wroteHeader = true
+		w.before(w.Header(), code)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
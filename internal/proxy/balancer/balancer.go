@@ -1,9 +1,12 @@
 package balancer
 
 import (
+	"net"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/asenalabs/asena/internal/clientip"
 	"github.com/asenalabs/asena/internal/config"
 )
 
@@ -33,6 +36,39 @@ type StickyCookieSetter interface {
 	SetStickyCookie(header http.Header, server *config.ServerCfg)
 }
 
+// Retrier is an optional capability for picking a server for another attempt at a request that
+// already failed, on a server it hasn't tried yet.
+//
+// A retry pick is kept apart from Next/Done on purpose: most algorithms are deterministic about
+// a given moment (Least Connections picks the least busy server, IP Hash the same server for the
+// same client), so asking Next again would mostly return the server that just failed. A retry pick
+// is also not counted by the algorithm, so its result must be reported with DoneRetry, not Done -
+// otherwise Least Connections would release a slot it never took.
+type Retrier interface {
+	NextRetry(r *http.Request, tried []*config.ServerCfg) *config.ServerCfg
+	DoneRetry(server *config.ServerCfg, drtn time.Duration, err error)
+}
+
+// ClientRequest returns the request to pass to Next for a client that isn't an HTTP request, like a
+// TCP connection or a UDP datagram: one that carries nothing but the client's address. The IP is put
+// on its context, where IP Hash and Consistent Hash read it from, the same as behind trusted proxies,
+// and Sticky Sessions finds no cookie and picks like Round Robin.
+func ClientRequest(addr net.Addr) *http.Request {
+	r := &http.Request{Header: make(http.Header), URL: &url.URL{}}
+	if addr == nil {
+		return r
+	}
+	r.RemoteAddr = addr.String()
+	ip := clientip.Peer(r)
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP.String()
+	case *net.UDPAddr:
+		ip = a.IP.String()
+	}
+	return r.WithContext(clientip.NewContext(r.Context(), ip))
+}
+
 func New(algorithm string, servers []*config.ServerCfg) Balancer {
 	switch algorithm {
 	case config.RoundRobin:
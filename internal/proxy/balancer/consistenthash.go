@@ -8,6 +8,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/asenalabs/asena/internal/clientip"
 	"github.com/asenalabs/asena/internal/config"
 )
 
@@ -70,14 +71,14 @@ func NewConsistentHash(servers []*config.ServerCfg) *ConsistentHash {
 	return ch
 }
 
-// Next hashes the client's IP (same extraction logic as IPHash - see clientIP in iphash.go) onto the ring,
+// Next hashes the client's IP (same extraction logic as IPHash - see package clientip) onto the ring,
 // then finds the nearest server point clockwise from it via binary search.
 func (ch *ConsistentHash) Next(r *http.Request) *config.ServerCfg {
 	if len(ch.ring) == 0 {
 		return nil
 	}
 
-	ip := clientIP(r)
+	ip := clientip.FromRequest(r)
 	if ip == "" {
 		l := uint64(len(ch.servers))
 		if l == 0 {
@@ -2,11 +2,11 @@ package balancer
 
 import (
 	"hash/fnv"
-	"net"
 	"net/http"
 	"sync/atomic"
 	"time"
 
+	"github.com/asenalabs/asena/internal/clientip"
 	"github.com/asenalabs/asena/internal/config"
 )
 
@@ -40,7 +40,7 @@ func (ih *IPHash) Next(r *http.Request) *config.ServerCfg {
 		return nil
 	}
 
-	ip := clientIP(r)
+	ip := clientip.FromRequest(r)
 	if ip == "" {
 		pos := atomic.AddUint64(&ih.fallback, 1)
 		return ih.servers[pos%uint64(l)]
@@ -54,19 +54,3 @@ func (ih *IPHash) Next(r *http.Request) *config.ServerCfg {
 // Done is a no-op: IP Hash doesn't track connections or response time, it
 // deterministically maps clients to servers based on IP alone.
 func (ih *IPHash) Done(server *config.ServerCfg, duration time.Duration, err error) {}
-
-// clientIP extracts just the IP portion (no port) from a request's
-// RemoteAddr. Returns "" if r is nil or no address is available at all.
-func clientIP(r *http.Request) string {
-	if r == nil || r.RemoteAddr == "" {
-		return ""
-	}
-
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		// No port to strip, for whatever reason - use the raw value
-		// rather than failing outright. Still deterministic.
-		return r.RemoteAddr
-	}
-	return host
-}
@@ -1,6 +1,7 @@
 package balancer
 
 import (
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -104,3 +105,19 @@ func TestIPHash_UnparseableRemoteAddrStillDeterministic(t *testing.T) {
 	require.NotNil(t, first)
 	require.Equal(t, *first.URL, *second.URL)
 }
+
+func TestIPHash_ClientRequestHashesTheIPOnly(t *testing.T) {
+	servers := []*config.ServerCfg{
+		{URL: strPtr("s1")}, {URL: strPtr("s2")}, {URL: strPtr("s3")},
+	}
+	ih := NewIPHash(servers)
+
+	want := ih.Next(reqFromIP("203.0.113.10:5555"))
+	for _, addr := range []net.Addr{
+		&net.UDPAddr{IP: net.ParseIP("203.0.113.10"), Port: 53},
+		&net.TCPAddr{IP: net.ParseIP("203.0.113.10"), Port: 5432},
+	} {
+		got := ih.Next(ClientRequest(addr))
+		require.Equal(t, *want.URL, *got.URL, "%s", addr)
+	}
+}
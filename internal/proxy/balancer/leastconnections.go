@@ -85,3 +85,12 @@ func (lc *LeastConnections) Done(server *config.ServerCfg, drtn time.Duration, e
 	}
 	cs.active--
 }
+
+func (lc *LeastConnections) setActive(server *config.ServerCfg, n int64) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if cs, ok := lc.byServer[server]; ok {
+		cs.active = n
+	}
+}
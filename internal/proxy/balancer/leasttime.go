@@ -119,3 +119,12 @@ func (lt *LeastTime) Done(server *config.ServerCfg, duration time.Duration, err
 
 	ts.avgMillis = lt.alpha*ms + (1-lt.alpha)*ts.avgMillis
 }
+
+func (lt *LeastTime) setActive(server *config.ServerCfg, n int64) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	if ts, ok := lt.byServer[server]; ok {
+		ts.active = n
+	}
+}
@@ -0,0 +1,129 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+)
+
+// outlierState is what the detector remembers about one server between requests.
+type outlierState struct {
+	failures    int       // consecutive failures, reset by any success
+	lastFailure time.Time // when the latest of those failures happened
+	ejections   int       // how many times in a row this server has been ejected
+	ejectedAt   time.Time // when the current (or latest) ejection started
+	ejectedFor  time.Duration
+	ejected     bool
+}
+
+// outlierDetector is passive health checking: instead of sending probes like the active health
+// checker, it watches the results of real requests as they come through Pool.Done, and ejects a
+// server that fails ConsecutiveFailures times in a row, within Window.
+//
+// An ejected server comes back on its own after an ejection time that doubles every time the same
+// server is ejected again (BaseEjectionTime, 2x, 4x, ... capped at MaxEjectionTime). A server that
+// flaps keeps getting longer breaks; one that stays healthy for as long as its last ejection lasted
+// starts over from BaseEjectionTime the next time.
+//
+// Nothing here needs to know which algorithm the Pool wraps, so ejection works the same way for all
+// of them, including IPHash, ConsistentHash and StickySession.
+type outlierDetector struct {
+	cfg  *config.OutlierDetectionCfg
+	pool *Pool
+
+	mu     sync.Mutex
+	states map[*config.ServerCfg]*outlierState
+	now    func() time.Time
+}
+
+func newOutlierDetector(cfg *config.OutlierDetectionCfg, pool *Pool) *outlierDetector {
+	return &outlierDetector{
+		cfg:    cfg,
+		pool:   pool,
+		states: make(map[*config.ServerCfg]*outlierState),
+		now:    time.Now,
+	}
+}
+
+// record counts one finished request. err is non-nil for a connection error or a 5xx response
+// (manager.go reports both as errors). A request the client gave up on says nothing about the
+// server, and isn't counted at all.
+func (od *outlierDetector) record(server *config.ServerCfg, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	st, ok := od.states[server]
+	if !ok {
+		st = &outlierState{}
+		od.states[server] = st
+	}
+
+	now := od.now()
+
+	if err == nil {
+		st.failures = 0
+		// Healthy for as long as the last ejection lasted: forgive the history.
+		if !st.ejected && st.ejections > 0 && now.Sub(st.ejectedAt) >= 2*st.ejectedFor {
+			st.ejections = 0
+		}
+		return
+	}
+
+	if st.ejected {
+		// Requests that were already in flight when the server got ejected still report back.
+		// They don't say anything new.
+		return
+	}
+
+	if st.failures > 0 && now.Sub(st.lastFailure) > *od.cfg.Window {
+		st.failures = 0
+	}
+	st.failures++
+	st.lastFailure = now
+
+	if st.failures < *od.cfg.ConsecutiveFailures {
+		return
+	}
+
+	st.failures = 0
+	st.ejected = true
+	st.ejections++
+	st.ejectedAt = now
+	st.ejectedFor = od.ejectionTime(st.ejections)
+
+	od.pool.setDown(server, downOutlier, true)
+	time.AfterFunc(st.ejectedFor, func() { od.readmit(server) })
+}
+
+// readmit puts an ejected server back into rotation once its ejection time is up.
+func (od *outlierDetector) readmit(server *config.ServerCfg) {
+	od.mu.Lock()
+	st, ok := od.states[server]
+	if ok {
+		st.ejected = false
+	}
+	od.mu.Unlock()
+
+	if ok {
+		od.pool.setDown(server, downOutlier, false)
+	}
+}
+
+// ejectionTime doubles BaseEjectionTime for every ejection after the first, up to MaxEjectionTime.
+func (od *outlierDetector) ejectionTime(ejections int) time.Duration {
+	d := *od.cfg.BaseEjectionTime
+	for i := 1; i < ejections; i++ {
+		d *= 2
+		if d >= *od.cfg.MaxEjectionTime {
+			return *od.cfg.MaxEjectionTime
+		}
+	}
+	return d
+}
@@ -0,0 +1,124 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func testOutlierCfg(failures int, base, max time.Duration) *config.OutlierDetectionCfg {
+	window := time.Minute
+	return &config.OutlierDetectionCfg{
+		ConsecutiveFailures: &failures,
+		Window:              &window,
+		BaseEjectionTime:    &base,
+		MaxEjectionTime:     &max,
+	}
+}
+
+var errBackend = errors.New("connection refused")
+
+func TestOutlier_EjectsAfterConsecutiveFailures(t *testing.T) {
+	servers := []*config.ServerCfg{{URL: strPtr("s1")}, {URL: strPtr("s2")}}
+	p := NewPool(config.RoundRobin, servers, testOutlierCfg(3, time.Hour, time.Hour))
+
+	p.Done(servers[0], time.Millisecond, errBackend)
+	p.Done(servers[0], time.Millisecond, errBackend)
+	require.Len(t, p.Healthy(), 2, "two failures are below the threshold")
+
+	p.Done(servers[0], time.Millisecond, errBackend)
+	require.Equal(t, []*config.ServerCfg{servers[1]}, p.Healthy())
+}
+
+func TestOutlier_SuccessResetsTheCount(t *testing.T) {
+	servers := []*config.ServerCfg{{URL: strPtr("s1")}, {URL: strPtr("s2")}}
+	p := NewPool(config.RoundRobin, servers, testOutlierCfg(2, time.Hour, time.Hour))
+
+	p.Done(servers[0], time.Millisecond, errBackend)
+	p.Done(servers[0], time.Millisecond, nil)
+	p.Done(servers[0], time.Millisecond, errBackend)
+
+	require.Len(t, p.Healthy(), 2)
+}
+
+func TestOutlier_CancelledRequestsDontEject(t *testing.T) {
+	servers := []*config.ServerCfg{{URL: strPtr("s1")}, {URL: strPtr("s2")}}
+	p := NewPool(config.RoundRobin, servers, testOutlierCfg(2, time.Hour, time.Hour))
+
+	// A slow server whose clients give up before it answers.
+	for i := 0; i < 5; i++ {
+		p.Done(servers[0], time.Second, fmt.Errorf("proxying: %w", context.Canceled))
+		p.DoneRetry(servers[0], time.Second, context.Canceled)
+	}
+	require.Len(t, p.Healthy(), 2, "clients going away say nothing about the server")
+}
+
+func TestOutlier_FailuresOutsideWindowDontAddUp(t *testing.T) {
+	servers := []*config.ServerCfg{{URL: strPtr("s1")}, {URL: strPtr("s2")}}
+	p := NewPool(config.RoundRobin, servers, testOutlierCfg(2, time.Hour, time.Hour))
+
+	now := time.Now()
+	p.outliers.now = func() time.Time { return now }
+	p.Done(servers[0], time.Millisecond, errBackend)
+
+	now = now.Add(2 * time.Minute) // past the 1 minute window
+	p.Done(servers[0], time.Millisecond, errBackend)
+
+	require.Len(t, p.Healthy(), 2)
+}
+
+func TestOutlier_ReadmittedAfterEjectionTime(t *testing.T) {
+	servers := []*config.ServerCfg{{URL: strPtr("s1")}, {URL: strPtr("s2")}}
+	p := NewPool(config.RoundRobin, servers, testOutlierCfg(1, 20*time.Millisecond, time.Second))
+
+	p.Done(servers[0], time.Millisecond, errBackend)
+	require.Len(t, p.Healthy(), 1)
+
+	require.Eventually(t, func() bool { return len(p.Healthy()) == 2 }, time.Second, 5*time.Millisecond)
+}
+
+func TestOutlier_EjectionTimeBacksOff(t *testing.T) {
+	od := newOutlierDetector(testOutlierCfg(1, time.Second, 5*time.Second), nil)
+
+	require.Equal(t, time.Second, od.ejectionTime(1))
+	require.Equal(t, 2*time.Second, od.ejectionTime(2))
+	require.Equal(t, 4*time.Second, od.ejectionTime(3))
+	require.Equal(t, 5*time.Second, od.ejectionTime(4), "capped at max_ejection_time")
+}
+
+// The reason outlier detection lives in Pool and not in each algorithm: a hash-based
+// balancer would otherwise keep sending the same client to the failing server.
+func TestOutlier_ConsistentHashMovesClientOffEjectedServer(t *testing.T) {
+	servers := []*config.ServerCfg{{URL: strPtr("s1")}, {URL: strPtr("s2")}, {URL: strPtr("s3")}}
+	p := NewPool(config.ConsistentHash, servers, testOutlierCfg(2, time.Hour, time.Hour))
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.RemoteAddr = "198.51.100.20:4000"
+
+	pinned := p.Next(r)
+	p.Done(pinned, time.Millisecond, errBackend)
+	p.Done(pinned, time.Millisecond, errBackend)
+
+	require.NotEqual(t, *pinned.URL, *p.Next(r).URL)
+}
+
+func TestOutlier_HealthCheckAndEjectionBothMustClear(t *testing.T) {
+	servers := []*config.ServerCfg{{URL: strPtr("s1")}, {URL: strPtr("s2")}}
+	p := NewPool(config.RoundRobin, servers, testOutlierCfg(1, 20*time.Millisecond, time.Second))
+
+	p.SetHealthy(servers[0], false)
+	p.Done(servers[0], time.Millisecond, errBackend)
+
+	// The ejection expires, but the health checker still says no.
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, p.Healthy(), 1)
+
+	p.SetHealthy(servers[0], true)
+	require.Len(t, p.Healthy(), 2)
+}
@@ -0,0 +1,233 @@
+package balancer
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+)
+
+// downReason records why a server is out of rotation. A server can be down for more than one
+// reason at once (failing its health checks AND ejected for errors), and it only comes back once
+// every reason has cleared, so each source of "down" gets its own bit instead of sharing one flag.
+type downReason uint8
+
+// activeCounter is implemented by the algorithms that count requests in flight per server, so a
+// rebuilt instance can start from the counts of the one it replaces. Servers it doesn't have are
+// ignored.
+type activeCounter interface {
+	setActive(server *config.ServerCfg, n int64)
+}
+
+const (
+	downHealthCheck downReason = 1 << iota
+	downOutlier
+)
+
+// Pool is the Balancer that manager.go actually talks to. It wraps one algorithm and keeps track of
+// which servers are currently allowed to take traffic.
+//
+// Instead of teaching every algorithm how to skip a "down" server, Pool simply rebuilds the
+// algorithm over the servers that are still up, every time that set changes. Each algorithm keeps
+// working on a plain, fixed server list, exactly as before, and a server that's out of rotation
+// can't be picked by anyone, not even IPHash, ConsistentHash or StickySession, which would otherwise
+// keep sending the same clients to it.
+//
+// The price is that per-algorithm state (Round Robin's counter, Smooth WRR's current weights, Least
+// Time's averages) starts over when a server goes up or down, which happens rarely compared to
+// requests. Requests in flight are the exception: Pool counts them itself and hands the counts to
+// every new instance, so a Done for a request the old instance picked releases a slot the new one
+// knows about, instead of one taken by a newer request.
+type Pool struct {
+	algorithm string
+	servers   []*config.ServerCfg
+
+	mu   sync.Mutex
+	down map[*config.ServerCfg]downReason
+
+	// outliers is nil unless the service has outlier_detection configured.
+	outliers *outlierDetector
+
+	// current holds the Balancer built over the servers that are up right now.
+	// It's swapped as a whole, so Next and Done never need to take mu.
+	current atomic.Value
+	// inflight counts the requests Next gave each server that Done hasn't seen yet. swap keeps a
+	// rebuild from reading the counts between a pick and its count going up.
+	inflight map[*config.ServerCfg]*atomic.Int64
+	swap     sync.RWMutex
+
+	// retries spreads retry picks across the remaining servers, see NextRetry.
+	retries uint64
+}
+
+// NewPool builds a Pool with every server in rotation, the same starting point as a plain balancer.New:
+// a server is trusted until something says otherwise. od turns on passive outlier detection; nil leaves it off.
+func NewPool(algorithm string, servers []*config.ServerCfg, od *config.OutlierDetectionCfg) *Pool {
+	p := &Pool{
+		algorithm: algorithm,
+		servers:   servers,
+		down:      make(map[*config.ServerCfg]downReason),
+		inflight:  make(map[*config.ServerCfg]*atomic.Int64, len(servers)),
+	}
+	for _, s := range servers {
+		p.inflight[s] = &atomic.Int64{}
+	}
+	if od != nil {
+		p.outliers = newOutlierDetector(od, p)
+	}
+	p.current.Store(New(algorithm, servers))
+
+	return p
+}
+
+func (p *Pool) Next(r *http.Request) *config.ServerCfg {
+	p.swap.RLock()
+	defer p.swap.RUnlock()
+
+	server := p.load().Next(r)
+	if n := p.inflight[server]; n != nil {
+		n.Add(1)
+	}
+	return server
+}
+
+// Done forwards to the wrapped algorithm first, so its own bookkeeping (active counts, latency)
+// is never skipped, then lets the outlier detector count the result.
+func (p *Pool) Done(server *config.ServerCfg, drtn time.Duration, err error) {
+	p.swap.RLock()
+	if n := p.inflight[server]; n != nil && n.Load() > 0 {
+		n.Add(-1)
+	}
+	p.load().Done(server, drtn, err)
+	p.swap.RUnlock()
+
+	if p.outliers != nil && server != nil {
+		p.outliers.record(server, err)
+	}
+}
+
+// SetStickyCookie forwards to the wrapped algorithm when it's Sticky Sessions, so wrapping a balancer
+// in a Pool doesn't hide the optional StickyCookieSetter capability from manager.go.
+func (p *Pool) SetStickyCookie(header http.Header, server *config.ServerCfg) {
+	if setter, ok := p.load().(StickyCookieSetter); ok {
+		setter.SetStickyCookie(header, server)
+	}
+}
+
+// NextRetry implements Retrier. It picks among the servers that are in rotation and not in tried,
+// taking turns, so retries from many failed requests spread across every remaining server instead
+// of all landing on the same one. It returns nil when every server in rotation has been tried.
+func (p *Pool) NextRetry(r *http.Request, tried []*config.ServerCfg) *config.ServerCfg {
+	p.mu.Lock()
+	up := p.upLocked()
+	p.mu.Unlock()
+
+	candidates := make([]*config.ServerCfg, 0, len(up))
+	for _, s := range up {
+		if !containsServer(tried, s) {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	pos := atomic.AddUint64(&p.retries, 1)
+	return candidates[pos%uint64(len(candidates))]
+}
+
+// DoneRetry implements Retrier. The algorithm never counted a retry pick, so only the outlier
+// detector hears about it: a server that fails retries is still failing.
+func (p *Pool) DoneRetry(server *config.ServerCfg, drtn time.Duration, err error) {
+	if p.outliers != nil && server != nil {
+		p.outliers.record(server, err)
+	}
+}
+
+// SetHealthy takes server out of rotation (healthy == false) or puts it back, on behalf of the
+// active health checker. Calling it with the state the server is already in does nothing.
+func (p *Pool) SetHealthy(server *config.ServerCfg, healthy bool) {
+	p.setDown(server, downHealthCheck, !healthy)
+}
+
+// Healthy returns the servers that are in rotation right now.
+func (p *Pool) Healthy() []*config.ServerCfg {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.healthyLocked()
+}
+
+// setDown sets or clears one reason for server being out of rotation, and only rebuilds the
+// algorithm when that actually moves the server in or out.
+func (p *Pool) setDown(server *config.ServerCfg, reason downReason, down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	was := p.down[server]
+	now := was &^ reason
+	if down {
+		now = was | reason
+	}
+	if now == 0 {
+		delete(p.down, server)
+	} else {
+		p.down[server] = now
+	}
+
+	if (was == 0) == (now == 0) {
+		return
+	}
+	p.rebuildLocked()
+}
+
+// rebuildLocked swaps in an algorithm over the servers that are up, with the requests in flight
+// carried over when it counts them.
+func (p *Pool) rebuildLocked() {
+	p.swap.Lock()
+	defer p.swap.Unlock()
+
+	b := New(p.algorithm, p.upLocked())
+	if c, ok := b.(activeCounter); ok {
+		for server, n := range p.inflight {
+			c.setActive(server, n.Load())
+		}
+	}
+	p.current.Store(b)
+}
+
+func (p *Pool) healthyLocked() []*config.ServerCfg {
+	up := make([]*config.ServerCfg, 0, len(p.servers))
+	for _, s := range p.servers {
+		if p.down[s] == 0 {
+			up = append(up, s)
+		}
+	}
+	return up
+}
+
+// upLocked returns the list the algorithm is rebuilt over. If every server is down, it returns
+// all of them: a guess at a server that might be back is better than a certain 502 for every
+// request, and it's the same list the service started with before any check ran.
+func (p *Pool) upLocked() []*config.ServerCfg {
+	up := p.healthyLocked()
+	if len(up) == 0 {
+		return p.servers
+	}
+	return up
+}
+
+func (p *Pool) load() Balancer {
+	return p.current.Load().(Balancer)
+}
+
+func containsServer(servers []*config.ServerCfg, s *config.ServerCfg) bool {
+	for _, v := range servers {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
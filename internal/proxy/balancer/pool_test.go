@@ -0,0 +1,123 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_SkipsUnhealthyServer(t *testing.T) {
+	servers := []*config.ServerCfg{
+		{URL: strPtr("s1")}, {URL: strPtr("s2")}, {URL: strPtr("s3")},
+	}
+	p := NewPool(config.RoundRobin, servers, nil)
+
+	p.SetHealthy(servers[1], false)
+
+	for i := 0; i < 10; i++ {
+		got := p.Next(nil)
+		require.NotNil(t, got)
+		require.NotEqual(t, "s2", *got.URL, "step %d", i)
+	}
+	require.Len(t, p.Healthy(), 2)
+}
+
+func TestPool_ServerComesBack(t *testing.T) {
+	servers := []*config.ServerCfg{{URL: strPtr("s1")}, {URL: strPtr("s2")}}
+	p := NewPool(config.RoundRobin, servers, nil)
+
+	p.SetHealthy(servers[0], false)
+	p.SetHealthy(servers[0], true)
+
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[*p.Next(nil).URL] = true
+	}
+	require.True(t, seen["s1"], "s1 should be back in rotation")
+	require.True(t, seen["s2"])
+}
+
+func TestPool_AllDownFailsOpen(t *testing.T) {
+	servers := []*config.ServerCfg{{URL: strPtr("s1")}, {URL: strPtr("s2")}}
+	p := NewPool(config.RoundRobin, servers, nil)
+
+	p.SetHealthy(servers[0], false)
+	p.SetHealthy(servers[1], false)
+
+	// With nothing healthy, Pool falls back to the full list rather than returning nil.
+	require.NotNil(t, p.Next(nil))
+	require.Empty(t, p.Healthy())
+}
+
+// Hash-based algorithms are the reason Pool exists: without it, the same client IP
+// would keep hashing to the same dead server.
+func TestPool_IPHashMovesClientOffDownServer(t *testing.T) {
+	servers := []*config.ServerCfg{
+		{URL: strPtr("s1")}, {URL: strPtr("s2")}, {URL: strPtr("s3")},
+	}
+	p := NewPool(config.IPHash, servers, nil)
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.RemoteAddr = "203.0.113.7:1234"
+
+	pinned := p.Next(r)
+	p.SetHealthy(pinned, false)
+
+	for i := 0; i < 5; i++ {
+		require.NotEqual(t, *pinned.URL, *p.Next(r).URL)
+	}
+}
+
+func TestPool_ForwardsStickyCookie(t *testing.T) {
+	servers := []*config.ServerCfg{{URL: strPtr("s1")}}
+	p := NewPool(config.StickySession, servers, nil)
+
+	header := http.Header{}
+	p.SetStickyCookie(header, servers[0])
+	require.Contains(t, header.Get("Set-Cookie"), defaultStickyCookieName)
+
+	// Non-sticky algorithms leave the response alone.
+	rr := NewPool(config.RoundRobin, servers, nil)
+	header = http.Header{}
+	rr.SetStickyCookie(header, servers[0])
+	require.Empty(t, header.Get("Set-Cookie"))
+}
+
+func TestPool_NextRetrySkipsTriedAndDownServers(t *testing.T) {
+	servers := []*config.ServerCfg{
+		{URL: strPtr("s1")}, {URL: strPtr("s2")}, {URL: strPtr("s3")},
+	}
+	p := NewPool(config.RoundRobin, servers, nil)
+	p.SetHealthy(servers[2], false)
+
+	for i := 0; i < 5; i++ {
+		got := p.NextRetry(nil, []*config.ServerCfg{servers[0]})
+		require.NotNil(t, got)
+		require.Equal(t, "s2", *got.URL, "step %d", i)
+	}
+
+	require.Nil(t, p.NextRetry(nil, []*config.ServerCfg{servers[0], servers[1]}), "every server in rotation was tried")
+}
+
+func TestPool_RebuildKeepsRequestsInFlight(t *testing.T) {
+	servers := []*config.ServerCfg{{URL: strPtr("s1")}, {URL: strPtr("s2")}, {URL: strPtr("s3")}}
+	p := NewPool(config.LeastConnections, servers, nil)
+
+	for _, want := range []string{"s1", "s2", "s3", "s1"} {
+		require.Equal(t, want, *p.Next(nil).URL)
+	}
+	p.Done(servers[2], 0, nil)
+
+	// s3 going down and back up rebuilds Least Connections twice; s1 and s2 still have requests.
+	p.SetHealthy(servers[2], false)
+	p.SetHealthy(servers[2], true)
+	require.Equal(t, "s3", *p.Next(nil).URL)
+
+	// The requests picked before the rebuild finish on the new instance.
+	p.Done(servers[0], 0, nil)
+	p.Done(servers[0], 0, nil)
+	require.Equal(t, "s1", *p.Next(nil).URL)
+}
@@ -17,10 +17,10 @@ const (
 // StickySession pins a client to the same server across requests using a cookie, instead of
 // hashing the client's IP (IP Hash) or anything about the request itself.
 //
-// Known limitation: Asena doesn't have health checking yet, so if a client is pinned to a
-// server that goes down, StickySession has no way to notice and move them elsewhere - they'll
-// keep hitting the same broken server until their cookie expires. Worth revisiting once
-// health checks exist.
+// StickySession itself never learns that a server went down. It doesn't need to: when a service has
+// health checks, Pool rebuilds it over only the healthy servers, so a cookie pointing at a server
+// that's out of rotation is no longer in byHash, and the client is moved to a healthy one by the
+// fallback (and re-pinned there by the next SetStickyCookie).
 type StickySession struct {
 	servers []*config.ServerCfg
 	// byHash maps a hashed server URL back to the actual server, so a
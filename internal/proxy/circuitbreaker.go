@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerBuckets is how many slices the rolling window is cut into. Old results fall out of
+// the window one slice at a time, instead of all at once when a single counter is reset.
+const breakerBuckets = 10
+
+// breakerBucket counts the results of one slice of the window. Counting slow requests directly,
+// instead of keeping every latency to sort later, is enough to answer "is the p99 above the
+// threshold?": it is exactly when more than 1% of requests were slower than the threshold.
+type breakerBucket struct {
+	start    time.Time
+	total    int
+	failures int
+	slow     int
+}
+
+// circuitBreaker stops sending requests to a service that is clearly failing, so callers get a fast
+// 503 instead of waiting out a dial timeout, and the service gets a break to recover.
+//
+// Closed is the normal state: every request goes through, and its result is counted. The breaker
+// opens when any configured condition is met: ConsecutiveFailures failures in a row, a failure
+// ratio of at least ErrorRatio, or a LatencyPercentile latency above LatencyThreshold (the last
+// two over the rolling Window, and only once MinRequests requests have been seen in it).
+//
+// Open rejects everything for OpenDuration. After that the breaker is half-open: it lets
+// HalfOpenRequests requests through as a test. If all of them succeed it closes again; if any of
+// them fails it opens again for another OpenDuration.
+type circuitBreaker struct {
+	cfg *config.CircuitBreakerCfg
+
+	mu          sync.Mutex
+	state       breakerState
+	openedAt    time.Time
+	buckets     [breakerBuckets]breakerBucket
+	consecutive int
+	// probes is how many half-open test requests are in flight, passed how many have come back fine.
+	probes, passed int
+
+	now func() time.Time
+}
+
+func newCircuitBreaker(cfg *config.CircuitBreakerCfg) *circuitBreaker {
+	return &circuitBreaker{cfg: cfg, now: time.Now}
+}
+
+// allow reports whether a request may go through. When it may not, retryAfter says how long
+// until the breaker will let a test request through again.
+//
+// A request that was allowed must be followed by exactly one call to record, even if it never
+// reached a server - in half-open state, that's what frees its test slot.
+func (cb *circuitBreaker) allow() (ok bool, retryAfter time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := cb.now()
+
+	if cb.state == breakerOpen {
+		wait := cb.openedAt.Add(*cb.cfg.OpenDuration).Sub(now)
+		if wait > 0 {
+			return false, wait
+		}
+		cb.state = breakerHalfOpen
+		cb.probes, cb.passed = 0, 0
+	}
+
+	if cb.state == breakerHalfOpen {
+		if cb.probes >= *cb.cfg.HalfOpenRequests {
+			// The test requests are still out. Ask the client to come back shortly
+			// rather than piling more traffic onto a service we're not sure about.
+			return false, time.Second
+		}
+		cb.probes++
+	}
+
+	return true, 0
+}
+
+// isOpen reports whether the breaker is rejecting everything right now. Unlike allow, it changes
+// nothing: a breaker whose open_duration is over counts as not open, though it only turns
+// half-open on the next allow.
+func (cb *circuitBreaker) isOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state == breakerOpen && cb.now().Before(cb.openedAt.Add(*cb.cfg.OpenDuration))
+}
+
+// record counts the result of one allowed request and returns the breaker's state afterwards, and
+// whether this result is what moved it there.
+func (cb *circuitBreaker) record(drtn time.Duration, err error) (breakerState, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	before := cb.state
+	cb.count(drtn, err)
+	return cb.state, cb.state != before
+}
+
+// count does the work of record. A request the client gave up on (context cancelled) says nothing
+// about the service, so it only frees its half-open slot.
+func (cb *circuitBreaker) count(drtn time.Duration, err error) {
+	clientGone := errors.Is(err, context.Canceled)
+	failed := err != nil && !clientGone
+
+	if cb.state == breakerHalfOpen {
+		if cb.probes > 0 {
+			cb.probes--
+		}
+		switch {
+		case clientGone:
+		case failed:
+			cb.trip()
+		default:
+			cb.passed++
+			if cb.passed >= *cb.cfg.HalfOpenRequests {
+				cb.reset()
+			}
+		}
+		return
+	}
+
+	if cb.state != breakerClosed || clientGone {
+		return
+	}
+
+	b := cb.bucket()
+	b.total++
+	if failed {
+		b.failures++
+		cb.consecutive++
+	} else {
+		cb.consecutive = 0
+	}
+	if cb.cfg.LatencyThreshold != nil && drtn > *cb.cfg.LatencyThreshold {
+		b.slow++
+	}
+
+	if cb.shouldTrip() {
+		cb.trip()
+	}
+}
+
+func (cb *circuitBreaker) shouldTrip() bool {
+	if cb.cfg.ConsecutiveFailures != nil && cb.consecutive >= *cb.cfg.ConsecutiveFailures {
+		return true
+	}
+
+	total, failures, slow := cb.totals()
+	if total < *cb.cfg.MinRequests {
+		return false
+	}
+	if cb.cfg.ErrorRatio != nil && float64(failures)/float64(total) >= *cb.cfg.ErrorRatio {
+		return true
+	}
+	if cb.cfg.LatencyThreshold != nil && float64(slow)/float64(total) > 1-*cb.cfg.LatencyPercentile/100 {
+		return true
+	}
+	return false
+}
+
+func (cb *circuitBreaker) trip() {
+	cb.state = breakerOpen
+	cb.openedAt = cb.now()
+	cb.probes, cb.passed = 0, 0
+}
+
+// reset closes the breaker with an empty window, so the failures that opened it can't open it again.
+func (cb *circuitBreaker) reset() {
+	cb.state = breakerClosed
+	cb.buckets = [breakerBuckets]breakerBucket{}
+	cb.consecutive = 0
+}
+
+// bucket returns the slice of the window that now falls into, clearing it first if what it
+// holds is from an older turn of the window.
+func (cb *circuitBreaker) bucket() *breakerBucket {
+	width := *cb.cfg.Window / breakerBuckets
+	if width <= 0 {
+		width = 1
+	}
+	now := cb.now()
+	start := now.Truncate(width)
+	b := &cb.buckets[(now.UnixNano()/int64(width))%breakerBuckets]
+	if !b.start.Equal(start) {
+		*b = breakerBucket{start: start}
+	}
+	return b
+}
+
+// totals adds up every bucket that's still inside the window.
+func (cb *circuitBreaker) totals() (total, failures, slow int) {
+	oldest := cb.now().Add(-*cb.cfg.Window)
+	for _, b := range cb.buckets {
+		if b.start.After(oldest) {
+			total += b.total
+			failures += b.failures
+			slow += b.slow
+		}
+	}
+	return total, failures, slow
+}
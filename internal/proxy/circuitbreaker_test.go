@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap/zaptest"
+)
+
+var errDial = errors.New("dial tcp: connection refused")
+
+// testBreaker builds a breaker from a partly filled config, with every default applied on top
+// the same way a dynamic.yaml load would, and a clock the test controls.
+func testBreaker(cfg *config.CircuitBreakerCfg) (*circuitBreaker, *time.Time) {
+	window := 10 * time.Second
+	minReq := 4
+	open := 30 * time.Second
+	halfOpen := 2
+	pct := 99.0
+	if cfg.Window == nil {
+		cfg.Window = &window
+	}
+	if cfg.MinRequests == nil {
+		cfg.MinRequests = &minReq
+	}
+	if cfg.OpenDuration == nil {
+		cfg.OpenDuration = &open
+	}
+	if cfg.HalfOpenRequests == nil {
+		cfg.HalfOpenRequests = &halfOpen
+	}
+	if cfg.LatencyPercentile == nil {
+		cfg.LatencyPercentile = &pct
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	cb := newCircuitBreaker(cfg)
+	cb.now = func() time.Time { return now }
+	return cb, &now
+}
+
+func TestCircuitBreaker_OpensOnConsecutiveFailures(t *testing.T) {
+	n := 3
+	cb, _ := testBreaker(&config.CircuitBreakerCfg{ConsecutiveFailures: &n})
+
+	for i := 0; i < 2; i++ {
+		cb.allow()
+		cb.record(time.Millisecond, errDial)
+	}
+	if ok, _ := cb.allow(); !ok {
+		t.Fatal("expected breaker to stay closed after 2 failures")
+	}
+	if state, changed := cb.record(time.Millisecond, errDial); state != breakerOpen || !changed {
+		t.Fatalf("expected breaker to open on the 3rd failure, got %s", state)
+	}
+
+	ok, retryAfter := cb.allow()
+	if ok {
+		t.Fatal("expected open breaker to reject")
+	}
+	if retryAfter != 30*time.Second {
+		t.Errorf("expected retryAfter 30s, got %v", retryAfter)
+	}
+}
+
+func TestCircuitBreaker_OpensOnErrorRatio(t *testing.T) {
+	ratio := 0.5
+	cb, _ := testBreaker(&config.CircuitBreakerCfg{ErrorRatio: &ratio})
+
+	// ok, fail, ok, fail: 50% failures once min_requests (4) is reached.
+	results := []error{nil, errDial, nil, errDial}
+	var state breakerState
+	for _, err := range results {
+		cb.allow()
+		state, _ = cb.record(time.Millisecond, err)
+	}
+	if state != breakerOpen {
+		t.Fatalf("expected open, got %s", state)
+	}
+}
+
+func TestCircuitBreaker_MinRequestsGuardsTheRatio(t *testing.T) {
+	ratio := 0.5
+	cb, _ := testBreaker(&config.CircuitBreakerCfg{ErrorRatio: &ratio})
+
+	cb.allow()
+	if state, _ := cb.record(time.Millisecond, errDial); state != breakerClosed {
+		t.Fatalf("one failure out of one request must not trip before min_requests, got %s", state)
+	}
+}
+
+func TestCircuitBreaker_OpensOnLatencyPercentile(t *testing.T) {
+	threshold := 100 * time.Millisecond
+	pct := 50.0
+	cb, _ := testBreaker(&config.CircuitBreakerCfg{LatencyThreshold: &threshold, LatencyPercentile: &pct})
+
+	// 3 out of 4 slower than 100ms: the p50 is above the threshold.
+	for _, d := range []time.Duration{10 * time.Millisecond, time.Second, time.Second, time.Second} {
+		cb.allow()
+		cb.record(d, nil)
+	}
+	if ok, _ := cb.allow(); ok {
+		t.Fatal("expected breaker to open on slow responses")
+	}
+}
+
+func TestCircuitBreaker_OldFailuresLeaveTheWindow(t *testing.T) {
+	ratio := 0.5
+	cb, now := testBreaker(&config.CircuitBreakerCfg{ErrorRatio: &ratio})
+
+	for i := 0; i < 3; i++ {
+		cb.allow()
+		cb.record(time.Millisecond, errDial)
+	}
+	*now = now.Add(time.Minute)
+
+	cb.allow()
+	if state, _ := cb.record(time.Millisecond, errDial); state != breakerClosed {
+		t.Fatalf("failures from a minute ago should be outside the 10s window, got %s", state)
+	}
+}
+
+func TestCircuitBreaker_HalfOpenClosesAfterSuccesses(t *testing.T) {
+	n := 1
+	cb, now := testBreaker(&config.CircuitBreakerCfg{ConsecutiveFailures: &n})
+
+	cb.allow()
+	cb.record(time.Millisecond, errDial)
+
+	*now = now.Add(31 * time.Second)
+
+	// half_open_requests is 2: two probes go through, a third waits.
+	for i := 0; i < 2; i++ {
+		if ok, _ := cb.allow(); !ok {
+			t.Fatalf("expected half-open probe %d to be allowed", i)
+		}
+	}
+	if ok, _ := cb.allow(); ok {
+		t.Fatal("expected a third concurrent probe to be rejected")
+	}
+
+	cb.record(time.Millisecond, nil)
+	if state, _ := cb.record(time.Millisecond, nil); state != breakerClosed {
+		t.Fatalf("expected closed after 2 good probes, got %s", state)
+	}
+}
+
+func TestCircuitBreaker_HalfOpenReopensOnFailure(t *testing.T) {
+	n := 1
+	cb, now := testBreaker(&config.CircuitBreakerCfg{ConsecutiveFailures: &n})
+
+	cb.allow()
+	cb.record(time.Millisecond, errDial)
+	*now = now.Add(31 * time.Second)
+
+	cb.allow()
+	if state, _ := cb.record(time.Millisecond, errDial); state != breakerOpen {
+		t.Fatalf("expected open after a failed probe, got %s", state)
+	}
+}
+
+func TestCircuitBreaker_ClientCancelIsNotAFailure(t *testing.T) {
+	n := 1
+	cb, _ := testBreaker(&config.CircuitBreakerCfg{ConsecutiveFailures: &n})
+
+	cb.allow()
+	if state, _ := cb.record(time.Millisecond, context.Canceled); state != breakerClosed {
+		t.Fatalf("expected a cancelled request not to trip the breaker, got %s", state)
+	}
+}
+
+func TestServeProxy_OpenBreakerAnswers503(t *testing.T) {
+	hits := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	pm := NewProxyManger(zaptest.NewLogger(t))
+
+	algo := "round-robin"
+	service := "api-service"
+	flash := 50 * time.Millisecond
+	backendURL := backend.URL
+	n := 2
+	cbCfg := &config.CircuitBreakerCfg{ConsecutiveFailures: &n}
+	testBreaker(cbCfg) // fill in defaults
+
+	cfg := &config.HTTPCfg{
+		Services: map[string]*config.ServiceCfg{
+			service: {
+				LoadBalancer: &config.LoadBalancerCfg{
+					Algorithm:     &algo,
+					Servers:       []*config.ServerCfg{{URL: &backendURL}},
+					FlashInterval: &flash,
+				},
+				CircuitBreaker: cbCfg,
+			},
+		},
+		Routers: map[string]*config.RoutersCfg{},
+	}
+	pm.BuildReverseProxy(cfg, testTransportCfg())
+
+	for i := 0; i < 2; i++ {
+		pm.ServeProxy(service, httptest.NewRecorder(), httptest.NewRequest("GET", "http://a.com/", nil))
+	}
+
+	w := httptest.NewRecorder()
+	pm.ServeProxy(service, w, httptest.NewRequest("GET", "http://a.com/", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 from open breaker, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "30" {
+		t.Errorf("expected Retry-After: 30, got %q", w.Header().Get("Retry-After"))
+	}
+	if hits != 2 {
+		t.Errorf("expected the backend to see only the 2 requests before the breaker opened, got %d", hits)
+	}
+}
+
+func TestServeProxy_AbortedResponseCountsAsFailure(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Promise more than is sent, then hang up half way through the body.
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		_ = conn.Close()
+	}))
+	defer backend.Close()
+
+	pm := NewProxyManger(zaptest.NewLogger(t))
+
+	algo := "round-robin"
+	service := "api-service"
+	flash := 50 * time.Millisecond
+	backendURL := backend.URL
+	n := 1
+	cbCfg := &config.CircuitBreakerCfg{ConsecutiveFailures: &n}
+	testBreaker(cbCfg) // fill in defaults
+
+	pm.BuildReverseProxy(&config.HTTPCfg{
+		Services: map[string]*config.ServiceCfg{
+			service: {
+				LoadBalancer:   &config.LoadBalancerCfg{Algorithm: &algo, Servers: []*config.ServerCfg{{URL: &backendURL}}, FlashInterval: &flash},
+				CircuitBreaker: cbCfg,
+			},
+		},
+		Routers: map[string]*config.RoutersCfg{},
+	}, testTransportCfg())
+
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("expected the ErrAbortHandler panic to reach net/http, got %v", p)
+			}
+		}()
+		// ReverseProxy only panics on a broken body under an http.Server.
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, &http.Server{}))
+		pm.ServeProxy(service, httptest.NewRecorder(), r)
+	}()
+
+	if !pm.getBreaker(service).isOpen() {
+		t.Error("expected the aborted response to count as a failure and open the breaker")
+	}
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap"
+)
+
+// failoverService sends all of its requests to a primary service, and to a fallback service while
+// the primary is down: when it has no server in rotation or its breaker is open (see serviceUp),
+// or after FailureThreshold of its requests in a row failed.
+//
+// Switching back needs nothing from the operator. Health checks and breakers put the primary back
+// on their own. After failures, the primary gets one request again every RecoveryInterval, and
+// the first one that succeeds switches everything back.
+//
+// A request the primary failed (5xx, or it couldn't be reached) is sent on to the fallback, before
+// anything has been written to the client, if it may be sent twice: the same rule as retries, so
+// idempotent methods, or any method on a router with retry_non_idempotent.
+type failoverService struct {
+	pm        *Manager
+	primary   string
+	fallback  string
+	threshold int
+	recovery  time.Duration
+	logg      *zap.Logger
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	// failedAt is when the primary was last given up on for failing; zero while it is trusted.
+	failedAt time.Time
+	// probing is set while the request testing whether the primary has recovered is out.
+	probing bool
+	// serving is the service the last request went to, to log the switches.
+	serving string
+}
+
+func newFailoverService(pm *Manager, cfg *config.FailoverCfg) *failoverService {
+	return &failoverService{
+		pm:        pm,
+		primary:   *cfg.Service,
+		fallback:  *cfg.Fallback,
+		threshold: *cfg.FailureThreshold,
+		recovery:  *cfg.RecoveryInterval,
+		logg:      pm.logg,
+		now:       time.Now,
+		serving:   *cfg.Service,
+	}
+}
+
+func (fs *failoverService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	usePrimary, probe := fs.pick()
+	if !usePrimary {
+		fs.serve(fs.fallback, w, r)
+		return
+	}
+
+	in, resend := r, retryAllowed(r)
+	if resend {
+		in = r.Clone(r.Context())
+		replayable, err := bufferBody(in)
+		resend = replayable && err == nil
+	}
+
+	saved := w.Header().Clone()
+	fw := &failoverWriter{ResponseWriter: w, hold: resend}
+	var err error
+	if ok := fs.pm.ServeProxy(fs.primary, fw, in); !ok {
+		err = errServiceNotFound
+	} else if result, ok := r.Context().Value(balancerResultKey{}).(*balancerResult); ok && result != nil {
+		err = result.err
+	}
+	fs.record(probe, err)
+
+	if !fw.held {
+		return
+	}
+	// Start the response over, without whatever the primary's answer set.
+	h := w.Header()
+	clear(h)
+	for k, vv := range saved {
+		h[k] = vv
+	}
+	if in.GetBody != nil {
+		in.Body, _ = in.GetBody()
+	}
+	fs.serve(fs.fallback, w, in)
+}
+
+var errServiceNotFound = errors.New("service not found")
+
+func (fs *failoverService) serve(service string, w http.ResponseWriter, r *http.Request) {
+	if ok := fs.pm.ServeProxy(service, w, r); !ok {
+		writeProxyError(w, http.StatusBadGateway, "Service not available") // 502 Bad Gateway
+	}
+}
+
+// pick decides whether a request goes to the primary, and whether it is the one testing whether
+// the primary has recovered.
+func (fs *failoverService) pick() (usePrimary, probe bool) {
+	primaryUp := fs.pm.serviceUp(fs.primary)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch {
+	case !primaryUp:
+	case fs.failedAt.IsZero():
+		fs.switchTo(fs.primary)
+		return true, false
+	case !fs.probing && !fs.now().Before(fs.failedAt.Add(fs.recovery)):
+		fs.probing = true
+		return true, true
+	}
+	fs.switchTo(fs.fallback)
+	return false, false
+}
+
+// record counts the outcome of a request to the primary. A request the client gave up on says
+// nothing about the primary, like for the circuit breaker.
+func (fs *failoverService) record(probe bool, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if probe {
+		fs.probing = false
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err == nil {
+		fs.failures = 0
+		fs.failedAt = time.Time{}
+		return
+	}
+
+	fs.failures++
+	if probe || fs.failures >= fs.threshold {
+		fs.failedAt = fs.now()
+	}
+}
+
+// switchTo notes which service requests go to now, and logs when that changes. A single request
+// the primary failed and the fallback answered doesn't count as a switch. fs.mu must be held.
+func (fs *failoverService) switchTo(service string) {
+	if fs.serving != service {
+		fs.serving = service
+		fs.logg.Warn("Failover service switched", zap.String("primary", fs.primary), zap.String("serving", service))
+	}
+}
+
+// up reports whether the primary or the fallback is up.
+func (fs *failoverService) up() bool {
+	return fs.pm.serviceUp(fs.primary) || fs.pm.serviceUp(fs.fallback)
+}
+
+// failoverWriter passes the primary's response through, except that with hold set, a 5xx is held
+// back, body and all, so the request can go to the fallback instead.
+type failoverWriter struct {
+	http.ResponseWriter
+	hold        bool
+	held        bool
+	wroteHeader bool
+}
+
+func (w *failoverWriter) WriteHeader(code int) {
+	if code < http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.hold && code >= http.StatusInternalServerError {
+		w.held = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *failoverWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.held {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *failoverWriter) Flush() {
+	if w.wroteHeader && !w.held {
+		_ = http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+func (w *failoverWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/proxy/balancer"
+	"go.uber.org/zap/zaptest"
+)
+
+// failoverServices builds "dc1" and "dc2" over the given backends, and a "dr" service that fails
+// over from dc1 to dc2, with a clock the test controls.
+func failoverServices(t *testing.T, primary, fallback http.Handler) (*Manager, *failoverService, *time.Time) {
+	t.Helper()
+
+	algo := "round-robin"
+	flash := 50 * time.Millisecond
+	services := map[string]*config.ServiceCfg{}
+	for name, h := range map[string]http.Handler{"dc1": primary, "dc2": fallback} {
+		backend := httptest.NewServer(h)
+		t.Cleanup(backend.Close)
+		u := backend.URL
+		services[name] = &config.ServiceCfg{LoadBalancer: &config.LoadBalancerCfg{
+			Algorithm: &algo, FlashInterval: &flash, Servers: []*config.ServerCfg{{URL: &u}},
+		}}
+	}
+	dc1, dc2 := "dc1", "dc2"
+	threshold := 3
+	recovery := 10 * time.Second
+	services["dr"] = &config.ServiceCfg{Failover: &config.FailoverCfg{
+		Service: &dc1, Fallback: &dc2, FailureThreshold: &threshold, RecoveryInterval: &recovery,
+	}}
+
+	pm := NewProxyManger(zaptest.NewLogger(t))
+	pm.BuildReverseProxy(&config.HTTPCfg{Services: services, Routers: map[string]*config.RoutersCfg{}}, testTransportCfg())
+
+	fs := pm.getComposite("dr").(*failoverService)
+	now := time.Unix(1_700_000_000, 0)
+	fs.now = func() time.Time { return now }
+	return pm, fs, &now
+}
+
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, name)
+	})
+}
+
+func serveFailover(pm *Manager, method, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	pm.ServeProxy("dr", w, httptest.NewRequest(method, "http://a.com/", strings.NewReader(body)))
+	return w
+}
+
+func TestFailover_SwitchesOnErrorsAndBack(t *testing.T) {
+	var failing atomic.Bool
+	var primaryHits atomic.Int32
+	failing.Store(true)
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, "dc1")
+	})
+	pm, _, now := failoverServices(t, primary, named("dc2"))
+
+	for i := 0; i < 3; i++ {
+		if w := serveFailover(pm, "GET", ""); w.Code != http.StatusOK || w.Body.String() != "dc2" {
+			t.Fatalf("request %d: expected the failed request to be answered by dc2, got %d %q", i, w.Code, w.Body.String())
+		}
+	}
+	if primaryHits.Load() != 3 {
+		t.Fatalf("expected 3 tries on dc1, got %d", primaryHits.Load())
+	}
+
+	// Past the threshold, requests go straight to dc2.
+	serveFailover(pm, "GET", "")
+	if primaryHits.Load() != 3 {
+		t.Fatal("expected dc1 to be skipped after 3 failures in a row")
+	}
+
+	failing.Store(false)
+	*now = now.Add(11 * time.Second)
+	if w := serveFailover(pm, "GET", ""); w.Body.String() != "dc1" {
+		t.Fatalf("expected a recovery request to dc1, got %q", w.Body.String())
+	}
+	if w := serveFailover(pm, "GET", ""); w.Body.String() != "dc1" {
+		t.Errorf("expected to stay on dc1 once it recovered, got %q", w.Body.String())
+	}
+}
+
+func TestFailover_NonIdempotentIsNotResent(t *testing.T) {
+	var fallbackHits atomic.Int32
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackHits.Add(1)
+	})
+	pm, _, _ := failoverServices(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}), fallback)
+
+	if w := serveFailover(pm, "POST", "order"); w.Code != http.StatusBadGateway {
+		t.Errorf("expected dc1's answer for a POST, got %d", w.Code)
+	}
+	if fallbackHits.Load() != 0 {
+		t.Error("expected the POST not to be sent to dc2 as well")
+	}
+}
+
+func TestFailover_ResentRequestKeepsItsBody(t *testing.T) {
+	pm, _, _ := failoverServices(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("X-From", "dc1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(b)
+	}))
+
+	w := serveFailover(pm, "PUT", "payload")
+	if w.Code != http.StatusOK || w.Body.String() != "payload" {
+		t.Errorf("expected dc2 to get the body, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-From") != "" {
+		t.Error("expected none of dc1's headers on dc2's answer")
+	}
+}
+
+func TestFailover_FollowsPrimaryHealth(t *testing.T) {
+	pm, _, _ := failoverServices(t, named("dc1"), named("dc2"))
+	pools := pm.pools.Load().(map[string]*balancer.Pool)
+	pool := pools["dc1"]
+	server := pool.Healthy()[0]
+
+	pool.SetHealthy(server, false)
+	if w := serveFailover(pm, "GET", ""); w.Body.String() != "dc2" {
+		t.Errorf("expected dc2 while dc1 has no healthy server, got %q", w.Body.String())
+	}
+
+	pool.SetHealthy(server, true)
+	if w := serveFailover(pm, "GET", ""); w.Body.String() != "dc1" {
+		t.Errorf("expected dc1 as soon as it's healthy again, got %q", w.Body.String())
+	}
+	if !pm.serviceUp("dr") {
+		t.Error("expected the failover service to be up")
+	}
+}
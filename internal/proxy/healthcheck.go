@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/proxy/balancer"
+	"go.uber.org/zap"
+)
+
+// healthChecker actively probes every server of one service and takes the ones that keep failing
+// out of the service's Pool, then puts them back once they keep passing again.
+//
+// There is one checker per service, started by BuildReverseProxy, and one goroutine per server
+// inside it, so a slow server can't delay the probes of its siblings. All of them stop when the
+// context is cancelled, which BuildReverseProxy does on the next config reload.
+type healthChecker struct {
+	service string
+	cfg     *config.HealthCheckCfg
+	pool    *balancer.Pool
+	client  *http.Client
+	logg    *zap.Logger
+}
+
+func newHealthChecker(service string, cfg *config.HealthCheckCfg, pool *balancer.Pool, transport http.RoundTripper, logg *zap.Logger) *healthChecker {
+	return &healthChecker{
+		service: service,
+		cfg:     cfg,
+		pool:    pool,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   *cfg.Timeout,
+			// A redirect is an answer, not a reason to go probe some other host.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		logg: logg,
+	}
+}
+
+// start probes servers until ctx is cancelled, then closes the checker's idle connections, which
+// would otherwise stay open to every server after each reload.
+func (hc *healthChecker) start(ctx context.Context, servers []*config.ServerCfg) {
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		if s.URL == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hc.watch(ctx, s)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		hc.client.CloseIdleConnections()
+	}()
+}
+
+// watch probes one server on every tick until ctx is cancelled.
+//
+// A server only changes state after a run of results in a row, not after one: a single lost probe
+// shouldn't pull a busy server out of rotation, and a single lucky one shouldn't put a crashing
+// server back in. Every server starts out healthy, so a fresh config serves traffic right away
+// instead of waiting HealthyThreshold intervals for its first green light.
+func (hc *healthChecker) watch(ctx context.Context, server *config.ServerCfg) {
+	ticker := time.NewTicker(*hc.cfg.Interval)
+	defer ticker.Stop()
+
+	healthy := true
+	passes, fails := 0, 0
+
+	for {
+		err := hc.probe(ctx, server)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			passes++
+			fails = 0
+			if !healthy && passes >= *hc.cfg.HealthyThreshold {
+				healthy = true
+				hc.pool.SetHealthy(server, true)
+				hc.logg.Info("Server is healthy again, back in rotation",
+					zap.String("service", hc.service), zap.String("server", *server.URL))
+			}
+		} else {
+			fails++
+			passes = 0
+			if healthy && fails >= *hc.cfg.UnhealthyThreshold {
+				healthy = false
+				hc.pool.SetHealthy(server, false)
+				hc.logg.Warn("Server failed health checks, taken out of rotation",
+					zap.String("service", hc.service), zap.String("server", *server.URL), zap.Error(err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe sends one GET to the server's health path and reports whether the answer was the expected one.
+func (hc *healthChecker) probe(ctx context.Context, server *config.ServerCfg) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthCheckURL(*server.URL, *hc.cfg.Path), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "asena-health-check")
+
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	// Drain a little of the body so the connection can go back to the idle pool
+	// instead of being torn down on every probe.
+	_, _ = io.CopyN(io.Discard, resp.Body, 4<<10)
+
+	if resp.StatusCode != *hc.cfg.ExpectedStatus {
+		return fmt.Errorf("health check: unexpected status %d, want %d", resp.StatusCode, *hc.cfg.ExpectedStatus)
+	}
+	return nil
+}
+
+// healthCheckURL joins a server URL and the health path without doubling or dropping the "/" between them.
+func healthCheckURL(serverURL, path string) string {
+	return strings.TrimRight(serverURL, "/") + "/" + strings.TrimLeft(path, "/")
+}
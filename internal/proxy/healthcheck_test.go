@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/proxy/balancer"
+	"go.uber.org/zap/zaptest"
+)
+
+func testHealthCheckCfg() *config.HealthCheckCfg {
+	path := "/healthz"
+	interval := 10 * time.Millisecond
+	timeout := 10 * time.Millisecond
+	expected := http.StatusOK
+	healthy := 2
+	unhealthy := 2
+	return &config.HealthCheckCfg{
+		Path:               &path,
+		Interval:           &interval,
+		Timeout:            &timeout,
+		ExpectedStatus:     &expected,
+		HealthyThreshold:   &healthy,
+		UnhealthyThreshold: &unhealthy,
+	}
+}
+
+func TestHealthChecker_TakesServerOutAndBack(t *testing.T) {
+	var failing atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("unexpected health check path %q", r.URL.Path)
+		}
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	url := backend.URL
+	servers := []*config.ServerCfg{{URL: &url}}
+	pool := balancer.NewPool(config.RoundRobin, servers, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hc := newHealthChecker("svc", testHealthCheckCfg(), pool, http.DefaultTransport, zaptest.NewLogger(t))
+	hc.start(ctx, servers)
+
+	failing.Store(true)
+	waitFor(t, func() bool { return len(pool.Healthy()) == 0 })
+
+	failing.Store(false)
+	waitFor(t, func() bool { return len(pool.Healthy()) == 1 })
+}
+
+func TestHealthChecker_ClosesIdleConnectionsWhenStopped(t *testing.T) {
+	var probed, closed atomic.Bool
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probed.Store(true)
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Store(true)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	url := backend.URL
+	servers := []*config.ServerCfg{{URL: &url}}
+	pool := balancer.NewPool(config.RoundRobin, servers, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hc := newHealthChecker("svc", testHealthCheckCfg(), pool, &http.Transport{}, zaptest.NewLogger(t))
+	hc.start(ctx, servers)
+
+	waitFor(t, probed.Load)
+	cancel()
+	waitFor(t, closed.Load)
+}
+
+func TestHealthCheckURL(t *testing.T) {
+	tests := []struct{ server, path, want string }{
+		{"http://a:80", "/healthz", "http://a:80/healthz"},
+		{"http://a:80/", "/healthz", "http://a:80/healthz"},
+		{"http://a:80", "healthz", "http://a:80/healthz"},
+		{"http://a:80/", "/", "http://a:80/"},
+	}
+	for _, tt := range tests {
+		if got := healthCheckURL(tt.server, tt.path); got != tt.want {
+			t.Errorf("healthCheckURL(%q, %q) = %q, want %q", tt.server, tt.path, got, tt.want)
+		}
+	}
+}
+
+// waitFor polls cond until it's true or a second has passed.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met within 1s")
+}
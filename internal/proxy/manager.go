@@ -4,15 +4,22 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/asenalabs/asena/internal/clientip"
 	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/middleware"
 	"github.com/asenalabs/asena/internal/proxy/balancer"
 	"github.com/asenalabs/asena/pkg/logger"
 	"go.uber.org/zap"
@@ -31,16 +38,54 @@ type balancerResultKey struct{}
 // not the clone. A new context value created inside Rewrite would only be visible
 // on the clone, so the error path would never see it. A box created up front and
 // shared by both is visible everywhere, and Rewrite just fills in its fields.
+//
+// reportDone also writes the outcome back into the box (duration, err), so ServeProxy can read it
+// once ServeHTTP returns, for things that care about the service as a whole rather than one server,
+// like the circuit breaker.
+//
+// in and retried are for retryTransport: in is the incoming request, which a retry needs to
+// rebuild the outgoing one for another server, and retried says the current server was picked
+// by a retry, so its result goes to Retrier.DoneRetry instead of Done.
 type balancerResult struct {
 	server    *config.ServerCfg
 	startTime time.Time
+	duration  time.Duration
+	err       error
+	in        *http.Request
+	retried   bool
 }
 
 type Manager struct {
 	ProxyHolder  atomic.Value
 	RouterHolder atomic.Value
-	mu           sync.RWMutex
-	logg         *zap.Logger
+	// breakers holds a map[string]*circuitBreaker, one per service that has a circuit_breaker
+	// block. It's swapped together with ProxyHolder, so a reload starts every breaker closed.
+	breakers atomic.Value
+	// mirrors holds a map[string]*mirroring, one per service that has a mirroring block, swapped
+	// together with breakers.
+	mirrors atomic.Value
+	// composites holds a map[string]http.Handler for the services that send their requests on to
+	// other services (weighted, failover) instead of to servers of their own. They are swapped
+	// together with ProxyHolder.
+	composites atomic.Value
+	// pools holds a map[string]*balancer.Pool, the balancer of every service with a proxy, so
+	// serviceUp can ask which of its servers are in rotation. Swapped with ProxyHolder.
+	pools atomic.Value
+	mu    sync.RWMutex
+	logg  *zap.Logger
+	// stopPrevious cancels the health checkers and middleware background work started by the
+	// last BuildReverseProxy. The next reload calls it after swapping in the new proxies, so old
+	// checkers never touch a Pool that's no longer serving traffic for longer than one probe.
+	stopPrevious context.CancelFunc
+	// entrypoints are the names of the entrypoints in asena.yaml, to warn about routers bound to
+	// one that doesn't exist. Nil when they aren't known.
+	entrypoints []string
+}
+
+// SetEntrypoints tells the manager which entrypoints exist. It's called once, before the first
+// BuildReverseProxy.
+func (pm *Manager) SetEntrypoints(names []string) {
+	pm.entrypoints = names
 }
 
 func NewProxyManger(logg *zap.Logger) *Manager {
@@ -49,6 +94,10 @@ func NewProxyManger(logg *zap.Logger) *Manager {
 	}
 	pm.ProxyHolder.Store(make(map[string]*httputil.ReverseProxy))
 	pm.RouterHolder.Store([]Route{})
+	pm.breakers.Store(make(map[string]*circuitBreaker))
+	pm.mirrors.Store(make(map[string]*mirroring))
+	pm.composites.Store(make(map[string]http.Handler))
+	pm.pools.Store(make(map[string]*balancer.Pool))
 
 	return pm
 }
@@ -59,49 +108,117 @@ func (pm *Manager) BuildReverseProxy(cfg *config.HTTPCfg, t *config.ProxyTranspo
 		return
 	}
 
+	cfgCtx, stopCfg := context.WithCancel(context.Background())
+
 	newProxies := make(map[string]*httputil.ReverseProxy)
+	newBreakers := make(map[string]*circuitBreaker)
+	newMirrors := make(map[string]*mirroring)
+	newComposites := make(map[string]http.Handler)
+	newPools := make(map[string]*balancer.Pool)
 	for name, group := range cfg.Services {
-		rp, err := pm.newReverseProxy(t, group.LoadBalancer)
+		if group.CircuitBreaker != nil {
+			newBreakers[name] = newCircuitBreaker(group.CircuitBreaker)
+		}
+
+		if group.Mirroring != nil {
+			newMirrors[name] = newMirroring(name, group.Mirroring, pm.logg)
+			go newMirrors[name].report(cfgCtx, mirrorReportInterval)
+		}
+
+		if group.Weighted != nil {
+			newComposites[name] = newWeightedService(pm, name, group.Weighted)
+			pm.logg.Info("Weighted service built", zap.String("service", name), zap.Int("services_count", len(group.Weighted.Services)))
+			continue
+		}
+
+		if group.Failover != nil {
+			newComposites[name] = newFailoverService(pm, group.Failover)
+			pm.logg.Info("Failover service built", zap.String("service", name), zap.String("primary", *group.Failover.Service), zap.String("fallback", *group.Failover.Fallback))
+			continue
+		}
+
+		pool := balancer.NewPool(*group.LoadBalancer.Algorithm, group.LoadBalancer.Servers, group.LoadBalancer.OutlierDetection)
+		rp, err := pm.newReverseProxy(t, group.LoadBalancer, pool)
 		if err != nil {
 			pm.logg.Error("Failed to build reverse proxy", zap.String("service", name), zap.Error(err))
 		}
 
+		if hc := group.LoadBalancer.HealthCheck; hc != nil {
+			newHealthChecker(name, hc, pool, newServiceTransport(t, group.LoadBalancer), pm.logg).start(cfgCtx, group.LoadBalancer.Servers)
+		}
+
 		newProxies[name] = rp
+		newPools[name] = pool
 		pm.logg.Info("Reverse proxy built", zap.String("service", name), zap.String("algorithm", *group.LoadBalancer.Algorithm), zap.Int("services_count", len(group.LoadBalancer.Servers)))
 	}
 
-	// Read and sort all rules once, here, at reload time.
-	newRouters := compileRoutes(cfg.Routers, pm.logg)
+	if pm.entrypoints != nil {
+		for name, r := range cfg.Routers {
+			for _, ep := range r.Entrypoints {
+				if !slices.Contains(pm.entrypoints, ep) {
+					pm.logg.Warn("Router uses unknown entrypoint, it gets no requests from it", zap.String("router", name), zap.String("entrypoint", ep))
+				}
+			}
+		}
+	}
+
+	// Read and sort all rules once, here, at reload time, and put each router's middleware
+	// chain in front of its service.
+	newMiddlewares := middleware.Build(cfgCtx, cfg.Middlewares, pm.logg)
+	newRouters := compileRoutes(cfg.Routers, newMiddlewares, cfg.Middlewares, pm.logg)
+	for i := range newRouters {
+		newRouters[i].Handler = newRouters[i].Middlewares.Then(pm.serviceHandler(newRouters[i].Service))
+	}
 
 	pm.mu.Lock()
 	pm.ProxyHolder.Store(newProxies)
+	pm.composites.Store(newComposites)
+	pm.pools.Store(newPools)
+	pm.breakers.Store(newBreakers)
+	pm.mirrors.Store(newMirrors)
 	pm.RouterHolder.Store(newRouters)
+	if pm.stopPrevious != nil {
+		pm.stopPrevious()
+	}
+	pm.stopPrevious = stopCfg
 	pm.mu.Unlock()
 }
 
-func (pm *Manager) newReverseProxy(t *config.ProxyTransportCfg, l *config.LoadBalancerCfg) (*httputil.ReverseProxy, error) {
-	bl := balancer.New(*l.Algorithm, l.Servers)
-
+func (pm *Manager) newReverseProxy(t *config.ProxyTransportCfg, l *config.LoadBalancerCfg, bl balancer.Balancer) (*httputil.ReverseProxy, error) {
 	rp := &httputil.ReverseProxy{
-		Transport:     newProxyTransport(t),
+		Transport:     newServiceTransport(t, l),
 		FlushInterval: *l.FlashInterval,
 		ErrorLog:      logger.MustZapToStdLoggerAtLevel(pm.logg, zap.WarnLevel),
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, e error) {
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("X-Content-Type-Options", "nosniff")
-			w.Header().Set("X-Frame-Options", "DENY")
-			w.WriteHeader(http.StatusBadGateway) // 502 Bad Gateway
-
-			resp := map[string]interface{}{
-				"error":   "Service not available",
-				"code":    http.StatusBadGateway,
-				"message": "Please try again later.",
-			}
-
-			_ = json.NewEncoder(w).Encode(resp)
+			reportDone(bl, r, e)
+			writeProxyError(w, http.StatusBadGateway, "Service not available") // 502 Bad Gateway
 		},
 	}
 
+	setTarget := func(preq *httputil.ProxyRequest, server *config.ServerCfg) error {
+		target, err := url.Parse(*server.URL)
+		if err != nil {
+			return err
+		}
+
+		preq.SetURL(target)
+
+		if l.PassHostHeader != nil && *l.PassHostHeader {
+			preq.Out.Host = target.Host
+		}
+		return nil
+	}
+
+	if retrier, ok := bl.(balancer.Retrier); ok && l.Retry != nil {
+		rp.Transport = &retryTransport{
+			base:      rp.Transport,
+			bl:        bl,
+			retrier:   retrier,
+			cfg:       l.Retry,
+			setTarget: setTarget,
+		}
+	}
+
 	rp.Rewrite = func(preq *httputil.ProxyRequest) {
 		server := bl.Next(preq.In)
 		if server == nil || server.URL == nil {
@@ -115,31 +232,31 @@ func (pm *Manager) newReverseProxy(t *config.ProxyTransportCfg, l *config.LoadBa
 		if result, ok := preq.In.Context().Value(balancerResultKey{}).(*balancerResult); ok {
 			result.server = server
 			result.startTime = time.Now()
+			result.in = preq.In
 		}
 
-		target, err := url.Parse(*server.URL)
-		if err != nil {
+		if err := setTarget(preq, server); err != nil {
 			pm.logg.Warn("Invalid server URL",
 				zap.String("url", *server.URL),
 				zap.Error(err))
 			return
 		}
 
-		preq.SetURL(target)
-
-		if l.PassHostHeader != nil && *l.PassHostHeader {
-			preq.Out.Host = target.Host
+		// SetXForwarded starts X-Forwarded-For over from the connection's address. Behind a trusted
+		// proxy that would leave only the proxy's address, so the chain it sent is kept and extended.
+		if clientip.TrustedPeer(preq.In.Context()) {
+			if prior, ok := preq.In.Header["X-Forwarded-For"]; ok {
+				preq.Out.Header["X-Forwarded-For"] = append([]string(nil), prior...)
+			}
 		}
-
 		preq.SetXForwarded()
 	}
 
 	rp.ModifyResponse = func(resp *http.Response) error {
-		reportDone(bl, resp.Request, nil)
+		reportDone(bl, resp.Request, upstreamStatusError(resp.StatusCode))
 		applyStickyCookie(bl, resp)
 
-		resp.Header.Set("X-Content-Type-Options", "nosniff")
-		resp.Header.Set("X-Frame-Options", "DENY")
+		setDefaultHeaders(resp.Header)
 
 		if resp.StatusCode >= http.StatusBadRequest {
 			pm.logg.Warn("Proxy response error", zap.Int("status_code", resp.StatusCode), zap.String("service", resp.Request.URL.Host), zap.String("url", resp.Request.URL.String()))
@@ -157,11 +274,66 @@ func (pm *Manager) newReverseProxy(t *config.ProxyTransportCfg, l *config.LoadBa
 // matter how it ends.
 func reportDone(bl balancer.Balancer, r *http.Request, err error) {
 	result, ok := r.Context().Value(balancerResultKey{}).(*balancerResult)
-	if !ok || result.server == nil {
+	if !ok {
 		return
 	}
 
-	bl.Done(result.server, time.Since(result.startTime), err)
+	// A request that never got a server (Rewrite found none) still failed, and still gets its
+	// outcome recorded for ServeProxy - it just has no server to report to the balancer.
+	result.err = err
+	if result.server == nil {
+		return
+	}
+
+	result.duration = time.Since(result.startTime)
+	if retrier, ok := bl.(balancer.Retrier); ok && result.retried {
+		retrier.DoneRetry(result.server, result.duration, err)
+		return
+	}
+	bl.Done(result.server, result.duration, err)
+}
+
+// writeProxyError writes the JSON error body Asena answers with when it can't get a response from
+// a service, in the same shape for every reason (backend down, circuit open, ...).
+func writeProxyError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	setDefaultHeaders(w.Header())
+	w.WriteHeader(code)
+
+	resp := map[string]interface{}{
+		"error":   msg,
+		"code":    code,
+		"message": "Please try again later.",
+	}
+
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// defaultResponseHeaders are added to every response that doesn't already have them. They're a
+// safe default, not a rule: a backend that sends its own value keeps it, and a router's headers
+// middleware runs after this and can change or remove them.
+var defaultResponseHeaders = map[string]string{
+	"X-Content-Type-Options": "nosniff",
+	"X-Frame-Options":        "DENY",
+}
+
+func setDefaultHeaders(h http.Header) {
+	for name, value := range defaultResponseHeaders {
+		if h.Get(name) == "" {
+			h.Set(name, value)
+		}
+	}
+}
+
+// upstreamStatusError turns a 5xx answer from a backend into an error for Balancer.Done. The request
+// did reach the server, but for the balancer's purposes (latency penalty, outlier detection) a server
+// that answers 500 is failing just like one that refuses the connection. Anything below 500 is the
+// client's problem or a normal answer, not the server's, so it's reported as success.
+func upstreamStatusError(code int) error {
+	if code < http.StatusInternalServerError {
+		return nil
+	}
+	return fmt.Errorf("upstream responded with status %d", code)
 }
 
 // applyStickyCookie lets a balancer write something onto a successful response - currently
@@ -224,14 +396,140 @@ func (pm *Manager) GetProxy(serviceName string) (*httputil.ReverseProxy, bool) {
 // lets Rewrite (which sees the clone) and ErrorHandler (which sees the original) both reach the same
 // box. See balancerResult's doc comment for the full story.
 //
+// It's also where the service's circuit breaker, if it has one, gets asked before anything is sent
+// and told about the result afterwards, and where a request the breaker lets through is copied to
+// the service's mirrors. A copy is served by calling ServeProxy for the mirror service, so it gets
+// a result box of its own and never reports to this service's balancer or breaker.
+//
+// A service made of other services (weighted) has no proxy of its own. It gets the same breaker and
+// mirrors, and its handler calls ServeProxy again for the service it picks. That inner call reports
+// its outcome to the outer one's result box as well as its own, so the outer breaker counts
+// what the picked service did.
+//
 // Callers that used to do `rp, _ := pm.GetProxy(name); rp.ServeHTTP(w, r)` should call this instead.
 func (pm *Manager) ServeProxy(serviceName string, w http.ResponseWriter, r *http.Request) bool {
 	rp, ok := pm.GetProxy(serviceName)
-	if !ok || rp == nil {
+	composite := pm.getComposite(serviceName)
+	if (!ok || rp == nil) && composite == nil {
 		return false
 	}
 
-	ctx := context.WithValue(r.Context(), balancerResultKey{}, &balancerResult{})
-	rp.ServeHTTP(w, r.WithContext(ctx))
+	cb := pm.getBreaker(serviceName)
+	if cb != nil {
+		if ok, retryAfter := cb.allow(); !ok {
+			// Open breaker: answer right away, without picking a server or dialing anything.
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeProxyError(w, http.StatusServiceUnavailable, "Service temporarily unavailable") // 503
+			reportToOuter(r, &balancerResult{err: errCircuitOpen})
+			return true
+		}
+	}
+
+	if m := pm.getMirroring(serviceName); m != nil && !isMirrored(r) {
+		r = m.mirror(pm, r)
+	}
+
+	result := &balancerResult{}
+	// Deferred, because ReverseProxy panics with http.ErrAbortHandler when copying the response body
+	// fails half way, and a half-open breaker must get its probe back even then.
+	defer func() {
+		p := recover()
+		if p != nil && result.err == nil {
+			result.err = errAborted
+			if err := r.Context().Err(); err != nil {
+				// The client went away; that says nothing about the service.
+				result.err = err
+			}
+		}
+		if cb != nil {
+			if state, changed := cb.record(result.duration, result.err); changed {
+				pm.logg.Warn("Circuit breaker changed state", zap.String("service", serviceName), zap.Stringer("state", state))
+			}
+		}
+		reportToOuter(r, result)
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	ctx := context.WithValue(r.Context(), balancerResultKey{}, result)
+	if composite != nil {
+		composite.ServeHTTP(w, r.WithContext(ctx))
+	} else {
+		rp.ServeHTTP(w, r.WithContext(ctx))
+	}
 	return true
 }
+
+var (
+	// errCircuitOpen is the outcome of a request an open breaker answered itself.
+	errCircuitOpen = errors.New("circuit breaker is open")
+	// errAborted is the outcome of a request whose response broke off after it had started.
+	errAborted = errors.New("response aborted")
+)
+
+// reportToOuter copies the outcome of serving r to the result box r already had, if any: the one of
+// the service that picked this one.
+func reportToOuter(r *http.Request, result *balancerResult) {
+	if outer, ok := r.Context().Value(balancerResultKey{}).(*balancerResult); ok && outer != nil {
+		outer.duration, outer.err = result.duration, result.err
+	}
+}
+
+// serviceHandler is the end of every router's middleware chain: the request is handed to the
+// service's proxy, or answered 404 if the service doesn't exist.
+func (pm *Manager) serviceHandler(serviceName string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok := pm.ServeProxy(serviceName, w, r); !ok {
+			pm.logg.Warn("No routing rule found for service", zap.String("service", serviceName))
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		}
+	})
+}
+
+func (pm *Manager) getBreaker(serviceName string) *circuitBreaker {
+	breakers, ok := pm.breakers.Load().(map[string]*circuitBreaker)
+	if !ok {
+		return nil
+	}
+	return breakers[serviceName]
+}
+
+func (pm *Manager) getMirroring(serviceName string) *mirroring {
+	mirrors, ok := pm.mirrors.Load().(map[string]*mirroring)
+	if !ok {
+		return nil
+	}
+	return mirrors[serviceName]
+}
+
+func (pm *Manager) getComposite(serviceName string) http.Handler {
+	composites, ok := pm.composites.Load().(map[string]http.Handler)
+	if !ok {
+		return nil
+	}
+	return composites[serviceName]
+}
+
+// compositeService is a service made of other services. up reports whether any of them can take
+// traffic, see serviceUp.
+type compositeService interface {
+	http.Handler
+	up() bool
+}
+
+// serviceUp reports whether a service looks able to take traffic right now: its breaker isn't open,
+// and it has servers in rotation, or for a composite service, one of its services is up. A service
+// without health checks or outlier detection never takes its servers out of rotation, so it is up
+// until its breaker (if it has one) says otherwise.
+func (pm *Manager) serviceUp(serviceName string) bool {
+	if cb := pm.getBreaker(serviceName); cb != nil && cb.isOpen() {
+		return false
+	}
+	if c, ok := pm.getComposite(serviceName).(compositeService); ok {
+		return c.up()
+	}
+	pools, _ := pm.pools.Load().(map[string]*balancer.Pool)
+	pool, ok := pools[serviceName]
+	return ok && len(pool.Healthy()) > 0
+}
@@ -8,7 +8,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/asenalabs/asena/internal/clientip"
 	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/proxy/balancer"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -136,7 +138,7 @@ func TestReverseProxy_DirectorRewrite(t *testing.T) {
 		TLSMinVersion:         &tlsMin,
 	}
 
-	rp, err := pm.newReverseProxy(tCfg, lb)
+	rp, err := pm.newReverseProxy(tCfg, lb, balancer.NewPool(algo, lb.Servers, nil))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -156,6 +158,52 @@ func TestReverseProxy_DirectorRewrite(t *testing.T) {
 	}
 }
 
+func TestReverseProxy_KeepsForwardedForFromTrustedProxies(t *testing.T) {
+	pm := NewProxyManger(zaptest.NewLogger(t))
+
+	algo := "round-robin"
+	urlStr := "http://127.0.0.1:8080"
+	flash := 50 * time.Millisecond
+	lb := &config.LoadBalancerCfg{
+		Algorithm:     &algo,
+		Servers:       []*config.ServerCfg{{URL: &urlStr}},
+		FlashInterval: &flash,
+	}
+	rp, err := pm.newReverseProxy(testTransportCfg(), lb, balancer.NewPool(algo, lb.Servers, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		trusted bool
+		want    string
+	}{
+		{"trusted peer", true, "203.0.113.7, 10.0.0.1"},
+		{"untrusted peer", false, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := httptest.NewRequest("GET", "http://a.com/", nil)
+			in.RemoteAddr = "10.0.0.1:4000"
+			in.Header.Set("X-Forwarded-For", "203.0.113.7")
+			if tt.trusted {
+				in = in.WithContext(clientip.WithTrustedPeer(in.Context()))
+			}
+			// ReverseProxy drops the inbound X-Forwarded-For from the outbound request before Rewrite.
+			out := in.Clone(in.Context())
+			out.Header.Del("X-Forwarded-For")
+			preq := &httputil.ProxyRequest{In: in, Out: out}
+
+			rp.Rewrite(preq)
+
+			if got := preq.Out.Header.Get("X-Forwarded-For"); got != tt.want {
+				t.Errorf("expected X-Forwarded-For %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
 func TestServeProxy_NotFound(t *testing.T) {
 	logg := zaptest.NewLogger(t)
 	pm := NewProxyManger(logg)
@@ -228,3 +276,162 @@ func TestServeProxy_RoundTripsToBackend(t *testing.T) {
 		t.Errorf("expected status 200 from backend, got %d", w.Code)
 	}
 }
+
+func TestServeProxy_5xxEjectsServer(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	pm := NewProxyManger(zaptest.NewLogger(t))
+
+	algo := "round-robin"
+	service := "api-service"
+	flash := 50 * time.Millisecond
+	brokenURL, healthyURL := broken.URL, healthy.URL
+	failures := 1
+	window := time.Minute
+	ejection := time.Hour
+
+	cfg := &config.HTTPCfg{
+		Services: map[string]*config.ServiceCfg{
+			service: {
+				LoadBalancer: &config.LoadBalancerCfg{
+					Algorithm:     &algo,
+					Servers:       []*config.ServerCfg{{URL: &brokenURL}, {URL: &healthyURL}},
+					FlashInterval: &flash,
+					OutlierDetection: &config.OutlierDetectionCfg{
+						ConsecutiveFailures: &failures,
+						Window:              &window,
+						BaseEjectionTime:    &ejection,
+						MaxEjectionTime:     &ejection,
+					},
+				},
+			},
+		},
+		Routers: map[string]*config.RoutersCfg{},
+	}
+	pm.BuildReverseProxy(cfg, testTransportCfg())
+
+	// Round robin hits each server once in the first two requests, so the broken one
+	// answers 500 exactly once and gets ejected; everything after that is a 200.
+	codes := make([]int, 0, 6)
+	for i := 0; i < 6; i++ {
+		w := httptest.NewRecorder()
+		pm.ServeProxy(service, w, httptest.NewRequest("GET", "http://a.com/", nil))
+		codes = append(codes, w.Code)
+	}
+
+	fails := 0
+	for _, c := range codes[2:] {
+		if c != http.StatusOK {
+			fails++
+		}
+	}
+	if fails != 0 {
+		t.Errorf("expected only 200s after the broken server was ejected, got %v", codes)
+	}
+}
+
+func testTransportCfg() *config.ProxyTransportCfg {
+	dialTimeout := time.Second
+	tlsMin := uint16(0x0303) // TLS1.2
+	return &config.ProxyTransportCfg{
+		DailTimeout:           &dialTimeout,
+		DailKeepalive:         &dialTimeout,
+		ForceHTTP2:            new(bool),
+		MaxIdleConn:           new(int),
+		MaxIdleConnPerHost:    new(int),
+		IdleConnTimeout:       &dialTimeout,
+		TLSHandshakeTimeout:   &dialTimeout,
+		ExpectContinueTimeout: &dialTimeout,
+		TLSMinVersion:         &tlsMin,
+	}
+}
+
+func TestBuildReverseProxy_RouterMiddlewaresRewritePath(t *testing.T) {
+	var gotPath, gotPrefix string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotPrefix = r.URL.EscapedPath(), r.Header.Get("X-Forwarded-Prefix")
+	}))
+	defer backend.Close()
+
+	algo := "round-robin"
+	service := "billing"
+	rule := "PathPrefix(`/billing`)"
+	flash := 50 * time.Millisecond
+	backendURL := backend.URL
+
+	cfg := &config.HTTPCfg{
+		Services: map[string]*config.ServiceCfg{
+			service: {
+				LoadBalancer: &config.LoadBalancerCfg{
+					Algorithm:     &algo,
+					Servers:       []*config.ServerCfg{{URL: &backendURL}},
+					FlashInterval: &flash,
+				},
+			},
+		},
+		Routers: map[string]*config.RoutersCfg{
+			"billing": {Rule: &rule, Service: &service, Middlewares: []string{"strip-billing"}},
+		},
+		Middlewares: map[string]*config.MiddlewareCfg{
+			"strip-billing": {StripPrefix: &config.StripPrefixCfg{Prefixes: []string{"/billing"}}},
+		},
+	}
+
+	pm := NewProxyManger(zaptest.NewLogger(t))
+	pm.BuildReverseProxy(cfg, testTransportCfg())
+
+	r := httptest.NewRequest("GET", "http://a.com/billing/invoices/a%2Fb", nil)
+	route, ok := pm.MatchRoute(r)
+	if !ok {
+		t.Fatal("expected the billing router to match")
+	}
+	route.Handler.ServeHTTP(httptest.NewRecorder(), WithRoute(r, route))
+
+	if gotPath != "/invoices/a%2Fb" {
+		t.Errorf("expected the backend to get /invoices/a%%2Fb, got %q", gotPath)
+	}
+	if gotPrefix != "/billing" {
+		t.Errorf("expected X-Forwarded-Prefix /billing, got %q", gotPrefix)
+	}
+}
+
+func TestServeProxy_DefaultHeadersDontOverrideBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	}))
+	defer backend.Close()
+
+	algo := "round-robin"
+	service := "api-service"
+	flash := 50 * time.Millisecond
+	backendURL := backend.URL
+
+	pm := NewProxyManger(zaptest.NewLogger(t))
+	pm.BuildReverseProxy(&config.HTTPCfg{
+		Services: map[string]*config.ServiceCfg{
+			service: {LoadBalancer: &config.LoadBalancerCfg{
+				Algorithm:     &algo,
+				Servers:       []*config.ServerCfg{{URL: &backendURL}},
+				FlashInterval: &flash,
+			}},
+		},
+		Routers: map[string]*config.RoutersCfg{},
+	}, testTransportCfg())
+
+	w := httptest.NewRecorder()
+	pm.ServeProxy(service, w, httptest.NewRequest("GET", "http://a.com/", nil))
+
+	if got := w.Header().Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Errorf("expected the backend's X-Frame-Options to be kept, got %q", got)
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("expected the nosniff default to be added, got %q", got)
+	}
+}
@@ -1,9 +1,16 @@
 package proxy
 
 import (
+	"context"
 	"net/http"
+	"slices"
+
+	"github.com/asenalabs/asena/internal/middleware"
 )
 
+// routeKey is the context key for the Route a request matched, same idea as balancerResultKey.
+type routeKey struct{}
+
 // MatchRouter finds the service name for the first Route whose rule matches r.
 //
 // All the slow work - reading and sorting the rules - already happened once,
@@ -11,16 +18,45 @@ import (
 // an already-sorted list and checks each one. The list is sorted from most
 // specific to least specific, so the first match is always the right match.
 func (pm *Manager) MatchRouter(r *http.Request) (string, bool, error) {
+	route, ok := pm.MatchRoute(r)
+	if !ok {
+		return "", false, nil
+	}
+	return route.Service, true, nil
+}
+
+// MatchRoute is MatchRouter, but returns the whole Route instead of only its service name, for
+// callers that need the router's own settings too. Routers bound to other entrypoints than the one
+// r came in through are passed over.
+func (pm *Manager) MatchRoute(r *http.Request) (*Route, bool) {
 	value := pm.RouterHolder.Load()
 	routes, ok := value.([]Route)
 	if !ok {
-		return "", false, nil
+		return nil, false
 	}
 
-	for _, route := range routes {
-		if route.Tree.Match(r) {
-			return route.Service, true, nil
+	entrypoint := middleware.EntrypointName(r.Context())
+	for i := range routes {
+		if len(routes[i].Entrypoints) > 0 && !slices.Contains(routes[i].Entrypoints, entrypoint) {
+			continue
+		}
+		if routes[i].Tree.Match(r) {
+			return &routes[i], true
 		}
 	}
-	return "", false, nil
+	return nil, false
+}
+
+// WithRoute returns a shallow copy of r that carries route on its context, so everything
+// downstream of the match (the router's middlewares, the service's proxy, its retries) can read
+// the router's settings. Middlewares get the router's name through middleware.RouterName.
+func WithRoute(r *http.Request, route *Route) *http.Request {
+	ctx := context.WithValue(r.Context(), routeKey{}, route)
+	return r.WithContext(middleware.WithRouterName(ctx, route.Name))
+}
+
+// RouteFromContext returns the Route stored by WithRoute, if any.
+func RouteFromContext(ctx context.Context) (*Route, bool) {
+	route, ok := ctx.Value(routeKey{}).(*Route)
+	return route, ok
 }
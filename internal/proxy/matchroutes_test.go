@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"testing"
 
+	"github.com/asenalabs/asena/internal/middleware"
 	"github.com/asenalabs/asena/internal/rule"
 	"go.uber.org/zap/zaptest"
 )
@@ -113,3 +114,43 @@ func TestMatchRouter_FirstMatchWinsInStoredOrder(t *testing.T) {
 		t.Errorf("expected the FIRST stored route to win regardless of specificity, got %s", svc)
 	}
 }
+
+func TestMatchRoute_Entrypoints(t *testing.T) {
+	pm := NewProxyManger(zaptest.NewLogger(t))
+
+	// The admin router is the more specific one, but only takes requests from "internal".
+	pm.RouterHolder.Store([]Route{
+		{
+			Name:        "admin",
+			Tree:        mustParseRule(t, "Host(`example.com`) && PathPrefix(`/admin`)"),
+			Service:     "admin-service",
+			Entrypoints: []string{"internal"},
+		},
+		{
+			Name:    "site",
+			Tree:    mustParseRule(t, "Host(`example.com`)"),
+			Service: "site-service",
+		},
+	})
+
+	for _, tt := range []struct {
+		entrypoint string
+		want       string
+	}{
+		{"internal", "admin-service"},
+		{"public", "site-service"},
+		{"", "site-service"},
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com/admin/users", nil)
+		if tt.entrypoint != "" {
+			middleware.Entrypoint(tt.entrypoint)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				req = r
+			})).ServeHTTP(nil, req)
+		}
+
+		route, ok := pm.MatchRoute(req)
+		if !ok || route.Service != tt.want {
+			t.Errorf("entrypoint %q: expected %s, got %v", tt.entrypoint, tt.want, route)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/asenalabs/asena/internal/clientip"
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap"
+)
+
+// maxMirrorsInFlight bounds the copies one service has on their way to its mirrors at once. A
+// shadow service that stops answering fills it up within its timeout, and further copies are
+// skipped instead of piling up.
+const maxMirrorsInFlight = 256
+
+// mirroredKey marks the context of a copy, so the mirror service doesn't mirror it again: two
+// services that mirror to each other would otherwise send copies back and forth forever.
+type mirroredKey struct{}
+
+// mirroring sends copies of a service's requests to its mirrors. It's built per reload, like the
+// circuit breakers.
+type mirroring struct {
+	service     string
+	targets     []*mirrorTarget
+	maxBodySize int64
+	timeout     time.Duration
+	inFlight    chan struct{}
+	logg        *zap.Logger
+}
+
+// mirrorReportInterval is how often the copies' outcomes are logged.
+const mirrorReportInterval = time.Minute
+
+// mirrorTarget is one mirror service and what happened to the copies sent to it. These counters
+// are the only place a copy's outcome goes: the mirror service's balancer sees the copy like any
+// other request, but the primary service's balancer and breaker never hear of it. report logs them.
+type mirrorTarget struct {
+	service string
+	percent float64
+
+	sent    atomic.Uint64
+	failed  atomic.Uint64
+	skipped atomic.Uint64
+	// reported are the counts at the last report.
+	reported [3]uint64
+}
+
+func newMirroring(service string, cfg *config.MirroringCfg, logg *zap.Logger) *mirroring {
+	m := &mirroring{
+		service:     service,
+		maxBodySize: *cfg.MaxBodySize,
+		timeout:     *cfg.Timeout,
+		inFlight:    make(chan struct{}, maxMirrorsInFlight),
+		logg:        logg,
+	}
+	for _, target := range cfg.Mirrors {
+		m.targets = append(m.targets, &mirrorTarget{service: *target.Service, percent: *target.Percent})
+	}
+	return m
+}
+
+// report logs, once per interval and once more when ctx is done, how many copies each mirror
+// got, failed and skipped since the last time, for the mirrors that had any.
+func (m *mirroring) report(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			m.logCounts()
+			return
+		case <-ticker.C:
+			m.logCounts()
+		}
+	}
+}
+
+func (m *mirroring) logCounts() {
+	for _, t := range m.targets {
+		now := [3]uint64{t.sent.Load(), t.failed.Load(), t.skipped.Load()}
+		if now == t.reported {
+			continue
+		}
+		m.logg.Info("Mirrored requests",
+			zap.String("service", m.service),
+			zap.String("mirror", t.service),
+			zap.Uint64("sent", now[0]-t.reported[0]),
+			zap.Uint64("failed", now[1]-t.reported[1]),
+			zap.Uint64("skipped", now[2]-t.reported[2]),
+		)
+		t.reported = now
+	}
+}
+
+// mirror picks which mirrors get a copy of r and sends them one each, in the background. It
+// returns the request to send to the primary service: r itself, or when the body had to be read
+// to copy it, r with a body that replays what was read.
+//
+// The only cost to the primary request is reading a body of up to maxBodySize into memory. A
+// larger body is never copied, and that request goes to no mirror.
+func (m *mirroring) mirror(pm *Manager, r *http.Request) *http.Request {
+	var targets []*mirrorTarget
+	for _, t := range m.targets {
+		if t.percent >= 100 || rand.Float64()*100 < t.percent {
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) == 0 {
+		return r
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		if r.ContentLength > m.maxBodySize {
+			m.skip(targets)
+			return r
+		}
+		buf, err := io.ReadAll(io.LimitReader(r.Body, m.maxBodySize+1))
+		primary := r.Clone(r.Context())
+		if err != nil || int64(len(buf)) > m.maxBodySize {
+			// Put the body back together as it was; the primary request still gets all of it.
+			primary.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+			m.skip(targets)
+			return primary
+		}
+		_ = r.Body.Close()
+		primary.Body = io.NopCloser(bytes.NewReader(buf))
+		body, r = buf, primary
+	}
+
+	for _, t := range targets {
+		select {
+		case m.inFlight <- struct{}{}:
+		default:
+			t.skipped.Add(1)
+			continue
+		}
+
+		// The copy outlives r, so its context starts afresh with only what the proxy reads: the
+		// client's IP and the route. Nothing of the primary's server or result box comes along; the
+		// server's context would make ReverseProxy panic on a broken copy, with nobody to recover.
+		ctx := context.WithValue(context.Background(), mirroredKey{}, true)
+		ctx = clientip.NewContext(ctx, clientip.FromRequest(r))
+		if route, ok := RouteFromContext(r.Context()); ok {
+			ctx = context.WithValue(ctx, routeKey{}, route)
+		}
+		ctx, cancel := context.WithTimeout(ctx, m.timeout)
+		copied := r.Clone(ctx)
+		copied.Body = http.NoBody
+		if body != nil {
+			copied.Body = io.NopCloser(bytes.NewReader(body))
+			copied.ContentLength = int64(len(body))
+		}
+
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					t.failed.Add(1)
+					m.logg.Debug("Mirrored request aborted", zap.String("service", m.service), zap.String("mirror", t.service), zap.Any("panic", p))
+				}
+				cancel()
+				<-m.inFlight
+			}()
+			t.sent.Add(1)
+
+			w := &discardWriter{header: http.Header{}}
+			if ok := pm.ServeProxy(t.service, w, copied); !ok || w.code >= http.StatusInternalServerError {
+				t.failed.Add(1)
+				m.logg.Debug("Mirrored request failed", zap.String("service", m.service), zap.String("mirror", t.service), zap.Int("status_code", w.code))
+			}
+		}()
+	}
+	return r
+}
+
+func (m *mirroring) skip(targets []*mirrorTarget) {
+	for _, t := range targets {
+		t.skipped.Add(1)
+	}
+}
+
+// isMirrored reports whether r is a copy sent to a mirror.
+func isMirrored(r *http.Request) bool {
+	mirrored, _ := r.Context().Value(mirroredKey{}).(bool)
+	return mirrored
+}
+
+// discardWriter takes a mirror's response and keeps only its status.
+type discardWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *discardWriter) Header() http.Header { return w.header }
+
+func (w *discardWriter) WriteHeader(code int) {
+	if w.code == 0 && code >= http.StatusOK {
+		w.code = code
+	}
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return len(b), nil
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// mirrorServices builds a "primary" service that mirrors everything to a "shadow" service, with a
+// circuit breaker on the primary that opens on the first failure it hears of.
+func mirrorServices(t *testing.T, primaryURL, shadowURL string, maxBodySize int64) *Manager {
+	t.Helper()
+
+	algo := "round-robin"
+	flash := 50 * time.Millisecond
+	shadow := "shadow"
+	percent := 100.0
+	timeout := 2 * time.Second
+	failures := 1
+	lb := func(u string) *config.LoadBalancerCfg {
+		return &config.LoadBalancerCfg{Algorithm: &algo, FlashInterval: &flash, Servers: []*config.ServerCfg{{URL: &u}}}
+	}
+
+	breaker := &config.CircuitBreakerCfg{ConsecutiveFailures: &failures}
+	testBreaker(breaker) // fill in defaults
+	cfg := &config.HTTPCfg{
+		Services: map[string]*config.ServiceCfg{
+			"primary": {
+				LoadBalancer:   lb(primaryURL),
+				CircuitBreaker: breaker,
+				Mirroring: &config.MirroringCfg{
+					Mirrors:     []*config.MirrorCfg{{Service: &shadow, Percent: &percent}},
+					MaxBodySize: &maxBodySize,
+					Timeout:     &timeout,
+				},
+			},
+			"shadow": {LoadBalancer: lb(shadowURL)},
+		},
+		Routers: map[string]*config.RoutersCfg{},
+	}
+
+	pm := NewProxyManger(zaptest.NewLogger(t))
+	pm.BuildReverseProxy(cfg, testTransportCfg())
+	return pm
+}
+
+func TestMirroring_CopiesWithoutDelayingOrFailingThePrimary(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, "primary")
+	}))
+	defer primary.Close()
+
+	bodies := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		time.Sleep(300 * time.Millisecond)
+		bodies <- string(b)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	pm := mirrorServices(t, primary.URL, shadow.URL, 1024)
+
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		pm.ServeProxy("primary", w, httptest.NewRequest("POST", "http://a.com/", strings.NewReader("payload")))
+		if w.Code != http.StatusOK || w.Body.String() != "primary" {
+			t.Fatalf("request %d: expected the primary's answer, got %d %q", i, w.Code, w.Body.String())
+		}
+		if d := time.Since(start); d > 200*time.Millisecond {
+			t.Fatalf("request %d: the primary waited %v for the mirror", i, d)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case b := <-bodies:
+			if b != "payload" {
+				t.Errorf("expected the mirror to get the body, got %q", b)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected every request to be mirrored")
+		}
+	}
+
+	target := pm.getMirroring("primary").targets[0]
+	waitFor(t, func() bool { return target.failed.Load() == 3 })
+	if target.sent.Load() != 3 || target.skipped.Load() != 0 {
+		t.Errorf("expected 3 sent and none skipped, got %d and %d", target.sent.Load(), target.skipped.Load())
+	}
+	if ok, _ := pm.getBreaker("primary").allow(); !ok {
+		t.Error("expected the mirror's failures to stay away from the primary's breaker")
+	}
+}
+
+func TestMirroring_BodyOverTheCapIsNotCopied(t *testing.T) {
+	var got string
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got = string(b)
+	}))
+	defer primary.Close()
+
+	mirrored := make(chan struct{}, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- struct{}{}
+	}))
+	defer shadow.Close()
+
+	pm := mirrorServices(t, primary.URL, shadow.URL, 4)
+
+	// No Content-Length, so the cap is only found out by reading.
+	body := strings.Repeat("x", 100)
+	r := httptest.NewRequest("POST", "http://a.com/", io.MultiReader(strings.NewReader(body)))
+	r.ContentLength = -1
+	pm.ServeProxy("primary", httptest.NewRecorder(), r)
+
+	if got != body {
+		t.Errorf("expected the primary to get the whole body, got %d bytes", len(got))
+	}
+	if target := pm.getMirroring("primary").targets[0]; target.skipped.Load() != 1 || target.sent.Load() != 0 {
+		t.Errorf("expected the copy to be skipped, got skipped=%d sent=%d", target.skipped.Load(), target.sent.Load())
+	}
+	select {
+	case <-mirrored:
+		t.Error("expected nothing to reach the mirror")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirroring_BrokenCopyDoesNotCrash(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "primary")
+	}))
+	defer primary.Close()
+
+	done := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		// Promise more than is sent, then hang up half way through the body.
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		_ = conn.Close()
+	}))
+	defer shadow.Close()
+
+	pm := mirrorServices(t, primary.URL, shadow.URL, 1024)
+
+	// Under an http.Server, ReverseProxy panics on a broken body; the copy must not take that
+	// context along into its goroutine.
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, &http.Server{}))
+	w := httptest.NewRecorder()
+	pm.ServeProxy("primary", w, r)
+	if w.Body.String() != "primary" {
+		t.Fatalf("expected the primary's answer, got %q", w.Body.String())
+	}
+
+	<-done
+	target := pm.getMirroring("primary").targets[0]
+	waitFor(t, func() bool { return len(pm.getMirroring("primary").inFlight) == 0 })
+	if target.sent.Load() != 1 {
+		t.Errorf("expected the copy to be counted as sent, got %d", target.sent.Load())
+	}
+}
+
+func TestMirroring_ReportsCounts(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	m := &mirroring{service: "primary", targets: []*mirrorTarget{{service: "shadow"}, {service: "idle"}}, logg: zap.New(core)}
+	m.targets[0].sent.Add(3)
+	m.targets[0].failed.Add(1)
+
+	m.logCounts()
+	m.logCounts()
+
+	entries := logs.FilterMessage("Mirrored requests").All()
+	if len(entries) != 1 {
+		t.Fatalf("expected one report, for the mirror with new counts, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["mirror"] != "shadow" || fields["sent"] != uint64(3) || fields["failed"] != uint64(1) || fields["skipped"] != uint64(0) {
+		t.Errorf("unexpected report: %v", fields)
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/asenalabs/asena/internal/clientip"
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/proxyproto"
+)
+
+// newServiceTransport returns the transport for a load_balancer's servers: the shared settings,
+// plus a PROXY protocol header on every connection when the service asks for one.
+func newServiceTransport(t *config.ProxyTransportCfg, l *config.LoadBalancerCfg) *http.Transport {
+	tr := newProxyTransport(t)
+	if l.ProxyProtocol != nil {
+		withProxyProtocol(tr, *l.ProxyProtocol.Version)
+	}
+	return tr
+}
+
+// withProxyProtocol makes tr send a PROXY protocol header at the start of every connection it
+// opens, naming the client of the request the connection was opened for.
+//
+// A header speaks for the whole connection, so a connection can't be kept for the next request,
+// which may come from another client: keep-alives and HTTP/2 are turned off, and every request gets
+// a connection of its own. For the same reason the header goes straight to the server, never
+// through an HTTP proxy from the environment.
+func withProxyProtocol(tr *http.Transport, version int) {
+	dial := tr.DialContext
+	tr.Proxy = nil
+	tr.DisableKeepAlives = true
+	tr.ForceAttemptHTTP2 = false
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(proxyProtocolHeader(ctx, version).Format()); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// proxyProtocolHeader builds the header for a connection opened for the request ctx belongs to.
+// The source is the client's IP as Asena resolved it; its port isn't known past trusted proxies, so
+// it is sent as 0. The destination is the address the client connected to. A connection not opened
+// for a client's request, like a health check's, gets a header that names no one.
+func proxyProtocolHeader(ctx context.Context, version int) *proxyproto.Header {
+	h := &proxyproto.Header{Version: version}
+	ip := net.ParseIP(clientip.FromContext(ctx))
+	if ip == nil {
+		return h
+	}
+	h.Source = &net.TCPAddr{IP: ip}
+	if local, ok := ctx.Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		h.Destination = local
+	}
+	return h
+}
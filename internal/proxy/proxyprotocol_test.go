@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/clientip"
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/proxyproto"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestProxyProtocol_SentToServers(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		// The backend trusts PROXY protocol from anywhere on loopback, and answers with the
+		// client address it was given.
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+		backend := &httptest.Server{
+			Listener: proxyproto.NewListener(inner, []*net.IPNet{loopback}),
+			Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, r.RemoteAddr)
+			})},
+		}
+		backend.Start()
+		t.Cleanup(backend.Close)
+
+		algo := "round-robin"
+		flash := 50 * time.Millisecond
+		u := backend.URL
+		services := map[string]*config.ServiceCfg{"api": {LoadBalancer: &config.LoadBalancerCfg{
+			Algorithm: &algo, FlashInterval: &flash, Servers: []*config.ServerCfg{{URL: &u}},
+			ProxyProtocol: &config.ProxyProtocolCfg{Version: &version},
+		}}}
+		pm := NewProxyManger(zaptest.NewLogger(t))
+		pm.BuildReverseProxy(&config.HTTPCfg{Services: services, Routers: map[string]*config.RoutersCfg{}}, testTransportCfg())
+
+		for _, client := range []string{"198.51.100.7", "198.51.100.8"} {
+			r := httptest.NewRequest("GET", "http://a.com/", nil)
+			r = r.WithContext(clientip.NewContext(r.Context(), client))
+			w := httptest.NewRecorder()
+			pm.ServeProxy("api", w, r)
+			if w.Body.String() != client+":0" {
+				t.Errorf("v%d: expected the backend to see %s, got %d %q", version, client, w.Code, w.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/proxy/balancer"
+)
+
+// retryBodyLimit is the largest request body that's kept in memory so it can be sent again.
+// A request with a bigger body still goes through, it just isn't retried.
+const retryBodyLimit = 1 << 20 // 1 MiB
+
+var errPerTryTimeout = errors.New("retry: per-try timeout exceeded")
+
+// retryTransport sends a failed request again, to a different server of the same service, as long as
+// nothing of the first response has reached the client yet.
+//
+// It sits where ReverseProxy calls its Transport, which is the one spot that is both after Rewrite
+// picked a server and before any byte of the response is written. Retrying anywhere later would
+// risk sending the client half of one answer and half of another.
+//
+// Each failed attempt is reported to the balancer right away, so outlier detection and Least
+// Connections see every server that was tried, not only the last one. The last attempt is reported
+// the normal way, by ModifyResponse or ErrorHandler.
+type retryTransport struct {
+	base      http.RoundTripper
+	bl        balancer.Balancer
+	retrier   balancer.Retrier
+	cfg       *config.RetryCfg
+	setTarget func(preq *httputil.ProxyRequest, server *config.ServerCfg) error
+}
+
+func (rt *retryTransport) RoundTrip(out *http.Request) (*http.Response, error) {
+	result, ok := out.Context().Value(balancerResultKey{}).(*balancerResult)
+	if !ok || result.server == nil || result.in == nil || !retryAllowed(result.in) {
+		return rt.roundTrip(out)
+	}
+
+	replayable, err := bufferBody(out)
+	if err != nil {
+		return nil, err
+	}
+	if !replayable {
+		return rt.roundTrip(out)
+	}
+
+	tried := []*config.ServerCfg{result.server}
+	for attempt := 1; ; attempt++ {
+		resp, err := rt.roundTrip(out)
+		if attempt >= *rt.cfg.Attempts || !rt.shouldRetry(result.in, resp, err) {
+			return resp, err
+		}
+
+		next := rt.retrier.NextRetry(result.in, tried)
+		if next == nil {
+			return resp, err
+		}
+
+		if resp != nil {
+			err = upstreamStatusError(resp.StatusCode)
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+			_ = resp.Body.Close()
+		}
+		rt.reportAttempt(result, err)
+
+		out, err = rt.retarget(out, result, next)
+		if err != nil {
+			return nil, err
+		}
+		tried = append(tried, next)
+	}
+}
+
+// roundTrip is one attempt. With a per-try timeout, the clock only runs until the response headers
+// arrive: a slow download of a response that did arrive in time is not a failed try.
+func (rt *retryTransport) roundTrip(out *http.Request) (*http.Response, error) {
+	if rt.cfg.PerTryTimeout == nil {
+		return rt.base.RoundTrip(out)
+	}
+
+	ctx, cancel := context.WithCancel(out.Context())
+	timer := time.AfterFunc(*rt.cfg.PerTryTimeout, cancel)
+
+	resp, err := rt.base.RoundTrip(out.WithContext(ctx))
+	if !timer.Stop() {
+		// The timer won the race. Whatever came back is tied to a cancelled context.
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		cancel()
+		if out.Context().Err() != nil {
+			return nil, out.Context().Err()
+		}
+		return nil, errPerTryTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// shouldRetry: a request the client already gave up on is never retried. Otherwise, any transport
+// error counts (refused, reset, per-try timeout - none of them produced a response), and so does a
+// response whose status is listed in retry_on_status.
+func (rt *retryTransport) shouldRetry(in *http.Request, resp *http.Response, err error) bool {
+	if in.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return slices.Contains(rt.cfg.RetryOnStatus, resp.StatusCode)
+}
+
+// reportAttempt tells the balancer how the attempt that just failed went. The first attempt was
+// picked by the algorithm's own Next, so it gets a normal Done; retries were picked by NextRetry
+// and get DoneRetry, see balancer.Retrier.
+func (rt *retryTransport) reportAttempt(result *balancerResult, err error) {
+	drtn := time.Since(result.startTime)
+	if result.retried {
+		rt.retrier.DoneRetry(result.server, drtn, err)
+	} else {
+		rt.bl.Done(result.server, drtn, err)
+	}
+}
+
+// retarget returns a copy of out pointed at server, with a fresh copy of the buffered body, and
+// moves the result box over to the new attempt.
+func (rt *retryTransport) retarget(out *http.Request, result *balancerResult, server *config.ServerCfg) (*http.Request, error) {
+	next := out.Clone(out.Context())
+	if out.GetBody != nil {
+		body, err := out.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		next.Body = body
+	}
+
+	if err := rt.setTarget(&httputil.ProxyRequest{In: result.in, Out: next}, server); err != nil {
+		return nil, err
+	}
+
+	result.server = server
+	result.startTime = time.Now()
+	result.retried = true
+	return next, nil
+}
+
+// retryAllowed reports whether in may be sent more than once. Idempotent methods always may; any
+// other method only when the router it matched opted in with retry_non_idempotent.
+func retryAllowed(in *http.Request) bool {
+	switch in.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	route, ok := RouteFromContext(in.Context())
+	return ok && route.RetryNonIdempotent
+}
+
+// bufferBody reads out's body into memory, so it can be sent again on a retry, and reports
+// whether that worked. A body larger than retryBodyLimit is put back together as it was and
+// reported as not replayable.
+func bufferBody(out *http.Request) (bool, error) {
+	if out.Body == nil || out.Body == http.NoBody {
+		return true, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(out.Body, retryBodyLimit+1))
+	if err != nil {
+		return false, err
+	}
+	if len(buf) > retryBodyLimit {
+		out.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), out.Body), out.Body}
+		return false, nil
+	}
+
+	_ = out.Body.Close()
+	out.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	out.Body, _ = out.GetBody()
+	return true, nil
+}
+
+// cancelOnClose releases a per-try context once the response body is done with, instead of
+// when RoundTrip returns, which would cut the body off mid-read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap/zaptest"
+)
+
+// retryService builds a round-robin service over urls with the given retry block and one router
+// in front of it, so ServeProxy can be called with a request that carries its Route.
+func retryService(t *testing.T, retry *config.RetryCfg, nonIdempotent bool, urls ...string) (*Manager, *Route) {
+	t.Helper()
+
+	algo := "round-robin"
+	service := "api-service"
+	rule := "PathPrefix(`/`)"
+	flash := 50 * time.Millisecond
+
+	servers := make([]*config.ServerCfg, 0, len(urls))
+	for i := range urls {
+		servers = append(servers, &config.ServerCfg{URL: &urls[i]})
+	}
+
+	cfg := &config.HTTPCfg{
+		Services: map[string]*config.ServiceCfg{
+			service: {
+				LoadBalancer: &config.LoadBalancerCfg{
+					Algorithm:     &algo,
+					Servers:       servers,
+					FlashInterval: &flash,
+					Retry:         retry,
+				},
+			},
+		},
+		Routers: map[string]*config.RoutersCfg{
+			"api-router": {Rule: &rule, Service: &service, RetryNonIdempotent: &nonIdempotent},
+		},
+	}
+
+	pm := NewProxyManger(zaptest.NewLogger(t))
+	pm.BuildReverseProxy(cfg, testTransportCfg())
+
+	route, ok := pm.MatchRoute(httptest.NewRequest("GET", "http://a.com/", nil))
+	if !ok {
+		t.Fatal("expected the test router to match")
+	}
+	return pm, route
+}
+
+func serveRetry(pm *Manager, route *Route, method, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, "http://a.com/", strings.NewReader(body))
+	pm.ServeProxy(route.Service, w, WithRoute(r, route))
+	return w
+}
+
+func TestRetry_MovesOnAfterRetryableStatus(t *testing.T) {
+	var brokenHits int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&brokenHits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	attempts := 2
+	pm, route := retryService(t, &config.RetryCfg{Attempts: &attempts, RetryOnStatus: []int{503}}, false, broken.URL, healthy.URL)
+
+	for i := 0; i < 4; i++ {
+		if w := serveRetry(pm, route, "GET", ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200 after retry, got %d", i, w.Code)
+		}
+	}
+	if atomic.LoadInt32(&brokenHits) == 0 {
+		t.Error("expected the broken server to be tried at least once")
+	}
+}
+
+func TestRetry_ReplaysBodyOnlyWhenRouterOptsIn(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	var got atomic.Value
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got.Store(string(b))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	retry := &config.RetryCfg{Attempts: new(int), RetryOnStatus: []int{503}}
+	*retry.Attempts = 2
+
+	// Round robin sends one of every two requests to the broken server first.
+	pm, route := retryService(t, retry, false, broken.URL, healthy.URL)
+	failed := 0
+	for i := 0; i < 2; i++ {
+		if w := serveRetry(pm, route, "POST", "payload"); w.Code == http.StatusServiceUnavailable {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("expected exactly one POST to reach the broken server without a retry, got %d", failed)
+	}
+
+	pm, route = retryService(t, retry, true, broken.URL, healthy.URL)
+	for i := 0; i < 2; i++ {
+		got.Store("")
+		if w := serveRetry(pm, route, "POST", "payload"); w.Code != http.StatusOK {
+			t.Fatalf("expected POST to be retried with retry_non_idempotent, got %d", w.Code)
+		}
+		if got.Load() != "payload" {
+			t.Errorf("expected the retried request to carry the original body, got %q", got.Load())
+		}
+	}
+}
+
+func TestRetry_PerTryTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fast.Close()
+
+	attempts := 2
+	perTry := 50 * time.Millisecond
+	pm, route := retryService(t, &config.RetryCfg{Attempts: &attempts, PerTryTimeout: &perTry}, false, slow.URL, fast.URL)
+
+	// Two requests, so one of them goes to the slow server first whichever way round robin starts.
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if w := serveRetry(pm, route, "GET", ""); w.Code != http.StatusOK {
+			t.Fatalf("expected the slow try to time out and the retry to succeed, got %d", w.Code)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected the per-try timeout to cut the slow try short, took %v", d)
+	}
+}
+
+func TestBufferBody_TooLargeIsNotReplayable(t *testing.T) {
+	body := strings.Repeat("x", retryBodyLimit+10)
+	r := httptest.NewRequest("PUT", "http://a.com/", strings.NewReader(body))
+
+	replayable, err := bufferBody(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayable {
+		t.Error("expected a body over the limit not to be replayable")
+	}
+
+	b, _ := io.ReadAll(r.Body)
+	if string(b) != body {
+		t.Error("expected the body to be put back together unchanged")
+	}
+}
@@ -1,10 +1,13 @@
 package proxy
 
 import (
+	"net/http"
+	"slices"
 	"sort"
 	"strings"
 
 	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/middleware"
 	"github.com/asenalabs/asena/internal/rule"
 	"go.uber.org/zap"
 )
@@ -19,6 +22,16 @@ type Route struct {
 	Tree        rule.Node
 	Service     string
 	Specificity int
+	// RetryNonIdempotent lets the service retry POST, PATCH and other non-idempotent
+	// requests that came in through this router. Off unless the router opts in.
+	RetryNonIdempotent bool
+	// Entrypoints are the entrypoints the router takes requests from; all of them when empty.
+	Entrypoints []string
+	// Middlewares is the router's own middleware chain, in the order the router lists them.
+	Middlewares middleware.Chain
+	// Handler is Middlewares wrapped around the call to the router's service. It's what the
+	// request handler runs once a request has matched this route.
+	Handler http.Handler
 }
 
 // compileRoutes turns the raw router config into a list of Route, sorted from most specific
@@ -28,9 +41,13 @@ type Route struct {
 // happens rarely, a match happens many times per second. Any work we can do once instead of
 // every time is worth doing once.
 //
-// If a router has no rule, no service, or a rule that fails to read, we log a warning and
-// skip just that router. One broken router should not stop the rest of the config from loading.
-func compileRoutes(routers map[string]*config.RoutersCfg, logg *zap.Logger) []Route {
+// If a router has no rule, no service, a rule that fails to read, or uses a middleware that isn't
+// in middlewares (it failed to build), we log a warning and skip just that router. One broken router
+// should not stop the rest of the config from loading. A router that can't get its middlewares must
+// not serve traffic without them, either. A router whose rule uses JWTClaim is skipped too unless one
+// of its middlewares is a jwt middleware, found by name in middlewareCfgs: without one, a forged token
+// would choose the service.
+func compileRoutes(routers map[string]*config.RoutersCfg, middlewares map[string]middleware.Middleware, middlewareCfgs map[string]*config.MiddlewareCfg, logg *zap.Logger) []Route {
 	routes := make([]Route, 0, len(routers))
 
 	for name, r := range routers {
@@ -51,13 +68,31 @@ func compileRoutes(routers map[string]*config.RoutersCfg, logg *zap.Logger) []Ro
 			continue
 		}
 
+		if rule.UsesJWTClaim(tree) && !slices.ContainsFunc(r.Middlewares, func(n string) bool {
+			return middlewareCfgs[n] != nil && middlewareCfgs[n].JWT != nil
+		}) {
+			logg.Warn("Skipping router: JWTClaim rule without a jwt middleware to check the token",
+				zap.String("router", name), zap.String("rule", ruleStr))
+			continue
+		}
+
+		chain, missing := routerChain(r, middlewares)
+		if missing != "" {
+			logg.Warn("Skipping router: middleware not available",
+				zap.String("router", name), zap.String("middleware", missing))
+			continue
+		}
+
 		spec := tree.Specificity()
 		routes = append(routes, Route{
-			Name:        name,
-			Rule:        ruleStr,
-			Tree:        tree,
-			Service:     *r.Service,
-			Specificity: spec,
+			Name:               name,
+			Rule:               ruleStr,
+			Tree:               tree,
+			Service:            *r.Service,
+			Specificity:        spec,
+			RetryNonIdempotent: r.RetryNonIdempotent != nil && *r.RetryNonIdempotent,
+			Entrypoints:        r.Entrypoints,
+			Middlewares:        chain,
 		})
 		logg.Info("Router compiled",
 			zap.String("router", name), zap.String("rule", ruleStr), zap.Int("specificity", spec))
@@ -74,3 +109,21 @@ func compileRoutes(routers map[string]*config.RoutersCfg, logg *zap.Logger) []Ro
 
 	return routes
 }
+
+// routerChain looks up the router's middlewares in middlewares, in order. If one is missing, it
+// returns its name. A router with client_auth checks the client's certificate first, so none of its
+// middlewares sees a request it turns away.
+func routerChain(r *config.RoutersCfg, middlewares map[string]middleware.Middleware) (middleware.Chain, string) {
+	ms := make([]middleware.Middleware, 0, len(r.Middlewares)+1)
+	if r.ClientAuth != nil {
+		ms = append(ms, middleware.RequireClientCert(r.ClientAuth.SANs))
+	}
+	for _, n := range r.Middlewares {
+		m, ok := middlewares[n]
+		if !ok {
+			return middleware.Chain{}, n
+		}
+		ms = append(ms, m)
+	}
+	return middleware.New(ms...), ""
+}
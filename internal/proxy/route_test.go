@@ -1,9 +1,13 @@
 package proxy
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
 	"testing"
 
 	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/middleware"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -13,7 +17,7 @@ func TestCompileRoutes_SkipsNilRule(t *testing.T) {
 	routers := map[string]*config.RoutersCfg{
 		"bad": {Service: strPtr("svc")}, // Rule left nil
 	}
-	routes := compileRoutes(routers, zaptest.NewLogger(t))
+	routes := compileRoutes(routers, nil, nil, zaptest.NewLogger(t))
 	if len(routes) != 0 {
 		t.Errorf("expected a nil-Rule router to be skipped, got %d routes", len(routes))
 	}
@@ -23,7 +27,7 @@ func TestCompileRoutes_SkipsNilService(t *testing.T) {
 	routers := map[string]*config.RoutersCfg{
 		"bad": {Rule: strPtr("Host(`a.com`)")}, // Service left nil
 	}
-	routes := compileRoutes(routers, zaptest.NewLogger(t))
+	routes := compileRoutes(routers, nil, nil, zaptest.NewLogger(t))
 	if len(routes) != 0 {
 		t.Errorf("expected a nil-Service router to be skipped, got %d routes", len(routes))
 	}
@@ -36,7 +40,7 @@ func TestCompileRoutes_SkipsInvalidRuleButKeepsOthers(t *testing.T) {
 		"bad":  {Rule: strPtr("NotAMatcher(`x`)"), Service: strPtr("svc-bad")},
 		"good": {Rule: strPtr("Host(`a.com`)"), Service: strPtr("svc-good")},
 	}
-	routes := compileRoutes(routers, zaptest.NewLogger(t))
+	routes := compileRoutes(routers, nil, nil, zaptest.NewLogger(t))
 	if len(routes) != 1 {
 		t.Fatalf("expected exactly 1 compiled route, got %d", len(routes))
 	}
@@ -51,7 +55,7 @@ func TestCompileRoutes_SortedMostSpecificFirst(t *testing.T) {
 		"host-and-method": {Rule: strPtr("Host(`a.com`) && Method(`GET`)"), Service: strPtr("svc-2")}, // spec 15+25+10=50
 		"header-only":     {Rule: strPtr("Header(`X-Key`, `v`)"), Service: strPtr("svc-3")},           // spec 30
 	}
-	routes := compileRoutes(routers, zaptest.NewLogger(t))
+	routes := compileRoutes(routers, nil, nil, zaptest.NewLogger(t))
 	if len(routes) != 3 {
 		t.Fatalf("expected 3 compiled routes, got %d", len(routes))
 	}
@@ -75,13 +79,95 @@ func TestCompileRoutes_TieBreaksBySortedName(t *testing.T) {
 	}
 
 	for i := 0; i < 20; i++ {
-		routes := compileRoutes(routers, zaptest.NewLogger(t))
+		routes := compileRoutes(routers, nil, nil, zaptest.NewLogger(t))
 		if len(routes) != 2 || routes[0].Name != "alpha" || routes[1].Name != "zebra" {
 			t.Fatalf("iteration %d: expected deterministic order [alpha, zebra], got %+v", i, routeNames(routes))
 		}
 	}
 }
 
+func TestCompileRoutes_MiddlewareChainOrder(t *testing.T) {
+	tag := func(name string) middleware.Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Order", name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	middlewares := map[string]middleware.Middleware{"first": tag("first"), "second": tag("second")}
+	routers := map[string]*config.RoutersCfg{
+		"api": {Rule: strPtr("Host(`a.com`)"), Service: strPtr("svc"), Middlewares: []string{"second", "first"}},
+	}
+
+	routes := compileRoutes(routers, middlewares, nil, zaptest.NewLogger(t))
+	if len(routes) != 1 {
+		t.Fatalf("expected 1 route, got %d", len(routes))
+	}
+
+	w := httptest.NewRecorder()
+	routes[0].Middlewares.Then(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "http://a.com/", nil))
+	if got := w.Header().Values("X-Order"); len(got) != 2 || got[0] != "second" || got[1] != "first" {
+		t.Errorf("expected middlewares to run in the router's order [second first], got %v", got)
+	}
+}
+
+func TestCompileRoutes_SkipsRouterWithMissingMiddleware(t *testing.T) {
+	routers := map[string]*config.RoutersCfg{
+		"guarded": {Rule: strPtr("Host(`a.com`)"), Service: strPtr("svc"), Middlewares: []string{"auth"}},
+		"open":    {Rule: strPtr("Host(`b.com`)"), Service: strPtr("svc")},
+	}
+
+	routes := compileRoutes(routers, nil, nil, zaptest.NewLogger(t))
+	if len(routes) != 1 || routes[0].Name != "open" {
+		t.Errorf("expected only the router without middlewares to be kept, got %v", routeNames(routes))
+	}
+}
+
+func TestCompileRoutes_JWTClaimNeedsJWTMiddleware(t *testing.T) {
+	pass := func(next http.Handler) http.Handler { return next }
+	middlewares := map[string]middleware.Middleware{"verify": pass, "headers": pass}
+	cfgs := map[string]*config.MiddlewareCfg{
+		"verify":  {JWT: &config.JWTCfg{}},
+		"headers": {Headers: &config.HeadersCfg{}},
+	}
+	routers := map[string]*config.RoutersCfg{
+		"checked":   {Rule: strPtr("Host(`a.com`) && JWTClaim(`role`, `admin`)"), Service: strPtr("admin"), Middlewares: []string{"headers", "verify"}},
+		"unchecked": {Rule: strPtr("JWTClaim(`role`, `admin`)"), Service: strPtr("admin"), Middlewares: []string{"headers"}},
+		"negated":   {Rule: strPtr("!JWTClaim(`role`, `guest`)"), Service: strPtr("admin")},
+		"open":      {Rule: strPtr("Host(`b.com`)"), Service: strPtr("svc")},
+	}
+
+	routes := compileRoutes(routers, middlewares, cfgs, zaptest.NewLogger(t))
+	if got := routeNames(routes); len(got) != 2 || !slices.Contains(got, "checked") || !slices.Contains(got, "open") {
+		t.Errorf("expected the JWTClaim routers without a jwt middleware to be skipped, got %v", got)
+	}
+}
+
+func TestCompileRoutes_ClientAuthRunsFirst(t *testing.T) {
+	reached := false
+	middlewares := map[string]middleware.Middleware{"mark": func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reached = true
+			next.ServeHTTP(w, r)
+		})
+	}}
+	routers := map[string]*config.RoutersCfg{
+		"partner": {Rule: strPtr("Host(`a.com`)"), Service: strPtr("svc"), Middlewares: []string{"mark"}, ClientAuth: &config.RouterClientAuthCfg{}},
+	}
+
+	routes := compileRoutes(routers, middlewares, nil, zaptest.NewLogger(t))
+	if len(routes) != 1 {
+		t.Fatalf("expected 1 route, got %d", len(routes))
+	}
+
+	w := httptest.NewRecorder()
+	routes[0].Middlewares.Then(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "https://a.com/", nil))
+	if w.Code != http.StatusForbidden || reached {
+		t.Errorf("expected a 403 before the router's middlewares without a client certificate, got %d (reached: %v)", w.Code, reached)
+	}
+}
+
 func routeNames(routes []Route) []string {
 	names := make([]string, len(routes))
 	for i, r := range routes {
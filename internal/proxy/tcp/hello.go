@@ -0,0 +1,89 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// helloTimeout bounds how long a client may take to start talking, and to finish a TLS handshake
+// when Asena terminates it.
+//
+// A client that sends nothing at all in that time is treated as one without TLS: some protocols,
+// like MySQL and SMTP, wait for the server to speak first. It is a variable so tests can shorten it.
+var helloTimeout = 5 * time.Second
+
+// recordTypeHandshake is the first byte of a TLS handshake record, which a ClientHello starts with.
+const recordTypeHandshake = 0x16
+
+// errHelloRead stops the handshake readClientHello starts, once the ClientHello is in.
+var errHelloRead = errors.New("tcp: client hello read")
+
+// readClientHello reads the TLS ClientHello a connection starts with, without taking it off the
+// connection: the net.Conn it returns reads everything again from the start, for whoever handles
+// the connection next. A connection that starts with anything else has no hello.
+//
+// The hello is parsed by crypto/tls itself, by starting a server handshake on a copy of what
+// comes in, and stopping it once the hello is read.
+func readClientHello(conn net.Conn) (*tls.ClientHelloInfo, net.Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			// Nothing was read, so the connection is handed on as it is.
+			return nil, conn, nil
+		}
+		return nil, nil, err
+	}
+	if first[0] != recordTypeHandshake {
+		return nil, &replayConn{Conn: conn, r: br}, nil
+	}
+
+	var seen bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err = tls.Server(&readOnlyConn{r: io.TeeReader(br, &seen)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, nil, fmt.Errorf("tcp: reading TLS client hello: %w", err)
+	}
+	return hello, &replayConn{Conn: conn, r: io.MultiReader(&seen, br)}, nil
+}
+
+// replayConn is a connection whose first bytes were already read, and are read again from r.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *replayConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// readOnlyConn is the connection readClientHello's handshake runs on. It only reads; the handshake
+// is stopped before it has anything to write back.
+type readOnlyConn struct{ r io.Reader }
+
+func (c *readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c *readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,341 @@
+// Package tcp routes raw TCP connections, taken on tcp entrypoints, to the servers of TCP services,
+// for databases, brokers and anything else that doesn't speak HTTP.
+//
+// Routers match a connection with the same rules as HTTP routers, limited to the matchers a TCP
+// connection has an answer for: HostSNI, the server name of its TLS handshake, and ClientIP. Services
+// pick a server with the same balancers as HTTP services, and a connection counts as one request
+// from the moment it's opened until it's closed, so Least Connections balances open connections.
+package tcp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/proxy/balancer"
+	"github.com/asenalabs/asena/internal/proxyproto"
+	"github.com/asenalabs/asena/internal/rule"
+	"go.uber.org/zap"
+)
+
+var errNoServer = errors.New("tcp: no server available")
+
+// route is one TCP router, with its rule already read, like proxy.Route.
+type route struct {
+	name        string
+	rule        string
+	tree        rule.Node
+	service     string
+	specificity int
+	entrypoints []string
+	// tls routers only take TLS connections, and terminate them unless passthrough is set.
+	tls         bool
+	passthrough bool
+	// sni is set when the rule can only match with a server name, so the ClientHello has to be read.
+	sni bool
+}
+
+type service struct {
+	pool *balancer.Pool
+	// proxyProtocol is the PROXY protocol version sent to the servers, 0 for none.
+	proxyProtocol int
+}
+
+// table is everything one reload of the tcp section built. It's swapped as a whole, so a connection
+// always sees routers and services from the same config.
+type table struct {
+	routes   []route
+	services map[string]*service
+	dialer   *net.Dialer
+}
+
+type Manager struct {
+	table atomic.Value
+	logg  *zap.Logger
+	// entrypoints are the names of the tcp entrypoints in asena.yaml, to warn about routers bound
+	// to one that doesn't exist. Nil when they aren't known.
+	entrypoints []string
+}
+
+func NewManager(logg *zap.Logger) *Manager {
+	m := &Manager{logg: logg}
+	m.table.Store(&table{services: make(map[string]*service), dialer: &net.Dialer{}})
+	return m
+}
+
+// SetEntrypoints tells the manager which tcp entrypoints exist. It's called once, before the first
+// Build.
+func (m *Manager) SetEntrypoints(names []string) {
+	m.entrypoints = names
+}
+
+// Build replaces the routers and services with the ones in cfg. A nil cfg removes them all.
+func (m *Manager) Build(cfg *config.TCPCfg, t *config.ProxyTransportCfg) {
+	if t == nil {
+		m.logg.Error("Proxy transport config is nil")
+		return
+	}
+	if cfg == nil {
+		cfg = &config.TCPCfg{}
+	}
+
+	tb := &table{
+		services: make(map[string]*service, len(cfg.Services)),
+		dialer:   &net.Dialer{Timeout: *t.DailTimeout, KeepAlive: *t.DailKeepalive},
+	}
+	for name, s := range cfg.Services {
+		lb := s.LoadBalancer
+		servers := make([]*config.ServerCfg, 0, len(lb.Servers))
+		for _, srv := range lb.Servers {
+			// The balancers know servers by URL; for TCP that's the address.
+			servers = append(servers, &config.ServerCfg{URL: srv.Address, Weight: srv.Weight})
+		}
+		svc := &service{pool: balancer.NewPool(*lb.Algorithm, servers, lb.OutlierDetection)}
+		if lb.ProxyProtocol != nil {
+			svc.proxyProtocol = *lb.ProxyProtocol.Version
+		}
+		tb.services[name] = svc
+		m.logg.Info("TCP service built", zap.String("service", name), zap.String("algorithm", *lb.Algorithm), zap.Int("servers_count", len(servers)))
+	}
+
+	for name, r := range cfg.Routers {
+		for _, ep := range r.Entrypoints {
+			if m.entrypoints != nil && !slices.Contains(m.entrypoints, ep) {
+				m.logg.Warn("TCP router uses unknown tcp entrypoint, it gets no connections from it", zap.String("router", name), zap.String("entrypoint", ep))
+			}
+		}
+	}
+	tb.routes = compileRoutes(cfg.Routers, tb.services, m.logg)
+
+	m.table.Store(tb)
+}
+
+// compileRoutes reads every router's rule and sorts the routers from most to least specific, the
+// same as for HTTP routers. A router that can't be read is skipped with a warning.
+func compileRoutes(routers map[string]*config.TCPRouterCfg, services map[string]*service, logg *zap.Logger) []route {
+	routes := make([]route, 0, len(routers))
+	for name, r := range routers {
+		if r.Rule == nil || r.Service == nil || services[*r.Service] == nil {
+			logg.Warn("Skipping TCP router: it needs a rule and a service", zap.String("router", name))
+			continue
+		}
+		ruleStr := strings.TrimSpace(*r.Rule)
+		tree, err := rule.ParseRule(ruleStr)
+		if err == nil {
+			err = checkRule(tree)
+		}
+		if err != nil {
+			logg.Warn("Skipping TCP router: invalid rule", zap.String("router", name), zap.String("rule", ruleStr), zap.Error(err))
+			continue
+		}
+
+		rt := route{
+			name:        name,
+			rule:        ruleStr,
+			tree:        tree,
+			service:     *r.Service,
+			specificity: tree.Specificity(),
+			entrypoints: r.Entrypoints,
+			tls:         r.TLS != nil,
+			passthrough: r.TLS != nil && r.TLS.Passthrough != nil && *r.TLS.Passthrough,
+			sni:         namesServer(tree),
+		}
+		routes = append(routes, rt)
+		logg.Info("TCP router compiled", zap.String("router", name), zap.String("rule", ruleStr), zap.Int("specificity", rt.specificity))
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].specificity != routes[j].specificity {
+			return routes[i].specificity > routes[j].specificity
+		}
+		return routes[i].name < routes[j].name
+	})
+	return routes
+}
+
+// checkRule returns an error for a matcher that needs an HTTP request, like Path or Header.
+func checkRule(n rule.Node) error {
+	switch n := n.(type) {
+	case *rule.AndNode:
+		if err := checkRule(n.Left); err != nil {
+			return err
+		}
+		return checkRule(n.Right)
+	case *rule.OrNode:
+		if err := checkRule(n.Left); err != nil {
+			return err
+		}
+		return checkRule(n.Right)
+	case *rule.NotNode:
+		return checkRule(n.Child)
+	case *rule.HostSNINode, *rule.ClientIPNode:
+		return nil
+	default:
+		return fmt.Errorf("only HostSNI and ClientIP work on TCP connections")
+	}
+}
+
+// namesServer reports whether the rule has a HostSNI other than HostSNI(`*`).
+func namesServer(n rule.Node) bool {
+	switch n := n.(type) {
+	case *rule.AndNode:
+		return namesServer(n.Left) || namesServer(n.Right)
+	case *rule.OrNode:
+		return namesServer(n.Left) || namesServer(n.Right)
+	case *rule.NotNode:
+		return namesServer(n.Child)
+	case *rule.HostSNINode:
+		return n.Host() != "*"
+	}
+	return false
+}
+
+// ServeConn routes a connection taken on entrypoint and relays it to a server of the router's
+// service until either side closes it. tlsConfig is the entrypoint's, for routers that terminate TLS.
+//
+// The ClientHello is only read when a router of the entrypoint needs it. Otherwise, the connection is
+// routed as soon as it's open, which protocols where the server speaks first need.
+func (m *Manager) ServeConn(entrypoint string, conn net.Conn, tlsConfig *tls.Config) {
+	tb := m.table.Load().(*table)
+
+	var routes []*route
+	needHello := false
+	for i := range tb.routes {
+		rt := &tb.routes[i]
+		if len(rt.entrypoints) > 0 && !slices.Contains(rt.entrypoints, entrypoint) {
+			continue
+		}
+		routes = append(routes, rt)
+		needHello = needHello || rt.tls || rt.sni
+	}
+
+	var hello *tls.ClientHelloInfo
+	if needHello {
+		var err error
+		hello, conn, err = readClientHello(conn)
+		if err != nil {
+			m.logg.Debug("TCP connection closed before it could be routed", zap.String("entrypoint", entrypoint), zap.Error(err))
+			return
+		}
+	}
+
+	r := connRequest(conn, hello)
+	var rt *route
+	for _, candidate := range routes {
+		if candidate.tls && hello == nil {
+			continue
+		}
+		if candidate.tree.Match(r) {
+			rt = candidate
+			break
+		}
+	}
+	if rt == nil {
+		m.logg.Warn("No TCP router matched the connection", zap.String("entrypoint", entrypoint), zap.String("client", r.RemoteAddr), zap.String("sni", r.Host))
+		return
+	}
+
+	if rt.tls && !rt.passthrough {
+		if tlsConfig == nil {
+			m.logg.Warn("TCP router terminates TLS, but its entrypoint has no certificate", zap.String("router", rt.name), zap.String("entrypoint", entrypoint))
+			return
+		}
+		tc := tls.Server(conn, tlsConfig)
+		_ = conn.SetDeadline(time.Now().Add(helloTimeout))
+		if err := tc.Handshake(); err != nil {
+			m.logg.Debug("TLS handshake failed", zap.String("router", rt.name), zap.String("client", r.RemoteAddr), zap.Error(err))
+			return
+		}
+		_ = conn.SetDeadline(time.Time{})
+		conn = tc
+	}
+
+	svc := tb.services[rt.service]
+	backend, server, retried, err := m.dial(tb, svc, r, conn)
+	if err != nil {
+		m.logg.Warn("No TCP server to send the connection to", zap.String("router", rt.name), zap.String("service", rt.service), zap.Error(err))
+		return
+	}
+	defer backend.Close()
+
+	start := time.Now()
+	sent, received := relay(conn, backend)
+	if retried {
+		svc.pool.DoneRetry(server, time.Since(start), nil)
+	} else {
+		svc.pool.Done(server, time.Since(start), nil)
+	}
+
+	m.logg.Info("connection",
+		zap.String("entrypoint", entrypoint),
+		zap.String("router", rt.name),
+		zap.String("service", rt.service),
+		zap.String("server", *server.URL),
+		zap.String("client", r.RemoteAddr),
+		zap.Int64("bytes_sent", sent),
+		zap.Int64("bytes_received", received),
+		zap.Duration("duration", time.Since(start)),
+	)
+}
+
+// dial connects to a server of svc. A server that can't be reached counts as a failure with the
+// balancer, and the connection goes to one of the others it hasn't tried, the same way an HTTP
+// retry does. retried says the server was picked for a retry, so it's reported with DoneRetry.
+func (m *Manager) dial(tb *table, svc *service, r *http.Request, client net.Conn) (backend net.Conn, server *config.ServerCfg, retried bool, err error) {
+	var tried []*config.ServerCfg
+	server = svc.pool.Next(r)
+	for server != nil {
+		start := time.Now()
+		backend, err = tb.dialer.Dial("tcp", *server.URL)
+		if err == nil && svc.proxyProtocol != 0 {
+			if _, err = backend.Write(proxyProtocolHeader(client, svc.proxyProtocol).Format()); err != nil {
+				_ = backend.Close()
+			}
+		}
+		if err == nil {
+			return backend, server, retried, nil
+		}
+
+		m.logg.Warn("Failed to connect to TCP server", zap.String("server", *server.URL), zap.Error(err))
+		if retried {
+			svc.pool.DoneRetry(server, time.Since(start), err)
+		} else {
+			svc.pool.Done(server, time.Since(start), err)
+		}
+		tried = append(tried, server)
+		server = svc.pool.NextRetry(r, tried)
+		retried = true
+	}
+	return nil, nil, false, errNoServer
+}
+
+// proxyProtocolHeader describes client's connection: where it came from, and the address it reached.
+func proxyProtocolHeader(client net.Conn, version int) *proxyproto.Header {
+	h := &proxyproto.Header{Version: version}
+	if src, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+		h.Source = src
+	}
+	if dst, ok := client.LocalAddr().(*net.TCPAddr); ok {
+		h.Destination = dst
+	}
+	return h
+}
+
+// connRequest describes conn as the *http.Request that rules and balancers read: the address it came
+// from, and the server name it asked for in its TLS handshake, if it started one.
+func connRequest(conn net.Conn, hello *tls.ClientHelloInfo) *http.Request {
+	r := balancer.ClientRequest(conn.RemoteAddr())
+	if hello != nil {
+		r.Host = hello.ServerName
+		r.TLS = &tls.ConnectionState{ServerName: hello.ServerName}
+	}
+	return r
+}
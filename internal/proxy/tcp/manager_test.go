@@ -0,0 +1,331 @@
+package tcp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/proxyproto"
+	"go.uber.org/zap/zaptest"
+)
+
+func testTransportCfg() *config.ProxyTransportCfg {
+	timeout, keepalive := time.Second, 30*time.Second
+	return &config.ProxyTransportCfg{DailTimeout: &timeout, DailKeepalive: &keepalive}
+}
+
+func testCert(t *testing.T, names ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// backend starts a server that hands every connection to serve, and returns its address. The test
+// waits for every serve to return before it ends, so none logs after it.
+func backend(t *testing.T, ln net.Listener, serve func(net.Conn)) string {
+	t.Helper()
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		_ = ln.Close()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+// greeter answers every connection with name, without waiting for the client to speak first.
+func greeter(name string) func(net.Conn) {
+	return func(conn net.Conn) { _, _ = io.WriteString(conn, name+"\n") }
+}
+
+func echo(conn net.Conn) { _, _ = io.Copy(conn, conn) }
+
+// entrypoint serves the "tcp" entrypoint through m, and returns its address.
+func entrypoint(t *testing.T, m *Manager, tlsConfig *tls.Config) string {
+	t.Helper()
+	return backend(t, listen(t), func(conn net.Conn) { m.ServeConn("tcp", conn, tlsConfig) })
+}
+
+func buildManager(t *testing.T, cfg *config.TCPCfg) *Manager {
+	t.Helper()
+	m := NewManager(zaptest.NewLogger(t))
+	m.Build(cfg, testTransportCfg())
+	return m
+}
+
+func tcpService(algorithm string, addresses ...string) *config.TCPServiceCfg {
+	lb := &config.TCPLoadBalancerCfg{Algorithm: &algorithm}
+	for _, addr := range addresses {
+		lb.Servers = append(lb.Servers, &config.TCPServerCfg{Address: &addr})
+	}
+	return &config.TCPServiceCfg{LoadBalancer: lb}
+}
+
+func tcpRouter(rule, service string, tlsCfg *config.TCPRouterTLSCfg) *config.TCPRouterCfg {
+	return &config.TCPRouterCfg{Rule: &rule, Service: &service, TLS: tlsCfg}
+}
+
+func readLine(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading from the connection: %v", err)
+	}
+	return strings.TrimSpace(line)
+}
+
+func TestServeConn_RoutesBySNIAndPassesTLSThrough(t *testing.T) {
+	tlsBackend := func(name string) string {
+		ln := tls.NewListener(listen(t), &tls.Config{Certificates: []tls.Certificate{testCert(t, name)}})
+		return backend(t, ln, greeter(name))
+	}
+	passthrough := true
+	m := buildManager(t, &config.TCPCfg{
+		Services: map[string]*config.TCPServiceCfg{
+			"a": tcpService("round-robin", tlsBackend("a.test")),
+			"b": tcpService("round-robin", tlsBackend("b.test")),
+		},
+		Routers: map[string]*config.TCPRouterCfg{
+			"a": tcpRouter("HostSNI(`a.test`)", "a", &config.TCPRouterTLSCfg{Passthrough: &passthrough}),
+			"b": tcpRouter("HostSNI(`b.test`)", "b", &config.TCPRouterTLSCfg{Passthrough: &passthrough}),
+		},
+	})
+	addr := entrypoint(t, m, nil)
+
+	for _, name := range []string{"a.test", "b.test"} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := readLine(t, conn); got != name {
+			t.Errorf("expected %s's backend, got %q", name, got)
+		}
+		if cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != name {
+			t.Errorf("expected the backend's own certificate for %s, got %q", name, cn)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestServeConn_TerminatesTLS(t *testing.T) {
+	m := buildManager(t, &config.TCPCfg{
+		Services: map[string]*config.TCPServiceCfg{"echo": tcpService("round-robin", backend(t, listen(t), echo))},
+		Routers:  map[string]*config.TCPRouterCfg{"echo": tcpRouter("HostSNI(`echo.test`)", "echo", &config.TCPRouterTLSCfg{})},
+	})
+	addr := entrypoint(t, m, &tls.Config{Certificates: []tls.Certificate{testCert(t, "echo.test")}})
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "echo.test", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "ping\n")
+	if got := readLine(t, conn); got != "ping" {
+		t.Errorf("expected the plain echo backend behind the terminated TLS, got %q", got)
+	}
+}
+
+func TestServeConn_ServerSpeaksFirst(t *testing.T) {
+	m := buildManager(t, &config.TCPCfg{
+		Services: map[string]*config.TCPServiceCfg{"smtp": tcpService("round-robin", backend(t, listen(t), greeter("220 ready")))},
+		Routers:  map[string]*config.TCPRouterCfg{"smtp": tcpRouter("HostSNI(`*`)", "smtp", nil)},
+	})
+
+	conn, err := net.Dial("tcp", entrypoint(t, m, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if got := readLine(t, conn); got != "220 ready" {
+		t.Errorf("expected the server's greeting, got %q", got)
+	}
+	if time.Since(start) >= helloTimeout {
+		t.Error("expected the connection to be routed without waiting for the client to speak")
+	}
+}
+
+func TestServeConn_ServerSpeaksFirstBehindProxyProtocol(t *testing.T) {
+	defer func(d time.Duration) { helloTimeout = d }(helloTimeout)
+	helloTimeout = 100 * time.Millisecond
+
+	passthrough := true
+	m := buildManager(t, &config.TCPCfg{
+		Services: map[string]*config.TCPServiceCfg{
+			"smtp": tcpService("round-robin", backend(t, listen(t), greeter("220 ready"))),
+			"tls":  tcpService("round-robin", backend(t, listen(t), echo)),
+		},
+		Routers: map[string]*config.TCPRouterCfg{
+			"smtp": tcpRouter("HostSNI(`*`)", "smtp", nil),
+			"tls":  tcpRouter("HostSNI(`a.test`)", "tls", &config.TCPRouterTLSCfg{Passthrough: &passthrough}),
+		},
+	})
+	// The TLS router makes the entrypoint read a ClientHello, through the PROXY protocol listener
+	// that reads its header on the first read.
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	ln := proxyproto.NewListener(listen(t), []*net.IPNet{trusted})
+	addr := backend(t, ln, func(conn net.Conn) { m.ServeConn("tcp", conn, nil) })
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := readLine(t, conn); got != "220 ready" {
+		t.Errorf("expected the server's greeting once the hello timed out, got %q", got)
+	}
+}
+
+func TestServeConn_LeastConnectionsCountsOpenConnections(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	closed := make(chan struct{}, 1)
+	m := buildManager(t, &config.TCPCfg{
+		Services: map[string]*config.TCPServiceCfg{"db": tcpService("least-connections",
+			backend(t, listen(t), func(conn net.Conn) {
+				greeter("one")(conn)
+				<-release
+			}),
+			backend(t, listen(t), func(conn net.Conn) {
+				greeter("two")(conn)
+				_, _ = io.Copy(io.Discard, conn)
+				closed <- struct{}{}
+			}),
+		)},
+		Routers: map[string]*config.TCPRouterCfg{"db": tcpRouter("HostSNI(`*`)", "db", nil)},
+	})
+	addr := entrypoint(t, m, nil)
+
+	dial := func() (net.Conn, string) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn, readLine(t, conn)
+	}
+
+	if _, got := dial(); got != "one" {
+		t.Fatalf("expected the first connection on one, got %q", got)
+	}
+	conn, got := dial()
+	if got != "two" {
+		t.Fatalf("expected the second connection on two, got %q", got)
+	}
+	_ = conn.Close()
+	<-closed
+	time.Sleep(50 * time.Millisecond) // the relay reports the closed connection right after
+
+	if _, got := dial(); got != "two" {
+		t.Errorf("expected two, which has no open connection left, got %q", got)
+	}
+}
+
+func TestServeConn_SkipsUnreachableServer(t *testing.T) {
+	down := listen(t)
+	unreachable := down.Addr().String()
+	_ = down.Close()
+
+	m := buildManager(t, &config.TCPCfg{
+		Services: map[string]*config.TCPServiceCfg{"db": tcpService("round-robin", unreachable, backend(t, listen(t), greeter("up")))},
+		Routers:  map[string]*config.TCPRouterCfg{"db": tcpRouter("ClientIP(`127.0.0.1`)", "db", nil)},
+	})
+	addr := entrypoint(t, m, nil)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readLine(t, conn); got != "up" {
+			t.Errorf("connection %d: expected the reachable server, got %q", i, got)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestServeConn_NoRouterClosesConnection(t *testing.T) {
+	m := buildManager(t, &config.TCPCfg{
+		Services: map[string]*config.TCPServiceCfg{"db": tcpService("round-robin", backend(t, listen(t), greeter("db")))},
+		Routers:  map[string]*config.TCPRouterCfg{"db": tcpRouter("ClientIP(`10.0.0.0/8`)", "db", nil)},
+	})
+
+	conn, err := net.Dial("tcp", entrypoint(t, m, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestCompileRoutes_SkipsHTTPMatchers(t *testing.T) {
+	m := buildManager(t, &config.TCPCfg{
+		Services: map[string]*config.TCPServiceCfg{"db": tcpService("round-robin", "127.0.0.1:5432")},
+		Routers: map[string]*config.TCPRouterCfg{
+			"path": tcpRouter("HostSNI(`*`) && PathPrefix(`/`)", "db", nil),
+			"ok":   tcpRouter("HostSNI(`db.test`) || ClientIP(`10.0.0.1`)", "db", nil),
+		},
+	})
+
+	routes := m.table.Load().(*table).routes
+	if len(routes) != 1 || routes[0].name != "ok" {
+		t.Fatalf("expected only the router without HTTP matchers, got %+v", routes)
+	}
+	if !routes[0].sni {
+		t.Error("expected a rule naming a server to need the ClientHello")
+	}
+}
@@ -0,0 +1,47 @@
+package tcp
+
+import (
+	"io"
+	"net"
+)
+
+// relay copies between client and backend, both ways, until both directions are done, and returns
+// how many bytes went each way.
+//
+// When one side is done sending, the other is told with a half close rather than a full one, so a
+// protocol where the client finishes its request before the answer comes still gets the answer. A
+// copy that fails closes both sides, which ends the other copy too.
+func relay(client, backend net.Conn) (sent, received int64) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := io.Copy(backend, client)
+		sent = n
+		if err != nil {
+			_ = client.Close()
+			_ = backend.Close()
+			return
+		}
+		closeWrite(backend)
+	}()
+
+	n, err := io.Copy(client, backend)
+	received = n
+	if err != nil {
+		_ = client.Close()
+		_ = backend.Close()
+	} else {
+		closeWrite(client)
+	}
+	<-done
+	return sent, received
+}
+
+// closeWrite half-closes conn when it can, and closes it otherwise.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,272 @@
+// Package udp proxies datagrams, taken on udp entrypoints, to the servers of UDP services, for DNS,
+// syslog, game traffic and anything else that runs over UDP.
+//
+// UDP has no connections, so the proxy keeps one of its own for each client: a session. The first
+// datagram from a client address picks a server with the service's balancer and opens a socket to
+// it, and the client's next datagrams go out on the same socket. Whatever the server sends back on
+// it goes to that client. A session that has seen no datagram either way for the service's
+// session_timeout ends, and counts as one finished request for the balancer.
+package udp
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/proxy/balancer"
+	"go.uber.org/zap"
+)
+
+// maxDatagramSize is the largest UDP payload there is; reading into a smaller buffer would cut
+// larger datagrams short.
+const maxDatagramSize = 64 * 1024
+
+var (
+	errNoRouter        = errors.New("udp: no router for this entrypoint")
+	errTooManySessions = errors.New("udp: the service has max_sessions open")
+)
+
+type router struct {
+	name        string
+	service     string
+	entrypoints []string
+}
+
+type service struct {
+	pool    *balancer.Pool
+	timeout time.Duration
+
+	// sessions counts the service's open sessions, on every entrypoint, against maxSessions.
+	sessions    atomic.Int64
+	maxSessions int64
+	// full is set while new clients are turned away, so that's logged once rather than per datagram.
+	full atomic.Bool
+}
+
+// table is everything one reload of the udp section built, swapped as a whole. Sessions keep the
+// service they started with until they end.
+type table struct {
+	routers  []router
+	services map[string]*service
+}
+
+type Manager struct {
+	table atomic.Value
+	logg  *zap.Logger
+	// entrypoints are the names of the udp entrypoints in asena.yaml, to warn about routers bound
+	// to one that doesn't exist. Nil when they aren't known.
+	entrypoints []string
+}
+
+func NewManager(logg *zap.Logger) *Manager {
+	m := &Manager{logg: logg}
+	m.table.Store(&table{services: make(map[string]*service)})
+	return m
+}
+
+// SetEntrypoints tells the manager which udp entrypoints exist. It's called once, before the first
+// Build.
+func (m *Manager) SetEntrypoints(names []string) {
+	m.entrypoints = names
+}
+
+// Build replaces the routers and services with the ones in cfg. A nil cfg removes them all.
+func (m *Manager) Build(cfg *config.UDPCfg) {
+	if cfg == nil {
+		cfg = &config.UDPCfg{}
+	}
+
+	tb := &table{services: make(map[string]*service, len(cfg.Services))}
+	for name, s := range cfg.Services {
+		lb := s.LoadBalancer
+		servers := make([]*config.ServerCfg, 0, len(lb.Servers))
+		for _, srv := range lb.Servers {
+			// The balancers know servers by URL; for UDP that's the address.
+			servers = append(servers, &config.ServerCfg{URL: srv.Address, Weight: srv.Weight})
+		}
+		tb.services[name] = &service{
+			pool:        balancer.NewPool(*lb.Algorithm, servers, nil),
+			timeout:     *lb.SessionTimeout,
+			maxSessions: int64(*lb.MaxSessions),
+		}
+		m.logg.Info("UDP service built", zap.String("service", name), zap.String("algorithm", *lb.Algorithm), zap.Int("servers_count", len(servers)))
+	}
+
+	for name, r := range cfg.Routers {
+		if r.Service == nil || tb.services[*r.Service] == nil {
+			m.logg.Warn("Skipping UDP router: service is missing", zap.String("router", name))
+			continue
+		}
+		for _, ep := range r.Entrypoints {
+			if m.entrypoints != nil && !slices.Contains(m.entrypoints, ep) {
+				m.logg.Warn("UDP router uses unknown udp entrypoint, it gets no datagrams from it", zap.String("router", name), zap.String("entrypoint", ep))
+			}
+		}
+		tb.routers = append(tb.routers, router{name: name, service: *r.Service, entrypoints: r.Entrypoints})
+	}
+
+	// A datagram has nothing to choose between routers with, so an entrypoint belongs to one router:
+	// the first by name of those that list it, or else of those that list no entrypoints.
+	sort.Slice(tb.routers, func(i, j int) bool { return tb.routers[i].name < tb.routers[j].name })
+	for _, ep := range m.entrypoints {
+		var taking []string
+		for _, r := range tb.routers {
+			if slices.Contains(r.entrypoints, ep) {
+				taking = append(taking, r.name)
+			}
+		}
+		if len(taking) > 1 {
+			m.logg.Warn("More than one UDP router uses the same entrypoint, only the first takes its datagrams", zap.String("entrypoint", ep), zap.Strings("routers", taking))
+		}
+	}
+
+	m.table.Store(tb)
+}
+
+// route returns the router that takes entrypoint's datagrams.
+func (tb *table) route(entrypoint string) (*router, error) {
+	for i := range tb.routers {
+		if slices.Contains(tb.routers[i].entrypoints, entrypoint) {
+			return &tb.routers[i], nil
+		}
+	}
+	for i := range tb.routers {
+		if len(tb.routers[i].entrypoints) == 0 {
+			return &tb.routers[i], nil
+		}
+	}
+	return nil, errNoRouter
+}
+
+// Serve proxies the datagrams that come in on conn, the socket of entrypoint, until conn is closed.
+// The sessions still open then are ended.
+func (m *Manager) Serve(entrypoint string, conn *net.UDPConn) {
+	var (
+		mu       sync.Mutex
+		sessions = make(map[string]*session)
+		wg       sync.WaitGroup
+	)
+
+	// open starts a session for client and adds it to sessions. It returns nil, having logged why,
+	// if it can't.
+	open := func(client *net.UDPAddr) *session {
+		key := client.String()
+		s, err := m.newSession(entrypoint, conn, client)
+		if errors.Is(err, errTooManySessions) {
+			// newSession warned when the service filled up.
+			m.logg.Debug("Dropping UDP datagram", zap.String("entrypoint", entrypoint), zap.String("client", key), zap.Error(err))
+			return nil
+		}
+		if err != nil {
+			m.logg.Warn("Dropping UDP datagram", zap.String("entrypoint", entrypoint), zap.String("client", key), zap.Error(err))
+			return nil
+		}
+		mu.Lock()
+		sessions[key] = s
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The session leaves the map before its socket is closed, so the client's next
+			// datagram starts a new session instead of going out on a closed one.
+			s.serve(m.logg, func() {
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			})
+		}()
+		return s
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			m.logg.Warn("[UDP] Failed to read datagram", zap.String("entrypoint", entrypoint), zap.Error(err))
+			continue
+		}
+
+		mu.Lock()
+		s := sessions[client.String()]
+		mu.Unlock()
+		if s == nil {
+			if s = open(client); s == nil {
+				continue
+			}
+		}
+
+		err = s.send(buf[:n])
+		if errors.Is(err, net.ErrClosed) {
+			// The session timed out between the lookup and the write, and has already left the
+			// map: the datagram goes out on a new one instead.
+			if s = open(client); s == nil {
+				continue
+			}
+			err = s.send(buf[:n])
+		}
+		if err != nil {
+			m.logg.Debug("Failed to send UDP datagram", zap.String("server", *s.server.URL), zap.Error(err))
+		}
+	}
+
+	mu.Lock()
+	for _, s := range sessions {
+		_ = s.backend.Close()
+	}
+	mu.Unlock()
+	wg.Wait()
+}
+
+// newSession picks a server for client and opens a socket to it, unless the service already has
+// max_sessions open.
+func (m *Manager) newSession(entrypoint string, conn *net.UDPConn, client *net.UDPAddr) (*session, error) {
+	tb := m.table.Load().(*table)
+	rt, err := tb.route(entrypoint)
+	if err != nil {
+		return nil, err
+	}
+	svc := tb.services[rt.service]
+
+	if svc.sessions.Add(1) > svc.maxSessions {
+		svc.sessions.Add(-1)
+		if svc.full.CompareAndSwap(false, true) {
+			m.logg.Warn("UDP service has max_sessions open, dropping datagrams from new clients",
+				zap.String("entrypoint", entrypoint), zap.String("service", rt.service), zap.Int64("max_sessions", svc.maxSessions))
+		}
+		return nil, errTooManySessions
+	}
+	server := svc.pool.Next(balancer.ClientRequest(client))
+	if server == nil {
+		svc.sessions.Add(-1)
+		return nil, errors.New("udp: no server available")
+	}
+	backend, err := net.Dial("udp", *server.URL)
+	if err != nil {
+		svc.sessions.Add(-1)
+		svc.pool.Done(server, 0, err)
+		return nil, err
+	}
+
+	s := &session{
+		entrypoint: entrypoint,
+		router:     rt.name,
+		service:    rt.service,
+		svc:        svc,
+		server:     server,
+		client:     client,
+		listener:   conn,
+		backend:    backend,
+		start:      time.Now(),
+	}
+	s.touch()
+	return s, nil
+}
@@ -0,0 +1,197 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap/zaptest"
+)
+
+func listen(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// backend starts a server that answers every datagram with name and the datagram, and returns its
+// address.
+func backend(t *testing.T, name string) string {
+	t.Helper()
+	conn := listen(t)
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(append([]byte(name+" "), buf[:n]...), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// entrypoint serves the "udp" entrypoint through m, and returns its address.
+func entrypoint(t *testing.T, m *Manager) string {
+	t.Helper()
+	conn := listen(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Serve("udp", conn)
+	}()
+	t.Cleanup(func() {
+		_ = conn.Close()
+		<-done
+	})
+	return conn.LocalAddr().String()
+}
+
+func buildManager(t *testing.T, cfg *config.UDPCfg) *Manager {
+	t.Helper()
+	m := NewManager(zaptest.NewLogger(t))
+	m.Build(cfg)
+	return m
+}
+
+func udpService(algorithm string, timeout time.Duration, addresses ...string) *config.UDPServiceCfg {
+	maxSessions := 100
+	lb := &config.UDPLoadBalancerCfg{Algorithm: &algorithm, SessionTimeout: &timeout, MaxSessions: &maxSessions}
+	for _, addr := range addresses {
+		lb.Servers = append(lb.Servers, &config.UDPServerCfg{Address: &addr})
+	}
+	return &config.UDPServiceCfg{LoadBalancer: lb}
+}
+
+func udpRouter(service string) *config.UDPRouterCfg {
+	return &config.UDPRouterCfg{Service: &service}
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// exchange sends msg on conn and returns the answer.
+func exchange(t *testing.T, conn net.Conn, msg string) string {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxDatagramSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("reading the answer to %q: %v", msg, err)
+	}
+	return string(buf[:n])
+}
+
+func TestServe_SessionKeepsItsServer(t *testing.T) {
+	m := buildManager(t, &config.UDPCfg{
+		Services: map[string]*config.UDPServiceCfg{"dns": udpService("round-robin", time.Minute, backend(t, "one"), backend(t, "two"))},
+		Routers:  map[string]*config.UDPRouterCfg{"dns": udpRouter("dns")},
+	})
+	addr := entrypoint(t, m)
+
+	first, second := dial(t, addr), dial(t, addr)
+	a := exchange(t, first, "a")
+	b := exchange(t, second, "b")
+	if a[:3] == b[:3] {
+		t.Fatalf("expected two clients on two servers with round-robin, got %q and %q", a, b)
+	}
+	for i := 0; i < 3; i++ {
+		if got := exchange(t, first, "again"); got != a[:3]+" again" {
+			t.Errorf("expected the first client to stay on its server, got %q", got)
+		}
+	}
+}
+
+func TestServe_SessionExpires(t *testing.T) {
+	m := buildManager(t, &config.UDPCfg{
+		Services: map[string]*config.UDPServiceCfg{"dns": udpService("round-robin", 100*time.Millisecond, backend(t, "one"), backend(t, "two"))},
+		Routers:  map[string]*config.UDPRouterCfg{"dns": udpRouter("dns")},
+	})
+	conn := dial(t, entrypoint(t, m))
+
+	before := exchange(t, conn, "a")
+	time.Sleep(300 * time.Millisecond)
+	if after := exchange(t, conn, "a"); after == before {
+		t.Errorf("expected a new session, balanced to the other server, after the timeout; got %q twice", after)
+	}
+}
+
+func TestServe_LeastConnectionsCountsOpenSessions(t *testing.T) {
+	m := buildManager(t, &config.UDPCfg{
+		Services: map[string]*config.UDPServiceCfg{"game": udpService("least-connections", time.Minute, backend(t, "one"), backend(t, "two"))},
+		Routers:  map[string]*config.UDPRouterCfg{"game": udpRouter("game")},
+	})
+	addr := entrypoint(t, m)
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[exchange(t, dial(t, addr), "x")]++
+	}
+	if seen["one x"] != 2 || seen["two x"] != 2 {
+		t.Errorf("expected the open sessions spread over both servers, got %v", seen)
+	}
+}
+
+func TestServe_MaxSessionsDropsNewClients(t *testing.T) {
+	svc := udpService("round-robin", 200*time.Millisecond, backend(t, "one"))
+	one := 1
+	svc.LoadBalancer.MaxSessions = &one
+	m := buildManager(t, &config.UDPCfg{
+		Services: map[string]*config.UDPServiceCfg{"dns": svc},
+		Routers:  map[string]*config.UDPRouterCfg{"dns": udpRouter("dns")},
+	})
+	addr := entrypoint(t, m)
+
+	first, second := dial(t, addr), dial(t, addr)
+	if got := exchange(t, first, "a"); got != "one a" {
+		t.Fatalf("expected the first client to get a session, got %q", got)
+	}
+	if _, err := second.Write([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	_ = second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := second.Read(make([]byte, maxDatagramSize)); err == nil {
+		t.Fatalf("expected the second client's datagram to be dropped, got an answer of %d bytes", n)
+	}
+
+	// Once the first session has expired, there's room again.
+	time.Sleep(300 * time.Millisecond)
+	if got := exchange(t, second, "b"); got != "one b" {
+		t.Errorf("expected the second client to get a session after the first ended, got %q", got)
+	}
+}
+
+func TestServe_RouterForEntrypoint(t *testing.T) {
+	syslog := udpRouter("syslog")
+	syslog.Entrypoints = []string{"other"}
+	m := buildManager(t, &config.UDPCfg{
+		Services: map[string]*config.UDPServiceCfg{
+			"dns":    udpService("round-robin", time.Minute, backend(t, "dns")),
+			"syslog": udpService("round-robin", time.Minute, backend(t, "syslog")),
+		},
+		Routers: map[string]*config.UDPRouterCfg{
+			"a-syslog": syslog,
+			"b-dns":    udpRouter("dns"),
+		},
+	})
+
+	if got := exchange(t, dial(t, entrypoint(t, m)), "x"); got != "dns x" {
+		t.Errorf("expected the router without entrypoints to take the udp entrypoint, got %q", got)
+	}
+}
@@ -0,0 +1,94 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap"
+)
+
+// session is one client's traffic to one server, through a socket of its own to that server.
+type session struct {
+	entrypoint, router, service string
+
+	svc      *service
+	server   *config.ServerCfg
+	client   *net.UDPAddr
+	listener *net.UDPConn
+	backend  net.Conn
+	start    time.Time
+
+	// lastActive is when the last datagram went either way, in Unix nanoseconds.
+	lastActive     atomic.Int64
+	sent, received atomic.Int64
+}
+
+func (s *session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// send passes one of the client's datagrams on to the server.
+func (s *session) send(b []byte) error {
+	s.touch()
+	if _, err := s.backend.Write(b); err != nil {
+		return err
+	}
+	s.sent.Add(int64(len(b)))
+	return nil
+}
+
+// serve sends the server's datagrams back to the client until the session has been idle for the
+// service's timeout, the server's socket fails, or it's closed because the entrypoint shut down.
+// It then calls forget, which takes the session off its entrypoint's map, closes the server's socket
+// and reports the session to the balancer as one finished request.
+func (s *session) serve(logg *zap.Logger, forget func()) {
+	var err error
+	buf := make([]byte, maxDatagramSize)
+	for {
+		deadline := time.Unix(0, s.lastActive.Load()).Add(s.svc.timeout)
+		if !time.Now().Before(deadline) {
+			break
+		}
+		_ = s.backend.SetReadDeadline(deadline)
+
+		n, rerr := s.backend.Read(buf)
+		if rerr != nil {
+			var ne net.Error
+			if errors.As(rerr, &ne) && ne.Timeout() {
+				// The client may have sent something since the deadline was set; check again.
+				continue
+			}
+			if !errors.Is(rerr, net.ErrClosed) {
+				// Most likely an ICMP port unreachable: nothing is listening on the server.
+				err = rerr
+			}
+			break
+		}
+
+		s.touch()
+		s.received.Add(int64(n))
+		if _, werr := s.listener.WriteToUDP(buf[:n], s.client); werr != nil {
+			logg.Debug("Failed to send UDP datagram", zap.String("client", s.client.String()), zap.Error(werr))
+		}
+	}
+	forget()
+	_ = s.backend.Close()
+	s.svc.sessions.Add(-1)
+	s.svc.full.Store(false)
+	s.svc.pool.Done(s.server, time.Since(s.start), err)
+
+	logg.Info("session",
+		zap.String("entrypoint", s.entrypoint),
+		zap.String("router", s.router),
+		zap.String("service", s.service),
+		zap.String("server", *s.server.URL),
+		zap.String("client", s.client.String()),
+		zap.Int64("bytes_sent", s.sent.Load()),
+		zap.Int64("bytes_received", s.received.Load()),
+		zap.Duration("duration", time.Since(s.start)),
+		zap.Error(err),
+	)
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"github.com/asenalabs/asena/internal/proxy/balancer"
+)
+
+// weightedService splits a service's requests between other services by weight, for things like
+// a canary release: 95 to api-v1, 5 to api-v2. Each of those keeps its own algorithm, health
+// checks, transport settings and so on; this only decides which of them gets the request.
+//
+// The split reuses WeightedRoundRobin: every service becomes a ServerCfg without a URL, carrying
+// just its weight, and picks are mapped back to the service's name.
+type weightedService struct {
+	pm  *Manager
+	wrr *balancer.WeightedRoundRobin
+	// byServer maps WeightedRoundRobin's picks back to service names.
+	byServer map[*config.ServerCfg]string
+
+	// With stickiness, byHash maps a cookie value back to a service name, like StickySession
+	// does for servers.
+	sticky       bool
+	byHash       map[string]string
+	cookieName   string
+	cookieMaxAge time.Duration
+	cookieSecure bool
+}
+
+func newWeightedService(pm *Manager, name string, cfg *config.WeightedCfg) *weightedService {
+	ws := &weightedService{
+		pm:       pm,
+		byServer: make(map[*config.ServerCfg]string),
+		byHash:   make(map[string]string),
+	}
+
+	var servers []*config.ServerCfg
+	for _, s := range cfg.Services {
+		// A weight of 0 takes a service out of the split without removing it from the config,
+		// for draining it. WeightedRoundRobin would treat it as 1, so it isn't given one.
+		if *s.Weight == 0 {
+			continue
+		}
+		server := &config.ServerCfg{Weight: s.Weight}
+		servers = append(servers, server)
+		ws.byServer[server] = *s.Name
+		ws.byHash[hashServiceName(*s.Name)] = *s.Name
+	}
+	ws.wrr = balancer.NewWeightedRoundRobin(servers)
+
+	if st := cfg.Sticky; st != nil {
+		ws.sticky = true
+		ws.cookieName = weightedCookieName(name)
+		if st.CookieName != nil {
+			ws.cookieName = *st.CookieName
+		}
+		ws.cookieMaxAge = *st.MaxAge
+		ws.cookieSecure = *st.Secure
+	}
+	return ws
+}
+
+// ServeHTTP picks a service and hands the request to it. A client with a cookie for a service
+// that is still in the split goes back to it. Anyone else is given a service by weight, and with
+// stickiness, a cookie for it: the cookie is only set when it changes, not refreshed on every
+// response, so cached responses aren't made uncacheable by a Set-Cookie.
+func (ws *weightedService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var service string
+	if ws.sticky {
+		if cookie, err := r.Cookie(ws.cookieName); err == nil {
+			service = ws.byHash[cookie.Value]
+		}
+	}
+	if service == "" {
+		service = ws.byServer[ws.wrr.Next(r)]
+		if ws.sticky {
+			cookie := &http.Cookie{
+				Name:     ws.cookieName,
+				Value:    hashServiceName(service),
+				Path:     "/",
+				MaxAge:   int(ws.cookieMaxAge.Seconds()),
+				Secure:   ws.cookieSecure,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			}
+			w.Header().Add("Set-Cookie", cookie.String())
+		}
+	}
+
+	if ok := ws.pm.ServeProxy(service, w, r); !ok {
+		writeProxyError(w, http.StatusBadGateway, "Service not available") // 502 Bad Gateway
+	}
+}
+
+// up reports whether any service in the split is up.
+func (ws *weightedService) up() bool {
+	for _, service := range ws.byServer {
+		if ws.pm.serviceUp(service) {
+			return true
+		}
+	}
+	return false
+}
+
+// weightedCookieName is the default sticky cookie name: one per weighted service, so two of them
+// on one site don't keep overwriting each other's cookie. Characters a cookie name can't have
+// become "_".
+func weightedCookieName(service string) string {
+	return "asena_" + strings.Map(func(r rune) rune {
+		if r > ' ' && r < 0x7f && !strings.ContainsRune(`()<>@,;:\"/[]?={}`, r) {
+			return r
+		}
+		return '_'
+	}, service)
+}
+
+// hashServiceName turns a service name into an opaque cookie value, for the same reasons
+// StickySession hashes server URLs.
+func hashServiceName(name string) string {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
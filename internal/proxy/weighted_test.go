@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap/zaptest"
+)
+
+// weightedServices builds "v1", "v2" and "v3", each over a backend that answers with its own name,
+// and a "canary" service that splits between them with the given weights.
+func weightedServices(t *testing.T, weights [3]uint, sticky *config.WeightedStickyCfg, breaker *config.CircuitBreakerCfg) *Manager {
+	t.Helper()
+
+	algo := "round-robin"
+	flash := 50 * time.Millisecond
+	services := map[string]*config.ServiceCfg{}
+	weighted := &config.WeightedCfg{Sticky: sticky}
+	for i, name := range []string{"v1", "v2", "v3"} {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/fail" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = io.WriteString(w, name)
+		}))
+		t.Cleanup(backend.Close)
+
+		u := backend.URL
+		services[name] = &config.ServiceCfg{LoadBalancer: &config.LoadBalancerCfg{
+			Algorithm: &algo, FlashInterval: &flash, Servers: []*config.ServerCfg{{URL: &u}},
+		}}
+		weighted.Services = append(weighted.Services, &config.WeightedServiceCfg{Name: &name, Weight: &weights[i]})
+	}
+	services["canary"] = &config.ServiceCfg{Weighted: weighted, CircuitBreaker: breaker}
+
+	pm := NewProxyManger(zaptest.NewLogger(t))
+	pm.BuildReverseProxy(&config.HTTPCfg{Services: services, Routers: map[string]*config.RoutersCfg{}}, testTransportCfg())
+	return pm
+}
+
+func TestWeightedService_SplitsByWeight(t *testing.T) {
+	pm := weightedServices(t, [3]uint{19, 1, 0}, nil, nil)
+
+	got := map[string]int{}
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		if ok := pm.ServeProxy("canary", w, httptest.NewRequest("GET", "http://a.com/", nil)); !ok {
+			t.Fatal("expected the weighted service to be served")
+		}
+		got[w.Body.String()]++
+	}
+
+	if got["v1"] != 95 || got["v2"] != 5 || got["v3"] != 0 {
+		t.Errorf("expected a 95/5 split with nothing for weight 0, got %v", got)
+	}
+}
+
+func TestWeightedService_StickyCookie(t *testing.T) {
+	maxAge := time.Hour
+	secure := false
+	pm := weightedServices(t, [3]uint{1, 1, 0}, &config.WeightedStickyCfg{MaxAge: &maxAge, Secure: &secure}, nil)
+
+	w := httptest.NewRecorder()
+	pm.ServeProxy("canary", w, httptest.NewRequest("GET", "http://a.com/", nil))
+	first := w.Body.String()
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "asena_canary" || cookies[0].MaxAge != 3600 {
+		t.Fatalf("expected a sticky cookie, got %v", w.Header().Values("Set-Cookie"))
+	}
+
+	for i := 0; i < 5; i++ {
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		r.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		pm.ServeProxy("canary", w, r)
+		if w.Body.String() != first {
+			t.Fatalf("request %d: expected to stay on %s, got %s", i, first, w.Body.String())
+		}
+		if w.Header().Get("Set-Cookie") != "" {
+			t.Fatal("expected the cookie not to be set again")
+		}
+	}
+
+	// A cookie for a service that left the split is ignored.
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.AddCookie(&http.Cookie{Name: "asena_canary", Value: hashServiceName("v3")})
+	w = httptest.NewRecorder()
+	pm.ServeProxy("canary", w, r)
+	if w.Body.String() == "v3" || w.Header().Get("Set-Cookie") == "" {
+		t.Errorf("expected a new pick and cookie, got %s", w.Body.String())
+	}
+}
+
+func TestWeightedService_BreakerCountsThePickedService(t *testing.T) {
+	failures := 2
+	breaker := &config.CircuitBreakerCfg{ConsecutiveFailures: &failures}
+	testBreaker(breaker) // fill in defaults
+	pm := weightedServices(t, [3]uint{1, 1, 1}, nil, breaker)
+
+	for i := 0; i < 2; i++ {
+		pm.ServeProxy("canary", httptest.NewRecorder(), httptest.NewRequest("GET", "http://a.com/fail", nil))
+	}
+
+	w := httptest.NewRecorder()
+	pm.ServeProxy("canary", w, httptest.NewRequest("GET", "http://a.com/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the weighted service's breaker to open on its services' 5xx, got %d", w.Code)
+	}
+}
+
+func TestWeightedCookieName(t *testing.T) {
+	if got := weightedCookieName("api canary/v2"); got != "asena_api_canary_v2" {
+		t.Errorf("got %q", got)
+	}
+}
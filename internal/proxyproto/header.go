@@ -0,0 +1,194 @@
+// Package proxyproto reads and writes HAProxy's PROXY protocol headers, versions 1 and 2. A proxy
+// working at the TCP level, like an L4 load balancer, sends one at the start of each connection to
+// tell the server behind it who the connection is really from.
+//
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// v2Signature starts every version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLength is the longest a version 1 header can be, CRLF included.
+const v1MaxLength = 107
+
+var errInvalidHeader = errors.New("proxyproto: invalid PROXY protocol header")
+
+// Header is one PROXY protocol header. Without Source, it says nothing about the client: version 1
+// sends "UNKNOWN" and version 2 the LOCAL command, which is how health checks and other connections
+// of the proxy's own are sent.
+type Header struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// Format returns the header as sent on the wire. Source and Destination are sent as one family:
+// a Destination missing or of the other family becomes the unspecified address of Source's family.
+func (h *Header) Format() []byte {
+	src, dst := h.Source, h.Destination
+	if src != nil {
+		src = &net.TCPAddr{IP: src.IP, Port: src.Port}
+		if ip4 := src.IP.To4(); ip4 != nil {
+			src.IP = ip4
+		}
+		if dst == nil || (dst.IP.To4() == nil) != (src.IP.To4() == nil) {
+			dst = &net.TCPAddr{IP: net.IPv6unspecified}
+			if src.IP.To4() != nil {
+				dst.IP = net.IPv4zero.To4()
+			}
+		}
+	}
+
+	if h.Version == 1 {
+		switch {
+		case src == nil:
+			return []byte("PROXY UNKNOWN\r\n")
+		case src.IP.To4() != nil:
+			return fmt.Appendf(nil, "PROXY TCP4 %s %s %d %d\r\n", src.IP, dst.IP.To4(), src.Port, dst.Port)
+		default:
+			return fmt.Appendf(nil, "PROXY TCP6 %s %s %d %d\r\n", src.IP, dst.IP.To16(), src.Port, dst.Port)
+		}
+	}
+
+	b := append([]byte(nil), v2Signature...)
+	if src == nil {
+		// LOCAL command, no address family, no addresses.
+		return append(b, 0x20, 0x00, 0x00, 0x00)
+	}
+	var addrs []byte
+	family := byte(0x21) // TCP over IPv6
+	if ip4 := src.IP.To4(); ip4 != nil {
+		family = 0x11 // TCP over IPv4
+		addrs = append(append(addrs, ip4...), dst.IP.To4()...)
+	} else {
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+
+	b = append(b, 0x21, family) // version 2, PROXY command
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+// Read reads a PROXY protocol header off the start of r. It returns a nil Header and no error when
+// the connection doesn't start with one, having read nothing.
+func Read(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		if start, err := r.Peek(6); err != nil || string(start) != "PROXY " {
+			return nil, nil
+		}
+		return readV1(r)
+	case '\r':
+		if start, err := r.Peek(len(v2Signature)); err != nil || !bytes.Equal(start, v2Signature) {
+			return nil, nil
+		}
+		return readV2(r)
+	}
+	return nil, nil
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidHeader
+	}
+	src, err1 := parseV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	dst, err2 := parseV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err1 != nil || err2 != nil {
+		return nil, errInvalidHeader
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseV1Addr(ip, port string, v4 bool) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (addr.To4() != nil) != v4 {
+		return nil, errInvalidHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errInvalidHeader
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	verCmd, family := fixed[12], fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:]))
+	if verCmd>>4 != 2 {
+		return nil, errInvalidHeader
+	}
+	// The rest, TLVs included, is read in full so the connection's own data comes next.
+	rest := make([]byte, length)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL: the proxy's own connection, the addresses are ignored
+		return h, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errInvalidHeader
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, errInvalidHeader
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(rest[0:4]), Port: int(binary.BigEndian.Uint16(rest[8:]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(rest[4:8]), Port: int(binary.BigEndian.Uint16(rest[10:]))}
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, errInvalidHeader
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(rest[0:16]), Port: int(binary.BigEndian.Uint16(rest[32:]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(rest[16:32]), Port: int(binary.BigEndian.Uint16(rest[34:]))}
+	}
+	// Any other family (UDP, unix sockets, unspecified) has no TCP addresses to give.
+	return h, nil
+}
@@ -0,0 +1,150 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeader_RoundTrip(t *testing.T) {
+	v4 := &Header{Source: &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 51000}, Destination: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}}
+	v6 := &Header{Source: &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51000}, Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}}
+
+	for _, version := range []int{1, 2} {
+		for _, h := range []*Header{v4, v6, {}} {
+			h.Version = version
+			wire := append(h.Format(), "GET / HTTP/1.1\r\n"...)
+			r := bufio.NewReader(bytes.NewReader(wire))
+
+			got, err := Read(r)
+			if err != nil {
+				t.Fatalf("v%d %v: %v", version, h.Source, err)
+			}
+			if got == nil || got.Version != version || got.Source.String() != h.Source.String() || got.Destination.String() != h.Destination.String() {
+				t.Errorf("v%d: expected %+v back, got %+v", version, h, got)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("v%d: expected the connection's data after the header, got %q", version, rest)
+			}
+		}
+	}
+}
+
+func TestHeader_FormatV1(t *testing.T) {
+	h := &Header{Version: 1, Source: &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 51000}}
+	if got := string(h.Format()); got != "PROXY TCP4 198.51.100.7 0.0.0.0 51000 0\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestRead_NoHeader(t *testing.T) {
+	for _, data := range []string{"GET / HTTP/1.1\r\n", "PUT / HTTP/1.1\r\n", "\r\nGET / HTTP/1.1\r\n"} {
+		r := bufio.NewReader(strings.NewReader(data))
+		if h, err := Read(r); h != nil || err != nil {
+			t.Errorf("%q: expected no header, got %+v, %v", data, h, err)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != data {
+			t.Errorf("%q: expected nothing to be read, got %q", data, rest)
+		}
+	}
+}
+
+func TestRead_Invalid(t *testing.T) {
+	for _, data := range []string{
+		"PROXY TCP4 198.51.100.7 192.0.2.1 51000\r\n",
+		"PROXY TCP4 2001:db8::7 192.0.2.1 51000 443\r\n",
+		"PROXY TCP4 198.51.100.7 192.0.2.1 51000 443" + strings.Repeat(" ", 100) + "\r\n",
+		string(v2Signature) + "\x11\x11\x00\x00",
+	} {
+		if _, err := Read(bufio.NewReader(strings.NewReader(data))); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
+
+func TestListener_OnlyTrustedAddresses(t *testing.T) {
+	for _, tt := range []struct {
+		trusted string
+		want    string
+	}{
+		{"127.0.0.0/8", "198.51.100.7:51000"},
+		{"10.0.0.0/8", ""},
+	} {
+		_, n, _ := net.ParseCIDR(tt.trusted)
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln := NewListener(inner, []*net.IPNet{n})
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, r.RemoteAddr)
+		})}
+		go func() { _ = srv.Serve(ln) }()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.WriteString(conn, "PROXY TCP4 198.51.100.7 192.0.2.1 51000 443\r\nGET / HTTP/1.1\r\nHost: a.com\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = conn.Close()
+		_ = srv.Close()
+
+		if tt.want == "" {
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("trusting %s: expected the header to be bad input from an untrusted address, got %d", tt.trusted, resp.StatusCode)
+			}
+		} else if string(body) != tt.want {
+			t.Errorf("trusting %s: expected RemoteAddr %s, got %q", tt.trusted, tt.want, body)
+		}
+	}
+}
+
+func TestListener_TrustedConnectionWithoutHeaderWhereServerSpeaksFirst(t *testing.T) {
+	defer func(d time.Duration) { headerTimeout = d }(headerTimeout)
+	headerTimeout = 50 * time.Millisecond
+
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, []*net.IPNet{n})
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.RemoteAddr()
+		_, _ = io.WriteString(conn, "220 ready\r\n")
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		_, _ = io.WriteString(conn, "echo "+line)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(conn)
+	if greeting, err := br.ReadString('\n'); err != nil || greeting != "220 ready\r\n" {
+		t.Fatalf("expected the server's greeting, got %q (%v)", greeting, err)
+	}
+	_, _ = io.WriteString(conn, "QUIT\r\n")
+	if reply, err := br.ReadString('\n'); err != nil || reply != "echo QUIT\r\n" {
+		t.Errorf("expected reads to work after the header timed out, got %q (%v)", reply, err)
+	}
+}
@@ -0,0 +1,149 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// headerTimeout bounds how long a connection may wait for a header. A connection that sends nothing
+// in that time has none, which is how a trusted connection for a protocol where the server speaks
+// first looks. It is a variable so tests can shorten it.
+var headerTimeout = 5 * time.Second
+
+// Listener reads a PROXY protocol header off connections from trusted addresses, and makes their
+// RemoteAddr and LocalAddr the ones the header names. Anyone could send a header, so one from any
+// other address isn't read: the connection is handed on as it is, and a header on it is just bad
+// input to whatever reads it next.
+//
+// A connection from a trusted address doesn't have to send a header. Without one, it is handed on as
+// it is too: a connection that starts with anything else, or sends nothing for headerTimeout, has no
+// header.
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// NewListener wraps inner, reading headers from connections whose address is in trusted.
+func NewListener(inner net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{Listener: inner, trusted: trusted}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusts(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &Conn{Conn: c, br: bufio.NewReader(c)}, nil
+}
+
+func (l *Listener) trusts(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from a trusted address. Its header is read on the first call to Read,
+// RemoteAddr or LocalAddr rather than in Accept, so one slow peer can't hold up accepting others.
+type Conn struct {
+	net.Conn
+	br *bufio.Reader
+
+	once   sync.Once
+	header *Header
+	err    error
+
+	// mu guards readDeadline, the last one set by the caller, which readHeader puts back once its
+	// own is no longer needed.
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// readHeader reads the header with a deadline of headerTimeout, or the caller's if that comes first,
+// and leaves the caller's in place after.
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		deadline := time.Now().Add(headerTimeout)
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+			deadline = c.readDeadline
+		}
+		c.mu.Unlock()
+
+		_ = c.Conn.SetReadDeadline(deadline)
+		c.header, c.err = Read(c.br)
+		var ne net.Error
+		if errors.As(c.err, &ne) && ne.Timeout() && c.br.Buffered() == 0 {
+			// Nothing came at all, so there's no header: the client is waiting for the server.
+			c.err = nil
+		}
+
+		c.mu.Lock()
+		_ = c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+	})
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Read reads the connection's data, after the header. A connection that sent a broken header
+// fails every Read, so the server closes it.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the client's address from the header, or without one, the connection's.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to from the header, or without one, the
+// connection's.
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite shuts down the writing side of the connection, when the connection underneath can,
+// and closes it otherwise.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
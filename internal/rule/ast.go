@@ -65,3 +65,33 @@ func (n *NotNode) Match(r *http.Request) bool {
 func (n *NotNode) Specificity() int {
 	return n.Child.Specificity() + 5
 }
+
+// Hosts returns the hosts of the Host matchers in n that a request can match on, the ones that aren't
+// under a NotNode. It's how Asena knows which names to get certificates for.
+func Hosts(n Node) []string {
+	switch n := n.(type) {
+	case *AndNode:
+		return append(Hosts(n.Left), Hosts(n.Right)...)
+	case *OrNode:
+		return append(Hosts(n.Left), Hosts(n.Right)...)
+	case *HostNode:
+		return []string{n.Host()}
+	}
+	return nil
+}
+
+// UsesJWTClaim reports whether n has a JWTClaim matcher anywhere, under a NotNode too. Those read a
+// token whose signature nobody has checked yet, so the router needs a jwt middleware.
+func UsesJWTClaim(n Node) bool {
+	switch n := n.(type) {
+	case *AndNode:
+		return UsesJWTClaim(n.Left) || UsesJWTClaim(n.Right)
+	case *OrNode:
+		return UsesJWTClaim(n.Left) || UsesJWTClaim(n.Right)
+	case *NotNode:
+		return UsesJWTClaim(n.Child)
+	case *JWTClaimNode:
+		return true
+	}
+	return false
+}
@@ -135,3 +135,14 @@ func TestSpecificity_NestedTree_MatchesWorkedExample(t *testing.T) {
 		t.Errorf("nested AND specificity = %d, want %d", got, want)
 	}
 }
+
+func TestHosts_SkipsNegatedHosts(t *testing.T) {
+	tree, err := ParseRule("(Host(`A.example.com`) || Host(`b.example.com`)) && !Host(`c.example.com`) && PathPrefix(`/`)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := Hosts(tree)
+	if len(got) != 2 || got[0] != "a.example.com" || got[1] != "b.example.com" {
+		t.Errorf("expected a.example.com and b.example.com, got %v", got)
+	}
+}
@@ -5,6 +5,10 @@ import (
 	"net"
 	"net/http"
 	"strings"
+
+	"github.com/asenalabs/asena/internal/clientcert"
+	"github.com/asenalabs/asena/internal/clientip"
+	"github.com/asenalabs/asena/internal/jwtclaims"
 )
 
 // buildLeaf turns one matcher call, like "Host(`example.com`)", into a real matcher. This is the
@@ -24,6 +28,12 @@ func buildLeaf(raw string) (Node, error) {
 		// Lowercase it once, here, so Match never has to think about case.
 		return &HostNode{host: strings.ToLower(args[0])}, nil
 
+	case "HostSNI":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("rule: HostSNI expects exactly 1 argument, got %d in %q", len(args), raw)
+		}
+		return &HostSNINode{host: strings.ToLower(args[0])}, nil
+
 	case "PathPrefix":
 		if len(args) != 1 {
 			return nil, fmt.Errorf("rule: PathPrefix expects exactly 1 argument, got %d in %q", len(args), raw)
@@ -54,8 +64,20 @@ func buildLeaf(raw string) (Node, error) {
 		}
 		return newClientIPNode(args[0])
 
+	case "JWTClaim":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("rule: JWTClaim expects exactly 2 arguments (claim, value), got %d in %q", len(args), raw)
+		}
+		return &JWTClaimNode{claim: args[0], val: args[1]}, nil
+
+	case "ClientCertSAN":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("rule: ClientCertSAN expects exactly 1 argument, got %d in %q", len(args), raw)
+		}
+		return &ClientCertSANNode{san: args[0]}, nil
+
 	default:
-		return nil, fmt.Errorf("rule: unknown matcher %q in %q (supported: Host, PathPrefix, Method, Header)", name, raw)
+		return nil, fmt.Errorf("rule: unknown matcher %q in %q (supported: Host, HostSNI, PathPrefix, Path, Method, Header, ClientIP, JWTClaim, ClientCertSAN)", name, raw)
 	}
 }
 
@@ -72,10 +94,36 @@ func (n *HostNode) Match(r *http.Request) bool {
 	return h == n.host
 }
 
+// Host returns the host the node matches, lowercased.
+func (n *HostNode) Host() string { return n.host }
+
 // Specificity, a Host match only narrows down which site. It says nothing about which
 // path, method, or header - so it scores lower than the others below.
 func (n *HostNode) Specificity() int { return 15 }
 
+// HostSNINode matches the server name the client asked for in its TLS handshake (SNI). The
+// host "*" matches every connection, TLS or not; any other host only matches TLS connections
+// that asked for it. TCP routers match on it, since a raw connection has no Host header.
+type HostSNINode struct{ host string }
+
+func (n *HostSNINode) Match(r *http.Request) bool {
+	if n.host == "*" {
+		return true
+	}
+	return r.TLS != nil && strings.ToLower(r.TLS.ServerName) == n.host
+}
+
+// Host returns the server name the node matches, "*" for any.
+func (n *HostSNINode) Host() string { return n.host }
+
+// Specificity is the same as Host's. HostSNI(`*`) matches everything, so it scores nothing.
+func (n *HostSNINode) Specificity() int {
+	if n.host == "*" {
+		return 0
+	}
+	return 15
+}
+
 // PathPrefixNode matches when the request path starts with prefix.
 type PathPrefixNode struct{ prefix string }
 
@@ -154,14 +202,10 @@ func newClientIPNode(raw string) (*ClientIPNode, error) {
 	return &ClientIPNode{single: ip}, nil
 }
 
-// Match reads the client's address straight from the TCP connection (r.RemoteAddr), never from a header like X-Forwarded-For.
-// A header is just text the client sent, anyone can put any value in it. RemoteAddr is not, it isthe actual socket Go accepted
-// the connection on, so it cannot be spoofed the way a header can.
+// Match reads the client's address through clientip.FromRequest, the same as the balancer does: the TCP connection's address,
+// or behind trusted_proxies, the client they forwarded the request for. A header the client itself sent is never believed.
 func (n *ClientIPNode) Match(r *http.Request) bool {
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		host = r.RemoteAddr
-	}
+	host := clientip.FromRequest(r)
 
 	ip := net.ParseIP(host)
 	if ip == nil {
@@ -194,6 +238,53 @@ func (n *ClientIPNode) Specificity() int {
 	return 128
 }
 
+// JWTClaimNode matches when the bearer token in the Authorization header has a claim with this
+// value, or, for a list claim like roles, has the value in the list. The claim name can reach into
+// nested objects with dots, like "realm_access.roles".
+//
+// Routing happens before any middleware runs, so the token's signature is NOT checked here: anyone
+// can send a token that claims role=admin. That's fine for choosing where a request goes, as long as
+// the router it lands on has a jwt middleware, which then rejects the forged token. The proxy skips a
+// router whose rule uses JWTClaim without one (see UsesJWTClaim).
+type JWTClaimNode struct{ claim, val string }
+
+func (n *JWTClaimNode) Match(r *http.Request) bool {
+	token := jwtclaims.BearerToken(r)
+	if token == "" {
+		return false
+	}
+	claims, err := jwtclaims.Decode(token)
+	if err != nil {
+		return false
+	}
+	return jwtclaims.Has(claims, n.claim, n.val)
+}
+
+// Specificity is the same as Header's. A claim is a value inside a header, and just as narrow.
+func (n *JWTClaimNode) Specificity() int { return 30 }
+
+// ClientCertSANNode matches when the client authenticated with a certificate that has this subject
+// alternative name: a DNS name, email address, IP address or URI, ignoring letter case.
+// Only a certificate verified against the entrypoint's client_auth CA bundle counts, so unlike
+// JWTClaim, what it matches can't be forged.
+type ClientCertSANNode struct{ san string }
+
+func (n *ClientCertSANNode) Match(r *http.Request) bool {
+	cert := clientcert.Verified(r)
+	if cert == nil {
+		return false
+	}
+	for _, san := range clientcert.SANs(cert) {
+		if strings.EqualFold(san, n.san) {
+			return true
+		}
+	}
+	return false
+}
+
+// Specificity is the same as Header's. It names one client exactly.
+func (n *ClientCertSANNode) Specificity() int { return 30 }
+
 // parseFunc splits a matcher call, like "Host(`example.com`)", into its
 // name ("Host") and its arguments (["example.com"]).
 func parseFunc(raw string) (name string, args []string, err error) {
@@ -1,6 +1,9 @@
 package rule
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"net/http"
 	"testing"
 )
@@ -25,6 +28,50 @@ func TestHostNode_MatchIgnoresPortAndCase(t *testing.T) {
 	}
 }
 
+func TestHostSNINode_Match(t *testing.T) {
+	node := &HostSNINode{host: "db.example.com"}
+	wildcard := &HostSNINode{host: "*"}
+
+	plain := &http.Request{}
+	if node.Match(plain) {
+		t.Error("expected a connection without TLS not to match a server name")
+	}
+	if !wildcard.Match(plain) {
+		t.Error("expected HostSNI(`*`) to match a connection without TLS")
+	}
+
+	for name, want := range map[string]bool{"db.example.com": true, "DB.Example.com": true, "other.com": false, "": false} {
+		r := &http.Request{TLS: &tls.ConnectionState{ServerName: name}}
+		if got := node.Match(r); got != want {
+			t.Errorf("SNI=%q: Match() = %v, want %v", name, got, want)
+		}
+	}
+	if wildcard.Specificity() >= node.Specificity() {
+		t.Error("expected HostSNI(`*`) to score lower than a server name")
+	}
+}
+
+func TestClientCertSANNode_Match(t *testing.T) {
+	node := &ClientCertSANNode{san: "partner.example.com"}
+	cert := &x509.Certificate{DNSNames: []string{"Partner.Example.com"}}
+
+	verified := &http.Request{TLS: &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}}
+	if !node.Match(verified) {
+		t.Error("expected a verified certificate with the SAN to match")
+	}
+
+	unverified := &http.Request{TLS: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}}
+	if node.Match(unverified) {
+		t.Error("expected a certificate that wasn't verified not to match")
+	}
+	if node.Match(&http.Request{}) {
+		t.Error("expected a request without TLS not to match")
+	}
+}
+
 func TestPathPrefixNode_Match(t *testing.T) {
 	node := &PathPrefixNode{prefix: "/api/v2"}
 
@@ -216,3 +263,41 @@ func TestParseArgs_NotBacktickQuoted(t *testing.T) {
 		t.Fatal("expected an error for an argument with no backticks")
 	}
 }
+
+// unsignedJWT builds a token with these claims and a junk signature. JWTClaim never checks it.
+func unsignedJWT(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." + enc.EncodeToString([]byte(claims)) + ".c2ln"
+}
+
+func TestJWTClaimNode_Match(t *testing.T) {
+	node, err := buildLeaf("JWTClaim(`role`, `admin`)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nested, _ := buildLeaf("JWTClaim(`realm_access.roles`, `admin`)")
+
+	cases := []struct {
+		name string
+		auth string
+		node Node
+		want bool
+	}{
+		{"string claim", "Bearer " + unsignedJWT(`{"role":"admin"}`), node, true},
+		{"list claim", "bearer " + unsignedJWT(`{"role":["user","admin"]}`), node, true},
+		{"other value", "Bearer " + unsignedJWT(`{"role":"user"}`), node, false},
+		{"nested claim", "Bearer " + unsignedJWT(`{"realm_access":{"roles":["admin"]}}`), nested, true},
+		{"no token", "", node, false},
+		{"not a JWT", "Bearer abc", node, false},
+		{"basic auth", "Basic YWRtaW46YWRtaW4=", node, false},
+	}
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "http://x/", nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		if got := c.node.Match(r); got != c.want {
+			t.Errorf("%s: Match() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
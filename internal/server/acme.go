@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig describes where ACME certificates come from, and for which names.
+type ACMEConfig struct {
+	Email string
+	// CAServer is the URL of the CA's ACME directory.
+	CAServer string
+	// Storage is the directory the account key and certificates are kept in.
+	Storage string
+	// Domains, when set, are the only names certificates are obtained for. Otherwise they're the
+	// hosts given to SetHosts.
+	Domains []string
+	Logg    *zap.Logger
+}
+
+// ACME obtains certificates from an ACME CA, answering its TLS-ALPN-01 challenges in GetCertificate
+// and its HTTP-01 challenges in the handler HTTPHandler wraps. A certificate is obtained on the first
+// handshake that asks for its name, kept in Storage, and renewed in the background before it expires.
+type ACME struct {
+	mgr     *autocert.Manager
+	domains []string
+	// hosts are the hosts of the Host matchers in the current dynamic config.
+	hosts atomic.Pointer[[]string]
+	logg  *zap.Logger
+}
+
+func NewACME(cfg ACMEConfig) *ACME {
+	a := &ACME{domains: cfg.Domains, logg: cfg.Logg}
+	a.hosts.Store(&[]string{})
+	a.mgr = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.Storage),
+		HostPolicy: a.hostPolicy,
+		Client:     &acme.Client{DirectoryURL: cfg.CAServer},
+		Email:      cfg.Email,
+	}
+	return a
+}
+
+// SetHosts replaces the hosts certificates are obtained for, unless the config lists its own domains.
+// It's called on every reload of dynamic.yaml.
+func (a *ACME) SetHosts(hosts []string) {
+	if len(a.domains) > 0 {
+		return
+	}
+	a.hosts.Store(&hosts)
+}
+
+// Covers reports whether name is one certificates are obtained for.
+func (a *ACME) Covers(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if len(a.domains) > 0 {
+		return slices.Contains(a.domains, name)
+	}
+	return slices.Contains(*a.hosts.Load(), name)
+}
+
+func (a *ACME) hostPolicy(_ context.Context, host string) error {
+	if !a.Covers(host) {
+		return fmt.Errorf("[ACME] no certificate is obtained for %q", host)
+	}
+	return nil
+}
+
+// GetCertificate answers TLS-ALPN-01 challenges, and returns the certificate for every other handshake
+// with a name it Covers, obtaining it first if it has none yet.
+func (a *ACME) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := a.mgr.GetCertificate(hello)
+	if err != nil {
+		a.logg.Warn("[ACME] Failed to get certificate", zap.String("server_name", hello.ServerName), zap.Error(err))
+	}
+	return cert, err
+}
+
+// HTTPHandler answers the CA's HTTP-01 challenges for the names ACME Covers, and hands every other
+// request to next, including challenges for other names, which a backend may be answering itself.
+func (a *ACME) HTTPHandler(next http.Handler) http.Handler {
+	challenge := a.mgr.HTTPHandler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") && a.Covers(host) {
+			challenge.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isChallenge reports whether hello is the CA connecting for a TLS-ALPN-01 challenge.
+func isChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// challengeConfig returns a GetConfigForClient for an entrypoint with base's config that asks for
+// client certificates. The CA has none to send, so its TLS-ALPN-01 connection gets base without
+// ClientAuth. Such a handshake only completes with the certificate of a challenge in progress, and
+// refuseChallengeRequests keeps the connection from carrying requests after it.
+func challengeConfig(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !isChallenge(hello) {
+			return nil, nil
+		}
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.ClientAuth = tls.NoClientCert
+		c.NextProtos = []string{acme.ALPNProto}
+		return c, nil
+	}
+}
+
+// refuseChallengeRequests turns away requests on a connection that negotiated acme-tls/1, which
+// challengeConfig let in without a client certificate.
+func refuseChallengeRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && r.TLS.NegotiatedProtocol == acme.ALPNProto {
+			http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/crypto/acme"
+)
+
+// newTestACME returns an ACME whose CA can't be reached.
+func newTestACME(t *testing.T, domains ...string) *ACME {
+	t.Helper()
+	return NewACME(ACMEConfig{
+		CAServer: "http://127.0.0.1:1/directory",
+		Storage:  t.TempDir(),
+		Domains:  domains,
+		Logg:     zaptest.NewLogger(t),
+	})
+}
+
+func TestACME_Covers(t *testing.T) {
+	fromRules := newTestACME(t)
+	fromRules.SetHosts([]string{"a.example.com"})
+	if !fromRules.Covers("A.example.com.") || fromRules.Covers("b.example.com") {
+		t.Error("expected only the hosts from the rules to be covered")
+	}
+
+	listed := newTestACME(t, "b.example.com")
+	listed.SetHosts([]string{"a.example.com"})
+	if listed.Covers("a.example.com") || !listed.Covers("b.example.com") {
+		t.Error("expected only the listed domains to be covered when there are some")
+	}
+}
+
+func TestACME_HTTPHandler(t *testing.T) {
+	a := newTestACME(t, "a.example.com")
+	h := a.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	tests := []struct {
+		name, target string
+		want         int
+	}{
+		{"other path", "http://a.example.com/", http.StatusTeapot},
+		{"challenge for another name", "http://b.example.com/.well-known/acme-challenge/token", http.StatusTeapot},
+		{"unknown challenge", "http://a.example.com/.well-known/acme-challenge/token", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}
+
+func TestCertManager_ACMEFallsBackToFile(t *testing.T) {
+	certFile, keyFile := generateCertKey(t)
+	cm, err := NewCertManager(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, _ := cm.Get()
+	cm.SetACME(newTestACME(t, "a.example.com"))
+
+	for _, name := range []string{"other.example.com", "a.example.com"} {
+		cert, err := cm.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if cert != file {
+			t.Errorf("%s: expected the certificate from the files", name)
+		}
+	}
+}
+
+func TestChallengeConfig_DropsClientAuthForTheCA(t *testing.T) {
+	base := &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, NextProtos: []string{"h2", "http/1.1", acme.ALPNProto}}
+	base.GetConfigForClient = challengeConfig(base)
+
+	if c, err := base.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{"h2", "http/1.1"}}); c != nil || err != nil {
+		t.Errorf("expected clients to keep the entrypoint's config, got %v, %v", c, err)
+	}
+	c, err := base.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ClientAuth != tls.NoClientCert || len(c.NextProtos) != 1 || c.NextProtos[0] != acme.ALPNProto {
+		t.Errorf("expected the CA to get acme-tls/1 without client certificates, got %v and %v", c.ClientAuth, c.NextProtos)
+	}
+	if base.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Error("expected the entrypoint's own config to be left alone")
+	}
+
+	h := refuseChallengeRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest(http.MethodGet, "https://a.example.com/", nil)
+	r.TLS = &tls.ConnectionState{NegotiatedProtocol: acme.ALPNProto}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusMisdirectedRequest {
+		t.Errorf("expected a request over acme-tls/1 to be refused, got %d", rec.Code)
+	}
+}
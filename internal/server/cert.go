@@ -2,14 +2,25 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap"
 )
 
 type CertManager struct {
 	mu   sync.RWMutex
 	cert *tls.Certificate
+	// acme, when set, gives the certificates for the names it covers; cert is for every other name,
+	// and for those too while the CA can't be reached.
+	acme *ACME
+	// store, when set, has the certificates of dynamic.yaml, which come before all of the above.
+	store *CertStore
 }
 
 func NewCertManager(certFile, keyFile string) (*CertManager, error) {
@@ -24,20 +35,64 @@ func NewCertManager(certFile, keyFile string) (*CertManager, error) {
 }
 
 func (m *CertManager) Load(certFile, keyFile string) error {
-	newCert, err := validateTLS(certFile, keyFile)
+	newCert, err := loadCertificate(certFile, keyFile)
 	if err != nil {
 		return err
 	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	tmp := newCert
-	m.cert = &tmp
+	m.cert = newCert
 
 	return nil
 }
 
-func (m *CertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+// SetACME makes the manager get certificates from a for the names it covers.
+func (m *CertManager) SetACME(a *ACME) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acme = a
+}
+
+// SetStore makes the manager look for a client's server name in s first.
+func (m *CertManager) SetStore(s *CertStore) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store = s
+}
+
+// GetCertificate picks the certificate for the server name the client asked for: one of the store's,
+// the manager's own if it's for that name, or ACME's. A client whose name none of them has gets the
+// store's default certificate, or else the manager's own, and without either, a handshake alert.
+func (m *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	a, store, own := m.acme, m.store, m.cert
+	m.mu.RUnlock()
+
+	if a != nil && isChallenge(hello) {
+		return a.GetCertificate(hello)
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if store != nil {
+		if cert := store.match(name); cert != nil {
+			return cert, nil
+		}
+	}
+	if own != nil && name != "" && own.Leaf != nil && own.Leaf.VerifyHostname(name) == nil {
+		return own, nil
+	}
+	if a != nil && a.Covers(name) {
+		if cert, err := a.GetCertificate(hello); err == nil {
+			return cert, nil
+		}
+	}
+
+	if store != nil {
+		if cert := store.defaultCert(); cert != nil {
+			return cert, nil
+		}
+	}
 	return m.Get()
 }
 
@@ -68,3 +123,138 @@ func validateTLS(certFile, keyFile string) (tls.Certificate, error) {
 
 	return cert, nil
 }
+
+// CertStore holds the certificates of dynamic.yaml's tls section, for every https entrypoint, indexed
+// by the names they're for. It's rebuilt on every reload and swapped as a whole.
+type CertStore struct {
+	index atomic.Pointer[certIndex]
+	logg  *zap.Logger
+}
+
+type certIndex struct {
+	// names maps a name to its certificate. A wildcard certificate is under its "*.example.com" name.
+	names map[string]*tls.Certificate
+	def   *tls.Certificate
+}
+
+func NewCertStore(logg *zap.Logger) *CertStore {
+	s := &CertStore{logg: logg}
+	s.index.Store(&certIndex{names: map[string]*tls.Certificate{}})
+	return s
+}
+
+// Build replaces the certificates with the ones in cfg. A certificate that can't be loaded is skipped
+// with a warning, and the others are still used. A nil cfg removes them all.
+func (s *CertStore) Build(cfg *config.TLSCfg) {
+	if cfg == nil {
+		cfg = &config.TLSCfg{}
+	}
+
+	idx := &certIndex{names: make(map[string]*tls.Certificate)}
+	for _, c := range cfg.Certificates {
+		cert, err := loadCertificate(*c.CertFile, *c.KeyFile)
+		if err != nil {
+			s.logg.Warn("[TLS] Skipping certificate", zap.String("cert_file", *c.CertFile), zap.Error(err))
+			continue
+		}
+		names := certNames(cert.Leaf)
+		for _, name := range names {
+			// The first certificate listed for a name keeps it.
+			if _, ok := idx.names[name]; !ok {
+				idx.names[name] = cert
+			}
+		}
+		s.logg.Info("[TLS] Certificate loaded", zap.String("cert_file", *c.CertFile), zap.Strings("names", names), zap.Time("not_after", cert.Leaf.NotAfter))
+	}
+	if c := cfg.DefaultCertificate; c != nil {
+		cert, err := loadCertificate(*c.CertFile, *c.KeyFile)
+		if err != nil {
+			s.logg.Warn("[TLS] Skipping default certificate", zap.String("cert_file", *c.CertFile), zap.Error(err))
+		} else {
+			idx.def = cert
+		}
+	}
+
+	s.index.Store(idx)
+}
+
+// Len returns how many certificates the store has, the default one included.
+func (s *CertStore) Len() int {
+	idx := s.index.Load()
+	seen := make(map[*tls.Certificate]bool)
+	for _, cert := range idx.names {
+		seen[cert] = true
+	}
+	if idx.def != nil {
+		seen[idx.def] = true
+	}
+	return len(seen)
+}
+
+// match returns the certificate for name: the one for exactly that name, or else the wildcard one for
+// its parent domain. A wildcard only stands for one label, as in TLS, so "*.example.com" is for
+// "www.example.com" and not for "example.com" or "a.b.example.com".
+func (s *CertStore) match(name string) *tls.Certificate {
+	if name == "" {
+		return nil
+	}
+	idx := s.index.Load()
+	if cert, ok := idx.names[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return idx.names["*"+name[i:]]
+	}
+	return nil
+}
+
+func (s *CertStore) defaultCert() *tls.Certificate {
+	return s.index.Load().def
+}
+
+// loadCertificate loads a certificate and makes sure its Leaf is parsed.
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := validateTLS(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("[TLS] failed to parse certificate %s: %w", certFile, err)
+		}
+	}
+	return &cert, nil
+}
+
+// certNames returns the names a certificate is for, lowercased: its DNS names, or its common name
+// when it has none.
+func certNames(leaf *x509.Certificate) []string {
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		out = append(out, strings.ToLower(n))
+	}
+	return out
+}
+
+// loadClientCAs loads the CAs client certificates are verified against. It returns nil without any
+// files, which lets the system's roots verify them.
+func loadClientCAs(files []string) (*x509.CertPool, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	for _, f := range files {
+		pem, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("[TLS] failed to read client CA file %s: %w", f, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("[TLS] no certificates found in client CA file %s", f)
+		}
+	}
+	return pool, nil
+}
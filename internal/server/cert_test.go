@@ -4,6 +4,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
@@ -12,6 +13,9 @@ import (
 	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/asenalabs/asena/internal/config"
+	"go.uber.org/zap/zaptest"
 )
 
 func TestCertManager_GetWithoutLoad(t *testing.T) {
@@ -34,6 +38,52 @@ func TestCertManager_LoadAndGet(t *testing.T) {
 	}
 }
 
+func TestCertManager_PicksCertificateByServerName(t *testing.T) {
+	certFile := func(names ...string) *config.CertificateCfg {
+		c, k := generateCertKey(t, names...)
+		return &config.CertificateCfg{CertFile: &c, KeyFile: &k}
+	}
+	store := NewCertStore(zaptest.NewLogger(t))
+	store.Build(&config.TLSCfg{Certificates: []*config.CertificateCfg{
+		certFile("example.com"),
+		certFile("*.example.com"),
+		certFile("API.example.org"),
+	}})
+	cm := &CertManager{}
+	cm.SetStore(store)
+
+	names := func(name string) []string {
+		t.Helper()
+		cert, err := cm.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			return nil
+		}
+		return cert.Leaf.DNSNames
+	}
+	tests := map[string]string{
+		"example.com":      "example.com",
+		"www.example.com":  "*.example.com",
+		"api.example.org.": "API.example.org",
+		"a.b.example.com":  "",
+		"unknown.test":     "",
+		"":                 "",
+	}
+	for name, want := range tests {
+		got := names(name)
+		if want == "" && got != nil {
+			t.Errorf("%q: expected a handshake error without a default certificate, got %v", name, got)
+		}
+		if want != "" && (len(got) != 1 || got[0] != want) {
+			t.Errorf("%q: expected the certificate for %s, got %v", name, want, got)
+		}
+	}
+
+	store.Build(&config.TLSCfg{DefaultCertificate: certFile("default.test")})
+	if got := names("example.com"); len(got) != 1 || got[0] != "default.test" {
+		t.Errorf("expected the reload to drop the old certificates for the default one, got %v", got)
+	}
+}
+
 func TestValidateTLS_MissingFiles(t *testing.T) {
 	_, err := validateTLS("no-cert.pem", "no-key.pem")
 	if err == nil {
@@ -41,8 +91,8 @@ func TestValidateTLS_MissingFiles(t *testing.T) {
 	}
 }
 
-// helper: generate temporary cert/key files
-func generateCertKey(t *testing.T) (string, string) {
+// helper: generate temporary cert/key files, for names, or for the common name localhost without any
+func generateCertKey(t *testing.T, names ...string) (string, string) {
 	t.Helper()
 
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
@@ -54,6 +104,7 @@ func generateCertKey(t *testing.T) (string, string) {
 	template := &x509.Certificate{
 		SerialNumber: big.NewInt(1),
 		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     names,
 		NotBefore:    time.Now(),
 		NotAfter:     time.Now().Add(time.Hour),
 		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
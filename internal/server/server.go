@@ -1,19 +1,29 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/asenalabs/asena/internal/clientip"
+	"github.com/asenalabs/asena/internal/proxyproto"
 	"github.com/asenalabs/asena/pkg/logger"
+	"github.com/quic-go/quic-go/http3"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/crypto/acme"
 )
 
+// ServerConfig describes one entrypoint's server.
 type ServerConfig struct {
+	Name        string
 	Address     string
 	Version     string
 	EnableHTTPS bool
@@ -21,46 +31,107 @@ type ServerConfig struct {
 	KeyFileTLS  string
 	Proxy       http.Handler
 	Logg        *zap.Logger
+	// Timeouts are passed on to http.Server as they are.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ProxyProtocolTrustedIPs, when set, makes the listeners read PROXY protocol headers from
+	// connections coming from these CIDR ranges.
+	ProxyProtocolTrustedIPs []string
+	// HTTP3 makes an HTTPS server also serve HTTP/3 on the UDP port of the same number.
+	HTTP3 bool
+	// ACME, when set, gives an HTTPS server its certificates for the names it covers. The certificate
+	// files are then only needed for the other names, and may be missing.
+	ACME *ACME
+	// Certs, when set, are the certificates of dynamic.yaml, picked by server name before the files'.
+	Certs *CertStore
+	// ClientAuth is how an HTTPS server asks clients for a certificate, and ClientCAFiles the PEM
+	// bundles of the CAs it's verified against.
+	ClientAuth    tls.ClientAuthType
+	ClientCAFiles []string
 }
 
-func ServeHTTPS(cfg *ServerConfig) (*http.Server, error) {
+// HTTPServer is an http or https entrypoint's server, with its HTTP/3 server when it has one.
+type HTTPServer struct {
+	*http.Server
+	h3   *http3.Server
+	h3ln net.PacketConn
+}
+
+// Shutdown shuts the HTTP/1.1 and HTTP/2 server down, then the HTTP/3 one, with the same deadline.
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+	if s.h3 != nil {
+		err = errors.Join(err, s.h3.Shutdown(ctx))
+		_ = s.h3ln.Close()
+	}
+	return err
+}
+
+// listen opens a TCP listener on address, reading PROXY protocol headers when cfg asks for it.
+func listen(cfg *ServerConfig, address string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.ProxyProtocolTrustedIPs) == 0 {
+		return ln, nil
+	}
+	trusted, err := clientip.ParseNets(cfg.ProxyProtocolTrustedIPs)
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return proxyproto.NewListener(ln, trusted), nil
+}
+
+func ServeHTTPS(cfg *ServerConfig) (*HTTPServer, error) {
 	if cfg.EnableHTTPS {
-		certMg, err := NewCertManager(cfg.CertFileTLS, cfg.KeyFileTLS)
+		// An entrypoint that asks for client certificates doesn't fall back to HTTP, nor serve without
+		// its client CAs: it would let in clients it's meant to turn away.
+		certMg, err := loadCertManager(cfg)
+		if err != nil && cfg.ClientAuth != tls.NoClientCert {
+			return nil, err
+		}
 		if err != nil {
 			cfg.Logg.Warn("Failed to reload certificates", zap.Error(err))
 			return startHTTP(cfg)
 		}
+		clientCAs, err := loadClientCAs(cfg.ClientCAFiles)
+		if err != nil {
+			return nil, err
+		}
 
-		//	SIGHUP listener for reload new TLS certificate
-		go func() {
-			signalChan := make(chan os.Signal, 1)
-			signal.Notify(signalChan, syscall.SIGHUP)
-
-			for range signalChan {
-				cfg.Logg.Info("[TLS] Reloading certificates...")
-				if err := certMg.Load(cfg.CertFileTLS, cfg.KeyFileTLS); err != nil {
-					cfg.Logg.Warn("Failed to reload certificates", zap.Error(err))
-				}
-				cfg.Logg.Info("[TLS] Certificates reloaded successfully.")
-			}
-		}()
+		ln, err := listen(cfg, cfg.Address)
+		if err != nil {
+			return nil, err
+		}
 
-		srv := &http.Server{
-			Addr:    cfg.Address,
-			Handler: cfg.Proxy,
-			TLSConfig: &tls.Config{
-				GetCertificate: certMg.GetCertificate,
-			},
-			ErrorLog: logger.MustZapToStdLoggerAtLevel(cfg.Logg, zapcore.WarnLevel),
+		srv := &HTTPServer{Server: newServer(cfg)}
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: certMg.GetCertificate,
+			ClientAuth:     cfg.ClientAuth,
+			ClientCAs:      clientCAs,
+		}
+		if cfg.ACME != nil {
+			// The CA asks for acme-tls/1 to check a TLS-ALPN-01 challenge.
+			srv.TLSConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+			if cfg.ClientAuth != tls.NoClientCert {
+				srv.TLSConfig.GetConfigForClient = challengeConfig(srv.TLSConfig)
+				srv.Handler = refuseChallengeRequests(srv.Handler)
+			}
+		}
+		if cfg.HTTP3 {
+			serveHTTP3(cfg, srv, ln.Addr(), certMg)
 		}
 
 		go func() {
-			cfg.Logg.Info("[HTTPS] Asena has started", zap.String("version", cfg.Version), zap.String("address", cfg.Address))
-			if err := srv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
-				cfg.Logg.Warn("[HTTPS] Failed to start HTTPS server", zap.Error(err), zap.String("version", cfg.Version))
+			cfg.Logg.Info("[HTTPS] Asena has started", zap.String("version", cfg.Version), zap.String("entrypoint", cfg.Name), zap.String("address", cfg.Address))
+			if err := srv.ServeTLS(ln, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				cfg.Logg.Warn("[HTTPS] Failed to start HTTPS server", zap.Error(err), zap.String("version", cfg.Version), zap.String("entrypoint", cfg.Name))
 			}
 		}()
-		go startRedirectToHTTPS(cfg.Logg)
 
 		return srv, nil
 
@@ -69,28 +140,132 @@ func ServeHTTPS(cfg *ServerConfig) (*http.Server, error) {
 	}
 }
 
-func startHTTP(cfg *ServerConfig) (*http.Server, error) {
-	srv := &http.Server{
-		Addr:     cfg.Address,
-		Handler:  cfg.Proxy,
-		ErrorLog: logger.MustZapToStdLoggerAtLevel(cfg.Logg, zap.WarnLevel),
+// serveHTTP3 starts an HTTP/3 server on the UDP port with the number of tcpAddr, the port srv
+// listens on, with the same handler and certificates. srv then advertises it to its clients with an
+// Alt-Svc header on every response. A UDP port that can't be opened only costs HTTP/3, with a warning.
+func serveHTTP3(cfg *ServerConfig, srv *HTTPServer, tcpAddr net.Addr, certMg *CertManager) {
+	host, _, _ := net.SplitHostPort(cfg.Address)
+	_, port, _ := net.SplitHostPort(tcpAddr.String())
+	udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		cfg.Logg.Warn("[HTTP3] Failed to start HTTP/3 server", zap.Error(err), zap.String("entrypoint", cfg.Name))
+		return
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		cfg.Logg.Warn("[HTTP3] Failed to start HTTP/3 server", zap.Error(err), zap.String("entrypoint", cfg.Name))
+		return
+	}
+
+	h3 := &http3.Server{
+		Handler: cfg.Proxy,
+		TLSConfig: &tls.Config{
+			GetCertificate: certMg.GetCertificate,
+			ClientAuth:     srv.TLSConfig.ClientAuth,
+			ClientCAs:      srv.TLSConfig.ClientCAs,
+		},
+		IdleTimeout: cfg.IdleTimeout,
 	}
+	srv.h3, srv.h3ln = h3, conn
+	srv.Handler = altSvc(h3, cfg.Proxy)
 
 	go func() {
-		cfg.Logg.Info("[HTTP] Asena has started", zap.String("version", cfg.Version), zap.String("address", cfg.Address))
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			cfg.Logg.Warn("[HTTP] Failed to start HTTP server", zap.Error(err), zap.String("version", cfg.Version))
+		cfg.Logg.Info("[HTTP3] Asena has started", zap.String("version", cfg.Version), zap.String("entrypoint", cfg.Name), zap.String("address", conn.LocalAddr().String()))
+		if err := h3.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			cfg.Logg.Warn("[HTTP3] Failed to start HTTP/3 server", zap.Error(err), zap.String("version", cfg.Version), zap.String("entrypoint", cfg.Name))
+		}
+	}()
+}
+
+// altSvc adds h3's Alt-Svc header to every response of next, so clients know they can switch to
+// HTTP/3 for their next requests.
+func altSvc(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loadCertManager loads cfg's certificate, and loads it again on every SIGHUP. With ACME, or
+// certificates in dynamic.yaml, a certificate that can't be loaded is only a warning, since they may
+// cover every name.
+func loadCertManager(cfg *ServerConfig) (*CertManager, error) {
+	certMg, err := NewCertManager(cfg.CertFileTLS, cfg.KeyFileTLS)
+	if err != nil {
+		if cfg.ACME == nil && (cfg.Certs == nil || cfg.Certs.Len() == 0) {
+			return nil, err
+		}
+		cfg.Logg.Warn("[TLS] Failed to load certificates, only names ACME or dynamic.yaml cover will have one", zap.String("entrypoint", cfg.Name), zap.Error(err))
+		certMg = &CertManager{}
+	}
+	if cfg.ACME != nil {
+		certMg.SetACME(cfg.ACME)
+	}
+	if cfg.Certs != nil {
+		certMg.SetStore(cfg.Certs)
+	}
+
+	//	SIGHUP listener for reload new TLS certificate
+	go func() {
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, syscall.SIGHUP)
+
+		for range signalChan {
+			cfg.Logg.Info("[TLS] Reloading certificates...")
+			if err := certMg.Load(cfg.CertFileTLS, cfg.KeyFileTLS); err != nil {
+				cfg.Logg.Warn("Failed to reload certificates", zap.Error(err))
+			}
+			cfg.Logg.Info("[TLS] Certificates reloaded successfully.")
+		}
+	}()
+
+	return certMg, nil
+}
+
+func startHTTP(cfg *ServerConfig) (*HTTPServer, error) {
+	ln, err := listen(cfg, cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &HTTPServer{Server: newServer(cfg)}
+
+	go func() {
+		cfg.Logg.Info("[HTTP] Asena has started", zap.String("version", cfg.Version), zap.String("entrypoint", cfg.Name), zap.String("address", cfg.Address))
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			cfg.Logg.Warn("[HTTP] Failed to start HTTP server", zap.Error(err), zap.String("version", cfg.Version), zap.String("entrypoint", cfg.Name))
 		}
 	}()
 
 	return srv, nil
 }
 
-func startRedirectToHTTPS(logg *zap.Logger) {
-	err := http.ListenAndServe(":80", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "https://"+r.Host+r.RequestURI, http.StatusMovedPermanently)
-	}))
-	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		logg.Warn("[HTTP → HTTPS] Failed to start redirect server", zap.String("error", err.Error()))
+func newServer(cfg *ServerConfig) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Address,
+		Handler:           cfg.Proxy,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          logger.MustZapToStdLoggerAtLevel(cfg.Logg, zapcore.WarnLevel),
 	}
 }
+
+// RedirectToHTTPS answers every request with a permanent redirect to the same URL over HTTPS, on the
+// port of address, the address of the https entrypoint to send clients to.
+func RedirectToHTTPS(address string) http.Handler {
+	_, port, _ := net.SplitHostPort(address)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
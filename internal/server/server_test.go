@@ -1,12 +1,18 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/asenalabs/asena/internal/clientcert"
+	"github.com/quic-go/quic-go/http3"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -81,3 +87,149 @@ func TestServeHTTPS_FallbackToHTTP(t *testing.T) {
 		t.Errorf("expected status OK, got %d", resp.StatusCode)
 	}
 }
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		address string
+		host    string
+		want    string
+	}{
+		{":443", "example.com", "https://example.com/a?b=c"},
+		{":443", "example.com:80", "https://example.com/a?b=c"},
+		{":8443", "example.com:8080", "https://example.com:8443/a?b=c"},
+		{":8443", "[::1]", "https://[::1]:8443/a?b=c"},
+		{":443", "[::1]:80", "https://[::1]/a?b=c"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://example.com/a?b=c", nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		RedirectToHTTPS(tt.address).ServeHTTP(w, r)
+
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.want {
+			t.Errorf("%s via %s: expected a redirect to %s, got %d %s", tt.host, tt.address, tt.want, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestServeHTTPS_HTTP3(t *testing.T) {
+	certFile, keyFile := generateCertKey(t)
+	cfg := &ServerConfig{
+		Name:        "websecure",
+		Address:     "127.0.0.1:0",
+		Version:     "test",
+		EnableHTTPS: true,
+		CertFileTLS: certFile,
+		KeyFileTLS:  keyFile,
+		HTTP3:       true,
+		Logg:        zaptest.NewLogger(t),
+		Proxy: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.Proto))
+		}),
+	}
+	srv, err := ServeHTTPS(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+	if srv.h3 == nil {
+		t.Fatal("expected an HTTP/3 server")
+	}
+	// The UDP port has the same number as the TCP one.
+	addr := srv.h3ln.LocalAddr().String()
+	_, port, _ := net.SplitHostPort(addr)
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Get("https://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if got, want := resp.Header.Get("Alt-Svc"), `h3=":`+port+`"`; !strings.HasPrefix(got, want) {
+		t.Errorf("expected Alt-Svc to advertise %s, got %q", want, got)
+	}
+
+	h3 := &http.Client{Transport: &http3.Transport{TLSClientConfig: tlsConfig}}
+	resp, err = h3.Get("https://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "HTTP/3.0" {
+		t.Errorf("expected the same handler to serve HTTP/3, got %q", body)
+	}
+}
+
+func TestServeHTTPS_ClientAuth(t *testing.T) {
+	certFile, keyFile := generateCertKey(t)
+	clientCertFile, clientKeyFile := generateCertKey(t, "partner.example.com")
+	// ServeHTTPS doesn't tell which port it got, so take a free one first.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	cfg := &ServerConfig{
+		Name:          "partners",
+		Address:       addr,
+		Version:       "test",
+		EnableHTTPS:   true,
+		CertFileTLS:   certFile,
+		KeyFileTLS:    keyFile,
+		ClientAuth:    tls.RequireAndVerifyClientCert,
+		ClientCAFiles: []string{clientCertFile},
+		Logg:          zaptest.NewLogger(t),
+		Proxy: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cert := clientcert.Verified(r); cert != nil {
+				_, _ = w.Write([]byte(strings.Join(clientcert.SANs(cert), ",")))
+			}
+		}),
+	}
+	srv, err := ServeHTTPS(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+	url := "https://" + addr
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	if resp, err := anonymous.Get(url); err == nil {
+		_ = resp.Body.Close()
+		t.Fatal("expected the handshake to fail without a client certificate")
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partner := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}}}}
+	resp, err := partner.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "partner.example.com" {
+		t.Errorf("expected the handler to see the verified client certificate, got %q", body)
+	}
+}
+
+func TestServeHTTPS_ClientCAsMissing(t *testing.T) {
+	certFile, keyFile := generateCertKey(t)
+	_, err := ServeHTTPS(&ServerConfig{
+		Address:       "127.0.0.1:0",
+		EnableHTTPS:   true,
+		CertFileTLS:   certFile,
+		KeyFileTLS:    keyFile,
+		ClientAuth:    tls.RequireAndVerifyClientCert,
+		ClientCAFiles: []string{"missing-ca.pem"},
+		Logg:          zaptest.NewLogger(t),
+	})
+	if err == nil {
+		t.Error("expected an error instead of serving without the client CAs")
+	}
+}
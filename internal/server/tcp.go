@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// acceptRetryDelay is how long a tcp entrypoint waits after a failed Accept, like running out of
+// file descriptors, before it tries again.
+const acceptRetryDelay = 50 * time.Millisecond
+
+// ConnHandler serves one connection of a tcp entrypoint. tlsConfig holds the entrypoint's
+// certificate, for routers that terminate TLS, and is nil when the entrypoint has none.
+type ConnHandler func(conn net.Conn, tlsConfig *tls.Config)
+
+// TCPServer is a tcp entrypoint: its listener, and the connections it's serving.
+type TCPServer struct {
+	Addr string
+	ln   net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// ServeTCP starts a tcp entrypoint, handing each connection to handle in a goroutine of its own.
+// Connections are closed once handle returns.
+func ServeTCP(cfg *ServerConfig, handle ConnHandler) (*TCPServer, error) {
+	var tlsConfig *tls.Config
+	if cfg.CertFileTLS != "" {
+		certMg, err := loadCertManager(cfg)
+		if err != nil {
+			cfg.Logg.Warn("Failed to load certificates, routers that terminate TLS won't work", zap.String("entrypoint", cfg.Name), zap.Error(err))
+		} else {
+			tlsConfig = &tls.Config{GetCertificate: certMg.GetCertificate}
+		}
+	}
+
+	ln, err := listen(cfg, cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &TCPServer{Addr: cfg.Address, ln: ln, conns: make(map[net.Conn]struct{})}
+
+	go func() {
+		cfg.Logg.Info("[TCP] Asena has started", zap.String("version", cfg.Version), zap.String("entrypoint", cfg.Name), zap.String("address", cfg.Address))
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				cfg.Logg.Warn("[TCP] Failed to accept connection", zap.Error(err), zap.String("entrypoint", cfg.Name))
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+			if !srv.track(conn) {
+				_ = conn.Close()
+				return
+			}
+			go func() {
+				defer srv.untrack(conn)
+				defer conn.Close()
+				handle(conn, tlsConfig)
+			}()
+		}
+	}()
+
+	return srv, nil
+}
+
+func (s *TCPServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *TCPServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// Shutdown stops accepting connections and waits for the open ones to finish, like
+// http.Server.Shutdown. Those still open when ctx is done are closed.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	_ = s.ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			_ = conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
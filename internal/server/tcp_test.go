@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestServeTCP_ShutdownClosesOpenConnections(t *testing.T) {
+	cfg := &ServerConfig{Name: "tcp", Address: "127.0.0.1:0", Version: "test", Logg: zaptest.NewLogger(t)}
+	srv, err := ServeTCP(cfg, func(conn net.Conn, tlsConfig *tls.Config) {
+		if tlsConfig != nil {
+			t.Error("expected no TLS config without a certificate")
+		}
+		_, _ = io.WriteString(conn, "hi")
+		_, _ = io.Copy(io.Discard, conn) // until the connection is closed
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", srv.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the open connection to outlast the deadline, got %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection to be closed at the deadline, got %v", err)
+	}
+	if _, err := net.Dial("tcp", srv.ln.Addr().String()); err == nil {
+		t.Error("expected no new connections after Shutdown")
+	}
+}
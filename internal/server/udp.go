@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// PacketHandler serves a udp entrypoint's socket, reading from it until it's closed.
+type PacketHandler func(conn *net.UDPConn)
+
+// UDPServer is a udp entrypoint.
+type UDPServer struct {
+	Addr string
+	conn *net.UDPConn
+	done chan struct{}
+}
+
+// ServeUDP starts a udp entrypoint, handing its socket to handle in a goroutine of its own.
+func ServeUDP(cfg *ServerConfig, handle PacketHandler) (*UDPServer, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &UDPServer{Addr: cfg.Address, conn: conn, done: make(chan struct{})}
+	go func() {
+		defer close(srv.done)
+		cfg.Logg.Info("[UDP] Asena has started", zap.String("version", cfg.Version), zap.String("entrypoint", cfg.Name), zap.String("address", cfg.Address))
+		handle(conn)
+	}()
+
+	return srv, nil
+}
+
+// Shutdown closes the socket and waits for the handler to end its sessions. UDP has no connections
+// to let finish, so nothing is waited for beyond that.
+func (s *UDPServer) Shutdown(ctx context.Context) error {
+	_ = s.conn.Close()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}